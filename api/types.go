@@ -6,6 +6,8 @@ import (
 	rpc "github.com/longhorn/types/pkg/generated/bimrpc"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+
+	"github.com/longhorn/backing-image-manager/pkg/rpcext"
 )
 
 type BackingImage struct {
@@ -99,6 +101,53 @@ func (s *BackingImageStream) Recv() error {
 	return err
 }
 
+type BackingImageEvent struct {
+	Revision int64  `json:"revision"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+
+	// BackingImage is the last known status for a deleted event, and is nil for a reset event.
+	BackingImage *BackingImage `json:"backingImage"`
+}
+
+type BackingImageEventStream struct {
+	conn      *grpc.ClientConn
+	ctxCancel context.CancelFunc
+	stream    rpcext.BackingImageManagerExtService_WatchEventsClient
+}
+
+func NewBackingImageEventStream(conn *grpc.ClientConn, ctxCancel context.CancelFunc, stream rpcext.BackingImageManagerExtService_WatchEventsClient) *BackingImageEventStream {
+	return &BackingImageEventStream{
+		conn,
+		ctxCancel,
+		stream,
+	}
+}
+
+func (s *BackingImageEventStream) Close() error {
+	s.ctxCancel()
+	if err := s.conn.Close(); err != nil {
+		return errors.Wrapf(err, "error closing backing image event watcher gRPC connection")
+	}
+	return nil
+}
+
+func (s *BackingImageEventStream) Recv() (*BackingImageEvent, error) {
+	event, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	res := &BackingImageEvent{
+		Revision: event.Revision,
+		Type:     event.Type,
+		Name:     event.Name,
+	}
+	if event.BackingImage != nil {
+		res.BackingImage = RPCToBackingImage(event.BackingImage)
+	}
+	return res, nil
+}
+
 type DataSourceInfo struct {
 	SourceType string            `json:"sourceType"`
 	Parameters map[string]string `json:"parameters"`
@@ -124,6 +173,156 @@ type FileInfo struct {
 	CurrentChecksum  string `json:"currentChecksum"`
 	Message          string `json:"message"`
 	SendingReference int    `json:"sendingReference"`
+
+	// LastScrubbedAt and LastScrubResult are empty if the file has not been scrubbed.
+	LastScrubbedAt  string `json:"lastScrubbedAt,omitempty"`
+	LastScrubResult string `json:"lastScrubResult,omitempty"`
+
+	// Queued is the position of the operation preparing the file in the queue of the same operation type,
+	// starting from 1. It's 0 if the operation is not queued.
+	Queued int `json:"queued,omitempty"`
+
+	// SourceFormat and SourceChecksum are the provenance of the file converted from another image format,
+	// e.g. VMDK, once ingested. The current checksum is the one of the converted file.
+	SourceFormat   string `json:"sourceFormat,omitempty"`
+	SourceChecksum string `json:"sourceChecksum,omitempty"`
+
+	// FailureReason is set only if the file failed for a known reason, e.g. insufficient-space.
+	FailureReason string `json:"failureReason,omitempty"`
+
+	// EvictionTime is when the ready or failed file will be forgotten automatically by the retention policy.
+	// It's empty if the file won't be forgotten, e.g. it's still referenced by the manager.
+	EvictionTime string `json:"evictionTime,omitempty"`
+}
+
+// UploadSession is the progress of a resumable chunked upload. The next chunk should start at Offset.
+type UploadSession struct {
+	FilePath string `json:"filePath"`
+	UUID     string `json:"uuid"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	State    string `json:"state"`
+}
+
+// BandwidthLimits are the max bytes per second of the transfers. 0 means no limit.
+type BandwidthLimits struct {
+	// Total is shared by all the operations below.
+	Total    int64 `json:"total"`
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+	Send     int64 `json:"send"`
+	Receive  int64 `json:"receive"`
+	Backup   int64 `json:"backup"`
+	Restore  int64 `json:"restore"`
+}
+
+type LeftoverType string
+
+const (
+	// LeftoverTypeOrphanedDirectory is a backing image work directory without a tracked file.
+	LeftoverTypeOrphanedDirectory = LeftoverType("orphaned-directory")
+	// LeftoverTypeOrphanedDataSourceFile is a file in the data source directory without an active data source.
+	LeftoverTypeOrphanedDataSourceFile = LeftoverType("orphaned-data-source-file")
+	LeftoverTypeTmpFile                = LeftoverType("tmp-file")
+	LeftoverTypeRawConversionFile      = LeftoverType("raw-conversion-file")
+	LeftoverTypeQcow2ConversionFile    = LeftoverType("qcow2-conversion-file")
+)
+
+// Leftover is an artefact on the disk not owned by any tracked sync file or active data source.
+type Leftover struct {
+	Path string       `json:"path"`
+	Type LeftoverType `json:"type"`
+	// Size is the allocated size in bytes, which is reclaimed once the leftover is deleted.
+	Size             int64  `json:"size"`
+	ModificationTime string `json:"modificationTime"`
+	// Expired means the leftover is not modified within the grace period, hence it can be deleted.
+	Expired bool   `json:"expired"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// LeftoverCollection is the result of a leftover collection. Nothing is deleted in a dry run.
+type LeftoverCollection struct {
+	DryRun      bool       `json:"dryRun"`
+	GracePeriod string     `json:"gracePeriod"`
+	Leftovers   []Leftover `json:"leftovers"`
+	// ReclaimedSize is the total size of the deleted leftovers.
+	ReclaimedSize int64 `json:"reclaimedSize"`
+}
+
+// InterruptedFile is a file whose preparing operation was interrupted by the drain.
+type InterruptedFile struct {
+	FilePath      string `json:"filePath"`
+	UUID          string `json:"uuid"`
+	Operation     string `json:"operation"`
+	ProcessedSize int64  `json:"processedSize"`
+	// Resumable means the partial data is kept, so that the same request can continue from it after a restart.
+	Resumable bool `json:"resumable"`
+}
+
+// DrainReport is the result of draining the sync service. The running operations not finished
+// within the timeout are interrupted.
+type DrainReport struct {
+	Timeout     string            `json:"timeout"`
+	Interrupted []InterruptedFile `json:"interrupted"`
+}
+
+// HealthCheck is the result of a dependency check of the readiness probe.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HealthReport is the response of the readiness probe. The server is ready only if all the checks are healthy.
+type HealthReport struct {
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func RPCToLeftoverCollection(obj *rpcext.CollectLeftoversResponse) *LeftoverCollection {
+	res := &LeftoverCollection{
+		DryRun:        obj.DryRun,
+		GracePeriod:   obj.GracePeriod,
+		Leftovers:     make([]Leftover, 0, len(obj.Leftovers)),
+		ReclaimedSize: obj.ReclaimedSize,
+	}
+	for _, leftover := range obj.Leftovers {
+		res.Leftovers = append(res.Leftovers, Leftover{
+			Path:             leftover.Path,
+			Type:             LeftoverType(leftover.Type),
+			Size:             leftover.Size,
+			ModificationTime: leftover.ModificationTime,
+			Expired:          leftover.Expired,
+			Deleted:          leftover.Deleted,
+			Error:            leftover.Error,
+		})
+	}
+	return res
+}
+
+type FileEventType string
+
+const (
+	FileEventTypeCreated  = FileEventType("created")
+	FileEventTypeState    = FileEventType("state")
+	FileEventTypeProgress = FileEventType("progress")
+	// FileEventTypeUpdated is for the changes other than the state and the progress, e.g., the sending reference.
+	FileEventTypeUpdated = FileEventType("updated")
+	FileEventTypeDeleted = FileEventType("deleted")
+	// FileEventTypeReset means the client cannot resume from its revision, hence it should drop all cached files.
+	// The reset event is followed by a created event for each existing file.
+	FileEventTypeReset = FileEventType("reset")
+)
+
+// FileEvent is a change of a sync file. The revision increases monotonically with each change,
+// and the client can resume the event stream from the last received revision after reconnecting.
+// The revisions restart after the sync server restarts, hence the epoch tells the event streams apart.
+type FileEvent struct {
+	Epoch    int64         `json:"epoch"`
+	Revision int64         `json:"revision"`
+	Type     FileEventType `json:"type"`
+	FileInfo *FileInfo     `json:"fileInfo,omitempty"`
 }
 
 func (in *DataSourceInfo) DeepCopy() *DataSourceInfo {
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+func authSecretFileFlag() cli.Flag {
+	return cli.StringFlag{
+		Name:  "auth-secret-file",
+		Usage: "The file containing the shared secret of the token authentication. The HTTP servers require the secret or a token signed by it for each request if it's set. The authentication is disabled by default",
+	}
+}
+
+// getAuthenticator returns nil if the authentication is disabled.
+func getAuthenticator(c *cli.Context) (*util.Authenticator, error) {
+	secretFile := c.String("auth-secret-file")
+	if secretFile == "" {
+		return nil, nil
+	}
+	secret, err := os.ReadFile(secretFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the authentication secret file %v: %v", secretFile, err)
+	}
+	return util.NewAuthenticator(strings.TrimSpace(string(secret)))
+}
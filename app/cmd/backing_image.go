@@ -7,7 +7,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 
-	"github.com/longhorn/backing-image-manager/pkg/client"
+	filesync "github.com/longhorn/backing-image-manager/pkg/sync"
 	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
 )
@@ -15,21 +15,23 @@ import (
 func BackingImageCmd() cli.Command {
 	return cli.Command{
 		Name: "backing-image",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "url",
 				Value: "localhost:" + strconv.Itoa(types.DefaultManagerPort),
 				Usage: "Specify the manager server endpoint to listen on host:port. Defaults to localhost:8000",
 			},
-		},
+		}, tlsFlags()...),
 		Subcommands: []cli.Command{
 			SyncCmd(),
 			SendCmd(),
+			RepairCmd(),
 			DeleteCmd(),
 			GetCmd(),
 			ListCmd(),
 			FetchCmd(),
 			PrepareDownloadCmd(),
+			CollectLeftoversCmd(),
 		},
 	}
 }
@@ -69,8 +71,7 @@ func SyncCmd() cli.Command {
 }
 
 func fileSync(c *cli.Context) error {
-	url := c.GlobalString("url")
-	bimClient := client.NewBackingImageManagerClient(url)
+	bimClient := newBackingImageManagerClient(c)
 	bi, err := bimClient.Sync(c.String("name"), c.String("uuid"), c.String("checksum"), c.String("from-address"), c.Int64("size"))
 	if err != nil {
 		return err
@@ -104,11 +105,44 @@ func SendCmd() cli.Command {
 }
 
 func send(c *cli.Context) error {
-	url := c.GlobalString("url")
-	bimClient := client.NewBackingImageManagerClient(url)
+	bimClient := newBackingImageManagerClient(c)
 	return bimClient.Send(c.String("name"), c.String("uuid"), c.String("to-address"))
 }
 
+func RepairCmd() cli.Command {
+	return cli.Command{
+		Name: "repair",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "The name of the backing image to be repaired",
+			},
+			cli.StringFlag{
+				Name:  "uuid",
+				Usage: "The uuid of the backing image to be repaired",
+			},
+			cli.StringFlag{
+				Name:  "from-address",
+				Usage: "Backing image manager address, will pull the corrupted blocks of backing image from the address",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := repair(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running backing image repair command")
+			}
+		},
+	}
+}
+
+func repair(c *cli.Context) error {
+	bimClient := newBackingImageManagerClient(c)
+	bi, err := bimClient.Repair(c.String("name"), c.String("uuid"), c.String("from-address"))
+	if err != nil {
+		return err
+	}
+	return util.PrintJSON(bi)
+}
+
 func DeleteCmd() cli.Command {
 	return cli.Command{
 		Name: "delete",
@@ -132,8 +166,7 @@ func DeleteCmd() cli.Command {
 }
 
 func del(c *cli.Context) error {
-	url := c.GlobalString("url")
-	bimClient := client.NewBackingImageManagerClient(url)
+	bimClient := newBackingImageManagerClient(c)
 	return bimClient.Delete(c.String("name"), c.String("uuid"))
 }
 
@@ -159,8 +192,7 @@ func GetCmd() cli.Command {
 }
 
 func get(c *cli.Context) error {
-	url := c.GlobalString("url")
-	bimClient := client.NewBackingImageManagerClient(url)
+	bimClient := newBackingImageManagerClient(c)
 	bi, err := bimClient.Get(c.String("name"), c.String("uuid"))
 	if err != nil {
 		return err
@@ -181,8 +213,7 @@ func ListCmd() cli.Command {
 }
 
 func list(c *cli.Context) error {
-	url := c.GlobalString("url")
-	bimClient := client.NewBackingImageManagerClient(url)
+	bimClient := newBackingImageManagerClient(c)
 	biList, err := bimClient.List()
 	if err != nil {
 		return err
@@ -226,8 +257,7 @@ func FetchCmd() cli.Command {
 }
 
 func fetch(c *cli.Context) error {
-	url := c.GlobalString("url")
-	bimClient := client.NewBackingImageManagerClient(url)
+	bimClient := newBackingImageManagerClient(c)
 	bi, err := bimClient.Fetch(c.String("name"), c.String("uuid"), c.String("checksum"), c.String("data-source-address"), c.Int64("size"))
 	if err != nil {
 		return err
@@ -257,13 +287,50 @@ func PrepareDownloadCmd() cli.Command {
 }
 
 func prepareDownload(c *cli.Context) error {
-	url := c.GlobalString("url")
-	bimClient := client.NewBackingImageManagerClient(url)
-	srcFilePath, address, err := bimClient.PrepareDownload(c.String("name"), c.String("uuid"))
+	bimClient := newBackingImageManagerClient(c)
+	srcFilePath, address, token, err := bimClient.PrepareDownload(c.String("name"), c.String("uuid"))
 	if err != nil {
 		return err
 	}
 	fmt.Println("Source file path:", srcFilePath)
 	fmt.Println("Download server address:", address)
+	if token != "" {
+		fmt.Println("Download token:", token)
+	}
 	return nil
 }
+
+func CollectLeftoversCmd() cli.Command {
+	return cli.Command{
+		Name: "collect-leftovers",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only report the leftovers without deleting them",
+			},
+			cli.DurationFlag{
+				Name:  "grace-period",
+				Value: filesync.DefaultLeftoverGracePeriod,
+				Usage: "Only the leftovers not modified within the grace period are deleted. Defaults to 24h",
+			},
+			cli.StringSliceFlag{
+				Name:  "active-data-source",
+				Usage: "The data source file name <name>-<uuid> of an active data source, whose files are kept",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := collectLeftovers(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running backing image collect leftovers command")
+			}
+		},
+	}
+}
+
+func collectLeftovers(c *cli.Context) error {
+	bimClient := newBackingImageManagerClient(c)
+	collection, err := bimClient.CollectLeftovers(c.Bool("dry-run"), c.Duration("grace-period"), c.StringSlice("active-data-source"))
+	if err != nil {
+		return err
+	}
+	return util.PrintJSON(collection)
+}
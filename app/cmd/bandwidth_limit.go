@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backing-image-manager/api"
+)
+
+func bandwidthLimitFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.Int64Flag{
+			Name:  "bandwidth-limit",
+			Value: 0,
+			Usage: "The max bytes per second shared by all the transfers. Defaults to 0, which means no limit",
+		},
+		cli.Int64Flag{
+			Name:  "download-bandwidth-limit",
+			Value: 0,
+			Usage: "The max bytes per second of the downloads from URLs. Defaults to 0, which means no limit",
+		},
+		cli.Int64Flag{
+			Name:  "upload-bandwidth-limit",
+			Value: 0,
+			Usage: "The max bytes per second of the uploads. Defaults to 0, which means no limit",
+		},
+		cli.Int64Flag{
+			Name:  "send-bandwidth-limit",
+			Value: 0,
+			Usage: "The max bytes per second of sending the files to the peers. Defaults to 0, which means no limit",
+		},
+		cli.Int64Flag{
+			Name:  "receive-bandwidth-limit",
+			Value: 0,
+			Usage: "The max bytes per second of receiving the files from the peers or volumes. Defaults to 0, which means no limit",
+		},
+		cli.Int64Flag{
+			Name:  "backup-bandwidth-limit",
+			Value: 0,
+			Usage: "The max bytes per second of the backup creation. Defaults to 0, which means no limit",
+		},
+		cli.Int64Flag{
+			Name:  "restore-bandwidth-limit",
+			Value: 0,
+			Usage: "The max bytes per second of the backup restoration. Defaults to 0, which means no limit",
+		},
+	}
+}
+
+func getBandwidthLimits(c *cli.Context) api.BandwidthLimits {
+	return api.BandwidthLimits{
+		Total:    c.Int64("bandwidth-limit"),
+		Download: c.Int64("download-bandwidth-limit"),
+		Upload:   c.Int64("upload-bandwidth-limit"),
+		Send:     c.Int64("send-bandwidth-limit"),
+		Receive:  c.Int64("receive-bandwidth-limit"),
+		Backup:   c.Int64("backup-bandwidth-limit"),
+		Restore:  c.Int64("restore-bandwidth-limit"),
+	}
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+
+	filesync "github.com/longhorn/backing-image-manager/pkg/sync"
+)
+
+func concurrencyLimitFlags() []cli.Flag {
+	flags := []cli.Flag{}
+	for _, operation := range filesync.ScheduledOperations {
+		flags = append(flags, cli.IntFlag{
+			Name:  getConcurrencyLimitFlagName(operation),
+			Value: 0,
+			Usage: fmt.Sprintf("The max number of the running %v operations in the disk. The exceeding ones are queued by priority. Defaults to 0, which means no limit", operation),
+		})
+	}
+	return flags
+}
+
+func getConcurrencyLimitFlagName(operation string) string {
+	return fmt.Sprintf("concurrent-%v-limit", operation)
+}
+
+func getConcurrencyLimits(c *cli.Context) map[string]int {
+	limits := map[string]int{}
+	for _, operation := range filesync.ScheduledOperations {
+		limits[operation] = c.Int(getConcurrencyLimitFlagName(operation))
+	}
+	return limits
+}
@@ -17,7 +17,7 @@ import (
 func DataSourceCmd() cli.Command {
 	return cli.Command{
 		Name: "data-source",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "listen",
 				Value: "localhost:" + strconv.Itoa(types.DefaultDataSourceServerPort),
@@ -53,7 +53,10 @@ func DataSourceCmd() cli.Command {
 				Name:  "credential",
 				Usage: "Credential for restoring backing image from backup store.",
 			},
-		},
+			diskSpaceSafetyMarginFlag(),
+			authSecretFileFlag(),
+			fileURLRootFlag(),
+		}, append(append(bandwidthLimitFlags(), retentionPolicyFlags()...), tlsFlags()...)...),
 		Action: func(c *cli.Context) {
 			if err := dataSource(c); err != nil {
 				logrus.WithError(err).Fatalf("Error running data-source command")
@@ -81,7 +84,40 @@ func dataSource(c *cli.Context) error {
 		return err
 	}
 
-	return datasource.NewServer(context.Background(), listen, syncListen, checksum, sourceType, name, uuid, types.DiskPathInContainer, parameters, credential, &sync.HTTPHandler{})
+	bandwidthLimiter, err := sync.NewBandwidthLimiter(getBandwidthLimits(c))
+	if err != nil {
+		return err
+	}
+
+	diskSpaceSafetyMargin, err := getDiskSpaceSafetyMargin(c)
+	if err != nil {
+		return err
+	}
+
+	retentionPolicy, err := getRetentionPolicy(c)
+	if err != nil {
+		return err
+	}
+
+	auth, err := getAuthenticator(c)
+	if err != nil {
+		return err
+	}
+
+	handlerRegistry, err := getHandlerRegistry(c)
+	if err != nil {
+		return err
+	}
+
+	syncOptions := sync.Options{
+		BandwidthLimiter:      bandwidthLimiter,
+		DiskSpaceSafetyMargin: diskSpaceSafetyMargin,
+		RetentionPolicy:       retentionPolicy,
+		TLS:                   getTLSOptions(c),
+		Auth:                  auth,
+	}
+
+	return datasource.NewServer(context.Background(), listen, syncListen, checksum, sourceType, name, uuid, types.DiskPathInContainer, parameters, credential, syncOptions, handlerRegistry)
 }
 
 func parseSliceToMap(sli []string) (map[string]string, error) {
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+)
+
+func diskSpaceSafetyMarginFlag() cli.Flag {
+	return cli.Int64Flag{
+		Name:  "disk-space-safety-margin",
+		Value: 0,
+		Usage: "The disk space in MiB kept free when preparing the backing images. The download, restore, clone, upload and receive fail with reason insufficient-space before writing data if the file cannot fit in the disk with the margin. Defaults to 0",
+	}
+}
+
+func getDiskSpaceSafetyMargin(c *cli.Context) (int64, error) {
+	margin := c.Int64("disk-space-safety-margin")
+	if margin < 0 {
+		return 0, fmt.Errorf("invalid disk space safety margin %v, which should not be negative", margin)
+	}
+	return margin * 1024 * 1024, nil
+}
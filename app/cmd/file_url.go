@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backing-image-manager/pkg/sync"
+)
+
+func fileURLRootFlag() cli.Flag {
+	return cli.StringSliceFlag{
+		Name:  "file-url-root",
+		Usage: "The absolute path of a host directory that the file:// download URLs can refer to. It can be specified multiple times. The URLs referring to the files out of the directories, including via the symlinks or the parent directory references, are refused. The file:// URLs are disabled by default",
+	}
+}
+
+func getHandlerRegistry(c *cli.Context) (*sync.HandlerRegistry, error) {
+	return sync.NewHandlerRegistry(c.StringSlice("file-url-root"))
+}
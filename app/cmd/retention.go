@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+
+	filesync "github.com/longhorn/backing-image-manager/pkg/sync"
+)
+
+func retentionPolicyFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.DurationFlag{
+			Name:  "failed-file-ttl",
+			Value: filesync.AutoForgetWaitInterval,
+			Usage: "The time a failed file is kept in the sync service before being forgotten automatically. 0 means never. Defaults to 24h",
+		},
+		cli.DurationFlag{
+			Name:  "ready-file-ttl",
+			Value: filesync.AutoForgetWaitInterval,
+			Usage: "The time a ready file is kept in the sync service before being forgotten automatically. The backing images tracked by the manager and the data source file waiting for the transfer are never forgotten unless they failed. 0 means never. Defaults to 24h",
+		},
+	}
+}
+
+func getRetentionPolicy(c *cli.Context) (filesync.RetentionPolicy, error) {
+	policy := filesync.RetentionPolicy{
+		FailedFileTTL: c.Duration("failed-file-ttl"),
+		ReadyFileTTL:  c.Duration("ready-file-ttl"),
+	}
+	if policy.FailedFileTTL < 0 || policy.ReadyFileTTL < 0 {
+		return filesync.RetentionPolicy{}, fmt.Errorf("invalid failed file TTL %v or ready file TTL %v", policy.FailedFileTTL, policy.ReadyFileTTL)
+	}
+	return policy, nil
+}
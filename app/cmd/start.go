@@ -17,7 +17,7 @@ import (
 func StartCmd() cli.Command {
 	return cli.Command{
 		Name: "daemon",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "listen",
 				Value: "localhost:" + strconv.Itoa(types.DefaultManagerPort),
@@ -28,6 +28,11 @@ func StartCmd() cli.Command {
 				Value: "localhost:" + strconv.Itoa(types.DefaultSyncServerPort),
 				Usage: "Specify the sync server endpoint to listen on host:port. Defaults to localhost:8001",
 			},
+			cli.StringFlag{
+				Name:  "metrics-listen",
+				Value: "",
+				Usage: "Specify the endpoint serving the Prometheus metrics of the manager on host:port. The metrics are disabled by default, and are always served by the sync server",
+			},
 			cli.StringFlag{
 				Name:  "disk-uuid",
 				Usage: "The corresponding disk uuid stored in the metafile of the disk path",
@@ -37,7 +42,25 @@ func StartCmd() cli.Command {
 				Value: "30001-31000",
 				Usage: "The port is used for starting temporary sparse file server when syncing backing image, Defaults to 30001-31000",
 			},
-		},
+			cli.DurationFlag{
+				Name:  "scrub-interval",
+				Value: 0,
+				Usage: "The interval of re-hashing the ready backing images to detect the silent corruption, e.g. 168h. Scrubbing is disabled by default",
+			},
+			cli.Int64Flag{
+				Name:  "scrub-rate-limit",
+				Value: 0,
+				Usage: "The max disk read rate of scrubbing in MiB per second. Defaults to 0, which means no limit",
+			},
+			cli.DurationFlag{
+				Name:  "drain-timeout",
+				Value: filesync.DefaultDrainTimeout,
+				Usage: "The max time waiting for the running operations on SIGTERM before interrupting them. The interrupted download, fetch and receive can be resumed by the same request after a restart. 0 means exiting without the drain. Defaults to 20s",
+			},
+			diskSpaceSafetyMarginFlag(),
+			authSecretFileFlag(),
+			fileURLRootFlag(),
+		}, append(append(append(bandwidthLimitFlags(), concurrencyLimitFlags()...), retentionPolicyFlags()...), tlsFlags()...)...),
 		Action: func(c *cli.Context) {
 			if err := start(c); err != nil {
 				logrus.WithError(err).Fatalf("Error running start command")
@@ -49,8 +72,18 @@ func StartCmd() cli.Command {
 func start(c *cli.Context) error {
 	listen := c.String("listen")
 	syncListen := c.String("sync-listen")
+	metricsListen := c.String("metrics-listen")
 	diskUUID := c.String("disk-uuid")
 	portRange := c.String("port-range")
+	scrubInterval := c.Duration("scrub-interval")
+	scrubRateLimit := c.Int64("scrub-rate-limit")
+	if scrubInterval < 0 || scrubRateLimit < 0 {
+		return fmt.Errorf("invalid scrub interval %v or scrub rate limit %v", scrubInterval, scrubRateLimit)
+	}
+	drainTimeout := c.Duration("drain-timeout")
+	if drainTimeout < 0 {
+		return fmt.Errorf("invalid drain timeout %v", drainTimeout)
+	}
 
 	diskUUIDInFile, err := util.GetDiskConfig(types.DiskPathInContainer)
 	if err != nil {
@@ -62,5 +95,42 @@ func start(c *cli.Context) error {
 		return fmt.Errorf("invalid input disk UUID %v, which doesn't match disk UUID %v the disk config file", diskUUID, diskUUIDInFile)
 	}
 
-	return manager.NewServer(context.Background(), listen, syncListen, diskUUID, types.DiskPathInContainer, portRange, &filesync.HTTPHandler{})
+	bandwidthLimiter, err := filesync.NewBandwidthLimiter(getBandwidthLimits(c))
+	if err != nil {
+		return err
+	}
+
+	diskSpaceSafetyMargin, err := getDiskSpaceSafetyMargin(c)
+	if err != nil {
+		return err
+	}
+
+	retentionPolicy, err := getRetentionPolicy(c)
+	if err != nil {
+		return err
+	}
+
+	auth, err := getAuthenticator(c)
+	if err != nil {
+		return err
+	}
+
+	handlerRegistry, err := getHandlerRegistry(c)
+	if err != nil {
+		return err
+	}
+
+	syncOptions := filesync.Options{
+		ScrubInterval:         scrubInterval,
+		ScrubRateLimit:        scrubRateLimit * 1024 * 1024,
+		BandwidthLimiter:      bandwidthLimiter,
+		ConcurrencyLimits:     getConcurrencyLimits(c),
+		DiskSpaceSafetyMargin: diskSpaceSafetyMargin,
+		RetentionPolicy:       retentionPolicy,
+		TLS:                   getTLSOptions(c),
+		Auth:                  auth,
+		DrainTimeout:          drainTimeout,
+	}
+
+	return manager.NewServer(context.Background(), listen, syncListen, metricsListen, diskUUID, types.DiskPathInContainer, portRange, syncOptions, handlerRegistry)
 }
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backing-image-manager/pkg/client"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+func tlsFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "The TLS certificate file. The servers serve TLS if it's set, and the clients present it to the servers requiring mutual TLS. The files are sent between the sync servers over TLS as well, while the volume export is still received in plain HTTP since the replicas don't support TLS. The file is reloaded once modified",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "The TLS private key file of the certificate. The file is reloaded once modified",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "The CA file to verify the peers. The servers require the client certificates signed by the CA, i.e. mutual TLS, if it's set. The file is reloaded once modified",
+		},
+	}
+}
+
+// getTLSOptions returns nil if TLS is not enabled.
+func getTLSOptions(c *cli.Context) *util.TLSOptions {
+	return newTLSOptions(c.String("tls-cert"), c.String("tls-key"), c.String("tls-ca"))
+}
+
+func newTLSOptions(certFile, keyFile, caFile string) *util.TLSOptions {
+	options := &util.TLSOptions{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+	}
+	if !options.Enabled() {
+		return nil
+	}
+	return options
+}
+
+// newBackingImageManagerClient creates the client with the global flags of the backing-image command.
+func newBackingImageManagerClient(c *cli.Context) *client.BackingImageManagerClient {
+	bimClient := client.NewBackingImageManagerClient(c.GlobalString("url"))
+	bimClient.TLS = newTLSOptions(c.GlobalString("tls-cert"), c.GlobalString("tls-key"), c.GlobalString("tls-ca"))
+	return bimClient
+}
@@ -1,6 +1,7 @@
 package backingimage
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -20,6 +21,7 @@ import (
 	diskutil "github.com/longhorn/longhorn-engine/pkg/util/disk"
 
 	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
 )
 
 const (
@@ -278,6 +280,9 @@ type BackupStatus struct {
 	BackupURL    string
 	State        common.ProgressState
 	IsOpened     bool
+
+	// RateLimiter limits the data read for the backup. It's nil if there is no limit.
+	RateLimiter *util.RateLimiter
 }
 
 func NewBackupStatus(name string, backingImage *BackingImage) *BackupStatus {
@@ -293,7 +298,10 @@ func (b *BackupStatus) CloseFile() {
 }
 
 func (b *BackupStatus) ReadFile(start int64, data []byte) error {
-	_, err := b.BackingImage.ReadAt(data, start)
+	n, err := b.BackingImage.ReadAt(data, start)
+	if waitErr := b.RateLimiter.WaitN(context.Background(), n); waitErr != nil {
+		return waitErr
+	}
 	return err
 }
 
@@ -28,6 +28,8 @@ type CreateBackupParameters struct {
 	ConcurrentLimit   int32
 	Labels            []string
 	Parameters        map[string]string
+	// RateLimiter limits the data read from the backing image. It's nil if there is no limit.
+	RateLimiter *util.RateLimiter
 }
 
 func DoBackupInit(params *CreateBackupParameters) (*backupbackingimage.BackupBackingImage, *backingimage.BackupStatus, *backupbackingimage.BackupConfig, error) {
@@ -58,6 +60,7 @@ func DoBackupInit(params *CreateBackupParameters) (*backupbackingimage.BackupBac
 	}
 
 	backupStatus := backingimage.NewBackupStatus(params.Name, backingImage)
+	backupStatus.RateLimiter = params.RateLimiter
 
 	backupBackingImage := &backupbackingimage.BackupBackingImage{
 		Name:              params.Name,
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,22 +9,33 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
 	"github.com/pkg/errors"
 )
 
+const (
+	UploadChunkRetryCount    = 10
+	UploadChunkRetryInterval = 3 * time.Second
+)
+
 type DataSourceClient struct {
 	Remote string
+	// TLS is nil if the data source server serves plain HTTP.
+	TLS *util.TLSOptions
+	// Token is presented as the bearer token if the data source server requires authentication.
+	Token string
 }
 
 func (client *DataSourceClient) Get() (*api.DataSourceInfo, error) {
-	httpClient := &http.Client{Timeout: HTTPClientTimeout, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
 
-	url := fmt.Sprintf("http://%s/v1/file", client.Remote)
+	url := fmt.Sprintf("%s/v1/file", util.GetHTTPURL(client.Remote, client.TLS))
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -60,9 +72,9 @@ func (client *DataSourceClient) Get() (*api.DataSourceInfo, error) {
 }
 
 func (client *DataSourceClient) Transfer() error {
-	httpClient := &http.Client{Timeout: HTTPClientTimeout, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/file", client.Remote)
+	requestURL := fmt.Sprintf("%s/v1/file", util.GetHTTPURL(client.Remote, client.TLS))
 	req, err := http.NewRequest("POST", requestURL, nil)
 	if err != nil {
 		return err
@@ -93,7 +105,7 @@ func (client *DataSourceClient) Transfer() error {
 }
 
 func (client *DataSourceClient) Upload(filePath string) error {
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 
 	stat, err := os.Stat(filePath)
 	if err != nil {
@@ -131,7 +143,7 @@ func (client *DataSourceClient) Upload(filePath string) error {
 		}
 	}()
 
-	url := fmt.Sprintf("http://%s/v1/file", client.Remote)
+	url := fmt.Sprintf("%s/v1/file", util.GetHTTPURL(client.Remote, client.TLS))
 
 	req, err := http.NewRequest("POST", url, r)
 	if err != nil {
@@ -163,3 +175,146 @@ func (client *DataSourceClient) Upload(filePath string) error {
 
 	return nil
 }
+
+// CreateUploadSession starts a resumable chunked upload, or returns the existing session of the data source file.
+func (client *DataSourceClient) CreateUploadSession(size int64) (*api.UploadSession, error) {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/file", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest("POST", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("action", "createUploadSession")
+	q.Add("size", strconv.FormatInt(size, 10))
+	req.URL.RawQuery = q.Encode()
+
+	return doUploadSessionRequest(httpClient, req, "create upload session")
+}
+
+// GetUploadSession returns the received offset of the upload session, from which the next chunk should start.
+func (client *DataSourceClient) GetUploadSession() (*api.UploadSession, error) {
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/file/upload", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return doUploadSessionRequest(httpClient, req, "get upload session")
+}
+
+// UploadChunk uploads the data at the offset with the chunk checksum.
+func (client *DataSourceClient) UploadChunk(offset int64, data []byte) (*api.UploadSession, error) {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/file/upload", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest("PUT", requestURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("offset", strconv.FormatInt(offset, 10))
+	q.Add("checksum", GetChunkChecksum(data))
+	req.URL.RawQuery = q.Encode()
+
+	return doUploadSessionRequest(httpClient, req, "upload chunk")
+}
+
+// FinalizeUploadSession asks the data source server to process the file after all chunks are uploaded.
+func (client *DataSourceClient) FinalizeUploadSession() error {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/file", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest("POST", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Add("action", "finalizeUploadSession")
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("finalize upload session failed, err: %s", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "%v, failed to read the response body", util.GetHTTPClientErrorPrefix(resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	return nil
+}
+
+// UploadResumable is the resuming mode of Upload. It uploads the file chunk by chunk via an upload session.
+// A failed chunk is retried from the received offset queried from the server, and calling it again after
+// an interruption resumes the upload from the received offset rather than the beginning.
+func (client *DataSourceClient) UploadResumable(filePath string, chunkSize int64) error {
+	if chunkSize <= 0 {
+		chunkSize = types.DefaultUploadChunkSize
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := file.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close file")
+		}
+	}()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	session, err := client.CreateUploadSession(stat.Size())
+	if err != nil {
+		return err
+	}
+	if session.Size != stat.Size() {
+		return fmt.Errorf("the size %v of the existing upload session doesn't match the file size %v", session.Size, stat.Size())
+	}
+
+	offset := session.Offset
+	buf := make([]byte, chunkSize)
+	retryCount := 0
+	for offset < stat.Size() {
+		n, err := file.ReadAt(buf[:min(chunkSize, stat.Size()-offset)], offset)
+		if err != nil && err != io.EOF {
+			return errors.Wrapf(err, "failed to read file %v at offset %v", filePath, offset)
+		}
+
+		session, err := client.UploadChunk(offset, buf[:n])
+		if err == nil {
+			offset = session.Offset
+			retryCount = 0
+			continue
+		}
+
+		retryCount++
+		if retryCount > UploadChunkRetryCount {
+			return errors.Wrapf(err, "failed to upload the chunk at offset %v after %v retries", offset, UploadChunkRetryCount)
+		}
+		logrus.WithError(err).Warnf("Failed to upload the chunk at offset %v, will resume from the received offset", offset)
+		time.Sleep(UploadChunkRetryInterval)
+		if session, err = client.GetUploadSession(); err != nil {
+			logrus.WithError(err).Warn("Failed to get the upload session, will retry the chunk")
+			continue
+		}
+		offset = session.Offset
+	}
+
+	return client.FinalizeUploadSession()
+}
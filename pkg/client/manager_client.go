@@ -3,6 +3,7 @@ package client
 import (
 	"context"
 	"fmt"
+	"time"
 
 	rpc "github.com/longhorn/types/pkg/generated/bimrpc"
 
@@ -13,11 +14,15 @@ import (
 
 	"github.com/longhorn/backing-image-manager/api"
 	"github.com/longhorn/backing-image-manager/pkg/meta"
+	"github.com/longhorn/backing-image-manager/pkg/rpcext"
 	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
 )
 
 type BackingImageManagerClient struct {
 	Address string
+	// TLS is nil if the backing image manager serves plain gRPC.
+	TLS *util.TLSOptions
 }
 
 func NewBackingImageManagerClient(address string) *BackingImageManagerClient {
@@ -27,17 +32,29 @@ func NewBackingImageManagerClient(address string) *BackingImageManagerClient {
 	}
 }
 
-func (cli *BackingImageManagerClient) Sync(name, uuid, checksum, fromAddress string, size int64) (*api.BackingImage, error) {
-	if name == "" || uuid == "" || fromAddress == "" || size <= 0 {
-		return nil, fmt.Errorf("failed to sync backing image: missing required parameter")
+func (cli *BackingImageManagerClient) newClientConn() (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if cli.TLS.Enabled() {
+		clientTLS, err := util.NewClientTLS(cli.TLS)
+		if err != nil {
+			return nil, err
+		}
+		creds = clientTLS.Credentials()
 	}
-
-	conn, err := grpc.NewClient(
+	return grpc.NewClient(
 		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithTransportCredentials(creds),
 		grpc.WithNoProxy(),
 		grpc.WithDisableServiceConfig(),
 	)
+}
+
+func (cli *BackingImageManagerClient) Sync(name, uuid, checksum, fromAddress string, size int64) (*api.BackingImage, error) {
+	if name == "" || uuid == "" || fromAddress == "" || size <= 0 {
+		return nil, fmt.Errorf("failed to sync backing image: missing required parameter")
+	}
+
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -71,12 +88,7 @@ func (cli *BackingImageManagerClient) Send(name, uuid, toAddress string) error {
 		return fmt.Errorf("failed to send backing image: missing required parameter")
 	}
 
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -98,17 +110,43 @@ func (cli *BackingImageManagerClient) Send(name, uuid, toAddress string) error {
 	return err
 }
 
+// Repair asks the backing image manager to pull the corrupted blocks of the backing image from the peer in fromAddress.
+func (cli *BackingImageManagerClient) Repair(name, uuid, fromAddress string) (*api.BackingImage, error) {
+	if name == "" || uuid == "" || fromAddress == "" {
+		return nil, fmt.Errorf("failed to repair backing image: missing required parameter")
+	}
+
+	conn, err := cli.newClientConn()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
+	}
+	defer func() {
+		if errClose := conn.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close backing image manager service connection")
+		}
+	}()
+
+	client := rpcext.NewBackingImageManagerExtServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	resp, err := client.Repair(ctx, &rpcext.RepairRequest{
+		Name:        name,
+		Uuid:        uuid,
+		FromAddress: fromAddress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return api.RPCToBackingImage(resp), nil
+}
+
 func (cli *BackingImageManagerClient) Delete(name, uuid string) error {
 	if name == "" || uuid == "" {
 		return fmt.Errorf("failed to delete backing image: missing required parameter")
 	}
 
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -134,12 +172,7 @@ func (cli *BackingImageManagerClient) Get(name, uuid string) (*api.BackingImage,
 		return nil, fmt.Errorf("failed to get backing image: missing required parameter")
 	}
 
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -164,12 +197,7 @@ func (cli *BackingImageManagerClient) Get(name, uuid string) (*api.BackingImage,
 }
 
 func (cli *BackingImageManagerClient) List() (map[string]*api.BackingImage, error) {
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -195,12 +223,7 @@ func (cli *BackingImageManagerClient) Fetch(name, uuid, checksum, dataSourceAddr
 		return nil, fmt.Errorf("failed to fetch backing image: missing required parameter")
 	}
 
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -229,19 +252,16 @@ func (cli *BackingImageManagerClient) Fetch(name, uuid, checksum, dataSourceAddr
 	return api.RPCToBackingImage(resp), nil
 }
 
-func (cli *BackingImageManagerClient) PrepareDownload(name, uuid string) (string, string, error) {
+// PrepareDownload returns the file path and the sync server address for the download, and the download token
+// of the file if the sync server requires authentication.
+func (cli *BackingImageManagerClient) PrepareDownload(name, uuid string) (srcFilePath, address, token string, err error) {
 	if name == "" || uuid == "" {
-		return "", "", fmt.Errorf("failed to get backing image: missing required parameter")
+		return "", "", "", fmt.Errorf("failed to get backing image: missing required parameter")
 	}
 
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
-		return "", "", fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
+		return "", "", "", fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
 	defer func() {
 		if errClose := conn.Close(); errClose != nil {
@@ -249,27 +269,22 @@ func (cli *BackingImageManagerClient) PrepareDownload(name, uuid string) (string
 		}
 	}()
 
-	client := rpc.NewBackingImageManagerServiceClient(conn)
+	client := rpcext.NewBackingImageManagerExtServiceClient(conn)
 	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
 	defer cancel()
 
-	resp, err := client.PrepareDownload(ctx, &rpc.PrepareDownloadRequest{
+	resp, err := client.PrepareDownloadWithToken(ctx, &rpcext.PrepareDownloadWithTokenRequest{
 		Name: name,
 		Uuid: uuid,
 	})
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
-	return resp.SrcFilePath, resp.Address, nil
+	return resp.SrcFilePath, resp.Address, resp.Token, nil
 }
 
 func (cli *BackingImageManagerClient) VersionGet() (*meta.VersionOutput, error) {
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -298,12 +313,7 @@ func (cli *BackingImageManagerClient) VersionGet() (*meta.VersionOutput, error)
 }
 
 func (cli *BackingImageManagerClient) Watch() (*api.BackingImageStream, error) {
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -321,17 +331,62 @@ func (cli *BackingImageManagerClient) Watch() (*api.BackingImageStream, error) {
 	return api.NewBackingImageStream(conn, cancel, stream), nil
 }
 
+// WatchEvents streams the changed backing images and the deletion tombstones. If the name is not empty,
+// only the events of the backing image are received. The stream resumes after the revision if it's positive.
+func (cli *BackingImageManagerClient) WatchEvents(name string, revision int64) (*api.BackingImageEventStream, error) {
+	conn, err := cli.newClientConn()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
+	}
+
+	// Don't cleanup the Client here, we don't know when the user will be done with the Stream. Pass it to the wrapper
+	// and allow the user to take care of it.
+	client := rpcext.NewBackingImageManagerExtServiceClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.WatchEvents(ctx, &rpcext.WatchRequest{
+		Name:     name,
+		Revision: revision,
+	})
+	if err != nil {
+		cancel()
+		_ = conn.Close()
+		return nil, err
+	}
+	return api.NewBackingImageEventStream(conn, cancel, stream), nil
+}
+
+func (cli *BackingImageManagerClient) CollectLeftovers(dryRun bool, gracePeriod time.Duration, activeDataSources []string) (*api.LeftoverCollection, error) {
+	conn, err := cli.newClientConn()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect backing image manager service to %v: %v", cli.Address, err)
+	}
+	defer func() {
+		if errClose := conn.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close backing image manager service connection")
+		}
+	}()
+
+	client := rpcext.NewBackingImageManagerExtServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), types.GRPCServiceTimeout)
+	defer cancel()
+
+	resp, err := client.CollectLeftovers(ctx, &rpcext.CollectLeftoversRequest{
+		DryRun:            dryRun,
+		GracePeriod:       gracePeriod.String(),
+		ActiveDataSources: activeDataSources,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return api.RPCToLeftoverCollection(resp), nil
+}
+
 func (cli *BackingImageManagerClient) BackupCreate(name, uuid, checksum, backupTargetURL string, labels, credential map[string]string, compressionMethod string, concurrentLimit int, parameters map[string]string) error {
 	if name == "" || uuid == "" || checksum == "" {
 		return fmt.Errorf("failed to create backup backing image: missing required parameter")
 	}
 
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return fmt.Errorf("failed to connect backing image manager service to %v: %v", cli.Address, err)
 	}
@@ -369,12 +424,7 @@ func (cli *BackingImageManagerClient) BackupStatus(name string) (*api.BackupStat
 		return nil, fmt.Errorf("failed to get backup backing image status: missing required parameter")
 	}
 
-	conn, err := grpc.NewClient(
-		cli.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithNoProxy(),
-		grpc.WithDisableServiceConfig(),
-	)
+	conn, err := cli.newClientConn()
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect backing image manager service to %v: %v", cli.Address, err)
 	}
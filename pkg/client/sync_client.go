@@ -1,7 +1,11 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,27 +14,39 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
 )
 
 const (
 	HTTPClientTimeout = 10 * time.Second
+	// BlockChecksumsTimeout is longer since the sync server may re-calculate the block checksums of the whole file.
+	BlockChecksumsTimeout = 10 * time.Minute
+	BlockDownloadTimeout  = 1 * time.Minute
 )
 
 type SyncClient struct {
 	Remote string
+	// Priority of the fetch, download, clone, restore, send and repair operations launched by the client.
+	// The operation with higher priority starts first when the sync server queues the operations.
+	Priority int
+	// TLS is nil if the sync server serves plain HTTP.
+	TLS *util.TLSOptions
+	// Token is presented as the bearer token if the sync server requires authentication.
+	Token string
 }
 
 func (client *SyncClient) Get(filePath string) (*api.FileInfo, error) {
-	httpClient := &http.Client{Timeout: HTTPClientTimeout, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files/%s", client.Remote, url.QueryEscape(filePath))
+	requestURL := fmt.Sprintf("%s/v1/files/%s", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
 	req, err := http.NewRequest("GET", requestURL, nil)
 	if err != nil {
 		return nil, err
@@ -67,9 +83,9 @@ func (client *SyncClient) Get(filePath string) (*api.FileInfo, error) {
 }
 
 func (client *SyncClient) List() (map[string]*api.FileInfo, error) {
-	httpClient := &http.Client{Timeout: HTTPClientTimeout, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files", client.Remote)
+	requestURL := fmt.Sprintf("%s/v1/files", util.GetHTTPURL(client.Remote, client.TLS))
 	req, err := http.NewRequest("GET", requestURL, nil)
 	if err != nil {
 		return nil, err
@@ -105,10 +121,82 @@ func (client *SyncClient) List() (map[string]*api.FileInfo, error) {
 	return result, nil
 }
 
+// WatchEvents consumes the event stream of the sync server until the context is done, the stream
+// is interrupted, or the handler returns an error. The stream resumes from the revision of the epoch
+// if the revision is positive. It returns an error if no event or keep-alive is received for a while.
+func (client *SyncClient) WatchEvents(ctx context.Context, epoch, revision int64, handler func(*api.FileEvent) error) error {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	requestURL := fmt.Sprintf("%s/v1/events", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	if revision > 0 {
+		q := req.URL.Query()
+		q.Add("epoch", strconv.FormatInt(epoch, 10))
+		q.Add("revision", strconv.FormatInt(revision, 10))
+		req.URL.RawQuery = q.Encode()
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("watch events failed, err: %s", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		bodyContent, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("%s, failed to read the response body: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), err)
+		}
+		return fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	idleTimeout := 2 * types.EventKeepAliveInterval
+	idleTimer := time.AfterFunc(idleTimeout, cancel)
+	defer idleTimer.Stop()
+
+	reader := bufio.NewReader(resp.Body)
+	data := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil && !idleTimer.Stop() {
+				return fmt.Errorf("no event or keep-alive is received in %v", idleTimeout)
+			}
+			return errors.Wrap(err, "failed to read the event stream")
+		}
+		idleTimer.Reset(idleTimeout)
+
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		case line == "" && data != "":
+			event := &api.FileEvent{}
+			if err := json.Unmarshal([]byte(data), event); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal event %v", data)
+			}
+			data = ""
+			if err := handler(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 func (client *SyncClient) Delete(filePath string) error {
-	httpClient := &http.Client{Timeout: HTTPClientTimeout, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files/%s", client.Remote, url.QueryEscape(filePath))
+	requestURL := fmt.Sprintf("%s/v1/files/%s", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
 	req, err := http.NewRequest("DELETE", requestURL, nil)
 	if err != nil {
 		return err
@@ -136,9 +224,9 @@ func (client *SyncClient) Delete(filePath string) error {
 }
 
 func (client *SyncClient) Forget(filePath string) error {
-	httpClient := &http.Client{Timeout: HTTPClientTimeout, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files/%s", client.Remote, url.QueryEscape(filePath))
+	requestURL := fmt.Sprintf("%s/v1/files/%s", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
 	req, err := http.NewRequest("POST", requestURL, nil)
 	if err != nil {
 		return err
@@ -169,15 +257,16 @@ func (client *SyncClient) Forget(filePath string) error {
 }
 
 func (client *SyncClient) Fetch(srcFilePath, dstFilePath, uuid, diskUUID, expectedChecksum string, size int64) error {
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files", client.Remote)
+	requestURL := fmt.Sprintf("%s/v1/files", util.GetHTTPURL(client.Remote, client.TLS))
 	req, err := http.NewRequest("POST", requestURL, nil)
 	if err != nil {
 		return err
 	}
 	q := req.URL.Query()
 	q.Add("action", "fetch")
+	client.addPriority(q)
 	q.Add("src-file-path", srcFilePath)
 	q.Add("dst-file-path", dstFilePath)
 	q.Add("uuid", uuid)
@@ -207,17 +296,25 @@ func (client *SyncClient) Fetch(srcFilePath, dstFilePath, uuid, diskUUID, expect
 	return nil
 }
 
-func (client *SyncClient) DownloadFromURL(downloadURL, filePath, uuid, diskUUID, expectedChecksum, dataEngine string) error {
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+func (client *SyncClient) DownloadFromURL(downloadURL, concurrentLimit, compression, decompressedSizeLimit, targetFormat, filePath, uuid, diskUUID, expectedChecksum, dataEngine string) error {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files", client.Remote)
+	requestURL := fmt.Sprintf("%s/v1/files", util.GetHTTPURL(client.Remote, client.TLS))
 	req, err := http.NewRequest("POST", requestURL, nil)
 	if err != nil {
 		return err
 	}
 	q := req.URL.Query()
 	q.Add("action", "downloadFromURL")
+	client.addPriority(q)
 	q.Add("url", downloadURL)
+	if concurrentLimit != "" {
+		q.Add("concurrent-limit", concurrentLimit)
+	}
+	addDecompressionParameters(q, compression, decompressedSizeLimit)
+	if targetFormat != "" {
+		q.Add(types.DataSourceTypeParameterTargetFormat, targetFormat)
+	}
 	q.Add("file-path", filePath)
 	q.Add("uuid", uuid)
 	q.Add("disk-uuid", diskUUID)
@@ -247,13 +344,13 @@ func (client *SyncClient) DownloadFromURL(downloadURL, filePath, uuid, diskUUID,
 }
 
 func (client *SyncClient) CloneFromBackingImage(sourceBackingImage, sourceBackingImageUUID, encryption, filePath, uuid, diskUUID, expectedChecksum string, credential map[string]string, dataEngine string) error {
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 	encodedCredential, err := json.Marshal(credential)
 	if err != nil {
 		return err
 	}
 
-	requestURL := fmt.Sprintf("http://%s/v1/files", client.Remote)
+	requestURL := fmt.Sprintf("%s/v1/files", util.GetHTTPURL(client.Remote, client.TLS))
 	req, err := http.NewRequest("POST", requestURL, bytes.NewReader(encodedCredential))
 	if err != nil {
 		return err
@@ -261,6 +358,7 @@ func (client *SyncClient) CloneFromBackingImage(sourceBackingImage, sourceBackin
 	req.Header.Set("Content-Type", "application/json")
 	q := req.URL.Query()
 	q.Add("action", "cloneFromBackingImage")
+	client.addPriority(q)
 	q.Add("backing-image", sourceBackingImage)
 	q.Add("backing-image-uuid", sourceBackingImageUUID)
 	q.Add("encryption", encryption)
@@ -293,14 +391,14 @@ func (client *SyncClient) CloneFromBackingImage(sourceBackingImage, sourceBackin
 	return nil
 }
 
-func (client *SyncClient) RestoreFromBackupURL(backupURL, concurrentLimit, filePath, uuid, diskUUID, expectedChecksum string, credential map[string]string, dataEngine string) error {
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+func (client *SyncClient) RestoreFromBackupURL(backupURL, concurrentLimit, compression, decompressedSizeLimit, targetFormat, filePath, uuid, diskUUID, expectedChecksum string, credential map[string]string, dataEngine string) error {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 	encodedCredential, err := json.Marshal(credential)
 	if err != nil {
 		return err
 	}
 
-	requestURL := fmt.Sprintf("http://%s/v1/files", client.Remote)
+	requestURL := fmt.Sprintf("%s/v1/files", util.GetHTTPURL(client.Remote, client.TLS))
 	req, err := http.NewRequest("POST", requestURL, bytes.NewReader(encodedCredential))
 	if err != nil {
 		return err
@@ -308,12 +406,17 @@ func (client *SyncClient) RestoreFromBackupURL(backupURL, concurrentLimit, fileP
 	req.Header.Set("Content-Type", "application/json")
 	q := req.URL.Query()
 	q.Add("action", "restoreFromBackupURL")
+	client.addPriority(q)
 	q.Add("backup-url", backupURL)
 	q.Add("file-path", filePath)
 	q.Add("uuid", uuid)
 	q.Add("disk-uuid", diskUUID)
 	q.Add("expected-checksum", expectedChecksum)
 	q.Add("concurrent-limit", concurrentLimit)
+	addDecompressionParameters(q, compression, decompressedSizeLimit)
+	if targetFormat != "" {
+		q.Add(types.DataSourceTypeParameterTargetFormat, targetFormat)
+	}
 	q.Add("data-engine", dataEngine)
 
 	req.URL.RawQuery = q.Encode()
@@ -340,7 +443,7 @@ func (client *SyncClient) RestoreFromBackupURL(backupURL, concurrentLimit, fileP
 }
 
 func (client *SyncClient) Upload(src, dst, uuid, diskUUID, expectedChecksum string) error {
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 
 	stat, err := os.Stat(src)
 	if err != nil {
@@ -378,7 +481,7 @@ func (client *SyncClient) Upload(src, dst, uuid, diskUUID, expectedChecksum stri
 		}
 	}()
 
-	requestURL := fmt.Sprintf("http://%s/v1/files", client.Remote)
+	requestURL := fmt.Sprintf("%s/v1/files", util.GetHTTPURL(client.Remote, client.TLS))
 
 	req, err := http.NewRequest("POST", requestURL, r)
 	if err != nil {
@@ -415,10 +518,102 @@ func (client *SyncClient) Upload(src, dst, uuid, diskUUID, expectedChecksum stri
 	return nil
 }
 
-func (client *SyncClient) Receive(filePath, uuid, diskUUID, expectedChecksum, fileType string, receiverPort int, size int64, dataEngine string) error {
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+// CreateUploadSession starts a resumable chunked upload, or returns the existing session of the file.
+func (client *SyncClient) CreateUploadSession(filePath, uuid, diskUUID, expectedChecksum, compression, decompressedSizeLimit, targetFormat, dataEngine string, size int64) (*api.UploadSession, error) {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/files", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest("POST", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("action", "createUploadSession")
+	q.Add("file-path", filePath)
+	q.Add("uuid", uuid)
+	q.Add("disk-uuid", diskUUID)
+	q.Add("expected-checksum", expectedChecksum)
+	q.Add("size", strconv.FormatInt(size, 10))
+	q.Add(types.DataSourceTypeParameterDataEngine, dataEngine)
+	addDecompressionParameters(q, compression, decompressedSizeLimit)
+	if targetFormat != "" {
+		q.Add(types.DataSourceTypeParameterTargetFormat, targetFormat)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	return doUploadSessionRequest(httpClient, req, "create upload session")
+}
+
+// GetUploadSession returns the received offset of the upload session, from which the next chunk should start.
+func (client *SyncClient) GetUploadSession(filePath string) (*api.UploadSession, error) {
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/files/%s/upload", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return doUploadSessionRequest(httpClient, req, "get upload session")
+}
+
+// UploadChunk uploads the data at the offset with the chunk checksum.
+func (client *SyncClient) UploadChunk(filePath string, offset int64, data []byte) (*api.UploadSession, error) {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/files/%s/upload", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
+	req, err := http.NewRequest("PUT", requestURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("offset", strconv.FormatInt(offset, 10))
+	q.Add("checksum", GetChunkChecksum(data))
+	req.URL.RawQuery = q.Encode()
+
+	return doUploadSessionRequest(httpClient, req, "upload chunk")
+}
+
+// FinalizeUploadSession asks the sync server to process the file after all chunks are uploaded.
+func (client *SyncClient) FinalizeUploadSession(filePath string) error {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/files/%s", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
+	req, err := http.NewRequest("POST", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Add("action", "finalizeUploadSession")
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("finalize upload session failed, err: %s", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "%v, failed to read the response body", util.GetHTTPClientErrorPrefix(resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	return nil
+}
+
+// Receive asks the sync server to launch a receiver at the port. The receiver serves TLS if the sync server does,
+// unless plainHTTPSender is set for the sender not supporting TLS.
+func (client *SyncClient) Receive(filePath, uuid, diskUUID, expectedChecksum, fileType string, receiverPort int, size int64, dataEngine string, plainHTTPSender bool) error {
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files", client.Remote)
+	requestURL := fmt.Sprintf("%s/v1/files", util.GetHTTPURL(client.Remote, client.TLS))
 	req, err := http.NewRequest("POST", requestURL, nil)
 	if err != nil {
 		return err
@@ -433,6 +628,7 @@ func (client *SyncClient) Receive(filePath, uuid, diskUUID, expectedChecksum, fi
 	q.Add("port", strconv.Itoa(receiverPort))
 	q.Add("size", strconv.FormatInt(size, 10))
 	q.Add("data-engine", dataEngine)
+	q.Add("plain-http-sender", strconv.FormatBool(plainHTTPSender))
 	req.URL.RawQuery = q.Encode()
 
 	resp, err := httpClient.Do(req)
@@ -457,15 +653,16 @@ func (client *SyncClient) Receive(filePath, uuid, diskUUID, expectedChecksum, fi
 }
 
 func (client *SyncClient) Send(filePath, toAddress string) error {
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files/%s", client.Remote, url.QueryEscape(filePath))
+	requestURL := fmt.Sprintf("%s/v1/files/%s", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
 	req, err := http.NewRequest("POST", requestURL, nil)
 	if err != nil {
 		return err
 	}
 	q := req.URL.Query()
 	q.Add("action", "sendToPeer")
+	client.addPriority(q)
 	q.Add("to-address", toAddress)
 	req.URL.RawQuery = q.Encode()
 
@@ -490,6 +687,193 @@ func (client *SyncClient) Send(filePath, toAddress string) error {
 	return nil
 }
 
+// RepairFromPeer asks the sync server to pull the mismatching blocks of the file from the peer sync server.
+// peerToken is presented to the peer sync server, e.g. the download token of the peer file.
+func (client *SyncClient) RepairFromPeer(filePath, peerAddress, peerFilePath, peerToken string) error {
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/files/%s", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
+	req, err := http.NewRequest("POST", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Add("action", "repairFromPeer")
+	q.Add("peer-address", peerAddress)
+	q.Add("peer-file-path", peerFilePath)
+	client.addPriority(q)
+	req.URL.RawQuery = q.Encode()
+	if peerToken != "" {
+		req.Header.Set(types.PeerTokenHeader, peerToken)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("repair from peer failed, err: %s", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "%v, failed to read the response body", util.GetHTTPClientErrorPrefix(resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	return nil
+}
+
+func (client *SyncClient) GetBandwidthLimits() (*api.BandwidthLimits, error) {
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/bandwidth-limits", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return doBandwidthLimitsRequest(httpClient, req, "get bandwidth limits")
+}
+
+// UpdateBandwidthLimits overwrites all the bandwidth limits of the sync server at runtime.
+func (client *SyncClient) UpdateBandwidthLimits(limits *api.BandwidthLimits) (*api.BandwidthLimits, error) {
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
+
+	encodedLimits, err := json.Marshal(limits)
+	if err != nil {
+		return nil, err
+	}
+	requestURL := fmt.Sprintf("%s/v1/bandwidth-limits", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest("PUT", requestURL, bytes.NewReader(encodedLimits))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doBandwidthLimitsRequest(httpClient, req, "update bandwidth limits")
+}
+
+// CollectLeftovers reports the artefacts on the disk not owned by any tracked file or active data source,
+// and deletes the ones not modified within the grace period unless it's a dry run.
+// activeDataSources are the data source file names, i.e. <name>-<uuid>, whose files should be kept.
+func (client *SyncClient) CollectLeftovers(dryRun bool, gracePeriod time.Duration, activeDataSources []string) (*api.LeftoverCollection, error) {
+	httpClient := util.NewHTTPClientWithToken(HTTPClientTimeout, client.TLS, client.Token)
+
+	method := "POST"
+	if dryRun {
+		method = "GET"
+	}
+	requestURL := fmt.Sprintf("%s/v1/leftovers", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest(method, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	if !dryRun {
+		q.Add("action", "collect")
+	}
+	q.Add("gracePeriod", gracePeriod.String())
+	for _, dataSource := range activeDataSources {
+		q.Add("activeDataSource", dataSource)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("collect leftovers failed, err: %s", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s, failed to read the response body: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	result := &api.LeftoverCollection{}
+	if err := json.Unmarshal(bodyContent, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Drain makes the sync service refuse the new operations, then waits up to the timeout for the running ones.
+// The operations still running after the timeout are interrupted and reported.
+func (client *SyncClient) Drain(timeout time.Duration) (*api.DrainReport, error) {
+	// The interrupted operations are given some extra time to record the progress.
+	httpClient := util.NewHTTPClientWithToken(timeout+HTTPClientTimeout, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/drain", util.GetHTTPURL(client.Remote, client.TLS))
+	req, err := http.NewRequest("POST", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("timeout", timeout.String())
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("drain failed, err: %s", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s, failed to read the response body: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	result := &api.DrainReport{}
+	if err := json.Unmarshal(bodyContent, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func doBandwidthLimitsRequest(httpClient *http.Client, req *http.Request, operation string) (*api.BandwidthLimits, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%v failed, err: %s", operation, err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s, failed to read the response body: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	result := &api.BandwidthLimits{}
+	if err := json.Unmarshal(bodyContent, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (client *SyncClient) DownloadToDst(srcFilePath, dstFilePath string) error {
 	if _, err := os.Stat(dstFilePath); err == nil || !os.IsNotExist(err) {
 		if err := os.RemoveAll(dstFilePath); err != nil {
@@ -506,9 +890,9 @@ func (client *SyncClient) DownloadToDst(srcFilePath, dstFilePath string) error {
 		}
 	}()
 
-	httpClient := &http.Client{Timeout: 0, Transport: util.NoProxyTransport}
+	httpClient := util.NewHTTPClientWithToken(0, client.TLS, client.Token)
 
-	requestURL := fmt.Sprintf("http://%s/v1/files/%s/download", client.Remote, url.QueryEscape(srcFilePath))
+	requestURL := fmt.Sprintf("%s/v1/files/%s/download", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(srcFilePath))
 	req, err := http.NewRequest("GET", requestURL, nil)
 	if err != nil {
 		return err
@@ -537,3 +921,124 @@ func (client *SyncClient) DownloadToDst(srcFilePath, dstFilePath string) error {
 	}
 	return nil
 }
+
+// GetBlockChecksums gets the block checksums of a ready file.
+// It may take a while since the block checksums will be re-calculated if they are outdated.
+func (client *SyncClient) GetBlockChecksums(ctx context.Context, filePath string) (*util.BlockChecksums, error) {
+	httpClient := util.NewHTTPClientWithToken(BlockChecksumsTimeout, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/files/%s/blocks", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath))
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get block checksums failed, err: %s", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s, failed to read the response body: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	result := &util.BlockChecksums{}
+	if err := json.Unmarshal(bodyContent, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// DownloadBlock downloads a block of a ready file then verifies the data with the block checksums.
+func (client *SyncClient) DownloadBlock(ctx context.Context, filePath string, index int, blockChecksums *util.BlockChecksums) ([]byte, error) {
+	httpClient := util.NewHTTPClientWithToken(BlockDownloadTimeout, client.TLS, client.Token)
+
+	requestURL := fmt.Sprintf("%s/v1/files/%s/blocks/%d", util.GetHTTPURL(client.Remote, client.TLS), url.QueryEscape(filePath), index)
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download block failed, err: %s", err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s, failed to read the response body: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+	if err := blockChecksums.VerifyBlock(index, bodyContent); err != nil {
+		return nil, errors.Wrapf(err, "failed to verify the downloaded block")
+	}
+
+	return bodyContent, nil
+}
+
+// addPriority adds the priority of the operation in the queue of the sync server, if it's set.
+func (client *SyncClient) addPriority(q url.Values) {
+	if client.Priority != 0 {
+		q.Add("priority", strconv.Itoa(client.Priority))
+	}
+}
+
+// addDecompressionParameters adds the optional decompression parameters. The sync server will
+// detect the compression and use the default size limit if they are not specified.
+func addDecompressionParameters(q url.Values, compression, decompressedSizeLimit string) {
+	if compression != "" {
+		q.Add(types.DataSourceTypeParameterCompression, compression)
+	}
+	if decompressedSizeLimit != "" {
+		q.Add(types.DataSourceTypeParameterDecompressedSizeLimit, decompressedSizeLimit)
+	}
+}
+
+// GetChunkChecksum returns the checksum of an upload chunk, which is verified by the server before accepting the chunk.
+func GetChunkChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return util.FormatChecksum(types.ChecksumAlgorithmSHA256, hex.EncodeToString(sum[:]))
+}
+
+func doUploadSessionRequest(httpClient *http.Client, req *http.Request, operation string) (*api.UploadSession, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%v failed, err: %s", operation, err)
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	bodyContent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s, failed to read the response body: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s, response body content: %v", util.GetHTTPClientErrorPrefix(resp.StatusCode), string(bodyContent))
+	}
+
+	result := &api.UploadSession{}
+	if err := json.Unmarshal(bodyContent, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -91,6 +91,19 @@ func (cp *EncryptParams) GetPBKDFMemory() string {
 	return cp.PBKDFMemory
 }
 
+// CheckCryptsetup verifies that cryptsetup can be executed in the host namespaces, which is required by the encryption.
+func CheckCryptsetup() error {
+	namespaces := []lhtypes.Namespace{lhtypes.NamespaceMnt, lhtypes.NamespaceIpc}
+	nsexec, err := lhns.NewNamespaceExecutor(lhtypes.ProcessNone, lhtypes.HostProcDirectory, namespaces)
+	if err != nil {
+		return err
+	}
+	if _, err := nsexec.Execute(nil, lhtypes.BinaryCryptsetup, []string{"--version"}, types.CommandExecutionTimeout); err != nil {
+		return errors.Wrapf(err, "failed to execute %v", lhtypes.BinaryCryptsetup)
+	}
+	return nil
+}
+
 // EncryptBackingImage encrypts provided device with LUKS.
 func EncryptBackingImage(devicePath, passphrase string, cryptoParams *EncryptParams) error {
 	namespaces := []lhtypes.Namespace{lhtypes.NamespaceMnt, lhtypes.NamespaceIpc}
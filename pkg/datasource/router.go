@@ -2,6 +2,10 @@ package datasource
 
 import (
 	"github.com/gorilla/mux"
+
+	"github.com/longhorn/backing-image-manager/pkg/health"
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
+	"github.com/longhorn/backing-image-manager/pkg/types"
 )
 
 // NewRouter creates and configures a mux router
@@ -13,7 +17,20 @@ func NewRouter(service *Service) *mux.Router {
 	// Application
 	router.HandleFunc("/v1/file", service.Get).Methods("Get")
 	router.HandleFunc("/v1/file", service.Upload).Methods("POST").Queries("action", "upload")
+	router.HandleFunc("/v1/file", service.CreateUploadSession).Methods("POST").Queries("action", "createUploadSession")
+	router.HandleFunc("/v1/file", service.FinalizeUploadSession).Methods("POST").Queries("action", "finalizeUploadSession")
+	router.HandleFunc("/v1/file/upload", service.GetUploadSession).Methods("GET")
+	router.HandleFunc("/v1/file/upload", service.UploadChunk).Methods("PUT")
 	router.HandleFunc("/v1/file", service.Transfer).Methods("POST").Queries("action", "transfer")
 
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	router.HandleFunc(types.HealthzPath, health.Liveness).Methods("GET")
+	router.HandleFunc(types.ReadyzPath, service.healthChecker.Readiness).Methods("GET")
+
+	if service.auth.Enabled() {
+		router.Use(service.auth.Middleware(nil))
+	}
+
 	return router
 }
@@ -7,33 +7,52 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/longhorn/backing-image-manager/pkg/health"
 	"github.com/longhorn/backing-image-manager/pkg/sync"
+	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
 )
 
-func NewServer(parentCtx context.Context, listenAddr, syncListenAddr, checksum, sourceType, biName, biUUID, diskPathInContainer string, parameters map[string]string, credential map[string]string, handler sync.Handler) error {
+func NewServer(parentCtx context.Context, listenAddr, syncListenAddr, checksum, sourceType, biName, biUUID, diskPathInContainer string, parameters map[string]string, credential map[string]string, syncOptions sync.Options, handler sync.Handler) error {
 	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
 	srv := &http.Server{
 		Addr: listenAddr,
 	}
 
+	if syncOptions.RetentionPolicy.IsFileReferenced == nil {
+		syncOptions.RetentionPolicy.IsFileReferenced = newFileReferencePredicate(types.GetDataSourceFilePath(diskPathInContainer, biName, biUUID))
+	}
+
+	// The sync service of the data source server doesn't manage the disk, but its files are still in the disk.
+	if len(syncOptions.AllowedRoots) == 0 {
+		syncOptions.AllowedRoots = sync.GetDiskAllowedRoots(diskPathInContainer)
+	}
+
 	// TODO: Will launch the sync service separately
 	go func() {
-		if err := sync.NewServer(ctx, syncListenAddr, handler); err != nil {
+		if err := sync.NewServer(ctx, syncListenAddr, "", syncOptions, handler); err != nil {
 			logrus.Warnf("File sync service errored out: %v", err)
 		}
 	}()
 	// Wait for Sync Service up and running
-	if !util.DetectHTTPServerAvailability("http://"+syncListenAddr, 5, true) {
+	if !health.WaitForHTTPServer(syncListenAddr, syncOptions.TLS, 5) {
 		return fmt.Errorf("failed to wait for sync service running in 5 second")
 	}
 
-	service, err := LaunchService(ctx, cancel, syncListenAddr, checksum, sourceType, biName, biUUID, diskPathInContainer, parameters, credential)
+	service, err := LaunchService(ctx, cancel, syncListenAddr, checksum, sourceType, biName, biUUID, diskPathInContainer, parameters, credential, syncOptions.TLS, syncOptions.Auth)
 	if err != nil {
 		return err
 	}
 	srv.Handler = NewRouter(service)
+	// The server shares the TLS options with the sync server.
+	if syncOptions.TLS.Enabled() {
+		tlsConfig, err := util.NewServerTLSConfig(syncOptions.TLS)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
 
 	go func() {
 		<-ctx.Done()
@@ -45,5 +64,17 @@ func NewServer(parentCtx context.Context, listenAddr, syncListenAddr, checksum,
 
 	logrus.Infof("Started data source server at %v", listenAddr)
 
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
 	return srv.ListenAndServe()
 }
+
+// newFileReferencePredicate returns the default IsFileReferenced of the data source. The data source file is
+// referenced until the manager takes it over via the transfer, unless it failed, since the manager retries a
+// failed data source with a new one rather than taking it over.
+func newFileReferencePredicate(dsFilePath string) func(string, types.State) bool {
+	return func(filePath string, state types.State) bool {
+		return filePath == dsFilePath && state != types.StateFailed
+	}
+}
@@ -82,7 +82,7 @@ func (s *DataSourceTestSuite) BenchmarkDownload(c *C) {
 	go func() {
 		_ = NewServer(s.ctx, s.addr, s.syncAddr, "", string(types.DataSourceTypeDownload), biName, TestBackingImageUUID, s.dir,
 			map[string]string{types.DataSourceTypeDownloadParameterURL: "http://mock-download"}, map[string]string{},
-			&sync.MockHandler{})
+			sync.Options{}, &sync.MockHandler{})
 	}()
 
 	err := checkAndWaitForServer(s.addr, s.syncAddr, 5, true)
@@ -118,7 +118,7 @@ func (s *DataSourceTestSuite) BenchmarkUpload(c *C) {
 
 	// Test if the proxy works
 	go func() {
-		_ = NewServer(s.ctx, s.addr, s.syncAddr, checksum, string(types.DataSourceTypeUpload), biName, TestBackingImageUUID, s.dir, map[string]string{"fileType": types.SyncingFileTypeQcow2}, map[string]string{}, &sync.HTTPHandler{})
+		_ = NewServer(s.ctx, s.addr, s.syncAddr, checksum, string(types.DataSourceTypeUpload), biName, TestBackingImageUUID, s.dir, map[string]string{"fileType": types.SyncingFileTypeQcow2}, map[string]string{}, sync.Options{}, &sync.HTTPHandler{})
 	}()
 
 	err = checkAndWaitForServer(s.addr, s.syncAddr, 5, true)
@@ -156,7 +156,7 @@ func (s *DataSourceTestSuite) TestTimeoutExportingFromVolume(c *C) {
 	}
 	go func() {
 		_ = NewServer(s.ctx, s.addr, s.syncAddr, "", string(types.DataSourceTypeExportFromVolume), biName, TestBackingImageUUID, s.dir,
-			parameters, map[string]string{}, &sync.HTTPHandler{})
+			parameters, map[string]string{}, sync.Options{}, &sync.HTTPHandler{})
 	}()
 	err := checkAndWaitForServer(s.addr, s.syncAddr, 5, true)
 	c.Assert(err, IsNil)
@@ -185,7 +185,7 @@ func (s *DataSourceTestSuite) TestTransfer(c *C) {
 	go func() {
 		_ = NewServer(s.ctx, s.addr, s.syncAddr, "", string(types.DataSourceTypeDownload), biName, TestBackingImageUUID, s.dir,
 			map[string]string{types.DataSourceTypeDownloadParameterURL: "http://mock-download"}, map[string]string{},
-			&sync.MockHandler{})
+			sync.Options{}, &sync.MockHandler{})
 	}()
 
 	err := checkAndWaitForServer(s.addr, s.syncAddr, 5, true)
@@ -213,6 +213,63 @@ func (s *DataSourceTestSuite) TestTransfer(c *C) {
 	c.Assert(stat.Size(), Equals, int64(MockFileSize))
 }
 
+func (s *DataSourceTestSuite) TestFileReferencePredicate(c *C) {
+	dsFilePath := types.GetDataSourceFilePath(s.dir, "data-source-reference", TestBackingImageUUID)
+	isFileReferenced := newFileReferencePredicate(dsFilePath)
+
+	c.Assert(isFileReferenced(dsFilePath, types.StateReadyForTransfer), Equals, true)
+	c.Assert(isFileReferenced(dsFilePath, types.StateReady), Equals, true)
+	// The manager retries the failed data source with a new one.
+	c.Assert(isFileReferenced(dsFilePath, types.StateFailed), Equals, false)
+	c.Assert(isFileReferenced(dsFilePath+"-other", types.StateReady), Equals, false)
+}
+
+func (s *DataSourceTestSuite) TestUploadResumable(c *C) {
+	biName := "data-source-upload-resumable"
+	originalFilePath := filepath.Join(s.dir, "data-source-resumable-original-file")
+	err := generateRandomDataFile(originalFilePath, 4)
+	c.Assert(err, IsNil)
+	checksum, err := util.GetFileChecksum(originalFilePath)
+	c.Assert(err, IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, s.syncAddr, checksum, string(types.DataSourceTypeUpload), biName, TestBackingImageUUID, s.dir,
+			map[string]string{}, map[string]string{}, sync.Options{}, &sync.HTTPHandler{})
+	}()
+	err = checkAndWaitForServer(s.addr, s.syncAddr, 5, true)
+	c.Assert(err, IsNil)
+
+	cli := &client.DataSourceClient{
+		Remote: s.addr,
+	}
+
+	_, err = getAndWaitFileState(cli, string(types.StatePending), 1)
+	c.Assert(err, IsNil)
+
+	// Simulate an upload interrupted after the first chunk.
+	original, err := os.ReadFile(originalFilePath)
+	c.Assert(err, IsNil)
+	session, err := cli.CreateUploadSession(int64(len(original)))
+	c.Assert(err, IsNil)
+	c.Assert(session.Offset, Equals, int64(0))
+	_, err = cli.UploadChunk(0, original[:1<<20])
+	c.Assert(err, IsNil)
+	session, err = cli.GetUploadSession()
+	c.Assert(err, IsNil)
+	c.Assert(session.Offset, Equals, int64(1<<20))
+
+	// The resumable upload continues from the received offset.
+	err = cli.UploadResumable(originalFilePath, 1<<20)
+	c.Assert(err, IsNil)
+
+	_, err = getAndWaitFileState(cli, string(types.StateReadyForTransfer), 30)
+	c.Assert(err, IsNil)
+
+	uploadedFilePath := types.GetDataSourceFilePath(s.dir, biName, TestBackingImageUUID)
+	err = exec.Command("diff", originalFilePath, uploadedFilePath).Run()
+	c.Assert(err, IsNil)
+}
+
 func getAndWaitFileState(cli *client.DataSourceClient, desireState string, waitIntervalInSecond int) (dsInfo *api.DataSourceInfo, err error) {
 	endTime := time.Now().Add(time.Duration(waitIntervalInSecond) * time.Second)
 
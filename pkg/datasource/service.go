@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,10 +16,12 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	butil "github.com/longhorn/backupstore/util"
 	repclient "github.com/longhorn/longhorn-engine/pkg/replica/client"
 
 	"github.com/longhorn/backing-image-manager/api"
 	"github.com/longhorn/backing-image-manager/pkg/client"
+	"github.com/longhorn/backing-image-manager/pkg/health"
 	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
 )
@@ -51,11 +54,16 @@ type Service struct {
 
 	syncListenAddr string
 	syncClient     client.SyncClient
+
+	healthChecker *health.Checker
+
+	// auth is shared with the sync service. The requests are not authenticated if it's nil.
+	auth *util.Authenticator
 }
 
 func LaunchService(ctx context.Context, cancel context.CancelFunc,
 	syncListenAddr, checksum, sourceType, name, uuid, diskPathInContainer string,
-	parameters map[string]string, credential map[string]string) (*Service, error) {
+	parameters map[string]string, credential map[string]string, syncTLS *util.TLSOptions, auth *util.Authenticator) (*Service, error) {
 
 	if name == "" || uuid == "" {
 		return nil, fmt.Errorf("the backing image name or uuid is not specified")
@@ -91,7 +99,18 @@ func LaunchService(ctx context.Context, cancel context.CancelFunc,
 		syncListenAddr: syncListenAddr,
 		syncClient: client.SyncClient{
 			Remote: syncListenAddr,
+			TLS:    syncTLS,
+			Token:  auth.GetSecretToken(),
 		},
+		auth: auth,
+
+		healthChecker: health.NewChecker(
+			health.DiskCheck(diskPathInContainer),
+			health.DiskUUIDCheck(diskPathInContainer, diskUUID),
+			health.QemuImgCheck(),
+			health.CryptsetupCheck(),
+			health.HTTPServerCheck(health.CheckSyncServer, syncListenAddr, syncTLS),
+		),
 	}
 	s.dsInfo = &api.DataSourceInfo{
 		SourceType: string(s.sourceType),
@@ -237,7 +256,11 @@ func (s *Service) restoreFromBackupURL() (err error) {
 		dataEngine = types.DataEnginev1
 	}
 
-	return s.syncClient.RestoreFromBackupURL(backupURL, concurrentLimit, s.filePath, s.uuid, s.diskUUID, s.expectedChecksum, s.credential, dataEngine)
+	compression := s.parameters[types.DataSourceTypeParameterCompression]
+	decompressedSizeLimit := s.parameters[types.DataSourceTypeParameterDecompressedSizeLimit]
+	targetFormat := s.parameters[types.DataSourceTypeParameterTargetFormat]
+
+	return s.syncClient.RestoreFromBackupURL(backupURL, concurrentLimit, compression, decompressedSizeLimit, targetFormat, s.filePath, s.uuid, s.diskUUID, s.expectedChecksum, s.credential, dataEngine)
 }
 
 func (s *Service) downloadFromURL(parameters map[string]string) (err error) {
@@ -250,7 +273,23 @@ func (s *Service) downloadFromURL(parameters map[string]string) (err error) {
 		dataEngine = types.DataEnginev1
 	}
 
-	return s.syncClient.DownloadFromURL(url, s.filePath, s.uuid, s.diskUUID, s.expectedChecksum, dataEngine)
+	// This is optional. The file will be downloaded via a single connection if it's not specified.
+	concurrentLimit := parameters[types.DataSourceTypeDownloadParameterConcurrentLimit]
+	compression := parameters[types.DataSourceTypeParameterCompression]
+	decompressedSizeLimit := parameters[types.DataSourceTypeParameterDecompressedSizeLimit]
+	targetFormat := parameters[types.DataSourceTypeParameterTargetFormat]
+
+	// The object store credential is retrieved from the environment variables by the handlers,
+	// and the sync service is in the same process.
+	urlType, err := butil.CheckBackupType(url)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse the URL %v", url)
+	}
+	if err := butil.SetupCredential(urlType, s.credential); err != nil {
+		return errors.Wrapf(err, "failed to setup credential for the URL %v", url)
+	}
+
+	return s.syncClient.DownloadFromURL(url, concurrentLimit, compression, decompressedSizeLimit, targetFormat, s.filePath, s.uuid, s.diskUUID, s.expectedChecksum, dataEngine)
 }
 
 func (s *Service) prepareForUpload() (err error) {
@@ -302,7 +341,8 @@ func (s *Service) exportFromVolume(parameters map[string]string) error {
 	}
 	s.log.Infof("DataSource Service: export volume via %v", storageIP)
 
-	if err := s.syncClient.Receive(s.filePath, s.uuid, s.diskUUID, s.expectedChecksum, fileType, types.DefaultVolumeExportReceiverPort, size, dataEngine); err != nil {
+	// The replica sends the data in plain HTTP even if the sync server serves TLS, since it doesn't support TLS.
+	if err := s.syncClient.Receive(s.filePath, s.uuid, s.diskUUID, s.expectedChecksum, fileType, types.DefaultVolumeExportReceiverPort, size, dataEngine, true); err != nil {
 		return err
 	}
 
@@ -334,11 +374,56 @@ func (s *Service) Upload(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	request.Host = s.syncListenAddr
-	request.URL.Host = s.syncListenAddr
-	request.URL.Scheme = "http"
-	request.URL.Path = "/v1/files"
 	q := request.URL.Query()
+	s.addUploadParameters(q)
+	s.forwardUploadRequest(writer, request, "/v1/files", q)
+}
+
+// CreateUploadSession starts a resumable chunked upload, or returns the existing session so that
+// an interrupted upload can resume from the received offset.
+func (s *Service) CreateUploadSession(writer http.ResponseWriter, request *http.Request) {
+	if s.sourceType != types.DataSourceTypeUpload {
+		http.Error(writer, fmt.Sprintf("cannot create upload session since data source type is %v rather than upload", s.sourceType), http.StatusBadRequest)
+		return
+	}
+
+	q := request.URL.Query()
+	s.addUploadParameters(q)
+	q.Add("disk-uuid", s.diskUUID)
+	s.forwardUploadRequest(writer, request, "/v1/files", q)
+}
+
+// GetUploadSession returns the received offset of the upload session.
+func (s *Service) GetUploadSession(writer http.ResponseWriter, request *http.Request) {
+	if s.sourceType != types.DataSourceTypeUpload {
+		http.Error(writer, fmt.Sprintf("cannot get upload session since data source type is %v rather than upload", s.sourceType), http.StatusBadRequest)
+		return
+	}
+
+	s.forwardUploadRequest(writer, request, fmt.Sprintf("/v1/files/%s/upload", url.QueryEscape(s.filePath)), request.URL.Query())
+}
+
+// UploadChunk forwards a chunk with the offset and the chunk checksum to the sync server.
+func (s *Service) UploadChunk(writer http.ResponseWriter, request *http.Request) {
+	if s.sourceType != types.DataSourceTypeUpload {
+		http.Error(writer, fmt.Sprintf("cannot upload chunk since data source type is %v rather than upload", s.sourceType), http.StatusBadRequest)
+		return
+	}
+
+	s.forwardUploadRequest(writer, request, fmt.Sprintf("/v1/files/%s/upload", url.QueryEscape(s.filePath)), request.URL.Query())
+}
+
+// FinalizeUploadSession should be invoked after all chunks are uploaded.
+func (s *Service) FinalizeUploadSession(writer http.ResponseWriter, request *http.Request) {
+	if s.sourceType != types.DataSourceTypeUpload {
+		http.Error(writer, fmt.Sprintf("cannot finalize upload session since data source type is %v rather than upload", s.sourceType), http.StatusBadRequest)
+		return
+	}
+
+	s.forwardUploadRequest(writer, request, fmt.Sprintf("/v1/files/%s", url.QueryEscape(s.filePath)), request.URL.Query())
+}
+
+func (s *Service) addUploadParameters(q url.Values) {
 	q.Add("file-path", s.filePath)
 	q.Add("uuid", s.uuid)
 	q.Add("expected-checksum", s.expectedChecksum)
@@ -348,13 +433,33 @@ func (s *Service) Upload(writer http.ResponseWriter, request *http.Request) {
 		dataEngine = types.DataEnginev1
 	}
 	q.Add("data-engine", dataEngine)
+	if compression := s.parameters[types.DataSourceTypeParameterCompression]; compression != "" {
+		q.Add(types.DataSourceTypeParameterCompression, compression)
+	}
+	if decompressedSizeLimit := s.parameters[types.DataSourceTypeParameterDecompressedSizeLimit]; decompressedSizeLimit != "" {
+		q.Add(types.DataSourceTypeParameterDecompressedSizeLimit, decompressedSizeLimit)
+	}
+	if targetFormat := s.parameters[types.DataSourceTypeParameterTargetFormat]; targetFormat != "" {
+		q.Add(types.DataSourceTypeParameterTargetFormat, targetFormat)
+	}
+}
 
-	request.URL.RawQuery = q.Encode()
+// forwardUploadRequest forwards the request to the path of the sync server. The path should be escaped.
+func (s *Service) forwardUploadRequest(writer http.ResponseWriter, request *http.Request, path string, q url.Values) {
+	syncURL, err := url.Parse(fmt.Sprintf("%s%s", util.GetHTTPURL(s.syncListenAddr, s.syncClient.TLS), path))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	syncURL.RawQuery = q.Encode()
+	request.Host = s.syncListenAddr
+	request.URL = syncURL
 	s.log.Debugf("DataSource Service: forwarding upload request to sync server %v", request.URL.String())
 
 	proxy := &httputil.ReverseProxy{
-		Director:  func(r *http.Request) {},
-		Transport: util.NoProxyTransport,
+		Director: func(r *http.Request) {},
+		// The request is authenticated by the sync server with the credential of the data source server.
+		Transport: util.NewHTTPClientWithToken(0, s.syncClient.TLS, s.syncClient.Token).Transport,
 	}
 	proxy.ServeHTTP(writer, request)
 }
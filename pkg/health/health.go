@@ -0,0 +1,204 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	imageutil "github.com/longhorn/go-common-libs/backingimage"
+
+	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/crypto"
+	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+const (
+	CheckDisk       = "disk"
+	CheckDiskUUID   = "disk-uuid"
+	CheckQemuImg    = "qemu-img"
+	CheckCryptsetup = "cryptsetup"
+	CheckSyncServer = "sync-server"
+	CheckPortPool   = "port-pool"
+
+	// CheckInterval is the interval of refreshing the gRPC health status of the manager.
+	CheckInterval = 10 * time.Second
+	// ServerCheckTimeout is the timeout of each request checking if an HTTP server is reachable.
+	ServerCheckTimeout = 3 * time.Second
+
+	diskProbeFileName = ".health-probe"
+)
+
+// Check is a dependency of a server. Run returns nil if the dependency is healthy.
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+// DiskCheck verifies that the disk is mounted and writable.
+func DiskCheck(diskPath string) Check {
+	return Check{
+		Name: CheckDisk,
+		Run: func() error {
+			info, err := os.Stat(diskPath)
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("disk path %v is not a directory", diskPath)
+			}
+			probeFilePath := filepath.Join(diskPath, diskProbeFileName)
+			if err := os.WriteFile(probeFilePath, []byte{}, 0666); err != nil {
+				return fmt.Errorf("disk path %v is not writable: %v", diskPath, err)
+			}
+			return os.Remove(probeFilePath)
+		},
+	}
+}
+
+// DiskUUIDCheck verifies that the disk config still records the UUID, which means the disk is not replaced.
+func DiskUUIDCheck(diskPath, diskUUID string) Check {
+	return Check{
+		Name: CheckDiskUUID,
+		Run: func() error {
+			currentDiskUUID, err := util.GetDiskConfig(diskPath)
+			if err != nil {
+				return err
+			}
+			if currentDiskUUID != diskUUID {
+				return fmt.Errorf("disk UUID %v doesn't match the expected %v", currentDiskUUID, diskUUID)
+			}
+			return nil
+		},
+	}
+}
+
+// QemuImgCheck verifies that qemu-img, which inspects and converts the images, can be executed.
+func QemuImgCheck() Check {
+	return Check{
+		Name: CheckQemuImg,
+		Run: func() error {
+			if _, err := imageutil.NewQemuImgExecutor().Exec([]string{}, "--version"); err != nil {
+				return fmt.Errorf("failed to execute %v: %v", imageutil.QemuImgBinary, err)
+			}
+			return nil
+		},
+	}
+}
+
+// CryptsetupCheck verifies that cryptsetup, which encrypts and decrypts the images, can be executed.
+func CryptsetupCheck() Check {
+	return Check{
+		Name: CheckCryptsetup,
+		Run:  crypto.CheckCryptsetup,
+	}
+}
+
+// HTTPServerCheck verifies that the liveness probe of the HTTP server at the address succeeds.
+func HTTPServerCheck(name, address string, tlsOptions *util.TLSOptions) Check {
+	return Check{
+		Name: name,
+		Run: func() error {
+			return probeHTTPServer(address, tlsOptions, ServerCheckTimeout)
+		},
+	}
+}
+
+func probeHTTPServer(address string, tlsOptions *util.TLSOptions, timeout time.Duration) error {
+	httpClient := util.NewHTTPClient(timeout, tlsOptions)
+	resp, err := httpClient.Get(util.GetHTTPURL(address, tlsOptions) + types.HealthzPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close the response body of the health probe")
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the liveness probe of %v returned %v", address, resp.StatusCode)
+	}
+	return nil
+}
+
+// WaitForHTTPServer polls the liveness probe of the HTTP server at the address until it succeeds, up to
+// waitIntervalInSecond seconds. It returns false if the server is not alive before the timeout.
+func WaitForHTTPServer(address string, tlsOptions *util.TLSOptions, waitIntervalInSecond int) bool {
+	endTime := time.Now().Add(time.Duration(waitIntervalInSecond) * time.Second)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+
+		err := probeHTTPServer(address, tlsOptions, time.Second)
+		if err == nil {
+			return true
+		}
+		if !time.Now().Before(endTime) {
+			logrus.WithError(err).Errorf("HTTP server %v is not alive after %v seconds", address, waitIntervalInSecond)
+			return false
+		}
+	}
+}
+
+// Checker runs the dependency checks of a server.
+type Checker struct {
+	checks []Check
+}
+
+func NewChecker(checks ...Check) *Checker {
+	return &Checker{checks: checks}
+}
+
+// Run runs all the checks in order. The report is ready only if all the checks are healthy.
+func (c *Checker) Run() *api.HealthReport {
+	report := &api.HealthReport{
+		Ready:  true,
+		Checks: []api.HealthCheck{},
+	}
+	for _, check := range c.checks {
+		result := api.HealthCheck{
+			Name:    check.Name,
+			Healthy: true,
+		}
+		if err := check.Run(); err != nil {
+			result.Healthy = false
+			result.Error = err.Error()
+			report.Ready = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// Liveness responds 200 as long as the server is serving the requests. It doesn't run any check, so that
+// an unhealthy dependency doesn't get the server restarted.
+func Liveness(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain")
+	if _, err := writer.Write([]byte("ok")); err != nil {
+		logrus.WithError(err).Warn("Failed to write the liveness response")
+	}
+}
+
+// Readiness responds the report of the checks, with 200 if all of them are healthy, otherwise 503.
+func (c *Checker) Readiness(writer http.ResponseWriter, request *http.Request) {
+	report := c.Run()
+	outgoingJSON, err := json.Marshal(report)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err := writer.Write(outgoingJSON); err != nil {
+		logrus.WithError(err).Warn("Failed to write the readiness response")
+	}
+}
@@ -0,0 +1,156 @@
+package manager
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
+	"github.com/longhorn/backing-image-manager/pkg/rpcext"
+)
+
+const (
+	EventHistoryLimit = 1024
+)
+
+// updateFileInfoNoLock records an updated event if the file info of the backing image is changed.
+func (m *Manager) updateFileInfoNoLock(biName string, fInfo *api.FileInfo) {
+	if reflect.DeepEqual(m.biFileInfoMap[biName], fInfo) {
+		return
+	}
+	m.biFileInfoMap[biName] = fInfo
+	metrics.SetSendingReference(biName, fInfo.SendingReference)
+	m.recordEventNoLock(rpcext.BackingImageEventTypeUpdated, biName, fInfo)
+}
+
+// deleteFileInfoNoLock records a deleted event carrying the last known file info of the backing image.
+func (m *Manager) deleteFileInfoNoLock(biName string) {
+	fInfo, exists := m.biFileInfoMap[biName]
+	if !exists {
+		return
+	}
+	delete(m.biFileInfoMap, biName)
+	metrics.DeleteSendingReference(biName)
+	m.recordEventNoLock(rpcext.BackingImageEventTypeDeleted, biName, fInfo)
+}
+
+func (m *Manager) recordEventNoLock(eventType, biName string, fInfo *api.FileInfo) {
+	m.revision++
+	event := &rpcext.BackingImageEvent{
+		Revision:     m.revision,
+		Type:         eventType,
+		Name:         biName,
+		BackingImage: backingImageResponse(fInfo),
+	}
+
+	m.eventHistory = append(m.eventHistory, event)
+	if len(m.eventHistory) > EventHistoryLimit {
+		m.eventHistory = m.eventHistory[len(m.eventHistory)-EventHistoryLimit:]
+	}
+	m.pendingEvents = append(m.pendingEvents, event)
+}
+
+// getReplayEventsNoLock returns the events after the revision. If the watcher cannot resume from the
+// revision, the events start with a reset event followed by an updated event for each backing image,
+// and all of them carry the current revision.
+func (m *Manager) getReplayEventsNoLock(revision int64) []*rpcext.BackingImageEvent {
+	oldestRevision := m.revision + 1
+	if len(m.eventHistory) > 0 {
+		oldestRevision = m.eventHistory[0].Revision
+	}
+	if revision > 0 && revision >= oldestRevision-1 && revision <= m.revision {
+		replay := []*rpcext.BackingImageEvent{}
+		for _, event := range m.eventHistory {
+			if event.Revision > revision {
+				replay = append(replay, event)
+			}
+		}
+		return replay
+	}
+
+	replay := []*rpcext.BackingImageEvent{{Revision: m.revision, Type: rpcext.BackingImageEventTypeReset}}
+	biNames := make([]string, 0, len(m.biFileInfoMap))
+	for biName := range m.biFileInfoMap {
+		biNames = append(biNames, biName)
+	}
+	sort.Strings(biNames)
+	for _, biName := range biNames {
+		replay = append(replay, &rpcext.BackingImageEvent{
+			Revision:     m.revision,
+			Type:         rpcext.BackingImageEventTypeUpdated,
+			Name:         biName,
+			BackingImage: backingImageResponse(m.biFileInfoMap[biName]),
+		})
+	}
+	return replay
+}
+
+// WatchEvents streams the changed backing images and the deletion tombstones. The watcher can resume
+// from the last received revision after reconnecting.
+func (m *Manager) WatchEvents(req *rpcext.WatchRequest, srv rpcext.BackingImageManagerExtService_WatchEventsServer) (err error) {
+	log := m.log.WithFields(logrus.Fields{"biName": req.Name, "revision": req.Revision})
+	log.Info("Backing Image Manager: prepare to start backing image event watch")
+
+	// Subscribe and take the replay events atomically so that no event is missed in between.
+	// The events recorded before the subscription are skipped by the revision check below.
+	m.lock.Lock()
+	responseChan, err := m.broadcaster.Subscribe(srv.Context(), m.broadcastConnector)
+	if err != nil {
+		m.lock.Unlock()
+		log.WithError(err).Error("Backing Image Manager: failed to subscribe response channel")
+		return err
+	}
+	replay := m.getReplayEventsNoLock(req.Revision)
+	lastRevision := m.revision
+	m.lock.Unlock()
+
+	defer func() {
+		if err != nil {
+			log.WithError(err).Error("Backing Image Manager: backing image event watch errored out")
+		} else {
+			log.Info("Backing Image Manager: backing image event watch ended successfully")
+		}
+	}()
+	log.Info("Backing Image Manager: backing image event watch started")
+
+	for _, event := range replay {
+		if !isEventWatched(req, event) {
+			continue
+		}
+		if err := srv.Send(event); err != nil {
+			return err
+		}
+	}
+
+	for item := range responseChan {
+		events, ok := item.([]*rpcext.BackingImageEvent)
+		if !ok {
+			continue
+		}
+		for _, event := range events {
+			if event.Revision <= lastRevision {
+				continue
+			}
+			lastRevision = event.Revision
+			if !isEventWatched(req, event) {
+				continue
+			}
+			if err := srv.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+
+	if srv.Context().Err() != nil {
+		return nil
+	}
+	return status.Errorf(codes.Aborted, "backing image event watch is closed since the watcher is too slow, it can resume from revision %v", lastRevision)
+}
+
+func isEventWatched(req *rpcext.WatchRequest, event *rpcext.BackingImageEvent) bool {
+	return req.Name == "" || event.Type == rpcext.BackingImageEventTypeReset || event.Name == req.Name
+}
@@ -0,0 +1,64 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/longhorn/backing-image-manager/pkg/health"
+)
+
+// newHealthChecker checks the disk, the image tools, the local sync server and the port pool of the manager.
+func (m *Manager) newHealthChecker() *health.Checker {
+	return health.NewChecker(
+		health.DiskCheck(m.diskPath),
+		health.DiskUUIDCheck(m.diskPath, m.diskUUID),
+		health.QemuImgCheck(),
+		health.CryptsetupCheck(),
+		health.HTTPServerCheck(health.CheckSyncServer, m.syncAddress, m.tls),
+		health.Check{Name: health.CheckPortPool, Run: m.checkPortPool},
+	)
+}
+
+// checkPortPool fails if all the ports are allocated, since the manager cannot send or receive any file then.
+func (m *Manager) checkPortPool() error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if portCount := int(m.portRangeMax - m.portRangeMin + 1); len(m.allocatedPorts) >= portCount {
+		return fmt.Errorf("all the %v ports in range %v-%v are allocated", portCount, m.portRangeMin, m.portRangeMax)
+	}
+	return nil
+}
+
+// updateHealth sets the status of each check as a service of the gRPC health server periodically.
+// The overall status, with the empty service name, is serving only if all the checks are healthy.
+func (m *Manager) updateHealth(healthServer *grpchealth.Server) {
+	checker := m.newHealthChecker()
+	ticker := time.NewTicker(health.CheckInterval)
+	defer ticker.Stop()
+	for {
+		report := checker.Run()
+		for _, check := range report.Checks {
+			healthServer.SetServingStatus(check.Name, getServingStatus(check.Healthy))
+			if !check.Healthy {
+				m.log.Warnf("Backing Image Manager: health check %v failed: %v", check.Name, check.Error)
+			}
+		}
+		healthServer.SetServingStatus("", getServingStatus(report.Ready))
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func getServingStatus(healthy bool) healthpb.HealthCheckResponse_ServingStatus {
+	if healthy {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
@@ -0,0 +1,52 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/backing-image-manager/pkg/rpcext"
+	filesync "github.com/longhorn/backing-image-manager/pkg/sync"
+)
+
+func (m *Manager) CollectLeftovers(ctx context.Context, req *rpcext.CollectLeftoversRequest) (resp *rpcext.CollectLeftoversResponse, err error) {
+	gracePeriod := filesync.DefaultLeftoverGracePeriod
+	if req.GracePeriod != "" {
+		if gracePeriod, err = time.ParseDuration(req.GracePeriod); err != nil || gracePeriod < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid grace period %v", req.GracePeriod)
+		}
+	}
+
+	log := m.log.WithFields(logrus.Fields{"dryRun": req.DryRun, "gracePeriod": gracePeriod})
+	log.Info("Backing Image Manager: prepare to collect leftovers")
+
+	collection, err := m.syncClient.CollectLeftovers(req.DryRun, gracePeriod, req.ActiveDataSources)
+	if err != nil {
+		log.WithError(err).Error("Backing Image Manager: failed to collect leftovers")
+		return nil, err
+	}
+
+	resp = &rpcext.CollectLeftoversResponse{
+		DryRun:        collection.DryRun,
+		GracePeriod:   collection.GracePeriod,
+		Leftovers:     make([]*rpcext.Leftover, 0, len(collection.Leftovers)),
+		ReclaimedSize: collection.ReclaimedSize,
+	}
+	for _, leftover := range collection.Leftovers {
+		resp.Leftovers = append(resp.Leftovers, &rpcext.Leftover{
+			Path:             leftover.Path,
+			Type:             string(leftover.Type),
+			Size:             leftover.Size,
+			ModificationTime: leftover.ModificationTime,
+			Expired:          leftover.Expired,
+			Deleted:          leftover.Deleted,
+			Error:            leftover.Error,
+		})
+	}
+
+	log.Infof("Backing Image Manager: found %v leftover(s), reclaimed %v bytes", len(resp.Leftovers), resp.ReclaimedSize)
+	return resp, nil
+}
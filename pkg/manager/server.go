@@ -6,45 +6,94 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 
 	rpc "github.com/longhorn/types/pkg/generated/bimrpc"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 
+	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/health"
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
+	"github.com/longhorn/backing-image-manager/pkg/rpcext"
 	"github.com/longhorn/backing-image-manager/pkg/sync"
+	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
 )
 
-func NewServer(parentCtx context.Context, listenAddr, syncListenAddr, diskUUID, diskPathInContainer, portRange string, syncHandler sync.Handler) error {
+func NewServer(parentCtx context.Context, listenAddr, syncListenAddr, metricsListenAddr, diskUUID, diskPathInContainer, portRange string, syncOptions sync.Options, syncHandler sync.Handler) error {
 	ctx, cancel := context.WithCancel(parentCtx)
 
+	// The backup creation of the manager shares the bandwidth limits with the sync service.
+	if syncOptions.BandwidthLimiter == nil {
+		bandwidthLimiter, err := sync.NewBandwidthLimiter(api.BandwidthLimits{})
+		if err != nil {
+			cancel()
+			return err
+		}
+		syncOptions.BandwidthLimiter = bandwidthLimiter
+	}
+
+	// The manager is created after the sync server is up, so the predicate looks it up for each call.
+	var trackingManager atomic.Pointer[Manager]
+	if syncOptions.RetentionPolicy.IsFileReferenced == nil {
+		syncOptions.RetentionPolicy.IsFileReferenced = func(filePath string, state types.State) bool {
+			m := trackingManager.Load()
+			// The files are kept until the manager starts tracking them.
+			return m == nil || m.isFileReferenced(filePath, state)
+		}
+	}
+
+	syncOptions.DiskUUID = diskUUID
+
 	// TODO: May launch the sync service separately
 	go func() {
-		if err := sync.NewServer(ctx, syncListenAddr, syncHandler); err != nil {
+		if err := sync.NewServer(ctx, syncListenAddr, diskPathInContainer, syncOptions, syncHandler); err != nil {
 			logrus.Warnf("File sync service errored out: %v", err)
 		}
 		cancel()
 	}()
-	if !util.DetectHTTPServerAvailability("http://"+syncListenAddr, 5, true) {
+	if !health.WaitForHTTPServer(syncListenAddr, syncOptions.TLS, 5) {
 		return fmt.Errorf("failed to wait for sync service running in 5 second")
 	}
 	logrus.Infof("The sync server of backing Image Manager listening to %v", syncListenAddr)
 
+	if metricsListenAddr != "" {
+		metrics.NewServer(ctx, metricsListenAddr)
+	}
+
 	listenAt, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return errors.Wrap(err, "Failed to listen")
 	}
 
-	bim, err := NewManager(ctx, syncListenAddr, diskUUID, diskPathInContainer, portRange)
+	bim, err := NewManager(ctx, syncListenAddr, diskUUID, diskPathInContainer, portRange, syncOptions.BandwidthLimiter, syncOptions.TLS, syncOptions.Auth)
 	if err != nil {
 		return err
 	}
-	rpcService := grpc.NewServer()
+	trackingManager.Store(bim)
+	var serverOptions []grpc.ServerOption
+	// The server shares the TLS options with the sync server.
+	if syncOptions.TLS.Enabled() {
+		tlsConfig, err := util.NewServerTLSConfig(syncOptions.TLS)
+		if err != nil {
+			return err
+		}
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	rpcService := grpc.NewServer(serverOptions...)
 	rpc.RegisterBackingImageManagerServiceServer(rpcService, bim)
+	rpcext.RegisterBackingImageManagerExtServiceServer(rpcService, bim)
 	reflection.Register(rpcService)
+	healthServer := grpchealth.NewServer()
+	healthpb.RegisterHealthServer(rpcService, healthServer)
+	go bim.updateHealth(healthServer)
 	go func() {
 		if err := rpcService.Serve(listenAt); err != nil {
 			logrus.WithError(err).Errorf("stopping the server due to there is an error")
@@ -59,6 +108,11 @@ func NewServer(parentCtx context.Context, listenAddr, syncListenAddr, diskUUID,
 	go func() {
 		sig := <-sigs
 		logrus.Infof("Backing Image Manager received %v to exit", sig)
+		// Stop taking the new requests routed by the readiness.
+		healthServer.Shutdown()
+		if syncOptions.DrainTimeout > 0 {
+			bim.drain(syncOptions.DrainTimeout)
+		}
 		rpcService.Stop()
 	}()
 
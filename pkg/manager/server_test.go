@@ -15,12 +15,16 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 
 	"github.com/longhorn/backing-image-manager/api"
 	"github.com/longhorn/backing-image-manager/pkg/client"
 	"github.com/longhorn/backing-image-manager/pkg/datasource"
+	"github.com/longhorn/backing-image-manager/pkg/rpcext"
 	filesync "github.com/longhorn/backing-image-manager/pkg/sync"
 	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
@@ -117,14 +121,14 @@ func (s *TestSuite) SetUpSuite(c *C) {
 	s.addr1 = fmt.Sprintf("localhost:%d", TestManagerServerPort1)
 	s.syncAddr1 = fmt.Sprintf("localhost:%d", TestSyncServerPort1)
 	go func() {
-		_ = NewServer(s.ctx, s.addr1, s.syncAddr1, TestDiskUUID1, s.testDiskPath1, "30001-31000", &filesync.HTTPHandler{})
+		_ = NewServer(s.ctx, s.addr1, s.syncAddr1, "", TestDiskUUID1, s.testDiskPath1, "30001-31000", filesync.Options{}, &filesync.HTTPHandler{})
 	}()
 
 	s.addr2 = fmt.Sprintf("localhost:%d", TestManagerServerPort2)
 	s.syncAddr2 = fmt.Sprintf("localhost:%d", TestSyncServerPort2)
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr2, s.syncAddr2, TestDiskUUID1, s.testDiskPath2, "31001-32000", &filesync.HTTPHandler{})
+		_ = NewServer(s.ctx, s.addr2, s.syncAddr2, "", TestDiskUUID1, s.testDiskPath2, "31001-32000", filesync.Options{}, &filesync.HTTPHandler{})
 	}()
 
 	err = checkAndWaitForServer(s.addr1, 5, true)
@@ -432,10 +436,11 @@ func (s *TestSuite) TestBackingImageDownloadToLocal(c *C) {
 
 	// Prepare the download
 	downloadFilePath := filepath.Join(s.testBIMDir1, "test-download-dst-sync-file")
-	srcFilePath, addr, err := cli1.PrepareDownload(biName, biUUID)
+	srcFilePath, addr, token, err := cli1.PrepareDownload(biName, biUUID)
 	c.Assert(err, IsNil)
 	c.Assert(addr, Equals, s.syncAddr1)
 	c.Assert(srcFilePath, Equals, biFilePath1)
+	c.Assert(token, Equals, "")
 
 	// Start the actual download
 	syncCli1 := &client.SyncClient{
@@ -460,6 +465,60 @@ func (s *TestSuite) TestBackingImageDownloadToLocal(c *C) {
 	s.deleteBackingImage(c, s.addr1, s.testDiskPath1, biName, biUUID)
 }
 
+func (s *TestSuite) TestBackingImageRepair(c *C) {
+	biName := "test-repair-file"
+	biUUID := TestBackingImageUUID
+	biFilePath1 := types.GetBackingImageFilePath(s.testDiskPath1, biName, biUUID)
+	biFilePath2 := types.GetBackingImageFilePath(s.testDiskPath2, biName, biUUID)
+
+	err := os.MkdirAll(filepath.Dir(biFilePath1), 0777)
+	c.Assert(err, IsNil)
+
+	sizeInMB := 64
+	size := int64(sizeInMB * MB)
+	err = generateRandomDataFile(biFilePath1, sizeInMB)
+	c.Assert(err, IsNil)
+	checksum, err := util.GetFileChecksum(biFilePath1)
+	c.Assert(err, IsNil)
+
+	cli1 := client.NewBackingImageManagerClient(s.addr1)
+	cli2 := client.NewBackingImageManagerClient(s.addr2)
+
+	_, err = cli1.Fetch(biName, biUUID, checksum, "", size)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli1, biName, biUUID, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	defer s.deleteBackingImage(c, s.addr1, s.testDiskPath1, biName, biUUID)
+
+	_, err = cli2.Sync(biName, biUUID, checksum, s.addr1, size)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli2, biName, biUUID, string(types.StateReady), 120)
+	c.Assert(err, IsNil)
+	defer s.deleteBackingImage(c, s.addr2, s.testDiskPath2, biName, biUUID)
+
+	// Corrupt a block of the 2nd copy.
+	f, err := os.OpenFile(biFilePath2, os.O_RDWR, 0666)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte("invalid data"), size/2)
+	c.Assert(err, IsNil)
+	err = f.Close()
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli2, biName, biUUID, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+
+	_, err = cli2.Repair(biName, biUUID, "")
+	c.Assert(err, NotNil)
+
+	_, err = cli2.Repair(biName, biUUID, s.addr1)
+	c.Assert(err, IsNil)
+	bi, err := getAndWaitFileState(cli2, biName, biUUID, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(bi.Status.CurrentChecksum, Equals, checksum)
+	repairedChecksum, err := util.GetFileChecksum(biFilePath2)
+	c.Assert(err, IsNil)
+	c.Assert(repairedChecksum, Equals, checksum)
+}
+
 func (s *TestSuite) TestDuplicateCalls(c *C) {
 	biName := "test-duplicate-calls-file"
 	biUUID := TestBackingImageUUID
@@ -573,6 +632,139 @@ func (s *TestSuite) TestDuplicateCalls(c *C) {
 	}
 }
 
+func (s *TestSuite) TestWatch(c *C) {
+	biName := "test-watch-file"
+	biUUID := TestBackingImageUUID + "-watch"
+
+	cli1 := client.NewBackingImageManagerClient(s.addr1)
+	stream, err := cli1.Watch()
+	c.Assert(err, IsNil)
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	// Drain the notifications of the previous tests.
+	notified := make(chan error, 100)
+	go func() {
+		for {
+			err := stream.Recv()
+			notified <- err
+			if err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(2 * types.MonitorInterval)
+	for len(notified) > 0 {
+		c.Assert(<-notified, IsNil)
+	}
+
+	// The file change in the sync server is notified without any manager API call.
+	srcFilePath := filepath.Join(s.testDiskPath1, "test-watch-src-file")
+	err = generateSimpleTestFile(srcFilePath, MockFileSize)
+	c.Assert(err, IsNil)
+	syncCli := &client.SyncClient{Remote: s.syncAddr1}
+	err = syncCli.Upload(srcFilePath, types.GetBackingImageFilePath(s.testDiskPath1, biName, biUUID), biUUID, TestDiskUUID1, "")
+	c.Assert(err, IsNil)
+
+	select {
+	case err := <-notified:
+		c.Assert(err, IsNil)
+	case <-time.After(3 * types.MonitorInterval):
+		c.Fatal("timeout waiting for the backing image update notification")
+	}
+
+	_, err = getAndWaitFileState(cli1, biName, biUUID, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestWatchEvents(c *C) {
+	biName := "test-watch-events-file"
+	biUUID := TestBackingImageUUID + "-watch-events"
+	otherBiName := "test-watch-events-other-file"
+	otherBiUUID := TestBackingImageUUID + "-watch-events-other"
+
+	cli1 := client.NewBackingImageManagerClient(s.addr1)
+	stream, err := cli1.WatchEvents(biName, 0)
+	c.Assert(err, IsNil)
+	events := receiveEvents(stream)
+
+	// A new watcher starts with a reset event.
+	event := waitForEvent(c, events, func(e *api.BackingImageEvent) bool { return true })
+	c.Assert(event.Type, Equals, rpcext.BackingImageEventTypeReset)
+
+	syncCli := &client.SyncClient{Remote: s.syncAddr1}
+	for name, uuid := range map[string]string{otherBiName: otherBiUUID, biName: biUUID} {
+		srcFilePath := filepath.Join(s.testDiskPath1, name+"-src")
+		err = generateSimpleTestFile(srcFilePath, MockFileSize)
+		c.Assert(err, IsNil)
+		err = syncCli.Upload(srcFilePath, types.GetBackingImageFilePath(s.testDiskPath1, name, uuid), uuid, TestDiskUUID1, "")
+		c.Assert(err, IsNil)
+	}
+
+	// The events carry the backing images, and the ones of the other backing images are filtered out.
+	event = waitForEvent(c, events, func(e *api.BackingImageEvent) bool {
+		c.Assert(e.Name, Equals, biName)
+		c.Assert(e.Type, Equals, rpcext.BackingImageEventTypeUpdated)
+		c.Assert(e.BackingImage, NotNil)
+		c.Assert(e.BackingImage.UUID, Equals, biUUID)
+		return e.BackingImage.Status.State == string(types.StateReady)
+	})
+	c.Assert(event.BackingImage.Size, Equals, int64(MockFileSize))
+	revision := event.Revision
+	err = stream.Close()
+	c.Assert(err, IsNil)
+
+	s.deleteBackingImage(c, s.addr1, s.testDiskPath1, otherBiName, otherBiUUID)
+	s.deleteBackingImage(c, s.addr1, s.testDiskPath1, biName, biUUID)
+
+	// The watcher resumes from the last received revision and receives the tombstone.
+	stream, err = cli1.WatchEvents(biName, revision)
+	c.Assert(err, IsNil)
+	defer func() {
+		_ = stream.Close()
+	}()
+	events = receiveEvents(stream)
+	event = waitForEvent(c, events, func(e *api.BackingImageEvent) bool {
+		c.Assert(e.Type, Not(Equals), rpcext.BackingImageEventTypeReset)
+		c.Assert(e.Revision > revision, Equals, true)
+		return e.Type == rpcext.BackingImageEventTypeDeleted
+	})
+	c.Assert(event.Name, Equals, biName)
+	c.Assert(event.BackingImage, NotNil)
+	c.Assert(event.BackingImage.UUID, Equals, biUUID)
+}
+
+func receiveEvents(stream *api.BackingImageEventStream) chan *api.BackingImageEvent {
+	events := make(chan *api.BackingImageEvent, 100)
+	go func() {
+		defer close(events)
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			events <- event
+		}
+	}()
+	return events
+}
+
+func waitForEvent(c *C, events chan *api.BackingImageEvent, match func(*api.BackingImageEvent) bool) *api.BackingImageEvent {
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			c.Assert(ok, Equals, true)
+			if match(event) {
+				return event
+			}
+		case <-timeout:
+			c.Fatal("timeout waiting for the backing image event")
+		}
+	}
+}
+
 func (s *TestSuite) deleteBackingImage(c *C, addr, diskPath, biName, biUUID string) {
 	biFilePath := types.GetBackingImageFilePath(diskPath, biName, biUUID)
 	biDir := types.GetBackingImageDirectory(diskPath, biName, biUUID)
@@ -655,7 +847,7 @@ func launchAndWaitTestDataSourceServer(ctx context.Context, addr, syncAddr, biNa
 		_ = datasource.NewServer(ctx, addr, syncAddr,
 			checksum, string(types.DataSourceTypeDownload), biName, biUUID, diskPath,
 			map[string]string{types.DataSourceTypeDownloadParameterURL: "http://mock-download"}, map[string]string{},
-			&filesync.MockHandler{},
+			filesync.Options{}, &filesync.MockHandler{},
 		)
 	}()
 
@@ -696,3 +888,102 @@ func checkAndWaitTestDataSourceFileState(addr, desireState string, waitIntervalI
 	}
 	return nil, fmt.Errorf("failed to get the data source file info from address %v when waiting for the file become state %v", addr, desireState)
 }
+
+func (s *TestSuite) TestHealth(c *C) {
+	logrus.Debugf("Testing manager: TestHealth")
+
+	conn, err := grpc.NewClient(s.addr1, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	healthClient := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, service := range []string{"disk", "disk-uuid", "sync-server", "port-pool"} {
+		resp, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		c.Assert(err, IsNil)
+		c.Assert(resp.Status, Equals, healthpb.HealthCheckResponse_SERVING, Commentf("service %v", service))
+	}
+	// The overall status is known even if qemu-img or cryptsetup is not available in the test environment.
+	resp, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: ""})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Status, Not(Equals), healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+
+	_, err = healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+}
+
+func (s *TestSuite) TestRetentionPolicy(c *C) {
+	logrus.Debugf("Testing manager: TestRetentionPolicy")
+
+	diskPath := filepath.Join(filepath.Dir(s.testDiskPath1), "manager-retention")
+	err := os.RemoveAll(diskPath)
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(diskPath)
+	err = os.MkdirAll(filepath.Join(diskPath, types.BackingImageManagerDirectoryName), 0777)
+	c.Assert(err, IsNil)
+	encodedDiskCfg, err := json.Marshal(&util.DiskConfig{DiskUUID: TestDiskUUID1})
+	c.Assert(err, IsNil)
+	err = os.WriteFile(filepath.Join(diskPath, util.DiskConfigFile), encodedDiskCfg, 0777)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	addr := fmt.Sprintf("localhost:%d", TestFirstReservedPort+100)
+	syncAddr := fmt.Sprintf("localhost:%d", TestFirstReservedPort+101)
+	// The default IsFileReferenced of the manager is used.
+	options := filesync.Options{
+		RetentionPolicy: filesync.RetentionPolicy{
+			FailedFileTTL: 2 * time.Second,
+			ReadyFileTTL:  2 * time.Second,
+		},
+	}
+	go func() {
+		_ = NewServer(ctx, addr, syncAddr, "", TestDiskUUID1, diskPath, "32001-32100", options, &filesync.HTTPHandler{})
+	}()
+	err = checkAndWaitForServer(addr, 5, true)
+	c.Assert(err, IsNil)
+	cli := client.NewBackingImageManagerClient(addr)
+
+	readyName, readyUUID := "test-retention-ready", TestBackingImageUUID+"-retention-ready"
+	readyFilePath := types.GetBackingImageFilePath(diskPath, readyName, readyUUID)
+	err = os.MkdirAll(filepath.Dir(readyFilePath), 0777)
+	c.Assert(err, IsNil)
+	err = generateSimpleTestFile(readyFilePath, MockFileSize)
+	c.Assert(err, IsNil)
+	checksum, err := util.GetFileChecksum(readyFilePath)
+	c.Assert(err, IsNil)
+	_, err = cli.Fetch(readyName, readyUUID, checksum, "", MockFileSize)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, readyName, readyUUID, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	failedName, failedUUID := "test-retention-failed", TestBackingImageUUID+"-retention-failed"
+	failedFilePath := types.GetBackingImageFilePath(diskPath, failedName, failedUUID)
+	err = os.MkdirAll(filepath.Dir(failedFilePath), 0777)
+	c.Assert(err, IsNil)
+	err = generateSimpleTestFile(failedFilePath, MockFileSize)
+	c.Assert(err, IsNil)
+	_, err = cli.Fetch(failedName, failedUUID, "invalid-checksum", "", MockFileSize)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, failedName, failedUUID, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+
+	// The failed backing image is not referenced by the manager, hence it's forgotten after the TTL.
+	forgotten := false
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Second)
+		if _, err := cli.Get(failedName, failedUUID); err != nil {
+			c.Assert(util.IsGRPCErrorNotFound(err), Equals, true)
+			forgotten = true
+			break
+		}
+	}
+	c.Assert(forgotten, Equals, true)
+
+	// The ready backing image tracked by the manager is kept.
+	bi, err := cli.Get(readyName, readyUUID)
+	c.Assert(err, IsNil)
+	c.Assert(bi.Status.State, Equals, string(types.StateReady))
+	s.deleteBackingImage(c, addr, diskPath, readyName, readyUUID)
+}
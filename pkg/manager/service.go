@@ -6,7 +6,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +26,9 @@ import (
 	"github.com/longhorn/backing-image-manager/api"
 	"github.com/longhorn/backing-image-manager/pkg/backup"
 	"github.com/longhorn/backing-image-manager/pkg/client"
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
+	"github.com/longhorn/backing-image-manager/pkg/rpcext"
+	filesync "github.com/longhorn/backing-image-manager/pkg/sync"
 	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
 	"github.com/longhorn/backing-image-manager/pkg/util/broadcaster"
@@ -33,6 +36,7 @@ import (
 
 type Manager struct {
 	rpc.UnimplementedBackingImageManagerServiceServer
+	rpcext.UnimplementedBackingImageManagerExtServiceServer
 	ctx context.Context
 
 	syncAddress  string
@@ -42,23 +46,37 @@ type Manager struct {
 
 	portRangeMax   int32
 	availablePorts *lhbitmap.Bitmap
+	// allocatedPorts is only for the port utilization metrics.
+	allocatedPorts map[int32]struct{}
 
-	// Need to acquire lock when operating biFileInfoMap or broadcastRequired.
+	// Need to acquire lock when operating biFileInfoMap, allocatedPorts or the events.
 	lock          *sync.RWMutex
 	biFileInfoMap map[string]*api.FileInfo
 
-	broadcastRequired bool
-	broadcastCh       chan interface{}
-	broadcaster       *broadcaster.Broadcaster
+	// Each change of biFileInfoMap is recorded as an event with a monotonically increasing revision.
+	// The pending events are broadcasted in batches, and the recent events are kept for the watchers to resume.
+	revision      int64
+	eventHistory  []*rpcext.BackingImageEvent
+	pendingEvents []*rpcext.BackingImageEvent
+	broadcastCh   chan interface{}
+	broadcaster   *broadcaster.Broadcaster
 
 	syncClient *client.SyncClient
+	// tls is used to connect the local sync server, the peer managers and the data source servers.
+	tls *util.TLSOptions
+	// auth is shared with the sync service. It issues the download tokens, and its secret is presented
+	// to the local sync server and the data source servers.
+	auth *util.Authenticator
+
+	// bandwidthLimiter is shared with the sync service.
+	bandwidthLimiter *filesync.BandwidthLimiter
 
 	BackupList *BackupList
 
 	log logrus.FieldLogger
 }
 
-func NewManager(ctx context.Context, syncAddress, diskUUID, diskPath, portRange string) (*Manager, error) {
+func NewManager(ctx context.Context, syncAddress, diskUUID, diskPath, portRange string, bandwidthLimiter *filesync.BandwidthLimiter, tlsOptions *util.TLSOptions, auth *util.Authenticator) (*Manager, error) {
 	workDir := filepath.Join(diskPath, types.BackingImageManagerDirectoryName)
 	if err := os.MkdirAll(workDir, 0666); err != nil && !os.IsExist(err) {
 		return nil, err
@@ -82,6 +100,7 @@ func NewManager(ctx context.Context, syncAddress, diskUUID, diskPath, portRange
 		portRangeMin:   start,
 		portRangeMax:   end,
 		availablePorts: bitmap,
+		allocatedPorts: map[int32]struct{}{},
 
 		lock:          &sync.RWMutex{},
 		biFileInfoMap: map[string]*api.FileInfo{},
@@ -91,7 +110,13 @@ func NewManager(ctx context.Context, syncAddress, diskUUID, diskPath, portRange
 
 		syncClient: &client.SyncClient{
 			Remote: syncAddress,
+			TLS:    tlsOptions,
+			Token:  auth.GetSecretToken(),
 		},
+		tls:  tlsOptions,
+		auth: auth,
+
+		bandwidthLimiter: bandwidthLimiter,
 
 		BackupList: &BackupList{},
 
@@ -104,6 +129,8 @@ func NewManager(ctx context.Context, syncAddress, diskUUID, diskPath, portRange
 		),
 	}
 
+	metrics.SetPorts(int(end-start+1), 0)
+
 	// help to kickstart the broadcaster
 	if _, err := m.broadcaster.Subscribe(ctx, m.broadcastConnector); err != nil {
 		return nil, err
@@ -125,45 +152,72 @@ func (m *Manager) startBroadcasting(ctx context.Context) {
 			m.log.Info("Backing Image Manager: stopped broadcasting due to context done")
 			done = true
 		case <-ticker.C:
-			if m.checkBroadcasting() {
-				m.broadcastCh <- nil
+			if events := m.checkBroadcasting(); len(events) != 0 {
+				m.broadcastCh <- events
 			}
 		}
 	}
 }
 
-func (m *Manager) checkBroadcasting() bool {
+func (m *Manager) checkBroadcasting() []*rpcext.BackingImageEvent {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	if m.broadcastRequired {
-		m.broadcastRequired = false
-		return true
-	}
-	return false
+	events := m.pendingEvents
+	m.pendingEvents = nil
+	return events
 }
 
+// monitoring keeps the backing image file info up to date by consuming the event stream of the sync server.
+// After reconnecting, the stream resumes from the last received revision.
 func (m *Manager) monitoring() {
-	ticker := time.NewTicker(types.MonitorInterval)
-	defer ticker.Stop()
-
-	done := false
+	var epoch, revision int64
 	for {
+		err := m.syncClient.WatchEvents(m.ctx, epoch, revision, func(event *api.FileEvent) error {
+			if err := m.handleFileEvent(event); err != nil {
+				return err
+			}
+			epoch, revision = event.Epoch, event.Revision
+			return nil
+		})
+		if m.ctx.Err() != nil {
+			m.log.Info("Backing Image Manager: stopped monitoring due to the context done")
+			return
+		}
+		m.log.WithError(err).Warn("Backing Image Manager: the event stream of the sync server is interrupted, will reconnect")
+
 		select {
 		case <-m.ctx.Done():
 			m.log.Info("Backing Image Manager: stopped monitoring due to the context done")
-			done = true
-			break // nolint: staticcheck
-		case <-ticker.C:
-			if _, err := m.listAndUpdate(); err != nil {
-				m.log.WithError(err).Warn("failed to list and update backing image files")
-			}
-		}
-		if done {
-			break
+			return
+		case <-time.After(types.MonitorInterval):
 		}
 	}
 }
 
+func (m *Manager) handleFileEvent(event *api.FileEvent) error {
+	if event.Type == api.FileEventTypeReset {
+		// The following created events only cover the existing files. Relisting the files rather than
+		// clearing the map finds out the deleted ones without dropping the others for the watchers.
+		_, err := m.listAndUpdate()
+		return err
+	}
+	if event.FileInfo == nil {
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	biName := types.GetBackingImageNameFromFilePath(event.FileInfo.FilePath, event.FileInfo.UUID)
+	switch event.Type {
+	case api.FileEventTypeDeleted:
+		m.deleteFileInfoNoLock(biName)
+	default:
+		m.updateFileInfoNoLock(biName, event.FileInfo)
+	}
+	return nil
+}
+
 func (m *Manager) Delete(ctx context.Context, req *rpc.DeleteRequest) (resp *emptypb.Empty, err error) {
 	log := m.log.WithFields(logrus.Fields{"biName": req.Name, "biUUID": req.Uuid})
 	log.Info("Backing Image Manager: prepare to delete backing image")
@@ -179,6 +233,10 @@ func (m *Manager) Delete(ctx context.Context, req *rpc.DeleteRequest) (resp *emp
 		if rmTmpFileErr := os.RemoveAll(tmpFilePath); rmTmpFileErr != nil {
 			log.WithError(rmTmpFileErr).Warn("Backing Image Manager: failed to remove the data source tmp file at the end of the deletion")
 		}
+		checkpointFilePath := util.GetDownloadCheckpointFilePath(tmpFilePath)
+		if rmCheckpointErr := os.RemoveAll(checkpointFilePath); rmCheckpointErr != nil {
+			log.WithError(rmCheckpointErr).Warn("Backing Image Manager: failed to remove the data source download checkpoint file at the end of the deletion")
+		}
 	}()
 
 	if err := m.syncClient.Delete(types.GetBackingImageFilePath(m.diskPath, req.Name, req.Uuid)); err != nil {
@@ -220,10 +278,7 @@ func (m *Manager) getAndUpdate(name, uuid string) (*rpc.BackingImageResponse, er
 	if err != nil {
 		if util.IsHTTPClientErrorNotFound(err) {
 			m.lock.Lock()
-			if _, exists := m.biFileInfoMap[name]; exists {
-				delete(m.biFileInfoMap, name)
-				m.broadcastRequired = true
-			}
+			m.deleteFileInfoNoLock(name)
 			m.lock.Unlock()
 			return nil, status.Errorf(codes.NotFound, "cannot find backing image %v(%v)", name, uuid)
 		}
@@ -231,10 +286,7 @@ func (m *Manager) getAndUpdate(name, uuid string) (*rpc.BackingImageResponse, er
 	}
 
 	m.lock.Lock()
-	if !reflect.DeepEqual(m.biFileInfoMap[name], fInfo) {
-		m.biFileInfoMap[name] = fInfo
-		m.broadcastRequired = true
-	}
+	m.updateFileInfoNoLock(name, fInfo)
 	m.lock.Unlock()
 
 	return backingImageResponse(fInfo), nil
@@ -271,21 +323,27 @@ func (m *Manager) listAndUpdate() (biFileInfoMap map[string]*api.FileInfo, err e
 
 	newBiFileInfoMap := map[string]*api.FileInfo{}
 	for filePath, fInfo := range fInfoList {
-		biName := types.GetBackingImageNameFromFilePath(filePath, fInfo.UUID)
-		newBiFileInfoMap[biName] = fInfo
-		if !m.broadcastRequired && !reflect.DeepEqual(m.biFileInfoMap[biName], fInfo) {
-			m.broadcastRequired = true
-		}
+		newBiFileInfoMap[types.GetBackingImageNameFromFilePath(filePath, fInfo.UUID)] = fInfo
 	}
+	// Sort the names so that the revisions of the events are deterministic
+	biNames := []string{}
 	for biName := range m.biFileInfoMap {
 		if newBiFileInfoMap[biName] == nil {
-			m.broadcastRequired = true
-		}
-		if m.broadcastRequired {
-			break
+			biNames = append(biNames, biName)
 		}
 	}
-	m.biFileInfoMap = newBiFileInfoMap
+	sort.Strings(biNames)
+	for _, biName := range biNames {
+		m.deleteFileInfoNoLock(biName)
+	}
+	biNames = []string{}
+	for biName := range newBiFileInfoMap {
+		biNames = append(biNames, biName)
+	}
+	sort.Strings(biNames)
+	for _, biName := range biNames {
+		m.updateFileInfoNoLock(biName, newBiFileInfoMap[biName])
+	}
 
 	copiedMap := map[string]*api.FileInfo{}
 	for biName, fInfo := range m.biFileInfoMap {
@@ -295,6 +353,24 @@ func (m *Manager) listAndUpdate() (biFileInfoMap map[string]*api.FileInfo, err e
 	return copiedMap, nil
 }
 
+// isFileReferenced is the default IsFileReferenced of the sync service. The manager references the backing image
+// files it tracks until they are deleted via the manager, unless they failed, since a failed backing image is
+// prepared again with a new file rather than reused. It's called with the lock of the sync file held, which is fine
+// since the manager lock is never held while calling the sync service.
+func (m *Manager) isFileReferenced(filePath string, state types.State) bool {
+	if state == types.StateFailed {
+		return false
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, fInfo := range m.biFileInfoMap {
+		if fInfo.FilePath == filePath {
+			return true
+		}
+	}
+	return false
+}
+
 func backingImageResponse(fInfo *api.FileInfo) *rpc.BackingImageResponse {
 	return &rpc.BackingImageResponse{
 		Spec: &rpc.BackingImageSpec{
@@ -343,7 +419,7 @@ func (m *Manager) Sync(ctx context.Context, req *rpc.SyncRequest) (resp *rpc.Bac
 	}()
 
 	biFilePath := types.GetBackingImageFilePath(m.diskPath, req.Spec.Name, req.Spec.Uuid)
-	if err := m.syncClient.Receive(biFilePath, req.Spec.Uuid, m.diskUUID, req.Spec.Checksum, "", int(port), req.Spec.Size, types.DataEnginev1); err != nil {
+	if err := m.syncClient.Receive(biFilePath, req.Spec.Uuid, m.diskUUID, req.Spec.Checksum, "", int(port), req.Spec.Size, types.DataEnginev1, false); err != nil {
 		portReleaseChannel <- nil
 		return nil, err
 	}
@@ -381,6 +457,7 @@ func (m *Manager) Sync(ctx context.Context, req *rpc.SyncRequest) (resp *rpc.Bac
 
 		// sender.Send is a non-blocking call
 		sender := client.NewBackingImageManagerClient(req.FromAddress)
+		sender.TLS = m.tls
 		if err = sender.Send(req.Spec.Name, req.Spec.Uuid, toAddress); err != nil {
 			err = errors.Wrapf(err, "sender failed to request backing image sending to %v", toAddress) // nolint:ineffassign,staticcheck
 			return
@@ -470,7 +547,7 @@ func (m *Manager) Fetch(ctx context.Context, req *rpc.FetchRequest) (resp *rpc.B
 	if req.DataSourceAddress != "" {
 		log.Infof("Backing Image Manager: need to transfer the file from the data source server first")
 		srcFilePath = types.GetDataSourceFilePath(m.diskPath, req.Spec.Name, req.Spec.Uuid)
-		dsClient := &client.DataSourceClient{Remote: req.DataSourceAddress}
+		dsClient := &client.DataSourceClient{Remote: req.DataSourceAddress, TLS: m.tls, Token: m.auth.GetSecretToken()}
 		dsInfo, err := dsClient.Get()
 		if err != nil {
 			return nil, err
@@ -496,6 +573,37 @@ func (m *Manager) Fetch(ctx context.Context, req *rpc.FetchRequest) (resp *rpc.B
 	return m.getAndUpdate(req.Spec.Name, req.Spec.Uuid)
 }
 
+// Repair compares the block checksums of the local backing image with the healthy copy of the peer
+// backing image manager in FromAddress, then pulls only the mismatching blocks.
+func (m *Manager) Repair(ctx context.Context, req *rpcext.RepairRequest) (resp *rpc.BackingImageResponse, err error) {
+	if req.Name == "" || req.Uuid == "" || req.FromAddress == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing required argument")
+	}
+
+	log := m.log.WithFields(logrus.Fields{"biName": req.Name, "biUUID": req.Uuid, "fromAddress": req.FromAddress})
+	log.Info("Backing Image Manager: prepare to repair backing image")
+	defer func() {
+		if err != nil {
+			log.WithError(err).Error("Backing Image Manager: failed to start repairing backing image")
+		}
+	}()
+
+	peerClient := client.NewBackingImageManagerClient(req.FromAddress)
+	peerClient.TLS = m.tls
+	peerFilePath, peerSyncAddress, peerToken, err := peerClient.PrepareDownload(req.Name, req.Uuid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to prepare the peer backing image for repairing")
+	}
+
+	biFilePath := types.GetBackingImageFilePath(m.diskPath, req.Name, req.Uuid)
+	if err := m.syncClient.RepairFromPeer(biFilePath, peerSyncAddress, peerFilePath, peerToken); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Backing Image Manager: started repairing backing image from peer sync service %v", peerSyncAddress)
+	return m.getAndUpdate(req.Name, req.Uuid)
+}
+
 func (m *Manager) PrepareDownload(ctx context.Context, req *rpc.PrepareDownloadRequest) (resp *rpc.PrepareDownloadResponse, err error) {
 	log := m.log.WithFields(logrus.Fields{"biName": req.Name, "biUUID": req.Uuid})
 	log.Infof("Backing Image Manager: start to make preparation for backing image download")
@@ -533,6 +641,41 @@ func (m *Manager) PrepareDownload(ctx context.Context, req *rpc.PrepareDownloadR
 	}, nil
 }
 
+// PrepareDownloadWithToken additionally issues a download token of the file if the sync server requires authentication.
+func (m *Manager) PrepareDownloadWithToken(ctx context.Context, req *rpcext.PrepareDownloadWithTokenRequest) (*rpcext.PrepareDownloadWithTokenResponse, error) {
+	prepared, err := m.PrepareDownload(ctx, &rpc.PrepareDownloadRequest{Name: req.Name, Uuid: req.Uuid})
+	if err != nil {
+		return nil, err
+	}
+	resp := &rpcext.PrepareDownloadWithTokenResponse{
+		SrcFilePath: prepared.SrcFilePath,
+		Address:     prepared.Address,
+	}
+	if m.auth.Enabled() {
+		token, expiresAt, err := m.auth.IssueToken([]util.TokenScope{util.TokenScopeDownload}, prepared.SrcFilePath, util.DefaultDownloadTokenTTL)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to issue the download token: %v", err)
+		}
+		resp.Token = token
+		resp.TokenExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+	}
+	return resp, nil
+}
+
+// drain stops the sync service accepting the new operations before the manager exits, and waits up to the timeout
+// for the running ones. The same requests can resume the interrupted operations after the restart if resumable.
+func (m *Manager) drain(timeout time.Duration) {
+	report, err := m.syncClient.Drain(timeout)
+	if err != nil {
+		m.log.WithError(err).Warn("Backing Image Manager: failed to drain the sync service before exit")
+		return
+	}
+	for _, file := range report.Interrupted {
+		m.log.Warnf("Backing Image Manager: the %v operation of file %v was interrupted at processed size %v before exit, resumable %v", file.Operation, file.FilePath, file.ProcessedSize, file.Resumable)
+	}
+	m.log.Infof("Backing Image Manager: drained the sync service with %v operations interrupted", len(report.Interrupted))
+}
+
 func (m *Manager) allocatePorts(portCount int32) (int32, int32, error) {
 	if portCount < 0 {
 		return 0, 0, fmt.Errorf("invalid port count %v", portCount)
@@ -544,6 +687,14 @@ func (m *Manager) allocatePorts(portCount int32) (int32, int32, error) {
 	if err != nil {
 		return 0, 0, errors.Wrapf(err, "fail to allocate %v ports", portCount)
 	}
+
+	m.lock.Lock()
+	for port := start; port <= end; port++ {
+		m.allocatedPorts[port] = struct{}{}
+	}
+	metrics.SetPorts(int(m.portRangeMax-m.portRangeMin+1), len(m.allocatedPorts))
+	m.lock.Unlock()
+
 	return start, end, nil
 }
 
@@ -551,7 +702,18 @@ func (m *Manager) releasePorts(start, end int32) error {
 	if start < 0 || end < 0 {
 		return fmt.Errorf("invalid start/end port %v %v", start, end)
 	}
-	return m.availablePorts.ReleaseRange(start, end)
+	if err := m.availablePorts.ReleaseRange(start, end); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	for port := start; port <= end; port++ {
+		delete(m.allocatedPorts, port)
+	}
+	metrics.SetPorts(int(m.portRangeMax-m.portRangeMin+1), len(m.allocatedPorts))
+	m.lock.Unlock()
+
+	return nil
 }
 
 func ParsePortRange(portRange string) (int32, int32, error) {
@@ -627,6 +789,7 @@ func (m *Manager) BackupCreate(ctx context.Context, req *rpc.BackupCreateRequest
 		ConcurrentLimit:   req.ConcurrentLimit,
 		Labels:            req.Labels,
 		Parameters:        req.Parameters,
+		RateLimiter:       m.bandwidthLimiter.Backup(),
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to initialize backup %v", req.Name)
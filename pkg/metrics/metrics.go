@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	namespace = "backing_image_manager"
+
+	DirectionReceived   = "received"
+	DirectionSent       = "sent"
+	DirectionDownloaded = "downloaded"
+
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	transferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transferred_bytes_total",
+		Help:      "The bytes received, sent or downloaded by the sync server",
+	}, []string{"direction", "source_type"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "operation_duration_seconds",
+		Help:      "The duration of the operations preparing or sending the files",
+		// 1 second to about 9 hours
+		Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+	}, []string{"operation", "outcome"})
+
+	files = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "files",
+		Help:      "The number of the files in the sync server in each state",
+	}, []string{"state"})
+
+	checksumDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "checksum_duration_seconds",
+		Help:      "The duration of calculating the checksum of a whole file",
+		// 0.1 second to about 1 hour
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 16),
+	}, []string{"algorithm"})
+
+	sendingReference = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sending_reference",
+		Help:      "The number of the in-flight sendings of each backing image",
+	}, []string{"backing_image"})
+
+	portsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ports_total",
+		Help:      "The number of the ports in the port range of the manager",
+	})
+
+	portsAllocated = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ports_allocated",
+		Help:      "The number of the ports allocated by the manager",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		transferredBytes,
+		operationDuration,
+		files,
+		checksumDuration,
+		sendingReference,
+		portsTotal,
+		portsAllocated,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		metricFamilies, err := registry.Gather()
+		if err != nil {
+			// The gathered metrics are still valid, hence only log the error.
+			logrus.WithError(err).Warn("Failed to gather some of the metrics")
+		}
+
+		format := expfmt.Negotiate(request.Header)
+		writer.Header().Set("Content-Type", string(format))
+		encoder := expfmt.NewEncoder(writer, format)
+		for _, metricFamily := range metricFamilies {
+			if err := encoder.Encode(metricFamily); err != nil {
+				logrus.WithError(err).Warn("Failed to encode the metrics")
+				return
+			}
+		}
+	})
+}
+
+// NewServer launches an HTTP server serving only the metrics. The server is closed once the context is done.
+func NewServer(ctx context.Context, listenAddr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := &http.Server{
+		Addr:    listenAddr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			logrus.WithError(err).Warn("Failed to close metrics server")
+		}
+	}()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Errorf("Metrics server at %v errored out", listenAddr)
+		}
+	}()
+
+	logrus.Infof("Started metrics server at %v", listenAddr)
+}
+
+func AddTransferredBytes(direction, sourceType string, bytes int64) {
+	if bytes <= 0 {
+		return
+	}
+	transferredBytes.WithLabelValues(direction, sourceType).Add(float64(bytes))
+}
+
+func ObserveOperation(operation string, startedAt time.Time, err error) {
+	outcome := OutcomeSucceeded
+	if err != nil {
+		outcome = OutcomeFailed
+	}
+	operationDuration.WithLabelValues(operation, outcome).Observe(time.Since(startedAt).Seconds())
+}
+
+// SetFileCounts overwrites the file counts of all states. The states not in the counts are set to 0.
+func SetFileCounts(states []string, counts map[string]int) {
+	for _, state := range states {
+		files.WithLabelValues(state).Set(float64(counts[state]))
+	}
+}
+
+func ObserveChecksum(algorithm string, startedAt time.Time) {
+	checksumDuration.WithLabelValues(algorithm).Observe(time.Since(startedAt).Seconds())
+}
+
+func SetSendingReference(backingImage string, reference int) {
+	sendingReference.WithLabelValues(backingImage).Set(float64(reference))
+}
+
+func DeleteSendingReference(backingImage string) {
+	sendingReference.DeleteLabelValues(backingImage)
+}
+
+func SetPorts(total, allocated int) {
+	portsTotal.Set(float64(total))
+	portsAllocated.Set(float64(allocated))
+}
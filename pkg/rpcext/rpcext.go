@@ -0,0 +1,20 @@
+// Package rpcext contains the gRPC methods of the backing image manager that are not defined in
+// the bimrpc package yet. They are served by the same gRPC server as a separate service.
+//
+// The messages and the service are generated from rpcext.proto, which imports bimrpc/bimrpc.proto of
+// github.com/longhorn/types:
+//
+//	protoc -I pkg -I <longhorn/types>/proto --go_out=pkg --go_opt=paths=source_relative \
+//		--go-grpc_out=pkg --go-grpc_opt=paths=source_relative rpcext/rpcext.proto
+package rpcext
+
+// The types of BackingImageEvent.
+const (
+	// BackingImageEventTypeUpdated is for a backing image added or changed.
+	BackingImageEventTypeUpdated = "updated"
+	// BackingImageEventTypeDeleted is the tombstone of a backing image, carrying its last known status.
+	BackingImageEventTypeDeleted = "deleted"
+	// BackingImageEventTypeReset means the watcher cannot resume from its revision, hence it should drop
+	// all cached backing images. The reset event is followed by an updated event for each backing image.
+	BackingImageEventTypeReset = "reset"
+)
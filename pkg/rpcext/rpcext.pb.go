@@ -0,0 +1,667 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: rpcext/rpcext.proto
+
+package rpcext
+
+import (
+	bimrpc "github.com/longhorn/types/pkg/generated/bimrpc"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type RepairRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Uuid  string                 `protobuf:"bytes,2,opt,name=uuid,proto3" json:"uuid,omitempty"`
+	// from_address is the address of the peer backing image manager having the healthy backing image.
+	FromAddress   string `protobuf:"bytes,3,opt,name=from_address,json=fromAddress,proto3" json:"from_address,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RepairRequest) Reset() {
+	*x = RepairRequest{}
+	mi := &file_rpcext_rpcext_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RepairRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RepairRequest) ProtoMessage() {}
+
+func (x *RepairRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_rpcext_rpcext_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RepairRequest.ProtoReflect.Descriptor instead.
+func (*RepairRequest) Descriptor() ([]byte, []int) {
+	return file_rpcext_rpcext_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RepairRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *RepairRequest) GetUuid() string {
+	if x != nil {
+		return x.Uuid
+	}
+	return ""
+}
+
+func (x *RepairRequest) GetFromAddress() string {
+	if x != nil {
+		return x.FromAddress
+	}
+	return ""
+}
+
+type WatchRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// name filters the events of a backing image. Empty means all backing images.
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// revision is the last received revision. The watch resumes from it if it's positive.
+	Revision      int64 `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchRequest) Reset() {
+	*x = WatchRequest{}
+	mi := &file_rpcext_rpcext_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRequest) ProtoMessage() {}
+
+func (x *WatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_rpcext_rpcext_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRequest.ProtoReflect.Descriptor instead.
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return file_rpcext_rpcext_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *WatchRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *WatchRequest) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+type BackingImageEvent struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Revision int64                  `protobuf:"varint,1,opt,name=revision,proto3" json:"revision,omitempty"`
+	// type is one of updated, deleted and reset.
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Name string `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	// backing_image is the last known status for a deleted event, and is unset for a reset event.
+	BackingImage  *bimrpc.BackingImageResponse `protobuf:"bytes,4,opt,name=backing_image,json=backingImage,proto3" json:"backing_image,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BackingImageEvent) Reset() {
+	*x = BackingImageEvent{}
+	mi := &file_rpcext_rpcext_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BackingImageEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BackingImageEvent) ProtoMessage() {}
+
+func (x *BackingImageEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_rpcext_rpcext_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BackingImageEvent.ProtoReflect.Descriptor instead.
+func (*BackingImageEvent) Descriptor() ([]byte, []int) {
+	return file_rpcext_rpcext_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *BackingImageEvent) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+func (x *BackingImageEvent) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *BackingImageEvent) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *BackingImageEvent) GetBackingImage() *bimrpc.BackingImageResponse {
+	if x != nil {
+		return x.BackingImage
+	}
+	return nil
+}
+
+type CollectLeftoversRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	DryRun bool                   `protobuf:"varint,1,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
+	// grace_period is a duration string, e.g. 24h. Empty means the default grace period.
+	GracePeriod string `protobuf:"bytes,2,opt,name=grace_period,json=gracePeriod,proto3" json:"grace_period,omitempty"`
+	// active_data_sources are the data source file names, i.e. <name>-<uuid>, whose files should be kept.
+	ActiveDataSources []string `protobuf:"bytes,3,rep,name=active_data_sources,json=activeDataSources,proto3" json:"active_data_sources,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *CollectLeftoversRequest) Reset() {
+	*x = CollectLeftoversRequest{}
+	mi := &file_rpcext_rpcext_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CollectLeftoversRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CollectLeftoversRequest) ProtoMessage() {}
+
+func (x *CollectLeftoversRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_rpcext_rpcext_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CollectLeftoversRequest.ProtoReflect.Descriptor instead.
+func (*CollectLeftoversRequest) Descriptor() ([]byte, []int) {
+	return file_rpcext_rpcext_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CollectLeftoversRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+func (x *CollectLeftoversRequest) GetGracePeriod() string {
+	if x != nil {
+		return x.GracePeriod
+	}
+	return ""
+}
+
+func (x *CollectLeftoversRequest) GetActiveDataSources() []string {
+	if x != nil {
+		return x.ActiveDataSources
+	}
+	return nil
+}
+
+type Leftover struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Path             string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Type             string                 `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Size             int64                  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	ModificationTime string                 `protobuf:"bytes,4,opt,name=modification_time,json=modificationTime,proto3" json:"modification_time,omitempty"`
+	Expired          bool                   `protobuf:"varint,5,opt,name=expired,proto3" json:"expired,omitempty"`
+	Deleted          bool                   `protobuf:"varint,6,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	Error            string                 `protobuf:"bytes,7,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Leftover) Reset() {
+	*x = Leftover{}
+	mi := &file_rpcext_rpcext_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Leftover) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Leftover) ProtoMessage() {}
+
+func (x *Leftover) ProtoReflect() protoreflect.Message {
+	mi := &file_rpcext_rpcext_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Leftover.ProtoReflect.Descriptor instead.
+func (*Leftover) Descriptor() ([]byte, []int) {
+	return file_rpcext_rpcext_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Leftover) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *Leftover) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Leftover) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Leftover) GetModificationTime() string {
+	if x != nil {
+		return x.ModificationTime
+	}
+	return ""
+}
+
+func (x *Leftover) GetExpired() bool {
+	if x != nil {
+		return x.Expired
+	}
+	return false
+}
+
+func (x *Leftover) GetDeleted() bool {
+	if x != nil {
+		return x.Deleted
+	}
+	return false
+}
+
+func (x *Leftover) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type CollectLeftoversResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	DryRun        bool                   `protobuf:"varint,1,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
+	GracePeriod   string                 `protobuf:"bytes,2,opt,name=grace_period,json=gracePeriod,proto3" json:"grace_period,omitempty"`
+	Leftovers     []*Leftover            `protobuf:"bytes,3,rep,name=leftovers,proto3" json:"leftovers,omitempty"`
+	ReclaimedSize int64                  `protobuf:"varint,4,opt,name=reclaimed_size,json=reclaimedSize,proto3" json:"reclaimed_size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CollectLeftoversResponse) Reset() {
+	*x = CollectLeftoversResponse{}
+	mi := &file_rpcext_rpcext_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CollectLeftoversResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CollectLeftoversResponse) ProtoMessage() {}
+
+func (x *CollectLeftoversResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_rpcext_rpcext_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CollectLeftoversResponse.ProtoReflect.Descriptor instead.
+func (*CollectLeftoversResponse) Descriptor() ([]byte, []int) {
+	return file_rpcext_rpcext_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CollectLeftoversResponse) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+func (x *CollectLeftoversResponse) GetGracePeriod() string {
+	if x != nil {
+		return x.GracePeriod
+	}
+	return ""
+}
+
+func (x *CollectLeftoversResponse) GetLeftovers() []*Leftover {
+	if x != nil {
+		return x.Leftovers
+	}
+	return nil
+}
+
+func (x *CollectLeftoversResponse) GetReclaimedSize() int64 {
+	if x != nil {
+		return x.ReclaimedSize
+	}
+	return 0
+}
+
+type PrepareDownloadWithTokenRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Uuid          string                 `protobuf:"bytes,2,opt,name=uuid,proto3" json:"uuid,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PrepareDownloadWithTokenRequest) Reset() {
+	*x = PrepareDownloadWithTokenRequest{}
+	mi := &file_rpcext_rpcext_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PrepareDownloadWithTokenRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PrepareDownloadWithTokenRequest) ProtoMessage() {}
+
+func (x *PrepareDownloadWithTokenRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_rpcext_rpcext_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PrepareDownloadWithTokenRequest.ProtoReflect.Descriptor instead.
+func (*PrepareDownloadWithTokenRequest) Descriptor() ([]byte, []int) {
+	return file_rpcext_rpcext_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PrepareDownloadWithTokenRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *PrepareDownloadWithTokenRequest) GetUuid() string {
+	if x != nil {
+		return x.Uuid
+	}
+	return ""
+}
+
+type PrepareDownloadWithTokenResponse struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	SrcFilePath string                 `protobuf:"bytes,1,opt,name=src_file_path,json=srcFilePath,proto3" json:"src_file_path,omitempty"`
+	Address     string                 `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"`
+	// token is the download token of the file for the sync server in address. It's empty if the sync server
+	// doesn't require authentication.
+	Token string `protobuf:"bytes,3,opt,name=token,proto3" json:"token,omitempty"`
+	// token_expires_at is in RFC3339 format.
+	TokenExpiresAt string `protobuf:"bytes,4,opt,name=token_expires_at,json=tokenExpiresAt,proto3" json:"token_expires_at,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *PrepareDownloadWithTokenResponse) Reset() {
+	*x = PrepareDownloadWithTokenResponse{}
+	mi := &file_rpcext_rpcext_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PrepareDownloadWithTokenResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PrepareDownloadWithTokenResponse) ProtoMessage() {}
+
+func (x *PrepareDownloadWithTokenResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_rpcext_rpcext_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PrepareDownloadWithTokenResponse.ProtoReflect.Descriptor instead.
+func (*PrepareDownloadWithTokenResponse) Descriptor() ([]byte, []int) {
+	return file_rpcext_rpcext_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *PrepareDownloadWithTokenResponse) GetSrcFilePath() string {
+	if x != nil {
+		return x.SrcFilePath
+	}
+	return ""
+}
+
+func (x *PrepareDownloadWithTokenResponse) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *PrepareDownloadWithTokenResponse) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *PrepareDownloadWithTokenResponse) GetTokenExpiresAt() string {
+	if x != nil {
+		return x.TokenExpiresAt
+	}
+	return ""
+}
+
+var File_rpcext_rpcext_proto protoreflect.FileDescriptor
+
+const file_rpcext_rpcext_proto_rawDesc = "" +
+	"\n" +
+	"\x13rpcext/rpcext.proto\x12\x06rpcext\x1a\x13bimrpc/bimrpc.proto\"Z\n" +
+	"\rRepairRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04uuid\x18\x02 \x01(\tR\x04uuid\x12!\n" +
+	"\ffrom_address\x18\x03 \x01(\tR\vfromAddress\">\n" +
+	"\fWatchRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1a\n" +
+	"\brevision\x18\x02 \x01(\x03R\brevision\"\x9a\x01\n" +
+	"\x11BackingImageEvent\x12\x1a\n" +
+	"\brevision\x18\x01 \x01(\x03R\brevision\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x12\n" +
+	"\x04name\x18\x03 \x01(\tR\x04name\x12A\n" +
+	"\rbacking_image\x18\x04 \x01(\v2\x1c.bimrpc.BackingImageResponseR\fbackingImage\"\x85\x01\n" +
+	"\x17CollectLeftoversRequest\x12\x17\n" +
+	"\adry_run\x18\x01 \x01(\bR\x06dryRun\x12!\n" +
+	"\fgrace_period\x18\x02 \x01(\tR\vgracePeriod\x12.\n" +
+	"\x13active_data_sources\x18\x03 \x03(\tR\x11activeDataSources\"\xbd\x01\n" +
+	"\bLeftover\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\x03R\x04size\x12+\n" +
+	"\x11modification_time\x18\x04 \x01(\tR\x10modificationTime\x12\x18\n" +
+	"\aexpired\x18\x05 \x01(\bR\aexpired\x12\x18\n" +
+	"\adeleted\x18\x06 \x01(\bR\adeleted\x12\x14\n" +
+	"\x05error\x18\a \x01(\tR\x05error\"\xad\x01\n" +
+	"\x18CollectLeftoversResponse\x12\x17\n" +
+	"\adry_run\x18\x01 \x01(\bR\x06dryRun\x12!\n" +
+	"\fgrace_period\x18\x02 \x01(\tR\vgracePeriod\x12.\n" +
+	"\tleftovers\x18\x03 \x03(\v2\x10.rpcext.LeftoverR\tleftovers\x12%\n" +
+	"\x0ereclaimed_size\x18\x04 \x01(\x03R\rreclaimedSize\"I\n" +
+	"\x1fPrepareDownloadWithTokenRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04uuid\x18\x02 \x01(\tR\x04uuid\"\xa0\x01\n" +
+	" PrepareDownloadWithTokenResponse\x12\"\n" +
+	"\rsrc_file_path\x18\x01 \x01(\tR\vsrcFilePath\x12\x18\n" +
+	"\aaddress\x18\x02 \x01(\tR\aaddress\x12\x14\n" +
+	"\x05token\x18\x03 \x01(\tR\x05token\x12(\n" +
+	"\x10token_expires_at\x18\x04 \x01(\tR\x0etokenExpiresAt2\xee\x02\n" +
+	"\x1dBackingImageManagerExtService\x12?\n" +
+	"\x06Repair\x12\x15.rpcext.RepairRequest\x1a\x1c.bimrpc.BackingImageResponse\"\x00\x12B\n" +
+	"\vWatchEvents\x12\x14.rpcext.WatchRequest\x1a\x19.rpcext.BackingImageEvent\"\x000\x01\x12W\n" +
+	"\x10CollectLeftovers\x12\x1f.rpcext.CollectLeftoversRequest\x1a .rpcext.CollectLeftoversResponse\"\x00\x12o\n" +
+	"\x18PrepareDownloadWithToken\x12'.rpcext.PrepareDownloadWithTokenRequest\x1a(.rpcext.PrepareDownloadWithTokenResponse\"\x00B6Z4github.com/longhorn/backing-image-manager/pkg/rpcextb\x06proto3"
+
+var (
+	file_rpcext_rpcext_proto_rawDescOnce sync.Once
+	file_rpcext_rpcext_proto_rawDescData []byte
+)
+
+func file_rpcext_rpcext_proto_rawDescGZIP() []byte {
+	file_rpcext_rpcext_proto_rawDescOnce.Do(func() {
+		file_rpcext_rpcext_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_rpcext_rpcext_proto_rawDesc), len(file_rpcext_rpcext_proto_rawDesc)))
+	})
+	return file_rpcext_rpcext_proto_rawDescData
+}
+
+var file_rpcext_rpcext_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_rpcext_rpcext_proto_goTypes = []any{
+	(*RepairRequest)(nil),                    // 0: rpcext.RepairRequest
+	(*WatchRequest)(nil),                     // 1: rpcext.WatchRequest
+	(*BackingImageEvent)(nil),                // 2: rpcext.BackingImageEvent
+	(*CollectLeftoversRequest)(nil),          // 3: rpcext.CollectLeftoversRequest
+	(*Leftover)(nil),                         // 4: rpcext.Leftover
+	(*CollectLeftoversResponse)(nil),         // 5: rpcext.CollectLeftoversResponse
+	(*PrepareDownloadWithTokenRequest)(nil),  // 6: rpcext.PrepareDownloadWithTokenRequest
+	(*PrepareDownloadWithTokenResponse)(nil), // 7: rpcext.PrepareDownloadWithTokenResponse
+	(*bimrpc.BackingImageResponse)(nil),      // 8: bimrpc.BackingImageResponse
+}
+var file_rpcext_rpcext_proto_depIdxs = []int32{
+	8, // 0: rpcext.BackingImageEvent.backing_image:type_name -> bimrpc.BackingImageResponse
+	4, // 1: rpcext.CollectLeftoversResponse.leftovers:type_name -> rpcext.Leftover
+	0, // 2: rpcext.BackingImageManagerExtService.Repair:input_type -> rpcext.RepairRequest
+	1, // 3: rpcext.BackingImageManagerExtService.WatchEvents:input_type -> rpcext.WatchRequest
+	3, // 4: rpcext.BackingImageManagerExtService.CollectLeftovers:input_type -> rpcext.CollectLeftoversRequest
+	6, // 5: rpcext.BackingImageManagerExtService.PrepareDownloadWithToken:input_type -> rpcext.PrepareDownloadWithTokenRequest
+	8, // 6: rpcext.BackingImageManagerExtService.Repair:output_type -> bimrpc.BackingImageResponse
+	2, // 7: rpcext.BackingImageManagerExtService.WatchEvents:output_type -> rpcext.BackingImageEvent
+	5, // 8: rpcext.BackingImageManagerExtService.CollectLeftovers:output_type -> rpcext.CollectLeftoversResponse
+	7, // 9: rpcext.BackingImageManagerExtService.PrepareDownloadWithToken:output_type -> rpcext.PrepareDownloadWithTokenResponse
+	6, // [6:10] is the sub-list for method output_type
+	2, // [2:6] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_rpcext_rpcext_proto_init() }
+func file_rpcext_rpcext_proto_init() {
+	if File_rpcext_rpcext_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_rpcext_rpcext_proto_rawDesc), len(file_rpcext_rpcext_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_rpcext_rpcext_proto_goTypes,
+		DependencyIndexes: file_rpcext_rpcext_proto_depIdxs,
+		MessageInfos:      file_rpcext_rpcext_proto_msgTypes,
+	}.Build()
+	File_rpcext_rpcext_proto = out.File
+	file_rpcext_rpcext_proto_goTypes = nil
+	file_rpcext_rpcext_proto_depIdxs = nil
+}
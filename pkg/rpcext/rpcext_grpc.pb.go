@@ -0,0 +1,257 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: rpcext/rpcext.proto
+
+package rpcext
+
+import (
+	context "context"
+	bimrpc "github.com/longhorn/types/pkg/generated/bimrpc"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	BackingImageManagerExtService_Repair_FullMethodName                   = "/rpcext.BackingImageManagerExtService/Repair"
+	BackingImageManagerExtService_WatchEvents_FullMethodName              = "/rpcext.BackingImageManagerExtService/WatchEvents"
+	BackingImageManagerExtService_CollectLeftovers_FullMethodName         = "/rpcext.BackingImageManagerExtService/CollectLeftovers"
+	BackingImageManagerExtService_PrepareDownloadWithToken_FullMethodName = "/rpcext.BackingImageManagerExtService/PrepareDownloadWithToken"
+)
+
+// BackingImageManagerExtServiceClient is the client API for BackingImageManagerExtService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// BackingImageManagerExtService contains the methods of the backing image manager that are not defined in
+// the bimrpc package yet. It's served by the same gRPC server as bimrpc.BackingImageManagerService.
+type BackingImageManagerExtServiceClient interface {
+	// Repair pulls the corrupted blocks of a backing image from the peer backing image manager in from_address.
+	Repair(ctx context.Context, in *RepairRequest, opts ...grpc.CallOption) (*bimrpc.BackingImageResponse, error)
+	// WatchEvents streams the changed backing images and the deletion tombstones.
+	WatchEvents(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BackingImageEvent], error)
+	// CollectLeftovers reports the files on the disk not owned by any backing image or active data source,
+	// and deletes the ones past the grace period unless it's a dry run.
+	CollectLeftovers(ctx context.Context, in *CollectLeftoversRequest, opts ...grpc.CallOption) (*CollectLeftoversResponse, error)
+	// PrepareDownloadWithToken is PrepareDownload with a download token of the file for the sync server.
+	PrepareDownloadWithToken(ctx context.Context, in *PrepareDownloadWithTokenRequest, opts ...grpc.CallOption) (*PrepareDownloadWithTokenResponse, error)
+}
+
+type backingImageManagerExtServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBackingImageManagerExtServiceClient(cc grpc.ClientConnInterface) BackingImageManagerExtServiceClient {
+	return &backingImageManagerExtServiceClient{cc}
+}
+
+func (c *backingImageManagerExtServiceClient) Repair(ctx context.Context, in *RepairRequest, opts ...grpc.CallOption) (*bimrpc.BackingImageResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(bimrpc.BackingImageResponse)
+	err := c.cc.Invoke(ctx, BackingImageManagerExtService_Repair_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backingImageManagerExtServiceClient) WatchEvents(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BackingImageEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &BackingImageManagerExtService_ServiceDesc.Streams[0], BackingImageManagerExtService_WatchEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, BackingImageEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BackingImageManagerExtService_WatchEventsClient = grpc.ServerStreamingClient[BackingImageEvent]
+
+func (c *backingImageManagerExtServiceClient) CollectLeftovers(ctx context.Context, in *CollectLeftoversRequest, opts ...grpc.CallOption) (*CollectLeftoversResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CollectLeftoversResponse)
+	err := c.cc.Invoke(ctx, BackingImageManagerExtService_CollectLeftovers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backingImageManagerExtServiceClient) PrepareDownloadWithToken(ctx context.Context, in *PrepareDownloadWithTokenRequest, opts ...grpc.CallOption) (*PrepareDownloadWithTokenResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PrepareDownloadWithTokenResponse)
+	err := c.cc.Invoke(ctx, BackingImageManagerExtService_PrepareDownloadWithToken_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BackingImageManagerExtServiceServer is the server API for BackingImageManagerExtService service.
+// All implementations must embed UnimplementedBackingImageManagerExtServiceServer
+// for forward compatibility.
+//
+// BackingImageManagerExtService contains the methods of the backing image manager that are not defined in
+// the bimrpc package yet. It's served by the same gRPC server as bimrpc.BackingImageManagerService.
+type BackingImageManagerExtServiceServer interface {
+	// Repair pulls the corrupted blocks of a backing image from the peer backing image manager in from_address.
+	Repair(context.Context, *RepairRequest) (*bimrpc.BackingImageResponse, error)
+	// WatchEvents streams the changed backing images and the deletion tombstones.
+	WatchEvents(*WatchRequest, grpc.ServerStreamingServer[BackingImageEvent]) error
+	// CollectLeftovers reports the files on the disk not owned by any backing image or active data source,
+	// and deletes the ones past the grace period unless it's a dry run.
+	CollectLeftovers(context.Context, *CollectLeftoversRequest) (*CollectLeftoversResponse, error)
+	// PrepareDownloadWithToken is PrepareDownload with a download token of the file for the sync server.
+	PrepareDownloadWithToken(context.Context, *PrepareDownloadWithTokenRequest) (*PrepareDownloadWithTokenResponse, error)
+	mustEmbedUnimplementedBackingImageManagerExtServiceServer()
+}
+
+// UnimplementedBackingImageManagerExtServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedBackingImageManagerExtServiceServer struct{}
+
+func (UnimplementedBackingImageManagerExtServiceServer) Repair(context.Context, *RepairRequest) (*bimrpc.BackingImageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Repair not implemented")
+}
+func (UnimplementedBackingImageManagerExtServiceServer) WatchEvents(*WatchRequest, grpc.ServerStreamingServer[BackingImageEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedBackingImageManagerExtServiceServer) CollectLeftovers(context.Context, *CollectLeftoversRequest) (*CollectLeftoversResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CollectLeftovers not implemented")
+}
+func (UnimplementedBackingImageManagerExtServiceServer) PrepareDownloadWithToken(context.Context, *PrepareDownloadWithTokenRequest) (*PrepareDownloadWithTokenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PrepareDownloadWithToken not implemented")
+}
+func (UnimplementedBackingImageManagerExtServiceServer) mustEmbedUnimplementedBackingImageManagerExtServiceServer() {
+}
+func (UnimplementedBackingImageManagerExtServiceServer) testEmbeddedByValue() {}
+
+// UnsafeBackingImageManagerExtServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BackingImageManagerExtServiceServer will
+// result in compilation errors.
+type UnsafeBackingImageManagerExtServiceServer interface {
+	mustEmbedUnimplementedBackingImageManagerExtServiceServer()
+}
+
+func RegisterBackingImageManagerExtServiceServer(s grpc.ServiceRegistrar, srv BackingImageManagerExtServiceServer) {
+	// If the following call pancis, it indicates UnimplementedBackingImageManagerExtServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&BackingImageManagerExtService_ServiceDesc, srv)
+}
+
+func _BackingImageManagerExtService_Repair_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RepairRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackingImageManagerExtServiceServer).Repair(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BackingImageManagerExtService_Repair_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackingImageManagerExtServiceServer).Repair(ctx, req.(*RepairRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BackingImageManagerExtService_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BackingImageManagerExtServiceServer).WatchEvents(m, &grpc.GenericServerStream[WatchRequest, BackingImageEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BackingImageManagerExtService_WatchEventsServer = grpc.ServerStreamingServer[BackingImageEvent]
+
+func _BackingImageManagerExtService_CollectLeftovers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CollectLeftoversRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackingImageManagerExtServiceServer).CollectLeftovers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BackingImageManagerExtService_CollectLeftovers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackingImageManagerExtServiceServer).CollectLeftovers(ctx, req.(*CollectLeftoversRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BackingImageManagerExtService_PrepareDownloadWithToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrepareDownloadWithTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackingImageManagerExtServiceServer).PrepareDownloadWithToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BackingImageManagerExtService_PrepareDownloadWithToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackingImageManagerExtServiceServer).PrepareDownloadWithToken(ctx, req.(*PrepareDownloadWithTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// BackingImageManagerExtService_ServiceDesc is the grpc.ServiceDesc for BackingImageManagerExtService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var BackingImageManagerExtService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rpcext.BackingImageManagerExtService",
+	HandlerType: (*BackingImageManagerExtServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Repair",
+			Handler:    _BackingImageManagerExtService_Repair_Handler,
+		},
+		{
+			MethodName: "CollectLeftovers",
+			Handler:    _BackingImageManagerExtService_CollectLeftovers_Handler,
+		},
+		{
+			MethodName: "PrepareDownloadWithToken",
+			Handler:    _BackingImageManagerExtService_PrepareDownloadWithToken_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _BackingImageManagerExtService_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rpcext/rpcext.proto",
+}
@@ -0,0 +1,134 @@
+package sync
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+// BandwidthLimiter holds the rate limiters of the transfers. The limiter of each operation is limited by
+// the total limiter as well. The limits can be updated at runtime, and the update applies to the
+// in-flight transfers immediately. A nil BandwidthLimiter doesn't limit anything.
+type BandwidthLimiter struct {
+	lock   sync.RWMutex
+	limits api.BandwidthLimits
+
+	total    *util.RateLimiter
+	download *util.RateLimiter
+	upload   *util.RateLimiter
+	send     *util.RateLimiter
+	receive  *util.RateLimiter
+	backup   *util.RateLimiter
+	restore  *util.RateLimiter
+}
+
+func NewBandwidthLimiter(limits api.BandwidthLimits) (*BandwidthLimiter, error) {
+	if err := validateBandwidthLimits(limits); err != nil {
+		return nil, err
+	}
+
+	total := util.NewAdjustableRateLimiter(limits.Total, nil)
+	return &BandwidthLimiter{
+		limits: limits,
+
+		total:    total,
+		download: util.NewAdjustableRateLimiter(limits.Download, total),
+		upload:   util.NewAdjustableRateLimiter(limits.Upload, total),
+		send:     util.NewAdjustableRateLimiter(limits.Send, total),
+		receive:  util.NewAdjustableRateLimiter(limits.Receive, total),
+		backup:   util.NewAdjustableRateLimiter(limits.Backup, total),
+		restore:  util.NewAdjustableRateLimiter(limits.Restore, total),
+	}, nil
+}
+
+func validateBandwidthLimits(limits api.BandwidthLimits) error {
+	for name, limit := range map[string]int64{
+		"total":    limits.Total,
+		"download": limits.Download,
+		"upload":   limits.Upload,
+		"send":     limits.Send,
+		"receive":  limits.Receive,
+		"backup":   limits.Backup,
+		"restore":  limits.Restore,
+	} {
+		if limit < 0 {
+			return fmt.Errorf("invalid %v bandwidth limit %v, which should not be negative", name, limit)
+		}
+	}
+	return nil
+}
+
+func (b *BandwidthLimiter) Get() api.BandwidthLimits {
+	if b == nil {
+		return api.BandwidthLimits{}
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.limits
+}
+
+func (b *BandwidthLimiter) Update(limits api.BandwidthLimits) error {
+	if b == nil {
+		return fmt.Errorf("cannot update the bandwidth limits since the bandwidth limiter is not initialized")
+	}
+	if err := validateBandwidthLimits(limits); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.limits = limits
+	b.total.SetLimit(limits.Total)
+	b.download.SetLimit(limits.Download)
+	b.upload.SetLimit(limits.Upload)
+	b.send.SetLimit(limits.Send)
+	b.receive.SetLimit(limits.Receive)
+	b.backup.SetLimit(limits.Backup)
+	b.restore.SetLimit(limits.Restore)
+	return nil
+}
+
+func (b *BandwidthLimiter) Download() *util.RateLimiter {
+	if b == nil {
+		return nil
+	}
+	return b.download
+}
+
+func (b *BandwidthLimiter) Upload() *util.RateLimiter {
+	if b == nil {
+		return nil
+	}
+	return b.upload
+}
+
+func (b *BandwidthLimiter) Send() *util.RateLimiter {
+	if b == nil {
+		return nil
+	}
+	return b.send
+}
+
+func (b *BandwidthLimiter) Receive() *util.RateLimiter {
+	if b == nil {
+		return nil
+	}
+	return b.receive
+}
+
+func (b *BandwidthLimiter) Backup() *util.RateLimiter {
+	if b == nil {
+		return nil
+	}
+	return b.backup
+}
+
+func (b *BandwidthLimiter) Restore() *util.RateLimiter {
+	if b == nil {
+		return nil
+	}
+	return b.restore
+}
@@ -0,0 +1,207 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+const (
+	// DefaultDrainTimeout is the max time waiting for the running operations before interrupting them.
+	DefaultDrainTimeout = 20 * time.Second
+	// DrainCheckInterval is the interval of checking if the running operations are done during the drain.
+	DrainCheckInterval = 500 * time.Millisecond
+	// DrainSettleTimeout is the max time waiting for the interrupted operations to record their progress.
+	DrainSettleTimeout = 5 * time.Second
+)
+
+var (
+	// ErrDraining means the sync service refuses the new operations since it's being shut down.
+	ErrDraining = errors.New("the sync service is draining")
+	// ErrInterrupted means the operation preparing the file was interrupted by the drain.
+	ErrInterrupted = errors.New("interrupted by the drain of the sync service")
+)
+
+func (s *Service) Drain(writer http.ResponseWriter, request *http.Request) {
+	timeout := DefaultDrainTimeout
+	if timeoutStr := request.URL.Query().Get("timeout"); timeoutStr != "" {
+		var err error
+		if timeout, err = time.ParseDuration(timeoutStr); err != nil || timeout < 0 {
+			http.Error(writer, fmt.Sprintf("invalid drain timeout %v", timeoutStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	outgoingJSON, err := json.Marshal(s.drain(timeout))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err := writer.Write(outgoingJSON); err != nil {
+		s.log.WithError(err).Warn("Failed to write response")
+	}
+}
+
+// drain refuses the new operations, then waits up to the timeout for the running ones, including the sending.
+// The operations preparing the files after the timeout are interrupted. The download, the fetch and the receive
+// keep the partial data, so that the same request can resume the operation after a restart.
+// The sending after the timeout is stopped as well, and the receiver is expected to retry it.
+func (s *Service) drain(timeout time.Duration) *api.DrainReport {
+	s.lock.Lock()
+	s.draining = true
+	s.lock.Unlock()
+	s.log.Infof("Sync Service: draining, will wait up to %v for the running operations", timeout)
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(DrainCheckInterval)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) && s.hasRunningOperations() {
+		<-ticker.C
+	}
+
+	var interruptedFiles []*SyncingFile
+	s.lock.RLock()
+	for _, sf := range s.filePathMap {
+		if sf.isPreparing() {
+			interruptedFiles = append(interruptedFiles, sf)
+		}
+		if sf.isSending() {
+			s.log.Warnf("Sync Service: stopping the sending of file %v", sf.filePath)
+			sf.sendingCancel()
+		}
+	}
+	s.lock.RUnlock()
+
+	report := &api.DrainReport{
+		Timeout:     timeout.String(),
+		Interrupted: []api.InterruptedFile{},
+	}
+	operations := map[*SyncingFile]string{}
+	for _, sf := range interruptedFiles {
+		operations[sf] = sf.interrupt()
+	}
+	// Give the interrupted operations a chance to record the progress before reporting.
+	settleDeadline := time.Now().Add(DrainSettleTimeout)
+	for _, sf := range interruptedFiles {
+		for sf.isPreparing() && time.Now().Before(settleDeadline) {
+			<-ticker.C
+		}
+		info := sf.Get()
+		report.Interrupted = append(report.Interrupted, api.InterruptedFile{
+			FilePath:      info.FilePath,
+			UUID:          info.UUID,
+			Operation:     operations[sf],
+			ProcessedSize: info.ProcessedSize,
+			Resumable:     util.IsDownloadCheckpointExisting(sf.tmpFilePath),
+		})
+		s.log.Warnf("Sync Service: interrupted the %v operation of file %v in state %v, resumable %v", operations[sf], info.FilePath, info.State, report.Interrupted[len(report.Interrupted)-1].Resumable)
+	}
+	s.log.Infof("Sync Service: drained with %v operations interrupted", len(report.Interrupted))
+
+	return report
+}
+
+func (s *Service) hasRunningOperations() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, sf := range s.filePathMap {
+		if sf.isPreparing() || sf.isSending() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) checkNotDrainingNoLock() error {
+	if s.draining {
+		return ErrDraining
+	}
+	return nil
+}
+
+func (sf *SyncingFile) isSending() bool {
+	sf.lock.RLock()
+	defer sf.lock.RUnlock()
+	return sf.sendingReference > 0
+}
+
+// interrupt stops the operation preparing the file, and returns the operation. The operation not started yet
+// fails immediately, while the running one fails with ErrInterrupted once it notices the cancellation.
+func (sf *SyncingFile) interrupt() string {
+	sf.lock.Lock()
+	sf.interrupted = true
+	operation := sf.operation
+	if sf.state == types.StateStarting && sf.operation == "" {
+		sf.handleFailureNoLock(ErrInterrupted)
+	}
+	sf.lock.Unlock()
+
+	sf.cancel()
+	return operation
+}
+
+func (sf *SyncingFile) isInterrupted() bool {
+	sf.lock.RLock()
+	defer sf.lock.RUnlock()
+	return sf.interrupted
+}
+
+// isPartialDataReusableNoLock means the tmp file is left by the same operation, which can continue from the
+// partial data. The download checkpoint doesn't record the operation.
+func (sf *SyncingFile) isPartialDataReusableNoLock(operation string) bool {
+	checkpoint, err := util.ReadDownloadCheckpoint(util.GetDownloadCheckpointFilePath(sf.tmpFilePath))
+	if err != nil {
+		return false
+	}
+	if operation == OperationDownload {
+		return checkpoint.Operation == ""
+	}
+	return checkpoint.Operation == operation
+}
+
+// loadResumeCheckpointNoLock returns the checkpoint left in the tmp file by the same operation from the same
+// source, or nil if there is no such partial data.
+func (sf *SyncingFile) loadResumeCheckpointNoLock(operation, source string) *util.DownloadCheckpoint {
+	checkpoint, err := util.ReadDownloadCheckpoint(util.GetDownloadCheckpointFilePath(sf.tmpFilePath))
+	if err != nil || checkpoint.Operation != operation || checkpoint.URL != source {
+		return nil
+	}
+	info, err := os.Stat(sf.tmpFilePath)
+	if err != nil || info.IsDir() || info.Size() != checkpoint.Size {
+		return nil
+	}
+	return checkpoint
+}
+
+// saveResumeCheckpointNoLock records that the tmp file will contain the data of the operation from the source.
+func (sf *SyncingFile) saveResumeCheckpointNoLock(operation, source string, size int64) error {
+	return util.WriteDownloadCheckpoint(util.GetDownloadCheckpointFilePath(sf.tmpFilePath), &util.DownloadCheckpoint{
+		Operation: operation,
+		URL:       source,
+		Size:      size,
+	})
+}
+
+// removeResumeCheckpointNoLock cleans up the checkpoint once the tmp file becomes the ready file.
+func (sf *SyncingFile) removeResumeCheckpointNoLock() {
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(sf.tmpFilePath)
+	if err := os.RemoveAll(checkpointFilePath); err != nil {
+		sf.log.WithError(err).Warnf("SyncingFile: failed to clean up the checkpoint file %v", checkpointFilePath)
+	}
+}
+
+// discardPartialDataNoLock removes the tmp file and its checkpoint left by the previous operation.
+func (sf *SyncingFile) discardPartialDataNoLock() error {
+	if err := os.RemoveAll(sf.tmpFilePath); err != nil {
+		return err
+	}
+	return os.RemoveAll(util.GetDownloadCheckpointFilePath(sf.tmpFilePath))
+}
@@ -0,0 +1,330 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
+	"github.com/longhorn/backing-image-manager/pkg/types"
+)
+
+const (
+	EventCheckInterval = 1 * time.Second
+	EventHistoryLimit  = 1024
+	// ReadyFileValidationInterval is the interval of checking if the ready files are modified on the disk.
+	ReadyFileValidationInterval = 5 * time.Second
+
+	eventSubscriberBufferSize = 256
+)
+
+// fileStates are the states reported by the file count metrics.
+var fileStates = []string{
+	string(types.StatePending),
+	string(types.StateStarting),
+	string(types.StateInProgress),
+	string(types.StateReadyForTransfer),
+	string(types.StateReady),
+	string(types.StateFailed),
+	string(types.StateUnknown),
+	string(types.StateCorrupted),
+}
+
+// eventHub records the changes of the sync files as events with monotonically increasing revisions.
+// The recent events are kept so that a reconnecting subscriber can resume from its last revision.
+// The epoch is the start time of the hub, so that the revisions before a restart are never resumed.
+type eventHub struct {
+	lock sync.Mutex
+
+	epoch       int64
+	revision    int64
+	history     []api.FileEvent
+	files       map[string]api.FileInfo
+	subscribers map[chan api.FileEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		epoch:       time.Now().UnixNano(),
+		files:       map[string]api.FileInfo{},
+		subscribers: map[chan api.FileEvent]struct{}{},
+	}
+}
+
+// update compares the current file info with the last recorded one then records the changes.
+func (h *eventHub) update(fileInfos map[string]api.FileInfo) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	filePaths := make([]string, 0, len(fileInfos))
+	for filePath := range fileInfos {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+	for _, filePath := range filePaths {
+		fInfo := fileInfos[filePath]
+		lastInfo, exists := h.files[filePath]
+		var eventType api.FileEventType
+		switch {
+		case !exists:
+			eventType = api.FileEventTypeCreated
+		case lastInfo.State != fInfo.State:
+			eventType = api.FileEventTypeState
+		case lastInfo.Progress != fInfo.Progress || lastInfo.ProcessedSize != fInfo.ProcessedSize:
+			eventType = api.FileEventTypeProgress
+		case !reflect.DeepEqual(lastInfo, fInfo):
+			eventType = api.FileEventTypeUpdated
+		default:
+			continue
+		}
+		h.files[filePath] = fInfo
+		h.recordNoLock(eventType, fInfo)
+	}
+
+	deletedFilePaths := []string{}
+	for filePath := range h.files {
+		if _, exists := fileInfos[filePath]; !exists {
+			deletedFilePaths = append(deletedFilePaths, filePath)
+		}
+	}
+	sort.Strings(deletedFilePaths)
+	for _, filePath := range deletedFilePaths {
+		fInfo := h.files[filePath]
+		delete(h.files, filePath)
+		h.recordNoLock(api.FileEventTypeDeleted, fInfo)
+	}
+}
+
+func (h *eventHub) recordNoLock(eventType api.FileEventType, fInfo api.FileInfo) {
+	h.revision++
+	event := api.FileEvent{
+		Epoch:    h.epoch,
+		Revision: h.revision,
+		Type:     eventType,
+		FileInfo: &fInfo,
+	}
+
+	h.history = append(h.history, event)
+	if len(h.history) > EventHistoryLimit {
+		h.history = h.history[len(h.history)-EventHistoryLimit:]
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber, it can resume from its last revision after reconnecting.
+			close(ch)
+			delete(h.subscribers, ch)
+		}
+	}
+}
+
+// subscribe returns the events to be replayed and the channel of the following events. If the
+// subscriber cannot resume from the revision, e.g., the revision is of another epoch, the replayed events
+// start with a reset event followed by a created event for each existing file, and all of them carry
+// the current revision.
+func (h *eventHub) subscribe(epoch, revision int64, resume bool) ([]api.FileEvent, chan api.FileEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ch := make(chan api.FileEvent, eventSubscriberBufferSize)
+	h.subscribers[ch] = struct{}{}
+
+	oldestRevision := h.revision + 1
+	if len(h.history) > 0 {
+		oldestRevision = h.history[0].Revision
+	}
+	if resume && epoch == h.epoch && revision >= oldestRevision-1 && revision <= h.revision {
+		replay := []api.FileEvent{}
+		for _, event := range h.history {
+			if event.Revision > revision {
+				replay = append(replay, event)
+			}
+		}
+		return replay, ch
+	}
+
+	replay := []api.FileEvent{{Epoch: h.epoch, Revision: h.revision, Type: api.FileEventTypeReset}}
+	filePaths := make([]string, 0, len(h.files))
+	for filePath := range h.files {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+	for _, filePath := range filePaths {
+		fInfo := h.files[filePath]
+		replay = append(replay, api.FileEvent{Epoch: h.epoch, Revision: h.revision, Type: api.FileEventTypeCreated, FileInfo: &fInfo})
+	}
+	return replay, ch
+}
+
+func (h *eventHub) unsubscribe(ch chan api.FileEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, exists := h.subscribers[ch]; exists {
+		close(ch)
+		delete(h.subscribers, ch)
+	}
+}
+
+// watchFileChanges records the changes of the sync files periodically, or immediately after a file
+// is added or removed.
+func (s *Service) watchFileChanges() {
+	ticker := time.NewTicker(EventCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.eventTrigger:
+		}
+
+		s.lock.RLock()
+		filePathMap := make(map[string]*SyncingFile, len(s.filePathMap))
+		for filePath, sf := range s.filePathMap {
+			filePathMap[filePath] = sf
+		}
+		s.lock.RUnlock()
+
+		fileInfos := make(map[string]api.FileInfo, len(filePathMap))
+		stateCounts := map[string]int{}
+		for filePath, sf := range filePathMap {
+			fInfo := sf.peek()
+			fileInfos[filePath] = fInfo
+			stateCounts[fInfo.State]++
+		}
+		s.events.update(fileInfos)
+		metrics.SetFileCounts(fileStates, stateCounts)
+	}
+}
+
+// validateReadyFiles re-checks the ready files modified on the disk periodically. The event stream only peeks
+// the files, hence the files would not be validated if no client lists or gets them.
+func (s *Service) validateReadyFiles() {
+	ticker := time.NewTicker(ReadyFileValidationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.lock.RLock()
+		syncingFiles := make([]*SyncingFile, 0, len(s.filePathMap))
+		for _, sf := range s.filePathMap {
+			syncingFiles = append(syncingFiles, sf)
+		}
+		s.lock.RUnlock()
+
+		for _, sf := range syncingFiles {
+			if sf.validateReadyFile() {
+				s.triggerFileChangeCheck()
+			}
+		}
+	}
+}
+
+func (s *Service) triggerFileChangeCheck() {
+	select {
+	case s.eventTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// Events streams the changes of the sync files as server-sent events. The client can resume from the
+// last received epoch and revision via the query parameters `epoch` and `revision`, or the header
+// `Last-Event-ID` in the format `<epoch>-<revision>`.
+func (s *Service) Events(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	queryParams := request.URL.Query()
+	epochStr, revisionStr := queryParams.Get("epoch"), queryParams.Get("revision")
+	if revisionStr == "" {
+		if lastEventID := request.Header.Get("Last-Event-ID"); lastEventID != "" {
+			var found bool
+			if epochStr, revisionStr, found = strings.Cut(lastEventID, "-"); !found {
+				http.Error(writer, fmt.Sprintf("invalid last event ID %v", lastEventID), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	var epoch, revision int64
+	if epochStr != "" {
+		var err error
+		if epoch, err = strconv.ParseInt(epochStr, 10, 64); err != nil {
+			http.Error(writer, fmt.Sprintf("invalid epoch %v: %v", epochStr, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if revisionStr != "" {
+		var err error
+		if revision, err = strconv.ParseInt(revisionStr, 10, 64); err != nil {
+			http.Error(writer, fmt.Sprintf("invalid revision %v: %v", revisionStr, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	replay, ch := s.events.subscribe(epoch, revision, revisionStr != "")
+	defer s.events.unsubscribe(ch)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+
+	for _, event := range replay {
+		if err := writeEvent(writer, event); err != nil {
+			s.log.WithError(err).Warn("Sync Service: failed to write event")
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(types.EventKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				s.log.Warn("Sync Service: closed the event stream of a slow subscriber")
+				return
+			}
+			if err := writeEvent(writer, event); err != nil {
+				s.log.WithError(err).Warn("Sync Service: failed to write event")
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(writer io.Writer, event api.FileEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "id: %d-%d\nevent: %s\ndata: %s\n\n", event.Epoch, event.Revision, event.Type, data)
+	return err
+}
@@ -1,6 +1,7 @@
 package sync
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
@@ -9,25 +10,64 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
 )
 
 const (
 	DownloadBufferSize = 1 << 12
+
+	// DownloadCheckpointInterval is the amount of downloaded data between two checkpoints.
+	DownloadCheckpointInterval = 1 << 26
+
+	// downloadProbeSize is large enough to contain the magic bytes of all supported compression types.
+	downloadProbeSize = 8
 )
 
 type ProgressUpdater interface {
 	UpdateProgress(size int64)
 }
 
+// ChecksumUpdater can be implemented by a ProgressUpdater to calculate the checksum during the copy.
+// IdleTimeoutCopy passes all data read from the source in order, including the zero ranges that are
+// skipped rather than written to the destination.
+type ChecksumUpdater interface {
+	UpdateChecksum(data []byte)
+}
+
+// RateLimitedUpdater can be implemented by a ProgressUpdater to limit the throughput of the copy.
+type RateLimitedUpdater interface {
+	GetRateLimiter() *util.RateLimiter
+}
+
+// ProgressRollbacker can be implemented by a ProgressUpdater to take back the progress reported by a download
+// that is abandoned, so that the fallback download starting from the beginning doesn't count the data twice.
+type ProgressRollbacker interface {
+	RollbackProgress(size int64)
+}
+
+// SpaceReservingUpdater can be implemented by a ProgressUpdater to reserve the disk space for the decompressed data,
+// whose size is unknown before the decompression. The copy fails if the reservation fails.
+type SpaceReservingUpdater interface {
+	ReserveSpace(size int64) error
+}
+
+func getRateLimiter(updater ProgressUpdater) *util.RateLimiter {
+	if rateLimitedUpdater, ok := updater.(RateLimitedUpdater); ok {
+		return rateLimitedUpdater.GetRateLimiter()
+	}
+	return nil
+}
+
 type Handler interface {
 	GetSizeFromURL(url string) (fileSize int64, err error)
-	DownloadFromURL(ctx context.Context, url, filePath string, updater ProgressUpdater) (written int64, err error)
+	DownloadFromURL(ctx context.Context, url, filePath string, concurrentLimit int, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error)
 }
 
 type HTTPHandler struct{}
@@ -70,28 +110,111 @@ func (h *HTTPHandler) GetSizeFromURL(url string) (size int64, err error) {
 	return size, nil
 }
 
-func (h *HTTPHandler) DownloadFromURL(ctx context.Context, url, filePath string, updater ProgressUpdater) (written int64, err error) {
+// DownloadFromURL downloads the file to filePath. When concurrentLimit is larger than 1 and the server
+// supports range requests, the file will be split into segments then fetched concurrently.
+// An interrupted download will be resumed from the checkpoint left by the previous call.
+// The compressed content will be decompressed during the download, which is always done via a single stream.
+func (h *HTTPHandler) DownloadFromURL(ctx context.Context, url, filePath string, concurrentLimit int, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
+	if compression != types.CompressionTypeAuto && compression != types.CompressionTypeNone {
+		return downloadStream(ctx, url, filePath, nil, compression, decompressedSizeLimit, updater)
+	}
+
+	checkpoint := loadDownloadCheckpoint(url, filePath)
+	if (checkpoint != nil && len(checkpoint.Segments) > 0) || (checkpoint == nil && concurrentLimit > 1) {
+		written, err = downloadSegments(ctx, url, filePath, concurrentLimit, checkpoint, compression == types.CompressionTypeAuto, updater)
+		if !errors.Is(err, errSegmentedDownloadUnavailable) {
+			return written, err
+		}
+		logrus.Infof("HTTPHandler: cannot do the segmented download from %v, will fall back to a single stream download: %v", url, err)
+		checkpoint = nil
+	}
+
+	return downloadStream(ctx, url, filePath, checkpoint, compression, decompressedSizeLimit, updater)
+}
+
+func downloadStream(ctx context.Context, url, filePath string, checkpoint *util.DownloadCheckpoint, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	rr, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(filePath)
+
+	resp, offset, err := openDownloadStream(ctx, url, checkpoint)
 	if err != nil {
 		return 0, err
 	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
 
-	client := NewDownloadHttpClient()
-	resp, err := client.Do(rr)
+	// The data of a resumed download is not compressed, since there is no checkpoint for the decompression.
+	var body io.ReadCloser = resp.Body
+	if offset == 0 && compression != types.CompressionTypeNone {
+		bufferedBody := bufio.NewReader(resp.Body)
+		body = &readCloser{Reader: bufferedBody, Closer: resp.Body}
+		if compression == types.CompressionTypeAuto {
+			if compression, err = util.DetectCompression(bufferedBody); err != nil {
+				return 0, err
+			}
+		}
+		if compression != types.CompressionTypeNone {
+			return downloadAndDecompress(ctx, cancel, url, filePath, bufferedBody, compression, decompressedSizeLimit, updater)
+		}
+	}
+
+	var outFile *os.File
+	if offset > 0 {
+		logrus.Infof("HTTPHandler: resuming the download from %v at offset %v", url, offset)
+		outFile, err = os.OpenFile(filePath, os.O_RDWR, 0666)
+	} else {
+		outFile, err = os.Create(filePath)
+	}
 	if err != nil {
 		return 0, err
 	}
 	defer func() {
-		if errClose := resp.Body.Close(); errClose != nil {
-			logrus.WithError(errClose).Error("Failed to close response body")
+		if errClose := outFile.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close destination file")
 		}
 	}()
+	if offset > 0 {
+		// Drop the data after the durable offset, and fill the possible skipped zero range before it.
+		if err := outFile.Truncate(offset); err != nil {
+			return 0, errors.Wrapf(err, "failed to truncate the file to the resume offset %v", offset)
+		}
+		if _, err := outFile.Seek(offset, io.SeekStart); err != nil {
+			return 0, errors.Wrapf(err, "failed to seek the file to the resume offset %v", offset)
+		}
+		updater.UpdateProgress(offset)
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("expected status code 200 from %s, got %s", url, resp.Status)
+	newCheckpoint := newDownloadCheckpoint(url, resp)
+	newCheckpoint.Offset = offset
+	checkpointer := newDownloadCheckpointer(newCheckpoint, outFile, checkpointFilePath, updater)
+	defer func() {
+		checkpointer.finish(err)
+	}()
+
+	copied, err := IdleTimeoutCopy(ctx, cancel, body, outFile, checkpointer, false)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := outFile.Truncate(offset + copied); err != nil {
+		return 0, errors.Wrapf(err, "failed to truncate the file after download")
+	}
+
+	return offset + copied, nil
+}
+
+func downloadAndDecompress(ctx context.Context, cancel context.CancelFunc, url, filePath string, src io.Reader, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
+	logrus.Infof("HTTPHandler: decompressing the %v content during the download from %v", compression, url)
+
+	// The partial decompressed data cannot be resumed.
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(filePath)
+	if err := os.RemoveAll(checkpointFilePath); err != nil {
+		return 0, errors.Wrapf(err, "failed to clean up download checkpoint file %v", checkpointFilePath)
 	}
 
 	outFile, err := os.Create(filePath)
@@ -104,20 +227,554 @@ func (h *HTTPHandler) DownloadFromURL(ctx context.Context, url, filePath string,
 		}
 	}()
 
-	copied, err := IdleTimeoutCopy(ctx, cancel, resp.Body, outFile, updater, false)
+	written, err = DecompressionCopy(ctx, cancel, src, outFile, compression, decompressedSizeLimit, updater)
 	if err != nil {
 		return 0, err
 	}
 
-	if err := outFile.Truncate(copied); err != nil {
+	if err := outFile.Truncate(written); err != nil {
 		return 0, errors.Wrapf(err, "failed to truncate the file after download")
 	}
 
-	return copied, nil
+	return written, nil
+}
+
+// errSegmentedDownloadUnavailable indicates that the segmented download cannot be done or continued,
+// e.g. the server does not support range requests, the remote content has been changed, or the
+// content is compressed.
+var errSegmentedDownloadUnavailable = fmt.Errorf("segmented download is unavailable")
+
+func downloadSegments(ctx context.Context, url, filePath string, concurrentLimit int, checkpoint *util.DownloadCheckpoint, detectCompression bool, updater ProgressUpdater) (written int64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(filePath)
+
+	// The data after the durable offset of a resumed segment may be stale,
+	// hence zero data cannot be skipped in this case.
+	resumed := checkpoint != nil
+	var outFile *os.File
+	if resumed {
+		logrus.Infof("HTTPHandler: resuming the segmented download from %v", url)
+		outFile, err = os.OpenFile(filePath, os.O_RDWR, 0666)
+	} else {
+		if checkpoint, err = prepareSegmentedDownload(ctx, url, concurrentLimit, detectCompression); err != nil {
+			return 0, err
+		}
+		outFile, err = os.Create(filePath)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if errClose := outFile.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close destination file")
+		}
+	}()
+	if err := outFile.Truncate(checkpoint.Size); err != nil {
+		return 0, errors.Wrapf(err, "failed to truncate the file to size %v before the segmented download", checkpoint.Size)
+	}
+
+	var pendingSegments []int
+	for i, segment := range checkpoint.Segments {
+		if segment.Offset > segment.Start {
+			updater.UpdateProgress(segment.Offset - segment.Start)
+		}
+		if segment.Offset < segment.End {
+			pendingSegments = append(pendingSegments, i)
+		}
+	}
+
+	checkpointer := newDownloadCheckpointer(checkpoint, outFile, checkpointFilePath, updater)
+	defer func() {
+		checkpointer.finish(err)
+	}()
+
+	segmentCh := make(chan int, len(pendingSegments))
+	for _, i := range pendingSegments {
+		segmentCh <- i
+	}
+	close(segmentCh)
+
+	workers := concurrentLimit
+	if workers > len(pendingSegments) {
+		workers = len(pendingSegments)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var errLock sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range segmentCh {
+				if segmentErr := downloadSegment(ctx, cancel, url, checkpoint, checkpoint.Segments[i], outFile, resumed, checkpointer.segmentUpdater(i)); segmentErr != nil {
+					errLock.Lock()
+					if err == nil {
+						err = segmentErr
+					}
+					errLock.Unlock()
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		if errors.Is(err, errSegmentedDownloadUnavailable) {
+			err = checkpointer.rollbackProgress(err)
+		}
+		return 0, err
+	}
+
+	return checkpoint.Size, nil
+}
+
+// prepareSegmentedDownload probes the range support, the size and the possible compression of
+// the remote content, then splits the content into segments.
+func prepareSegmentedDownload(ctx context.Context, url string, concurrentLimit int, detectCompression bool) (*util.DownloadCheckpoint, error) {
+	resp, err := sendDownloadRequest(ctx, url, fmt.Sprintf("bytes=0-%d", downloadProbeSize-1), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, errors.Wrapf(errSegmentedDownloadUnavailable, "got %s from %v", resp.Status, url)
+	default:
+		return nil, fmt.Errorf("expected status code 206 from %s, got %s", url, resp.Status)
+	}
+
+	checkpoint := newDownloadCheckpoint(url, resp)
+	if checkpoint.Size <= 0 {
+		return nil, errors.Wrapf(errSegmentedDownloadUnavailable, "unknown size in content range %v from %v", resp.Header.Get("Content-Range"), url)
+	}
+	if detectCompression {
+		header, err := io.ReadAll(io.LimitReader(resp.Body, downloadProbeSize))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the header of the content from %v", url)
+		}
+		if compression := util.DetectCompressionFromHeader(header); compression != types.CompressionTypeNone {
+			return nil, errors.Wrapf(errSegmentedDownloadUnavailable, "the content from %v is %v compressed", url, compression)
+		}
+	}
+
+	segmentSize := (checkpoint.Size + int64(concurrentLimit) - 1) / int64(concurrentLimit)
+	segmentSize = (segmentSize + DownloadBufferSize - 1) / DownloadBufferSize * DownloadBufferSize
+	for start := int64(0); start < checkpoint.Size; start += segmentSize {
+		end := start + segmentSize
+		if end > checkpoint.Size {
+			end = checkpoint.Size
+		}
+		checkpoint.Segments = append(checkpoint.Segments, util.DownloadSegment{Start: start, End: end, Offset: start})
+	}
+
+	return checkpoint, nil
+}
+
+func downloadSegment(ctx context.Context, cancel context.CancelFunc, url string, checkpoint *util.DownloadCheckpoint, segment util.DownloadSegment, file *os.File, writeZero bool, updater ProgressUpdater) error {
+	resp, err := sendDownloadRequest(ctx, url, fmt.Sprintf("bytes=%d-%d", segment.Offset, segment.End-1), checkpoint)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return errors.Wrapf(errSegmentedDownloadUnavailable, "got %s from %v for segment [%v, %v)", resp.Status, url, segment.Offset, segment.End)
+	default:
+		return fmt.Errorf("expected status code 206 from %s for segment [%v, %v), got %s", url, segment.Offset, segment.End, resp.Status)
+	}
+	if start, end, _, rangeErr := parseContentRange(resp.Header.Get("Content-Range")); rangeErr != nil || start != segment.Offset || end != segment.End-1 {
+		return errors.Wrapf(errSegmentedDownloadUnavailable, "invalid content range %v from %v for segment [%v, %v)", resp.Header.Get("Content-Range"), url, segment.Offset, segment.End)
+	}
+
+	// The data beyond the segment belongs to the other segments, hence it's never written.
+	expected := segment.End - segment.Offset
+	copied, err := IdleTimeoutCopy(ctx, cancel, &readCloser{Reader: io.LimitReader(resp.Body, expected), Closer: resp.Body}, io.NewOffsetWriter(file, segment.Offset), updater, writeZero)
+	if err != nil {
+		return err
+	}
+	if copied != expected {
+		return fmt.Errorf("expected %v bytes from %v for segment [%v, %v), got %v bytes", expected, url, segment.Offset, segment.End, copied)
+	}
+	if n, _ := io.ReadFull(resp.Body, make([]byte, 1)); n > 0 {
+		return fmt.Errorf("expected %v bytes from %v for segment [%v, %v), got more", expected, url, segment.Offset, segment.End)
+	}
+	return nil
+}
+
+// loadDownloadCheckpoint returns the checkpoint of the previous download to the same file
+// if the download can be resumed. Otherwise, it returns nil.
+func loadDownloadCheckpoint(url, filePath string) *util.DownloadCheckpoint {
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(filePath)
+	checkpoint, err := util.ReadDownloadCheckpoint(checkpointFilePath)
+	if err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			logrus.WithError(err).Warnf("HTTPHandler: failed to read download checkpoint file %v, will download from the beginning", checkpointFilePath)
+		}
+		return nil
+	}
+	if !isDownloadCheckpointValid(url, checkpoint) {
+		logrus.Infof("HTTPHandler: download checkpoint file %v cannot be used for the download from %v, will download from the beginning", checkpointFilePath, url)
+		return nil
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		logrus.WithError(err).Infof("HTTPHandler: cannot find the partial download file %v, will download from the beginning", filePath)
+		return nil
+	}
+	return checkpoint
+}
+
+func isDownloadCheckpointValid(url string, checkpoint *util.DownloadCheckpoint) bool {
+	if checkpoint.URL != url || (checkpoint.ETag == "" && checkpoint.LastModified == "") {
+		return false
+	}
+	if len(checkpoint.Segments) == 0 {
+		return checkpoint.Offset > 0 && (checkpoint.Size <= 0 || checkpoint.Offset <= checkpoint.Size)
+	}
+	if checkpoint.Size <= 0 {
+		return false
+	}
+	for _, segment := range checkpoint.Segments {
+		if segment.Start < 0 || segment.Start > segment.Offset || segment.Offset > segment.End || segment.End > checkpoint.Size {
+			return false
+		}
+	}
+	return true
+}
+
+// openDownloadStream requests the remaining content when there is a valid checkpoint, and returns
+// the offset the response body starts from. It falls back to the full content if the server
+// cannot resume the download, e.g. the range is not supported or the content has been changed.
+func openDownloadStream(ctx context.Context, url string, checkpoint *util.DownloadCheckpoint) (resp *http.Response, offset int64, err error) {
+	if checkpoint != nil {
+		resp, err = sendDownloadRequest(ctx, url, fmt.Sprintf("bytes=%d-", checkpoint.Offset), checkpoint)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			if start, _, _, rangeErr := parseContentRange(resp.Header.Get("Content-Range")); rangeErr == nil && start == checkpoint.Offset {
+				return resp, checkpoint.Offset, nil
+			}
+			logrus.Warnf("HTTPHandler: invalid content range %v in the response from %v, will download from the beginning", resp.Header.Get("Content-Range"), url)
+		case http.StatusOK:
+			logrus.Infof("HTTPHandler: the server of %v does not resume the download, will download from the beginning", url)
+			return resp, 0, nil
+		default:
+			logrus.Warnf("HTTPHandler: failed to resume the download from %v, got %s, will download from the beginning", url, resp.Status)
+		}
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+	}
+
+	resp, err = sendDownloadRequest(ctx, url, "", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if errClose := resp.Body.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close response body")
+		}
+		return nil, 0, fmt.Errorf("expected status code 200 from %s, got %s", url, resp.Status)
+	}
+	return resp, 0, nil
+}
+
+// sendDownloadRequest sends a GET request. If the checkpoint is provided, the range will be
+// returned only when the remote content still matches the validator in the checkpoint.
+func sendDownloadRequest(ctx context.Context, url, byteRange string, checkpoint *util.DownloadCheckpoint) (*http.Response, error) {
+	rr, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		rr.Header.Set("Range", byteRange)
+	}
+	if checkpoint != nil {
+		// Prefer the strong validator. The server will return the full content if it does not match.
+		if checkpoint.ETag != "" {
+			rr.Header.Set("If-Range", checkpoint.ETag)
+		} else if checkpoint.LastModified != "" {
+			rr.Header.Set("If-Range", checkpoint.LastModified)
+		}
+	}
+
+	client := NewDownloadHttpClient()
+	return client.Do(rr)
+}
+
+// parseContentRange parses the header value in format "bytes <start>-<end>/<size>".
+// The size will be -1 if it is unknown.
+func parseContentRange(contentRange string) (start, end, size int64, err error) {
+	var sizeStr string
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &sizeStr); err != nil {
+		return 0, 0, 0, errors.Wrapf(err, "failed to parse content range %v", contentRange)
+	}
+	if start < 0 || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid content range %v", contentRange)
+	}
+	if sizeStr == "*" {
+		return start, end, -1, nil
+	}
+	size, err = strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return 0, 0, 0, errors.Wrapf(err, "failed to parse size in content range %v", contentRange)
+	}
+	return start, end, size, nil
+}
+
+// newDownloadCheckpoint builds a checkpoint without progress based on the validators and the size in the response.
+func newDownloadCheckpoint(url string, resp *http.Response) *util.DownloadCheckpoint {
+	checkpoint := &util.DownloadCheckpoint{
+		URL:          url,
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         -1,
+	}
+	// A weak ETag cannot be used in If-Range.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		checkpoint.ETag = etag
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		if _, _, size, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil {
+			checkpoint.Size = size
+		}
+	} else if resp.ContentLength >= 0 {
+		checkpoint.Size = resp.ContentLength
+	}
+	return checkpoint
+}
+
+// downloadCheckpointer wraps the progress updater of a download and periodically persists
+// the offsets of the data that has been flushed to the disk.
+type downloadCheckpointer struct {
+	lock               sync.Mutex
+	updater            ProgressUpdater
+	file               *os.File
+	checkpointFilePath string
+	checkpoint         util.DownloadCheckpoint
+	unsaved            int64
+
+	// checksumUpdater is set only for a single stream download starting from the beginning of the file.
+	checksumUpdater ChecksumUpdater
+	// abandoned means the segmented download cannot be continued, hence the checkpoint is useless.
+	abandoned bool
+}
+
+func newDownloadCheckpointer(checkpoint *util.DownloadCheckpoint, file *os.File, checkpointFilePath string, updater ProgressUpdater) *downloadCheckpointer {
+	dc := &downloadCheckpointer{
+		updater:            updater,
+		file:               file,
+		checkpointFilePath: checkpointFilePath,
+		checkpoint:         *checkpoint,
+	}
+	if checkpoint.Offset == 0 && len(checkpoint.Segments) == 0 {
+		dc.checksumUpdater, _ = updater.(ChecksumUpdater)
+	}
+	return dc
+}
+
+// UpdateProgress records the progress of a single stream download.
+func (dc *downloadCheckpointer) UpdateProgress(size int64) {
+	dc.updateProgress(&dc.checkpoint.Offset, size)
+}
+
+func (dc *downloadCheckpointer) UpdateChecksum(data []byte) {
+	if dc.checksumUpdater != nil {
+		dc.checksumUpdater.UpdateChecksum(data)
+	}
+}
+
+func (dc *downloadCheckpointer) GetRateLimiter() *util.RateLimiter {
+	return getRateLimiter(dc.updater)
+}
+
+type segmentProgressUpdater struct {
+	dc    *downloadCheckpointer
+	index int
+}
+
+func (u *segmentProgressUpdater) UpdateProgress(size int64) {
+	u.dc.updateProgress(&u.dc.checkpoint.Segments[u.index].Offset, size)
+}
+
+// GetRateLimiter returns the limiter shared by all segments.
+func (u *segmentProgressUpdater) GetRateLimiter() *util.RateLimiter {
+	return u.dc.GetRateLimiter()
+}
+
+func (dc *downloadCheckpointer) segmentUpdater(index int) ProgressUpdater {
+	return &segmentProgressUpdater{dc: dc, index: index}
+}
+
+func (dc *downloadCheckpointer) updateProgress(offset *int64, size int64) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.updater.UpdateProgress(size)
+	*offset += size
+	dc.unsaved += size
+	if dc.unsaved < DownloadCheckpointInterval {
+		return
+	}
+	if err := dc.saveNoLock(); err != nil {
+		logrus.WithError(err).Warnf("HTTPHandler: failed to save download checkpoint file %v", dc.checkpointFilePath)
+	}
+}
+
+// finish cleans up the checkpoint file after a successful download, or records the progress
+// so that the next download can continue from here.
+func (dc *downloadCheckpointer) finish(err error) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if err == nil || dc.abandoned || errors.Is(err, errSegmentedDownloadUnavailable) {
+		if rmErr := os.RemoveAll(dc.checkpointFilePath); rmErr != nil {
+			logrus.WithError(rmErr).Warnf("HTTPHandler: failed to clean up download checkpoint file %v", dc.checkpointFilePath)
+		}
+		return
+	}
+	if saveErr := dc.saveNoLock(); saveErr != nil {
+		logrus.WithError(saveErr).Warnf("HTTPHandler: failed to save download checkpoint file %v", dc.checkpointFilePath)
+	}
+}
+
+// rollbackProgress takes back the progress reported by the segmented download before falling back to
+// a single stream download. The fallback is impossible if the updater cannot roll back the progress.
+func (dc *downloadCheckpointer) rollbackProgress(err error) error {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	reported := int64(0)
+	for _, segment := range dc.checkpoint.Segments {
+		reported += segment.Offset - segment.Start
+	}
+	if reported == 0 {
+		return err
+	}
+	rollbacker, ok := dc.updater.(ProgressRollbacker)
+	if !ok {
+		dc.abandoned = true
+		return fmt.Errorf("cannot fall back to a single stream download after reporting the progress %v of the segmented download: %v", reported, err)
+	}
+	rollbacker.RollbackProgress(reported)
+	return err
+}
+
+func (dc *downloadCheckpointer) saveNoLock() error {
+	dc.unsaved = 0
+	// Without a validator, there is no way to tell if the remote content is changed before resuming.
+	if !dc.hasProgressNoLock() || (dc.checkpoint.ETag == "" && dc.checkpoint.LastModified == "") {
+		return os.RemoveAll(dc.checkpointFilePath)
+	}
+	if err := dc.file.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync the file before saving the checkpoint")
+	}
+	return util.WriteDownloadCheckpoint(dc.checkpointFilePath, &dc.checkpoint)
+}
+
+func (dc *downloadCheckpointer) hasProgressNoLock() bool {
+	if dc.checkpoint.Offset > 0 {
+		return true
+	}
+	for _, segment := range dc.checkpoint.Segments {
+		if segment.Offset > segment.Start {
+			return true
+		}
+	}
+	return false
+}
+
+// DecompressionCopy decompresses the data from src then copies it to dst via IdleTimeoutCopy.
+// The progress is updated based on the compressed data read from src rather than the data written to dst,
+// while the checksum is calculated with the decompressed data. The rate limit applies to the compressed data as well.
+func DecompressionCopy(ctx context.Context, cancel context.CancelFunc, src io.Reader, dst io.WriteSeeker, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
+	compressedSrc := &progressReader{reader: util.NewRateLimitedReader(ctx, src, getRateLimiter(updater)), updater: updater}
+	reader, err := util.NewDecompressionReader(compressedSrc, compression, decompressedSizeLimit)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if errClose := reader.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close %v reader", compression)
+		}
+	}()
+
+	decompressedUpdater := &decompressedDataUpdater{}
+	decompressedUpdater.checksumUpdater, _ = updater.(ChecksumUpdater)
+	if spaceReservingUpdater, ok := updater.(SpaceReservingUpdater); ok {
+		dst = util.NewSpaceReservingWriteSeeker(dst, spaceReservingUpdater.ReserveSpace, decompressedSizeLimit)
+	}
+	written, err = IdleTimeoutCopy(ctx, cancel, reader, dst, decompressedUpdater, false)
+	if err != nil {
+		return 0, err
+	}
+
+	// The decompressor may stop before the end of the source, e.g. there is padding after the compressed stream.
+	// Consume the rest so that the progress can reach the end.
+	if _, err := io.Copy(io.Discard, compressedSrc); err != nil {
+		return 0, errors.Wrapf(err, "failed to read the remaining %v compressed data", compression)
+	}
+
+	return written, nil
+}
+
+// progressReader updates the progress based on the data read from the source.
+type progressReader struct {
+	reader  io.Reader
+	updater ProgressUpdater
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.updater.UpdateProgress(int64(n))
+	}
+	return n, err
+}
+
+// decompressedDataUpdater skips the progress of the decompressed data, and passes the data to the checksum calculation.
+type decompressedDataUpdater struct {
+	checksumUpdater ChecksumUpdater
+}
+
+func (u *decompressedDataUpdater) UpdateProgress(size int64) {}
+
+func (u *decompressedDataUpdater) UpdateChecksum(data []byte) {
+	if u.checksumUpdater != nil {
+		u.checksumUpdater.UpdateChecksum(data)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
 
 // IdleTimeoutCopy relies on ctx of the reader/src or a separate timer to interrupt the processing.
+// If updater is a ChecksumUpdater as well, the data will be passed to it after being handled.
+// If updater is a RateLimitedUpdater as well, the copy waits for its rate limiter before handling the data.
 func IdleTimeoutCopy(ctx context.Context, cancel context.CancelFunc, src io.ReadCloser, dst io.WriteSeeker, updater ProgressUpdater, writeZero bool) (copied int64, err error) {
+	checksumUpdater, _ := updater.(ChecksumUpdater)
+	limiter := getRateLimiter(updater)
+
 	writeSeekCh := make(chan int64, 100)
 	defer close(writeSeekCh)
 
@@ -164,6 +821,10 @@ func IdleTimeoutCopy(ctx context.Context, cancel context.CancelFunc, src io.Read
 			// Read will error out once the context is cancelled.
 			nr, rErr = src.Read(buf)
 			if nr > 0 {
+				if handleErr = limiter.WaitN(ctx, nr); handleErr != nil {
+					err = handleErr
+					break
+				}
 				// Skip writing zero data
 				if !writeZero && bytes.Equal(buf[0:nr], zeroByteArray[0:nr]) {
 					_, handleErr = dst.Seek(int64(nr), io.SeekCurrent)
@@ -176,6 +837,9 @@ func IdleTimeoutCopy(ctx context.Context, cancel context.CancelFunc, src io.Read
 					err = handleErr
 					break
 				}
+				if checksumUpdater != nil {
+					checksumUpdater.UpdateChecksum(buf[0:nws])
+				}
 				writeSeekCh <- nws
 				copied += nws
 				updater.UpdateProgress(nws)
@@ -222,7 +886,7 @@ type MockHandler struct{}
 func (mh *MockHandler) GetSizeFromURL(url string) (fileSize int64, err error) {
 	return MockFileSize, nil
 }
-func (mh *MockHandler) DownloadFromURL(ctx context.Context, url, filePath string, updater ProgressUpdater) (written int64, err error) {
+func (mh *MockHandler) DownloadFromURL(ctx context.Context, url, filePath string, concurrentLimit int, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
 	return mh.mockFile(ctx, filePath, updater)
 }
 
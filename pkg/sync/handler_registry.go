@@ -0,0 +1,281 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+const (
+	URLSchemeHTTP   = "http"
+	URLSchemeHTTPS  = "https"
+	URLSchemeFile   = "file"
+	URLSchemeS3     = "s3"
+	URLSchemeAZBlob = "azblob"
+	URLSchemeNFS    = "nfs"
+)
+
+// HandlerRegistry dispatches the requests to the handler registered for the scheme of the URL.
+type HandlerRegistry struct {
+	lock     sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewHandlerRegistry returns a registry containing the built-in handlers. The file URLs can only refer to
+// the files under fileURLRoots, and are refused if there is no root.
+func NewHandlerRegistry(fileURLRoots []string) (*HandlerRegistry, error) {
+	fileHandler, err := NewFileHandler(fileURLRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &HandlerRegistry{
+		handlers: map[string]Handler{},
+	}
+
+	httpHandler := &HTTPHandler{}
+	r.Register(URLSchemeHTTP, httpHandler)
+	r.Register(URLSchemeHTTPS, httpHandler)
+	r.Register(URLSchemeFile, fileHandler)
+	backupStoreHandler := &BackupStoreHandler{}
+	r.Register(URLSchemeS3, backupStoreHandler)
+	r.Register(URLSchemeAZBlob, backupStoreHandler)
+	r.Register(URLSchemeNFS, backupStoreHandler)
+
+	return r, nil
+}
+
+// Register adds or replaces the handler for the scheme.
+func (r *HandlerRegistry) Register(scheme string, handler Handler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handlers[strings.ToLower(scheme)] = handler
+}
+
+func (r *HandlerRegistry) GetHandler(rawURL string) (Handler, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse URL %v", rawURL)
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	handler, exists := r.handlers[strings.ToLower(u.Scheme)]
+	if !exists {
+		return nil, fmt.Errorf("no handler for the scheme %q of URL %v", u.Scheme, rawURL)
+	}
+	return handler, nil
+}
+
+func (r *HandlerRegistry) GetSizeFromURL(url string) (fileSize int64, err error) {
+	handler, err := r.GetHandler(url)
+	if err != nil {
+		return 0, err
+	}
+	return handler.GetSizeFromURL(url)
+}
+
+func (r *HandlerRegistry) DownloadFromURL(ctx context.Context, url, filePath string, concurrentLimit int, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
+	handler, err := r.GetHandler(url)
+	if err != nil {
+		return 0, err
+	}
+	return handler.DownloadFromURL(ctx, url, filePath, concurrentLimit, compression, decompressedSizeLimit, updater)
+}
+
+// URLChecker can be implemented by a Handler to refuse the URLs out of its confinement before the download starts.
+type URLChecker interface {
+	CheckURL(url string) error
+}
+
+// CheckURL checks the URL via the handler registered for its scheme if the handler is a URLChecker.
+func (r *HandlerRegistry) CheckURL(url string) error {
+	handler, err := r.GetHandler(url)
+	if err != nil {
+		return err
+	}
+	if checker, ok := handler.(URLChecker); ok {
+		return checker.CheckURL(url)
+	}
+	return nil
+}
+
+// FileHandler copies the file mounted on the host, e.g. file:///mnt/images/image.qcow2.
+// The file should be under one of the roots, otherwise the URL is refused.
+type FileHandler struct {
+	roots *PathConfinement
+}
+
+// NewFileHandler returns a handler refusing all file URLs if there is no root.
+func NewFileHandler(roots []string) (*FileHandler, error) {
+	confinement, err := NewPathConfinement(roots)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid file URL roots")
+	}
+	return &FileHandler{roots: confinement}, nil
+}
+
+// getLocalFilePath returns the cleaned path of the URL after confining it to the roots.
+func (h *FileHandler) getLocalFilePath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse URL %v", rawURL)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL %v must refer to a local path", rawURL)
+	}
+	if u.Path == "" {
+		return "", fmt.Errorf("no file path in URL %v", rawURL)
+	}
+	// The nil confinement allows all paths, hence it has to be checked here.
+	if h.roots == nil {
+		return "", fmt.Errorf("%w: file URL %v is disabled since there is no allowed root for the file URLs", ErrPathNotAllowed, rawURL)
+	}
+	return h.roots.Check(u.Path)
+}
+
+func (h *FileHandler) CheckURL(url string) error {
+	_, err := h.getLocalFilePath(url)
+	return err
+}
+
+func (h *FileHandler) GetSizeFromURL(url string) (size int64, err error) {
+	filePath, err := h.getLocalFilePath(url)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("%v is not a regular file", filePath)
+	}
+	return info.Size(), nil
+}
+
+func (h *FileHandler) DownloadFromURL(ctx context.Context, url, filePath string, concurrentLimit int, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
+	srcFilePath, err := h.getLocalFilePath(url)
+	if err != nil {
+		return 0, err
+	}
+	src, err := os.Open(srcFilePath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if errClose := src.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close source file %v", srcFilePath)
+		}
+	}()
+
+	return downloadFromReader(ctx, src, filePath, compression, decompressedSizeLimit, updater)
+}
+
+// BackupStoreHandler downloads the file via the backupstore drivers, e.g. s3://bucket@region/path/image.qcow2,
+// azblob://container@endpoint/path/image.qcow2, or nfs://server:/path/image.qcow2.
+// The credential is retrieved from the environment variables, which is the same as the backup restore.
+type BackupStoreHandler struct{}
+
+func getBackupStoreDriver(rawURL string) (backupstore.BackupStoreDriver, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to parse URL %v", rawURL)
+	}
+	dir, name := path.Split(u.Path)
+	if name == "" {
+		return nil, "", fmt.Errorf("no file name in URL %v", rawURL)
+	}
+
+	// The driver works on the directory containing the file.
+	driverURL := *u
+	driverURL.Path = dir
+	driver, err := backupstore.GetBackupStoreDriver(driverURL.String())
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to get backupstore driver for %v", driverURL.String())
+	}
+	return driver, name, nil
+}
+
+func (h *BackupStoreHandler) GetSizeFromURL(url string) (size int64, err error) {
+	driver, name, err := getBackupStoreDriver(url)
+	if err != nil {
+		return 0, err
+	}
+	size = driver.FileSize(name)
+	if size < 0 {
+		return 0, fmt.Errorf("failed to get the size of %v in %v", name, driver.GetURL())
+	}
+	return size, nil
+}
+
+func (h *BackupStoreHandler) DownloadFromURL(ctx context.Context, url, filePath string, concurrentLimit int, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
+	driver, name, err := getBackupStoreDriver(url)
+	if err != nil {
+		return 0, err
+	}
+	src, err := driver.Read(name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read %v in %v", name, driver.GetURL())
+	}
+	defer func() {
+		if errClose := src.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close %v in %v", name, driver.GetURL())
+		}
+	}()
+
+	return downloadFromReader(ctx, src, filePath, compression, decompressedSizeLimit, updater)
+}
+
+// downloadFromReader copies the content of src to filePath via a single stream,
+// and decompresses the content if necessary.
+func downloadFromReader(ctx context.Context, src io.ReadCloser, filePath string, compression types.CompressionType, decompressedSizeLimit int64, updater ProgressUpdater) (written int64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	bufferedSrc := bufio.NewReader(src)
+	if compression == types.CompressionTypeAuto {
+		if compression, err = util.DetectCompression(bufferedSrc); err != nil {
+			return 0, err
+		}
+	}
+
+	outFile, err := os.Create(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if errClose := outFile.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close destination file")
+		}
+	}()
+
+	if compression == types.CompressionTypeNone {
+		written, err = IdleTimeoutCopy(ctx, cancel, &readCloser{Reader: bufferedSrc, Closer: src}, outFile, updater, false)
+	} else {
+		written, err = DecompressionCopy(ctx, cancel, bufferedSrc, outFile, compression, decompressedSizeLimit, updater)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := outFile.Truncate(written); err != nil {
+		return 0, errors.Wrapf(err, "failed to truncate the file after download")
+	}
+
+	return written, nil
+}
@@ -1,8 +1,30 @@
 package sync
 
 import (
-	. "gopkg.in/check.v1"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+
+	. "gopkg.in/check.v1"
 )
 
 type TestSuite struct{}
@@ -18,3 +40,572 @@ func (s *TestSuite) TestRemoveReferer(c *C) {
 	c.Assert(req.Referer(), Equals, "")
 	c.Assert(req.Header, HasLen, 1)
 }
+
+type testProgressUpdater struct {
+	processed int64
+}
+
+func (u *testProgressUpdater) UpdateProgress(size int64) {
+	u.processed += size
+}
+
+// testChecksumUpdater calculates the checksum of the data passed by the copy.
+type testChecksumUpdater struct {
+	testProgressUpdater
+	hash hash.Hash
+}
+
+func newTestChecksumUpdater() *testChecksumUpdater {
+	return &testChecksumUpdater{hash: sha512.New()}
+}
+
+func (u *testChecksumUpdater) UpdateChecksum(data []byte) {
+	_, _ = u.hash.Write(data)
+}
+
+// brokenReadSeeker fails the read after the limit is reached, which interrupts the response.
+type brokenReadSeeker struct {
+	io.ReadSeeker
+	limit int64
+}
+
+func (r *brokenReadSeeker) Read(p []byte) (int, error) {
+	if r.limit <= 0 {
+		return 0, fmt.Errorf("broken reader")
+	}
+	if int64(len(p)) > r.limit {
+		p = p[:r.limit]
+	}
+	n, err := r.ReadSeeker.Read(p)
+	r.limit -= int64(n)
+	return n, err
+}
+
+func (s *TestSuite) TestDownloadFromURLResume(c *C) {
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+
+	lock := gosync.Mutex{}
+	var rangeHeaders []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		rangeHeaders = append(rangeHeaders, r.Header.Get("Range"))
+		isFirstRequest := len(rangeHeaders) == 1
+		lock.Unlock()
+
+		var reader io.ReadSeeker = bytes.NewReader(content)
+		if isFirstRequest {
+			reader = &brokenReadSeeker{ReadSeeker: reader, limit: 300 << 10}
+		}
+		w.Header().Set("ETag", `"test-etag"`)
+		http.ServeContent(w, r, "", time.Now(), reader)
+	}))
+	defer server.Close()
+
+	dir := c.MkDir()
+	filePath := filepath.Join(dir, "download-resume")
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(filePath)
+	h := &HTTPHandler{}
+
+	_, err = h.DownloadFromURL(context.Background(), server.URL, filePath, 1, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, &testProgressUpdater{})
+	c.Assert(err, NotNil)
+	checkpoint, err := util.ReadDownloadCheckpoint(checkpointFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(checkpoint.URL, Equals, server.URL)
+	c.Assert(checkpoint.ETag, Equals, `"test-etag"`)
+	c.Assert(checkpoint.Size, Equals, int64(len(content)))
+	c.Assert(checkpoint.Offset > 0, Equals, true)
+	c.Assert(checkpoint.Offset <= 300<<10, Equals, true)
+
+	updater := &testProgressUpdater{}
+	written, err := h.DownloadFromURL(context.Background(), server.URL, filePath, 1, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, updater)
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, int64(len(content)))
+	c.Assert(updater.processed, Equals, int64(len(content)))
+	c.Assert(rangeHeaders, DeepEquals, []string{"", fmt.Sprintf("bytes=%d-", checkpoint.Offset)})
+
+	downloaded, err := os.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(downloaded, content), Equals, true)
+	_, err = os.Stat(checkpointFilePath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestSuite) TestDownloadFromURLResumeFallback(c *C) {
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+
+	// The server ignores the range request and always returns the full content.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"test-etag"`)
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	dir := c.MkDir()
+	filePath := filepath.Join(dir, "download-resume-fallback")
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(filePath)
+	c.Assert(os.WriteFile(filePath, bytes.Repeat([]byte{1}, 4096), 0666), IsNil)
+	c.Assert(util.WriteDownloadCheckpoint(checkpointFilePath, &util.DownloadCheckpoint{
+		URL:    server.URL,
+		ETag:   `"test-etag"`,
+		Size:   int64(len(content)),
+		Offset: 4096,
+	}), IsNil)
+
+	updater := &testProgressUpdater{}
+	written, err := (&HTTPHandler{}).DownloadFromURL(context.Background(), server.URL, filePath, 1, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, updater)
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, int64(len(content)))
+	c.Assert(updater.processed, Equals, int64(len(content)))
+
+	downloaded, err := os.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(downloaded, content), Equals, true)
+	_, err = os.Stat(checkpointFilePath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestSuite) TestDownloadFromURLSegments(c *C) {
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+
+	lock := gosync.Mutex{}
+	broken := true
+	var rangeHeaders []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		rangeHeaders = append(rangeHeaders, r.Header.Get("Range"))
+		isBroken := broken
+		lock.Unlock()
+
+		var reader io.ReadSeeker = bytes.NewReader(content)
+		if isBroken && r.Header.Get("Range") != "bytes=0-7" {
+			reader = &brokenReadSeeker{ReadSeeker: reader, limit: 100 << 10}
+		}
+		w.Header().Set("ETag", `"test-etag"`)
+		http.ServeContent(w, r, "", time.Now(), reader)
+	}))
+	defer server.Close()
+
+	dir := c.MkDir()
+	filePath := filepath.Join(dir, "download-segments")
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(filePath)
+	h := &HTTPHandler{}
+
+	// All segments are interrupted in the middle.
+	_, err = h.DownloadFromURL(context.Background(), server.URL, filePath, 4, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, &testProgressUpdater{})
+	c.Assert(err, NotNil)
+	checkpoint, err := util.ReadDownloadCheckpoint(checkpointFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(checkpoint.Size, Equals, int64(len(content)))
+	c.Assert(checkpoint.Segments, HasLen, 4)
+	c.Assert(rangeHeaders[0], Equals, "bytes=0-7")
+
+	lock.Lock()
+	broken = false
+	rangeHeaders = nil
+	lock.Unlock()
+
+	updater := &testProgressUpdater{}
+	written, err := h.DownloadFromURL(context.Background(), server.URL, filePath, 4, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, updater)
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, int64(len(content)))
+	c.Assert(updater.processed, Equals, int64(len(content)))
+	// Only the remaining part of each segment is requested.
+	resumedSegmentCount := 0
+	expectedRangeHeaders := map[string]bool{}
+	for _, segment := range checkpoint.Segments {
+		if segment.Offset > segment.Start {
+			resumedSegmentCount++
+		}
+		expectedRangeHeaders[fmt.Sprintf("bytes=%d-%d", segment.Offset, segment.End-1)] = true
+	}
+	c.Assert(resumedSegmentCount > 0, Equals, true)
+	// A request cancelled in the first round may arrive at the server late.
+	requestedRanges := map[string]bool{}
+	lock.Lock()
+	for _, rangeHeader := range rangeHeaders {
+		requestedRanges[rangeHeader] = true
+	}
+	lock.Unlock()
+	c.Assert(requestedRanges, DeepEquals, expectedRangeHeaders)
+
+	downloaded, err := os.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(downloaded, content), Equals, true)
+	_, err = os.Stat(checkpointFilePath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestSuite) TestDownloadFromURLSegmentsFallback(c *C) {
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+
+	// The server ignores the range request and always returns the full content.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	filePath := filepath.Join(c.MkDir(), "download-segments-fallback")
+	updater := &testProgressUpdater{}
+	written, err := (&HTTPHandler{}).DownloadFromURL(context.Background(), server.URL, filePath, 4, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, updater)
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, int64(len(content)))
+	c.Assert(updater.processed, Equals, int64(len(content)))
+
+	downloaded, err := os.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(downloaded, content), Equals, true)
+}
+
+func (s *TestSuite) TestDownloadFromURLSegmentsInvalidRange(c *C) {
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+
+	// The server answers the range requests of the segments with a shorter range, or with more data than the range.
+	overrun := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || end == 7 {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		data := content[start : end+1]
+		if overrun {
+			data = append(append([]byte{}, data...), bytes.Repeat([]byte{0xff}, 10)...)
+		} else {
+			end = (start + end) / 2
+			data = content[start : end+1]
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	// The shorter range fails the segmented download, then the download falls back to a single stream.
+	filePath := filepath.Join(c.MkDir(), "download-segments-invalid-range")
+	updater := &testProgressUpdater{}
+	written, err := (&HTTPHandler{}).DownloadFromURL(context.Background(), server.URL, filePath, 4, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, updater)
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, int64(len(content)))
+	downloaded, err := os.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(downloaded, content), Equals, true)
+
+	// The data beyond the segment is detected rather than written.
+	overrun = true
+	filePath = filepath.Join(c.MkDir(), "download-segments-overrun")
+	_, err = (&HTTPHandler{}).DownloadFromURL(context.Background(), server.URL, filePath, 4, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, &testProgressUpdater{})
+	c.Assert(err, ErrorMatches, "(?s).*got more.*")
+	downloaded, err = os.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(downloaded, bytes.Repeat([]byte{0xff}, 10)), Equals, false)
+}
+
+// testRollbackUpdater can take back the progress, and closes progressed once any progress is reported.
+type testRollbackUpdater struct {
+	lock       gosync.Mutex
+	processed  int64
+	rolledBack int64
+	progressed chan struct{}
+}
+
+func (u *testRollbackUpdater) UpdateProgress(size int64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.processed == 0 && u.rolledBack == 0 && size > 0 {
+		close(u.progressed)
+	}
+	u.processed += size
+}
+
+func (u *testRollbackUpdater) RollbackProgress(size int64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.processed -= size
+	u.rolledBack += size
+}
+
+func (s *TestSuite) TestDownloadFromURLSegmentsFallbackAfterProgress(c *C) {
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+
+	// The server supports the range requests for the probe and the first segment only. It ignores the range
+	// of the other segments and returns the full content after the first segment has reported some progress.
+	lock := gosync.Mutex{}
+	var progressed chan struct{}
+	modTime := time.Now()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader := r.Header.Get("Range")
+		if rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-") {
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
+			return
+		}
+		lock.Lock()
+		segmentProgressed := progressed
+		lock.Unlock()
+		select {
+		case <-segmentProgressed:
+		case <-time.After(10 * time.Second):
+		}
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	dir := c.MkDir()
+	h := &HTTPHandler{}
+
+	lock.Lock()
+	progressed = make(chan struct{})
+	updater := &testRollbackUpdater{progressed: progressed}
+	lock.Unlock()
+	filePath := filepath.Join(dir, "download-segments-fallback-after-progress")
+	written, err := h.DownloadFromURL(context.Background(), server.URL, filePath, 4, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, updater)
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, int64(len(content)))
+	c.Assert(updater.rolledBack > 0, Equals, true)
+	c.Assert(updater.processed, Equals, int64(len(content)))
+	downloaded, err := os.ReadFile(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(downloaded, content), Equals, true)
+
+	// Without the rollback, the progress would exceed the size after the fallback.
+	// testProgressUpdater cannot tell the progress, hence the server waits for a while instead.
+	lock.Lock()
+	progressed = make(chan struct{})
+	time.AfterFunc(500*time.Millisecond, func() { close(progressed) })
+	lock.Unlock()
+	filePath = filepath.Join(dir, "download-segments-no-rollback")
+	noRollbackUpdater := &testProgressUpdater{}
+	_, err = h.DownloadFromURL(context.Background(), server.URL, filePath, 4, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, noRollbackUpdater)
+	c.Assert(err, ErrorMatches, "cannot fall back to a single stream download.*")
+	_, err = os.Stat(util.GetDownloadCheckpointFilePath(filePath))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+// testBzip2Data is "longhorn" repeated 512 times compressed by bzip2,
+// since there is no bzip2 writer in the standard library.
+var testBzip2Data = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x1b, 0x37, 0x88, 0xa0, 0x00, 0x02,
+	0xff, 0x81, 0x80, 0x00, 0xc5, 0x90, 0x00, 0x20, 0x00, 0x50, 0x60, 0x01, 0x54, 0x0d, 0x34, 0x01,
+	0x60, 0x0b, 0x00, 0x70, 0x02, 0x00, 0x20, 0x02, 0x00, 0x34, 0x01, 0xe2, 0xee, 0x48, 0xa7, 0x0a,
+	0x12, 0x03, 0x66, 0xf1, 0x14, 0x00,
+}
+
+func compressTestData(c *C, compression types.CompressionType, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case types.CompressionTypeGzip:
+		w = gzip.NewWriter(buf)
+	case types.CompressionTypeXz:
+		w, err = xz.NewWriter(buf)
+	case types.CompressionTypeZstd:
+		w, err = zstd.NewWriter(buf)
+	default:
+		c.Fatalf("unsupported compression type %v for the test", compression)
+	}
+	c.Assert(err, IsNil)
+	_, err = w.Write(data)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	return buf.Bytes()
+}
+
+func (s *TestSuite) TestDownloadFromURLDecompression(c *C) {
+	content := bytes.Repeat([]byte("longhorn"), 512)
+	sources := map[types.CompressionType][]byte{
+		types.CompressionTypeNone:  content,
+		types.CompressionTypeGzip:  compressTestData(c, types.CompressionTypeGzip, content),
+		types.CompressionTypeXz:    compressTestData(c, types.CompressionTypeXz, content),
+		types.CompressionTypeZstd:  compressTestData(c, types.CompressionTypeZstd, content),
+		types.CompressionTypeBzip2: testBzip2Data,
+	}
+
+	dir := c.MkDir()
+	for compression, data := range sources {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}))
+
+		// The compression is detected by the magic bytes, or specified explicitly.
+		for _, compressionParameter := range []types.CompressionType{types.CompressionTypeAuto, compression} {
+			for _, concurrentLimit := range []int{1, 4} {
+				filePath := filepath.Join(dir, fmt.Sprintf("download-%v-%v-%d", compression, compressionParameter, concurrentLimit))
+				updater := &testProgressUpdater{}
+				written, err := (&HTTPHandler{}).DownloadFromURL(context.Background(), server.URL, filePath, concurrentLimit, compressionParameter, types.DefaultDecompressedSizeLimit, updater)
+				c.Assert(err, IsNil)
+				c.Assert(written, Equals, int64(len(content)))
+				// The progress is based on the compressed data.
+				c.Assert(updater.processed, Equals, int64(len(data)))
+
+				downloaded, err := os.ReadFile(filePath)
+				c.Assert(err, IsNil)
+				c.Assert(bytes.Equal(downloaded, content), Equals, true)
+			}
+		}
+
+		server.Close()
+	}
+}
+
+func (s *TestSuite) TestDownloadFromURLDecompressedSizeLimit(c *C) {
+	data := compressTestData(c, types.CompressionTypeGzip, make([]byte, 1<<20))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	filePath := filepath.Join(c.MkDir(), "download-size-limit")
+	_, err := (&HTTPHandler{}).DownloadFromURL(context.Background(), server.URL, filePath, 1, types.CompressionTypeAuto, 64<<10, &testProgressUpdater{})
+	c.Assert(err, ErrorMatches, ".*exceeds the size limit.*")
+}
+
+func (s *TestSuite) TestHandlerRegistry(c *C) {
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+	compressedContent := compressTestData(c, types.CompressionTypeGzip, content)
+
+	srcDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(srcDir, "image.raw"), content, 0666), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(srcDir, "image.raw.gz"), compressedContent, 0666), IsNil)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer server.Close()
+
+	r, err := NewHandlerRegistry([]string{srcDir})
+	c.Assert(err, IsNil)
+	for url, expected := range map[string]Handler{
+		"http://foo.bar/image.raw":          &HTTPHandler{},
+		"HTTPS://foo.bar/image.raw":         &HTTPHandler{},
+		"file:///mnt/image.raw":             &FileHandler{},
+		"s3://bucket@region/path/image.raw": &BackupStoreHandler{},
+		"azblob://container/path/image.raw": &BackupStoreHandler{},
+		"nfs://server:/path/image.raw":      &BackupStoreHandler{},
+	} {
+		handler, err := r.GetHandler(url)
+		c.Assert(err, IsNil)
+		c.Assert(handler, FitsTypeOf, expected)
+	}
+	_, err = r.GetHandler("ftp://foo.bar/image.raw")
+	c.Assert(err, ErrorMatches, "no handler for the scheme.*")
+
+	// The local backupstore driver stands in for the object stores and the file shares.
+	r.Register("vfs", &BackupStoreHandler{})
+
+	dstDir := c.MkDir()
+	for i, url := range []string{
+		server.URL + "/image.raw",
+		server.URL + "/image.raw.gz",
+		"file://" + filepath.Join(srcDir, "image.raw"),
+		"file://" + filepath.Join(srcDir, "image.raw.gz"),
+		"vfs://" + filepath.Join(srcDir, "image.raw"),
+		"vfs://" + filepath.Join(srcDir, "image.raw.gz"),
+	} {
+		size, err := r.GetSizeFromURL(url)
+		c.Assert(err, IsNil)
+
+		filePath := filepath.Join(dstDir, fmt.Sprintf("download-%d", i))
+		updater := &testProgressUpdater{}
+		written, err := r.DownloadFromURL(context.Background(), url, filePath, 1, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, updater)
+		c.Assert(err, IsNil)
+		c.Assert(written, Equals, int64(len(content)))
+		c.Assert(updater.processed, Equals, size)
+
+		downloaded, err := os.ReadFile(filePath)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(downloaded, content), Equals, true)
+	}
+
+	_, err = r.GetSizeFromURL("file://" + filepath.Join(srcDir, "nonexistent"))
+	c.Assert(err, NotNil)
+	_, err = r.GetSizeFromURL("vfs://" + filepath.Join(srcDir, "nonexistent"))
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestFileHandlerRoots(c *C) {
+	rootDir := c.MkDir()
+	outsideDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "image.raw"), []byte("inside"), 0666), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(outsideDir, "image.raw"), []byte("outside"), 0666), IsNil)
+	c.Assert(os.Symlink(filepath.Join(outsideDir, "image.raw"), filepath.Join(rootDir, "link.raw")), IsNil)
+	c.Assert(os.Symlink(outsideDir, filepath.Join(rootDir, "link")), IsNil)
+
+	h, err := NewFileHandler([]string{rootDir})
+	c.Assert(err, IsNil)
+	size, err := h.GetSizeFromURL("file://" + filepath.Join(rootDir, "image.raw"))
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(len("inside")))
+
+	for _, url := range []string{
+		"file://" + filepath.Join(outsideDir, "image.raw"),
+		"file://" + rootDir + "/../" + filepath.Base(outsideDir) + "/image.raw",
+		"file://" + filepath.Join(rootDir, "link.raw"),
+		"file://" + filepath.Join(rootDir, "link", "image.raw"),
+	} {
+		_, err = h.GetSizeFromURL(url)
+		c.Assert(errors.Is(err, ErrPathNotAllowed), Equals, true, Commentf("URL %v", url))
+		_, err = h.DownloadFromURL(context.Background(), url, filepath.Join(c.MkDir(), "download"), 1, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, &testProgressUpdater{})
+		c.Assert(errors.Is(err, ErrPathNotAllowed), Equals, true, Commentf("URL %v", url))
+	}
+
+	// The file URLs are disabled without any root.
+	h, err = NewFileHandler(nil)
+	c.Assert(err, IsNil)
+	_, err = h.GetSizeFromURL("file://" + filepath.Join(rootDir, "image.raw"))
+	c.Assert(errors.Is(err, ErrPathNotAllowed), Equals, true)
+
+	_, err = NewFileHandler([]string{"relative/dir"})
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestDownloadFromURLChecksum(c *C) {
+	// The zero ranges skipped by the copy should be included in the checksum.
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content[:100<<10])
+	c.Assert(err, IsNil)
+	_, err = rand.Read(content[600<<10 : 700<<10])
+	c.Assert(err, IsNil)
+	expectedChecksum := sha512.Sum512(content)
+	emptyChecksum := sha512.Sum512(nil)
+
+	sources := map[string][]byte{
+		"raw":  content,
+		"gzip": compressTestData(c, types.CompressionTypeGzip, content),
+	}
+	dir := c.MkDir()
+	for name, data := range sources {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"test-etag"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}))
+
+		for _, concurrentLimit := range []int{1, 4} {
+			filePath := filepath.Join(dir, fmt.Sprintf("download-checksum-%v-%d", name, concurrentLimit))
+			updater := newTestChecksumUpdater()
+			written, err := (&HTTPHandler{}).DownloadFromURL(context.Background(), server.URL, filePath, concurrentLimit, types.CompressionTypeAuto, types.DefaultDecompressedSizeLimit, updater)
+			c.Assert(err, IsNil)
+			c.Assert(written, Equals, int64(len(content)))
+
+			// The segments are written out of order, hence no checksum is calculated during the download.
+			if concurrentLimit > 1 && name == "raw" {
+				c.Assert(updater.hash.Sum(nil), DeepEquals, emptyChecksum[:])
+			} else {
+				c.Assert(updater.hash.Sum(nil), DeepEquals, expectedChecksum[:])
+			}
+		}
+
+		server.Close()
+	}
+}
@@ -0,0 +1,225 @@
+package sync
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+// DefaultLeftoverGracePeriod is used when the leftover collection doesn't specify the grace period.
+const DefaultLeftoverGracePeriod = 24 * time.Hour
+
+// fileSuffixes are the suffixes of the files derived from a sync file, in the order of stripping.
+var fileSuffixes = []string{
+	util.DownloadCheckpointFileSuffix,
+	util.RawConversionFileSuffix,
+	util.Qcow2ConversionFileSuffix,
+	TmpFileSuffix,
+	util.SyncingFileConfigFileSuffix,
+	util.BlockChecksumsFileSuffix,
+}
+
+// collectLeftovers finds the artefacts in the backing image work directory and the data source directory
+// of the disk that are not owned by any tracked sync file or active data source. The leftovers not modified
+// within the grace period are deleted unless it's a dry run.
+// activeDataSources are the data source file names, i.e. <name>-<uuid>, of the data sources still in use.
+func (s *Service) collectLeftovers(dryRun bool, gracePeriod time.Duration, activeDataSources []string) *api.LeftoverCollection {
+	// Block the new files during the collection, so that their directories won't be treated as orphaned.
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// The conversion files of the clone sources are derived from the source files but used by the clone targets.
+	inUseFiles := map[string]struct{}{}
+	for _, sf := range s.filePathMap {
+		if filePath := sf.getInUseCloneSourceConversionFilePath(); filePath != "" {
+			inUseFiles[filePath] = struct{}{}
+		}
+	}
+
+	leftovers := []api.Leftover{}
+	workDir := filepath.Join(s.diskPath, types.BackingImageManagerDirectoryName)
+	if entries, err := os.ReadDir(workDir); err != nil {
+		if !os.IsNotExist(err) {
+			s.log.WithError(err).Warnf("Sync Service: failed to read the work directory %v for the leftover collection", workDir)
+		}
+	} else {
+		for _, entry := range entries {
+			entryPath := filepath.Join(workDir, entry.Name())
+			if !entry.IsDir() {
+				continue
+			}
+			sf := s.filePathMap[filepath.Join(entryPath, types.BackingImageFileName)]
+			if sf == nil {
+				leftovers = append(leftovers, newLeftover(entryPath, api.LeftoverTypeOrphanedDirectory))
+				continue
+			}
+			files, err := os.ReadDir(entryPath)
+			if err != nil {
+				s.log.WithError(err).Warnf("Sync Service: failed to read the backing image directory %v for the leftover collection", entryPath)
+				continue
+			}
+			for _, file := range files {
+				filePath := filepath.Join(entryPath, file.Name())
+				if _, inUse := inUseFiles[filePath]; inUse {
+					continue
+				}
+				if leftoverType, isLeftover := getDerivedFileLeftoverType(filePath, sf); isLeftover {
+					leftovers = append(leftovers, newLeftover(filePath, leftoverType))
+				}
+			}
+		}
+	}
+
+	dataSourceDir := filepath.Join(s.diskPath, types.DataSourceDirectoryName)
+	if entries, err := os.ReadDir(dataSourceDir); err != nil {
+		if !os.IsNotExist(err) {
+			s.log.WithError(err).Warnf("Sync Service: failed to read the data source directory %v for the leftover collection", dataSourceDir)
+		}
+	} else {
+		for _, entry := range entries {
+			if entry.IsDir() || isActiveDataSourceFile(entry.Name(), activeDataSources) {
+				continue
+			}
+			filePath := filepath.Join(dataSourceDir, entry.Name())
+			if leftoverType, isLeftover := getDerivedFileLeftoverType(filePath, s.filePathMap[getSyncFilePath(filePath)]); isLeftover {
+				leftovers = append(leftovers, newLeftover(filePath, leftoverType))
+			}
+		}
+	}
+
+	res := &api.LeftoverCollection{
+		DryRun:      dryRun,
+		GracePeriod: gracePeriod.String(),
+		Leftovers:   leftovers,
+	}
+	for i := range res.Leftovers {
+		leftover := &res.Leftovers[i]
+		if modificationTime, err := time.Parse(time.RFC3339, leftover.ModificationTime); err == nil {
+			leftover.Expired = time.Since(modificationTime) >= gracePeriod
+		}
+		if dryRun || !leftover.Expired || leftover.Error != "" {
+			continue
+		}
+		if err := os.RemoveAll(leftover.Path); err != nil {
+			leftover.Error = err.Error()
+			s.log.WithError(err).Warnf("Sync Service: failed to delete %v leftover %v", leftover.Type, leftover.Path)
+			continue
+		}
+		leftover.Deleted = true
+		res.ReclaimedSize += leftover.Size
+		s.log.Infof("Sync Service: deleted %v leftover %v of size %v", leftover.Type, leftover.Path, leftover.Size)
+	}
+
+	return res
+}
+
+// getDerivedFileLeftoverType checks if the file is a leftover of the sync file. All the files are leftovers
+// if the sync file is not tracked. Otherwise, only the tmp files and the conversion files are leftovers
+// once the sync file is no longer being prepared, unless the download can be resumed from the tmp file.
+func getDerivedFileLeftoverType(filePath string, sf *SyncingFile) (api.LeftoverType, bool) {
+	var leftoverType api.LeftoverType
+	switch {
+	case strings.HasSuffix(filePath, util.RawConversionFileSuffix):
+		leftoverType = api.LeftoverTypeRawConversionFile
+	case strings.HasSuffix(filePath, util.Qcow2ConversionFileSuffix):
+		leftoverType = api.LeftoverTypeQcow2ConversionFile
+	case strings.HasSuffix(filePath, TmpFileSuffix), strings.HasSuffix(filePath, TmpFileSuffix+util.DownloadCheckpointFileSuffix):
+		leftoverType = api.LeftoverTypeTmpFile
+	}
+
+	if sf == nil {
+		if leftoverType == "" {
+			leftoverType = api.LeftoverTypeOrphanedDataSourceFile
+		}
+		return leftoverType, true
+	}
+	if leftoverType == "" || sf.isPreparing() {
+		return "", false
+	}
+	if leftoverType == api.LeftoverTypeTmpFile && util.IsDownloadCheckpointExisting(sf.tmpFilePath) {
+		return "", false
+	}
+	return leftoverType, true
+}
+
+// getSyncFilePath strips the suffixes of the derived file to get the path of the sync file.
+func getSyncFilePath(filePath string) string {
+	for _, suffix := range fileSuffixes {
+		filePath = strings.TrimSuffix(filePath, suffix)
+	}
+	return filePath
+}
+
+func isActiveDataSourceFile(fileName string, activeDataSources []string) bool {
+	for _, dataSource := range activeDataSources {
+		if dataSource == "" {
+			continue
+		}
+		if fileName == dataSource || strings.HasPrefix(fileName, dataSource+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// newLeftover gets the allocated size and the latest modification time of the file or the whole directory.
+func newLeftover(path string, leftoverType api.LeftoverType) api.Leftover {
+	leftover := api.Leftover{
+		Path: path,
+		Type: leftoverType,
+	}
+
+	var latest time.Time
+	err := filepath.WalkDir(path, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		if !d.IsDir() {
+			if size, err := util.GetFileRealSize(walkPath); err == nil {
+				leftover.Size += size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		leftover.Error = err.Error()
+	}
+	leftover.ModificationTime = latest.UTC().Format(time.RFC3339)
+
+	return leftover
+}
+
+// getInUseCloneSourceConversionFilePath returns the raw image converted from the clone source if the clone
+// is still preparing this file, otherwise empty.
+func (sf *SyncingFile) getInUseCloneSourceConversionFilePath() string {
+	sf.lock.RLock()
+	defer sf.lock.RUnlock()
+	if !sf.isPreparingNoLock() {
+		return ""
+	}
+	return sf.cloneSourceConversionFilePath
+}
+
+// isPreparing means the file may still be written by the operation preparing it.
+func (sf *SyncingFile) isPreparing() bool {
+	sf.lock.RLock()
+	defer sf.lock.RUnlock()
+	return sf.isPreparingNoLock()
+}
+
+func (sf *SyncingFile) isPreparingNoLock() bool {
+	return sf.state == types.StatePending || sf.state == types.StateStarting || sf.state == types.StateInProgress
+}
@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+)
+
+// ErrPathNotAllowed means the path is out of the allowed roots of the sync service.
+var ErrPathNotAllowed = errors.New("path not allowed")
+
+// GetDiskAllowedRoots returns the backing image directory and the data source directory under the disk path.
+func GetDiskAllowedRoots(diskPath string) []string {
+	return []string{
+		filepath.Join(diskPath, types.BackingImageManagerDirectoryName),
+		filepath.Join(diskPath, types.DataSourceDirectoryName),
+	}
+}
+
+// PathConfinement restricts the files operated by the sync service to the allowed roots.
+// The nil confinement allows all paths.
+type PathConfinement struct {
+	roots []string
+}
+
+func NewPathConfinement(roots []string) (*PathConfinement, error) {
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	c := &PathConfinement{}
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			return nil, fmt.Errorf("the allowed root %v should be an absolute path", root)
+		}
+		c.roots = append(c.roots, filepath.Clean(root))
+	}
+	return c, nil
+}
+
+// Check returns the cleaned path if it's inside one of the allowed roots. The path should be absolute without
+// any `..` element, and cannot escape from the roots via the symlinks of itself or its existing ancestors.
+func (c *PathConfinement) Check(filePath string) (string, error) {
+	if c == nil {
+		return filePath, nil
+	}
+	if !filepath.IsAbs(filePath) {
+		return "", fmt.Errorf("%w: %v is not an absolute path", ErrPathNotAllowed, filePath)
+	}
+	for _, element := range strings.Split(filePath, string(filepath.Separator)) {
+		if element == ".." {
+			return "", fmt.Errorf("%w: %v contains the parent directory reference", ErrPathNotAllowed, filePath)
+		}
+	}
+
+	cleanedPath := filepath.Clean(filePath)
+	resolvedPath, err := resolveExistingPath(cleanedPath)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to resolve %v: %v", ErrPathNotAllowed, filePath, err)
+	}
+	for _, root := range c.roots {
+		resolvedRoot, err := resolveExistingPath(root)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(resolvedPath, resolvedRoot+string(filepath.Separator)) {
+			return cleanedPath, nil
+		}
+	}
+	if resolvedPath != cleanedPath {
+		return "", fmt.Errorf("%w: %v resolved to %v is out of the allowed roots %v", ErrPathNotAllowed, filePath, resolvedPath, c.roots)
+	}
+	return "", fmt.Errorf("%w: %v is out of the allowed roots %v", ErrPathNotAllowed, filePath, c.roots)
+}
+
+// resolveExistingPath evaluates the symlinks of the longest existing ancestor of the path,
+// since the file and its parent directories may not be created yet.
+func resolveExistingPath(path string) (string, error) {
+	var missingElements []string
+	for {
+		resolvedPath, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolvedPath}, missingElements...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		missingElements = append([]string{filepath.Base(path)}, missingElements...)
+		path = parent
+	}
+}
+
+// confinePath logs the refused request if the path is not allowed.
+func (s *Service) confinePath(request *http.Request, filePath string) (string, error) {
+	confinedPath, err := s.pathConfinement.Check(filePath)
+	if err != nil {
+		s.log.WithError(err).Warnf("Sync Service: forbidden %v request %v from %v", request.Method, request.URL.Path, request.RemoteAddr)
+		return "", err
+	}
+	return confinedPath, nil
+}
+
+// confineURL refuses the URL if the handler confines the source files, e.g. the local path of a file URL
+// should be under the file URL roots.
+func (s *Service) confineURL(request *http.Request, url string) error {
+	checker, ok := s.handler.(URLChecker)
+	if !ok {
+		return nil
+	}
+	if err := checker.CheckURL(url); err != nil {
+		if errors.Is(err, ErrPathNotAllowed) {
+			s.log.WithError(err).Warnf("Sync Service: forbidden %v request %v from %v", request.Method, request.URL.Path, request.RemoteAddr)
+		}
+		return err
+	}
+	return nil
+}
+
+// getErrorStatusCode returns 403 for the paths out of the allowed roots, 503 during the drain,
+// otherwise the default status code.
+func getErrorStatusCode(err error, defaultStatusCode int) int {
+	switch {
+	case errors.Is(err, ErrPathNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrDraining):
+		return http.StatusServiceUnavailable
+	}
+	return defaultStatusCode
+}
@@ -0,0 +1,85 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+)
+
+// RetentionPolicy decides how long the ready and the failed files are kept in the sync service before
+// being forgotten automatically. Forgetting a file doesn't delete the file in the disk.
+type RetentionPolicy struct {
+	// FailedFileTTL is the time a failed file is kept after the failure. 0 means it's never forgotten.
+	FailedFileTTL time.Duration
+	// ReadyFileTTL is the time a ready file is kept after becoming ready. 0 means it's never forgotten.
+	ReadyFileTTL time.Duration
+	// IsFileReferenced reports the files still referenced by the caller, e.g. the manager, which are never
+	// forgotten automatically. It's called with the lock of the file held, hence it should not call the sync service.
+	IsFileReferenced func(filePath string, state types.State) bool
+}
+
+// getEvictionTime returns the time when the file will be forgotten, or the zero time if it won't be.
+func (p *RetentionPolicy) getEvictionTime(filePath string, state types.State, finishedAt time.Time) time.Time {
+	if p == nil || finishedAt.IsZero() {
+		return time.Time{}
+	}
+
+	var ttl time.Duration
+	switch state {
+	case types.StateFailed:
+		ttl = p.FailedFileTTL
+	case types.StateReady:
+		ttl = p.ReadyFileTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	if p.IsFileReferenced != nil && p.IsFileReferenced(filePath, state) {
+		return time.Time{}
+	}
+	return finishedAt.Add(ttl)
+}
+
+// getCheckInterval makes sure the files are forgotten in time even if the TTL is shorter than AutoForgetCheckInterval.
+func (p *RetentionPolicy) getCheckInterval() time.Duration {
+	interval := time.Duration(0)
+	for _, ttl := range []time.Duration{p.FailedFileTTL, p.ReadyFileTTL} {
+		if ttl > 0 && (interval == 0 || ttl < interval) {
+			interval = ttl
+		}
+	}
+	return min(interval, AutoForgetCheckInterval)
+}
+
+func (s *Service) autoForget() {
+	ticker := time.NewTicker(s.retentionPolicy.getCheckInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.forgetExpiredFiles(time.Now())
+		}
+	}
+}
+
+func (s *Service) forgetExpiredFiles(now time.Time) {
+	expiredFiles := map[string]types.State{}
+	s.lock.RLock()
+	for filePath, sf := range s.filePathMap {
+		sf.lock.RLock()
+		evictionTime := sf.getEvictionTimeNoLock()
+		state := sf.state
+		sf.lock.RUnlock()
+		if !evictionTime.IsZero() && !now.Before(evictionTime) {
+			expiredFiles[filePath] = state
+		}
+	}
+	s.lock.RUnlock()
+
+	for filePath, state := range expiredFiles {
+		s.log.Infof("Sync Service: automatically forgetting %v file %v since its retention period expired", state, filePath)
+		s.cleanup(filePath, false)
+	}
+}
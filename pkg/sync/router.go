@@ -1,9 +1,15 @@
 package sync
 
 import (
+	"net/http"
 	"net/http/pprof"
+	"net/url"
 
 	"github.com/gorilla/mux"
+
+	"github.com/longhorn/backing-image-manager/pkg/health"
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
+	"github.com/longhorn/backing-image-manager/pkg/types"
 )
 
 // NewRouter creates and configures a mux router
@@ -11,22 +17,40 @@ func NewRouter(service *Service) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true).UseEncodedPath()
 
 	router.HandleFunc("/v1/files", service.List).Methods("GET")
+	router.HandleFunc("/v1/events", service.Events).Methods("GET")
+	router.HandleFunc("/v1/bandwidth-limits", service.GetBandwidthLimits).Methods("GET")
+	router.HandleFunc("/v1/bandwidth-limits", service.UpdateBandwidthLimits).Methods("PUT")
+	router.HandleFunc("/v1/leftovers", service.ListLeftovers).Methods("GET")
+	router.HandleFunc("/v1/leftovers", service.CollectLeftovers).Methods("POST").Queries("action", "collect")
+	router.HandleFunc("/v1/drain", service.Drain).Methods("POST")
 
 	// Operate a file
 	router.HandleFunc("/v1/files/{id}", service.Get).Methods("GET")
 	router.HandleFunc("/v1/files/{id}", service.Delete).Methods("DELETE")
 	router.HandleFunc("/v1/files/{id}", service.Forget).Methods("POST").Queries("action", "forget")
 	router.HandleFunc("/v1/files/{id}", service.SendToPeer).Methods("POST").Queries("action", "sendToPeer")
+	router.HandleFunc("/v1/files/{id}", service.RepairFromPeer).Methods("POST").Queries("action", "repairFromPeer")
+	router.HandleFunc("/v1/files/{id}", service.FinalizeUploadSession).Methods("POST").Queries("action", "finalizeUploadSession")
+	router.HandleFunc("/v1/files/{id}/upload", service.GetUploadSession).Methods("GET")
+	router.HandleFunc("/v1/files/{id}/upload", service.UploadChunk).Methods("PUT")
 	router.HandleFunc("/v1/files/{id}/download", service.DownloadToDst).Methods("GET", "HEAD")
+	router.HandleFunc("/v1/files/{id}/blocks", service.GetBlockChecksums).Methods("GET")
+	router.HandleFunc("/v1/files/{id}/blocks/{index}", service.DownloadBlock).Methods("GET")
 
 	// Launch a new file
 	router.HandleFunc("/v1/files", service.Fetch).Methods("POST").Queries("action", "fetch")
 	router.HandleFunc("/v1/files", service.RestoreFromBackupURL).Methods("POST").Queries("action", "restoreFromBackupURL")
 	router.HandleFunc("/v1/files", service.DownloadFromURL).Methods("POST").Queries("action", "downloadFromURL")
 	router.HandleFunc("/v1/files", service.UploadFromRequest).Methods("POST").Queries("action", "upload")
+	router.HandleFunc("/v1/files", service.CreateUploadSession).Methods("POST").Queries("action", "createUploadSession")
 	router.HandleFunc("/v1/files", service.ReceiveFromPeer).Methods("POST").Queries("action", "receiveFromPeer")
 	router.HandleFunc("/v1/files", service.CloneFromBackingImage).Methods("POST").Queries("action", "cloneFromBackingImage")
 
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	router.HandleFunc(types.HealthzPath, health.Liveness).Methods("GET")
+	router.HandleFunc(types.ReadyzPath, service.healthChecker.Readiness).Methods("GET")
+
 	router.HandleFunc("/debug/pprof/", pprof.Index).Methods("GET")
 	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline).Methods("GET")
 	router.HandleFunc("/debug/pprof/profile", pprof.Profile).Methods("GET")
@@ -39,5 +63,39 @@ func NewRouter(service *Service) *mux.Router {
 	router.Handle("/debug/pprof/mutex", pprof.Handler("mutex")).Methods("GET")
 	router.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate")).Methods("GET")
 
+	if service.options.Auth.Enabled() {
+		router.Use(service.options.Auth.Middleware(getDownloadFilePath))
+	}
+
 	return router
 }
+
+// downloadRoutes are the routes reading a single file, which can be allowed by a download token of the file.
+var downloadRoutes = map[string]struct{}{
+	"/v1/files/{id}":                {},
+	"/v1/files/{id}/download":       {},
+	"/v1/files/{id}/blocks":         {},
+	"/v1/files/{id}/blocks/{index}": {},
+}
+
+func getDownloadFilePath(request *http.Request) string {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return ""
+	}
+	route := mux.CurrentRoute(request)
+	if route == nil {
+		return ""
+	}
+	pathTemplate, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	if _, exists := downloadRoutes[pathTemplate]; !exists {
+		return ""
+	}
+	filePath, err := url.QueryUnescape(mux.Vars(request)["id"])
+	if err != nil {
+		return ""
+	}
+	return filePath
+}
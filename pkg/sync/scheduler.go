@@ -0,0 +1,169 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ScheduledOperations are the heavy operations queued by the OperationScheduler.
+var ScheduledOperations = []string{
+	OperationFetch,
+	OperationDownload,
+	OperationRestore,
+	OperationClone,
+	OperationSend,
+	OperationRepair,
+}
+
+// OperationScheduler limits the number of the running operations of each type in the sync service.
+// The operations exceeding the limit are queued, and the ones with higher priority start first.
+// The operations with the same priority start in the order of scheduling.
+type OperationScheduler struct {
+	ctx context.Context
+
+	lock    sync.Mutex
+	limits  map[string]int
+	running map[string]int
+	// queued is sorted in the order of starting.
+	queued  []*operationTicket
+	nextSeq int64
+}
+
+type operationTicket struct {
+	operation string
+	priority  int
+	seq       int64
+	// started is closed once the operation is allowed to run.
+	started chan struct{}
+}
+
+// NewOperationScheduler creates a scheduler with the concurrency limits of the operations.
+// The operations without a positive limit are not limited.
+func NewOperationScheduler(ctx context.Context, limits map[string]int) (*OperationScheduler, error) {
+	schedulerLimits := map[string]int{}
+	for operation, limit := range limits {
+		if !isScheduledOperation(operation) {
+			return nil, fmt.Errorf("invalid operation %v for the concurrency limit, the supported operations are %v", operation, ScheduledOperations)
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("invalid concurrency limit %v for operation %v", limit, operation)
+		}
+		if limit > 0 {
+			schedulerLimits[operation] = limit
+		}
+	}
+
+	return &OperationScheduler{
+		ctx: ctx,
+
+		limits:  schedulerLimits,
+		running: map[string]int{},
+	}, nil
+}
+
+func isScheduledOperation(operation string) bool {
+	for _, scheduledOperation := range ScheduledOperations {
+		if operation == scheduledOperation {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule queues the operation. The operation starts immediately if it doesn't exceed the limit.
+func (s *OperationScheduler) schedule(operation string, priority int) *operationTicket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nextSeq++
+	ticket := &operationTicket{
+		operation: operation,
+		priority:  priority,
+		seq:       s.nextSeq,
+		started:   make(chan struct{}),
+	}
+	s.queued = append(s.queued, ticket)
+	sort.SliceStable(s.queued, func(i, j int) bool {
+		if s.queued[i].priority != s.queued[j].priority {
+			return s.queued[i].priority > s.queued[j].priority
+		}
+		return s.queued[i].seq < s.queued[j].seq
+	})
+	s.startQueuedNoLock(operation)
+
+	return ticket
+}
+
+// wait blocks until the operation starts. The operation is removed from the queue if the context is done.
+func (s *OperationScheduler) wait(ctx context.Context, ticket *operationTicket) error {
+	select {
+	case <-ticket.started:
+		return nil
+	case <-ctx.Done():
+	case <-s.ctx.Done():
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, queuedTicket := range s.queued {
+		if queuedTicket == ticket {
+			s.queued = append(s.queued[:i], s.queued[i+1:]...)
+			return fmt.Errorf("cancelled the queued %v operation", ticket.operation)
+		}
+	}
+	// The operation just started, hence giving it up.
+	s.doneNoLock(ticket)
+	return fmt.Errorf("cancelled the %v operation right after it started", ticket.operation)
+}
+
+// done should be called once the started operation is finished, so that the queued ones can start.
+func (s *OperationScheduler) done(ticket *operationTicket) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.doneNoLock(ticket)
+}
+
+func (s *OperationScheduler) doneNoLock(ticket *operationTicket) {
+	s.running[ticket.operation]--
+	s.startQueuedNoLock(ticket.operation)
+}
+
+func (s *OperationScheduler) startQueuedNoLock(operation string) {
+	for i := 0; i < len(s.queued); {
+		ticket := s.queued[i]
+		if ticket.operation != operation {
+			i++
+			continue
+		}
+		if limit, exists := s.limits[operation]; exists && s.running[operation] >= limit {
+			return
+		}
+		s.running[operation]++
+		s.queued = append(s.queued[:i], s.queued[i+1:]...)
+		close(ticket.started)
+	}
+}
+
+// position returns the position of the operation in the queue of the same type, starting from 1.
+// It returns 0 if the operation is not queued.
+func (s *OperationScheduler) position(ticket *operationTicket) int {
+	if s == nil || ticket == nil {
+		return 0
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	position := 0
+	for _, queuedTicket := range s.queued {
+		if queuedTicket.operation != ticket.operation {
+			continue
+		}
+		position++
+		if queuedTicket == ticket {
+			return position
+		}
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+// scrub periodically re-hashes the ready files one by one, so that the silent corruption can be
+// detected even if the file modification time is not changed.
+func (s *Service) scrub() {
+	limiter := util.NewRateLimiter(s.options.ScrubRateLimit)
+
+	s.log.Infof("Sync Service: start scrubbing the ready files every %v, rate limit %v bytes per second", s.options.ScrubInterval, s.options.ScrubRateLimit)
+
+	ticker := time.NewTicker(s.options.ScrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.log.Info("Sync Service: stopped scrubbing the ready files")
+			return
+		case <-ticker.C:
+		}
+
+		s.lock.RLock()
+		syncingFiles := make([]*SyncingFile, 0, len(s.filePathMap))
+		for _, sf := range s.filePathMap {
+			syncingFiles = append(syncingFiles, sf)
+		}
+		s.lock.RUnlock()
+
+		for _, sf := range syncingFiles {
+			if s.ctx.Err() != nil {
+				return
+			}
+			sf.Scrub(s.ctx, limiter)
+		}
+	}
+}
+
+// Scrub re-calculates the checksum of the ready file and compares it with the recorded one.
+// The file becomes state corrupted if the data is changed while the modification time is not.
+func (sf *SyncingFile) Scrub(ctx context.Context, limiter *util.RateLimiter) {
+	sf.lock.Lock()
+	sf.validateReadyFileNoLock()
+	if sf.state != types.StateReady {
+		sf.lock.Unlock()
+		return
+	}
+	filePath := sf.filePath
+	modificationTime := sf.modificationTime
+	currentChecksum := sf.currentChecksum
+	checksumAlgorithm := sf.checksumAlgorithm
+	sf.lock.Unlock()
+
+	sf.log.Debugf("SyncingFile: start scrubbing file")
+	checksum, blockChecksums, err := util.GetFileBlockChecksumsWithRateLimit(ctx, filePath, checksumAlgorithm, util.DefaultChecksumBlockSize, limiter)
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	// The result is meaningless if the file is modified or re-processed during scrubbing.
+	if sf.state != types.StateReady || sf.modificationTime != modificationTime || util.FileModificationTime(filePath) != modificationTime {
+		sf.log.Infof("SyncingFile: skipped the scrubbing result since the file is changed during scrubbing")
+		return
+	}
+
+	sf.lastScrubbedAt = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		sf.lastScrubResult = types.ScrubResultError
+		sf.log.WithError(err).Warn("SyncingFile: failed to scrub file")
+		return
+	}
+	if checksum != currentChecksum {
+		sf.lastScrubResult = types.ScrubResultCorrupted
+		sf.state = types.StateCorrupted
+		sf.message = fmt.Sprintf("scrubbing found the file checksum %v doesn't match the checksum %v while the file is not modified%v", checksum, currentChecksum, sf.getCorruptedBlocksMessage(blockChecksums))
+		sf.log.Errorf("SyncingFile: %s", sf.message)
+		return
+	}
+	sf.lastScrubResult = types.ScrubResultPassed
+	sf.log.Debugf("SyncingFile: scrubbed file")
+}
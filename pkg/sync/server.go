@@ -3,21 +3,71 @@ package sync
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backing-image-manager/pkg/util"
 )
 
-func NewServer(parentCtx context.Context, listenAddr string, handler Handler) error {
+// Options contains the optional features of the sync server. The zero value disables all of them.
+type Options struct {
+	// ScrubInterval is the interval of re-hashing the ready files to detect the silent corruption.
+	ScrubInterval time.Duration
+	// ScrubRateLimit is the max bytes per second read by scrubbing. 0 means no limit.
+	ScrubRateLimit int64
+	// BandwidthLimiter limits the transfers of the sync files. It can be shared with the backup creation.
+	// If it's nil, the service will create one without any limit, which can be updated via the API later.
+	BandwidthLimiter *BandwidthLimiter
+	// ConcurrencyLimits is the max number of the running operations of each type in ScheduledOperations.
+	// The operations exceeding the limit are queued by priority. The operations without a limit are not queued.
+	ConcurrencyLimits map[string]int
+	// DiskSpaceSafetyMargin is the bytes kept free on the disk. The operations with a known size fail
+	// with reason insufficient-space before writing any data if the file cannot fit in the disk with the margin.
+	DiskSpaceSafetyMargin int64
+	// RetentionPolicy decides when the ready and the failed files are forgotten automatically.
+	// The files are never forgotten automatically by default.
+	RetentionPolicy RetentionPolicy
+	// TLS enables HTTPS for the server, and mutual TLS if the CA file is set. The same options are used
+	// to connect the peer sync servers, and to send and receive the files between the peers. A receive can still
+	// accept a plain HTTP sender explicitly, e.g. the volume replica exporting the data, which doesn't support TLS.
+	// The server is plain HTTP if it's nil.
+	TLS *util.TLSOptions
+	// Auth requires a bearer token with the read, write or debug scope for each request. A download token
+	// issued for a file can read the file only. The requests are not authenticated if it's nil.
+	Auth *util.Authenticator
+	// AllowedRoots are the directories containing all the files operated by the sync service. The requests
+	// with the paths out of the roots are refused with 403. If it's empty, the roots are the backing image
+	// directory and the data source directory under the disk path, and the paths are not confined without
+	// the disk path.
+	AllowedRoots []string
+	// DrainTimeout is the max time the process serving the sync server waits for the running operations
+	// on shutdown before interrupting them. The process is shut down without the drain if it's 0.
+	DrainTimeout time.Duration
+	// DiskUUID is checked against the disk config by the readiness probe. The UUID is not checked if it's empty.
+	DiskUUID string
+}
+
+// NewServer launches the sync server. If diskPath is specified, the ready files left in the disk
+// by the previous run will be introduced before serving.
+func NewServer(parentCtx context.Context, listenAddr, diskPath string, options Options, handler Handler) error {
 	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
 	srv := &http.Server{
 		Addr: listenAddr,
 	}
-	service, err := InitService(ctx, listenAddr, handler)
+	service, err := InitService(ctx, listenAddr, diskPath, options, handler)
 	if err != nil {
 		return err
 	}
 	srv.Handler = NewRouter(service)
+	if options.TLS.Enabled() {
+		tlsConfig, err := util.NewServerTLSConfig(options.TLS)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
 
 	go func() {
 		<-ctx.Done()
@@ -29,5 +79,8 @@ func NewServer(parentCtx context.Context, listenAddr string, handler Handler) er
 
 	logrus.Infof("Started sync server at %v", listenAddr)
 
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
 	return srv.ListenAndServe()
 }
@@ -1,22 +1,43 @@
 package sync
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"lukechampine.com/blake3"
 
 	imageutil "github.com/longhorn/go-common-libs/backingimage"
+	"github.com/longhorn/sparse-tools/sparse"
 
 	"github.com/longhorn/backing-image-manager/api"
 	"github.com/longhorn/backing-image-manager/pkg/client"
@@ -86,7 +107,7 @@ func (s *SyncTestSuite) BenchmarkMultipleDownload(c *C) {
 	downloadedFilePathBase := filepath.Join(s.dir, fileName)
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -106,7 +127,7 @@ func (s *SyncTestSuite) BenchmarkMultipleDownload(c *C) {
 				Remote: s.addr,
 			}
 
-			err := cli.DownloadFromURL("http://test-download-from-url.io", curPath, curUUID, TestDiskUUID, "", types.DataEnginev1)
+			err := cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, curUUID, TestDiskUUID, "", types.DataEnginev1)
 			c.Assert(err, IsNil)
 
 			_, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
@@ -143,7 +164,7 @@ func (s *SyncTestSuite) BenchmarkUpload(c *C) {
 	c.Assert(err, IsNil)
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -196,7 +217,7 @@ func (s *SyncTestSuite) BenchmarkOneReceiveAndMultiSendWithSendingLimit(c *C) {
 	c.Assert(checksum, Not(Equals), "")
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	if !util.DetectHTTPServerAvailability(s.httpAddr, 5, true) {
 		logrus.Fatal("failed to wait for sync service running in 5 second")
@@ -221,7 +242,7 @@ func (s *SyncTestSuite) BenchmarkOneReceiveAndMultiSendWithSendingLimit(c *C) {
 		curUUID := TestSyncingFileUUID + "-dst-" + strconv.Itoa(i)
 		curReceiverPort := TestSyncServiceReceivePort + i
 		curReceiverAddress := fmt.Sprintf("localhost:%d", curReceiverPort)
-		err := cli.Receive(dstFilePath, curUUID, TestDiskUUID, checksum, types.SyncingFileTypeQcow2, curReceiverPort, int64(sizeInMB*MB), types.DataEnginev1)
+		err := cli.Receive(dstFilePath, curUUID, TestDiskUUID, checksum, types.SyncingFileTypeQcow2, curReceiverPort, int64(sizeInMB*MB), types.DataEnginev1, false)
 		c.Assert(err, IsNil)
 
 		err = cli.Send(originalFilePath, curReceiverAddress)
@@ -269,7 +290,7 @@ func (s *SyncTestSuite) BenchmarkMultiReceiveAndMultiSend(c *C) {
 	c.Assert(checksum, Not(Equals), "")
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	if !util.DetectHTTPServerAvailability(s.httpAddr, 5, true) {
 		logrus.Fatal("failed to wait for sync service running in 5 second")
@@ -317,7 +338,7 @@ func (s *SyncTestSuite) BenchmarkMultiReceiveAndMultiSend(c *C) {
 				Remote: s.addr,
 			}
 
-			err := cli.Receive(dstFilePath, curUUID, TestDiskUUID, checksum, types.SyncingFileTypeQcow2, curReceiverPort, int64(sizeInMB*MB), types.DataEnginev1)
+			err := cli.Receive(dstFilePath, curUUID, TestDiskUUID, checksum, types.SyncingFileTypeQcow2, curReceiverPort, int64(sizeInMB*MB), types.DataEnginev1, false)
 			c.Assert(err, IsNil)
 			err = cli.Send(srcFilePath, curReceiverAddress)
 			c.Assert(err, IsNil)
@@ -342,7 +363,7 @@ func (s *SyncTestSuite) TestTimeoutReceiveFromPeers(c *C) {
 	curPath := filepath.Join(s.dir, fileName)
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	if !util.DetectHTTPServerAvailability(s.httpAddr, 5, true) {
 		logrus.Fatal("failed to wait for sync service running in 5 second")
@@ -353,7 +374,7 @@ func (s *SyncTestSuite) TestTimeoutReceiveFromPeers(c *C) {
 	}
 
 	go func() {
-		err := cli.Receive(curPath, TestSyncingFileUUID, TestDiskUUID, "", types.SyncingFileTypeQcow2, TestSyncServiceReceivePort, MockFileSize, types.DataEnginev1)
+		err := cli.Receive(curPath, TestSyncingFileUUID, TestDiskUUID, "", types.SyncingFileTypeQcow2, TestSyncServiceReceivePort, MockFileSize, types.DataEnginev1, false)
 		c.Assert(err, IsNil)
 	}()
 
@@ -384,7 +405,7 @@ func (s *SyncTestSuite) TestFetch(c *C) {
 	c.Assert(checksum, Not(Equals), "")
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -481,7 +502,7 @@ func (s *SyncTestSuite) TestDownloadToDst(c *C) {
 	c.Assert(checksum, Not(Equals), "")
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -520,7 +541,7 @@ func (s *SyncTestSuite) TestDuplicateCalls(c *C) {
 	curPath := filepath.Join(s.dir, fileName)
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -529,7 +550,7 @@ func (s *SyncTestSuite) TestDuplicateCalls(c *C) {
 		Remote: s.addr,
 	}
 
-	err := cli.DownloadFromURL("http://test-download-from-url.io", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	err := cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
 	c.Assert(err, IsNil)
 
 	_, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
@@ -537,13 +558,13 @@ func (s *SyncTestSuite) TestDuplicateCalls(c *C) {
 
 	// Duplicate file launching calls should error out:
 	// "resp.StatusCode(500) != http.StatusOK(200), response body content: file /root/test-dir/sync-tests/sync-download-file-for-dup-calls already exists\n"
-	err = cli.DownloadFromURL("http://test-download-from-url.io", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
 	c.Assert(err, ErrorMatches, `.*already exists[\s\S]*`)
 	err = cli.Upload(curPath, curPath, TestSyncingFileUUID, TestDiskUUID, "")
 	c.Assert(err, ErrorMatches, `.*already exists[\s\S]*`)
-	err = cli.Receive(curPath, TestDiskUUID, TestSyncingFileUUID, "", "", types.DefaultVolumeExportReceiverPort, MockFileSize, types.DataEnginev1)
+	err = cli.Receive(curPath, TestDiskUUID, TestSyncingFileUUID, "", "", types.DefaultVolumeExportReceiverPort, MockFileSize, types.DataEnginev1, false)
 	c.Assert(err, ErrorMatches, `.*already exists[\s\S]*`)
-	err = cli.DownloadFromURL("http://test-download-from-url.io", curPath+"-non-existing", TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath+"-non-existing", TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
 	c.Assert(err, ErrorMatches, `.*already exists[\s\S]*`)
 
 	// Duplicate delete or forget calls won't error out
@@ -570,7 +591,7 @@ func (s *SyncTestSuite) TestForgetFile(c *C) {
 	c.Assert(err, IsNil)
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -606,7 +627,7 @@ func (s *SyncTestSuite) TestReadyFileValidation(c *C) {
 	curPath := filepath.Join(s.dir, fileName)
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -615,7 +636,7 @@ func (s *SyncTestSuite) TestReadyFileValidation(c *C) {
 		Remote: s.addr,
 	}
 
-	err := cli.DownloadFromURL("http://test-download-from-url.io", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	err := cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
 	c.Assert(err, IsNil)
 
 	fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
@@ -654,8 +675,257 @@ func (s *SyncTestSuite) TestReadyFileValidation(c *C) {
 	fInfo, err = getAndWaitFileState(cli, curPath, string(types.StateUnknown), 1)
 	c.Assert(err, IsNil)
 	c.Check(fInfo.ModificationTime == oldModificationTime, Equals, false)
-	_, err = getAndWaitFileState(cli, curPath, string(types.StateFailed), 10)
+	fInfo, err = getAndWaitFileState(cli, curPath, string(types.StateFailed), 10)
 	c.Assert(err, IsNil)
+	// The stored block checksums tell where the damage is.
+	c.Assert(fInfo.Message, Matches, ".*corrupted blocks \\[0\\] .*")
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestBlockChecksums(c *C) {
+	logrus.Debugf("Testing sync server: TestBlockChecksums")
+
+	originalFilePath := filepath.Join(s.dir, "sync-block-checksums-original")
+	err := generateRandomDataFile(originalFilePath, "5")
+	c.Assert(err, IsNil)
+	original, err := os.ReadFile(originalFilePath)
+	c.Assert(err, IsNil)
+	originalChecksum, originalBlockChecksums, err := util.GetFileBlockChecksums(originalFilePath, types.ChecksumAlgorithmSHA512, util.DefaultChecksumBlockSize)
+	c.Assert(err, IsNil)
+	c.Assert(originalBlockChecksums.Blocks, HasLen, 3)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	curPath := filepath.Join(s.dir, "sync-block-checksums")
+	err = cli.Upload(originalFilePath, curPath, TestSyncingFileUUID, TestDiskUUID, originalChecksum)
+	c.Assert(err, IsNil)
+	fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	// The block checksums are stored next to the config file when the file becomes ready.
+	storedBlockChecksums, err := util.ReadBlockChecksums(util.GetBlockChecksumsFilePath(curPath))
+	c.Assert(err, IsNil)
+	c.Assert(storedBlockChecksums.ModificationTime, Equals, fInfo.ModificationTime)
+	blockChecksums, err := cli.GetBlockChecksums(s.ctx, curPath)
+	c.Assert(err, IsNil)
+	c.Assert(blockChecksums.Root, Equals, originalBlockChecksums.Root)
+	c.Assert(blockChecksums.Blocks, DeepEquals, originalBlockChecksums.Blocks)
+	diff, err := blockChecksums.Diff(originalBlockChecksums)
+	c.Assert(err, IsNil)
+	c.Assert(diff, HasLen, 0)
+
+	// The missing block checksums are re-calculated.
+	err = os.Remove(util.GetBlockChecksumsFilePath(curPath))
+	c.Assert(err, IsNil)
+	blockChecksums, err = cli.GetBlockChecksums(s.ctx, curPath)
+	c.Assert(err, IsNil)
+	c.Assert(blockChecksums.Root, Equals, originalBlockChecksums.Root)
+	_, err = os.Stat(util.GetBlockChecksumsFilePath(curPath))
+	c.Assert(err, IsNil)
+
+	for i := range blockChecksums.Blocks {
+		data, err := cli.DownloadBlock(s.ctx, curPath, i, blockChecksums)
+		c.Assert(err, IsNil)
+		offset, length := blockChecksums.GetBlockRange(i)
+		c.Assert(data, DeepEquals, original[offset:offset+length])
+	}
+	_, err = cli.DownloadBlock(s.ctx, curPath, len(blockChecksums.Blocks), blockChecksums)
+	c.Assert(err, ErrorMatches, "(?s).*invalid block index.*")
+
+	// Corrupt a block silently by restoring the modification time,
+	// then the corrupted block won't be sent out.
+	stat, err := os.Stat(curPath)
+	c.Assert(err, IsNil)
+	f, err := os.OpenFile(curPath, os.O_RDWR, 0666)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte("invalid data"), util.DefaultChecksumBlockSize+1)
+	c.Assert(err, IsNil)
+	err = f.Close()
+	c.Assert(err, IsNil)
+	err = os.Chtimes(curPath, stat.ModTime(), stat.ModTime())
+	c.Assert(err, IsNil)
+	_, err = cli.DownloadBlock(s.ctx, curPath, 0, blockChecksums)
+	c.Assert(err, IsNil)
+	_, err = cli.DownloadBlock(s.ctx, curPath, 1, blockChecksums)
+	c.Assert(err, ErrorMatches, "(?s).*block 1 is corrupted.*")
+
+	// The corrupted block is found by comparing the block checksums with the healthy copy.
+	_, corruptedBlockChecksums, err := util.GetFileBlockChecksums(curPath, types.ChecksumAlgorithmSHA512, util.DefaultChecksumBlockSize)
+	c.Assert(err, IsNil)
+	diff, err = corruptedBlockChecksums.Diff(blockChecksums)
+	c.Assert(err, IsNil)
+	c.Assert(diff, DeepEquals, []int{1})
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(util.GetBlockChecksumsFilePath(curPath))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *SyncTestSuite) TestRepairFromPeer(c *C) {
+	logrus.Debugf("Testing sync server: TestRepairFromPeer")
+
+	originalFilePath := filepath.Join(s.dir, "sync-repair-original")
+	err := generateRandomDataFile(originalFilePath, "5")
+	c.Assert(err, IsNil)
+	original, err := os.ReadFile(originalFilePath)
+	c.Assert(err, IsNil)
+	checksum, err := util.GetFileChecksum(originalFilePath)
+	c.Assert(err, IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	// The same sync server holds both the healthy copy and the corrupted copy.
+	peerPath := filepath.Join(s.dir, "sync-repair-peer")
+	err = cli.Upload(originalFilePath, peerPath, TestSyncingFileUUID+"-peer", TestDiskUUID, checksum)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, peerPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	curPath := filepath.Join(s.dir, "sync-repair")
+	err = cli.Upload(originalFilePath, curPath, TestSyncingFileUUID, TestDiskUUID, checksum)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	// Repairing a healthy file changes nothing.
+	err = cli.RepairFromPeer(curPath, s.addr, peerPath, "")
+	c.Assert(err, IsNil)
+	fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.CurrentChecksum, Equals, checksum)
+
+	f, err := os.OpenFile(curPath, os.O_RDWR, 0666)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte("invalid data"), util.DefaultChecksumBlockSize+1)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte("invalid data"), 2*util.DefaultChecksumBlockSize+1)
+	c.Assert(err, IsNil)
+	err = f.Close()
+	c.Assert(err, IsNil)
+	fInfo, err = getAndWaitFileState(cli, curPath, string(types.StateFailed), 10)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.Message, Matches, ".*corrupted blocks \\[1 2\\] .*")
+
+	// A failed repair keeps the file failed.
+	err = cli.RepairFromPeer(curPath, s.addr, filepath.Join(s.dir, "non-existing-file"), "")
+	c.Assert(err, IsNil)
+	fInfo, err = getAndWaitFileState(cli, curPath, string(types.StateFailed), 10)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.Message, Matches, "(?s)failed to repair the file from peer.*")
+
+	err = cli.RepairFromPeer(curPath, s.addr, peerPath, "")
+	c.Assert(err, IsNil)
+	fInfo, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.CurrentChecksum, Equals, checksum)
+	c.Assert(fInfo.Message, Equals, "")
+	repaired, err := os.ReadFile(curPath)
+	c.Assert(err, IsNil)
+	c.Assert(repaired, DeepEquals, original)
+
+	// The config and the block checksums are updated with the new modification time.
+	config, err := util.ReadSyncingFileConfig(util.GetSyncingFileConfigFilePath(curPath))
+	c.Assert(err, IsNil)
+	c.Assert(config.ModificationTime, Equals, fInfo.ModificationTime)
+	blockChecksums, err := util.ReadBlockChecksums(util.GetBlockChecksumsFilePath(curPath))
+	c.Assert(err, IsNil)
+	c.Assert(blockChecksums.ModificationTime, Equals, fInfo.ModificationTime)
+
+	// The repair from a stalled peer is cancelled by the deletion. The peer token is not in the URL.
+	stalled := make(chan string, 1)
+	stalledPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		stalled <- r.URL.RawQuery + " " + r.Header.Get("Authorization")
+	}))
+	defer stalledPeer.Close()
+	err = cli.RepairFromPeer(curPath, stalledPeer.Listener.Addr().String(), peerPath, "peer-token")
+	c.Assert(err, IsNil)
+	fInfo, err = getAndWaitFileState(cli, curPath, string(types.StateInProgress), 10)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.Message, Matches, "repairing the file from peer.*")
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+	select {
+	case request := <-stalled:
+		c.Assert(request, Equals, " Bearer peer-token")
+	case <-time.After(10 * time.Second):
+		c.Fatal("the repair from the stalled peer is not cancelled by the deletion")
+	}
+	err = cli.Delete(peerPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestScrub(c *C) {
+	logrus.Debugf("Testing sync server: TestScrub")
+
+	originalFilePath := filepath.Join(s.dir, "sync-scrub-original")
+	err := generateRandomDataFile(originalFilePath, "5")
+	c.Assert(err, IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{ScrubInterval: time.Second, ScrubRateLimit: 10 * MB}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	curPath := filepath.Join(s.dir, "sync-scrub")
+	err = cli.Upload(originalFilePath, curPath, TestSyncingFileUUID, TestDiskUUID, "")
+	c.Assert(err, IsNil)
+	fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	checksum := fInfo.CurrentChecksum
+
+	fInfo, err = getAndWaitFileScrubResult(cli, curPath, types.ScrubResultPassed, 30)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.State, Equals, string(types.StateReady))
+	_, err = time.Parse(time.RFC3339, fInfo.LastScrubbedAt)
+	c.Assert(err, IsNil)
+
+	// Corrupt a block silently by restoring the modification time,
+	// which can be detected by scrubbing only.
+	stat, err := os.Stat(curPath)
+	c.Assert(err, IsNil)
+	f, err := os.OpenFile(curPath, os.O_RDWR, 0666)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte("invalid data"), util.DefaultChecksumBlockSize+1)
+	c.Assert(err, IsNil)
+	err = f.Close()
+	c.Assert(err, IsNil)
+	err = os.Chtimes(curPath, stat.ModTime(), stat.ModTime())
+	c.Assert(err, IsNil)
+
+	fInfo, err = getAndWaitFileState(cli, curPath, string(types.StateCorrupted), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.LastScrubResult, Equals, string(types.ScrubResultCorrupted))
+	c.Assert(fInfo.CurrentChecksum, Equals, checksum)
+	c.Assert(fInfo.Message, Matches, "scrubbing found the file checksum .* corrupted blocks \\[1\\] .*")
+
+	// The corrupted file cannot be sent out.
+	err = cli.Send(curPath, "localhost:12345")
+	c.Assert(err, ErrorMatches, "(?s).*invalid state corrupted for file sending.*")
 
 	err = cli.Delete(curPath)
 	c.Assert(err, IsNil)
@@ -681,7 +951,7 @@ func (s *SyncTestSuite) TestVirtualSizeQcow2(c *C) {
 	fileSize := stat.Size()
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -727,7 +997,7 @@ func (s *SyncTestSuite) TestVirtualSizeRaw(c *C) {
 	fileSize := stat.Size()
 
 	go func() {
-		_ = NewServer(s.ctx, s.addr, &MockHandler{})
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
 	}()
 	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
 	c.Assert(isRunning, Equals, true)
@@ -751,98 +1021,555 @@ func (s *SyncTestSuite) TestVirtualSizeRaw(c *C) {
 	c.Assert(err, IsNil)
 }
 
-func getAndWaitFileState(cli *client.SyncClient, curPath, desireState string, waitIntervalInSecond int) (fInfo *api.FileInfo, err error) {
-	endTime := time.Now().Add(time.Duration(waitIntervalInSecond) * time.Second)
+func (s *SyncTestSuite) TestIntroduceExistingFiles(c *C) {
+	logrus.Debugf("Testing sync server: TestIntroduceExistingFiles")
 
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	for time.Now().Before(endTime) {
-		<-ticker.C
+	biName := "sync-introduce-file"
+	biUUID := TestSyncingFileUUID + "-introduce"
+	curPath := types.GetBackingImageFilePath(s.dir, biName, biUUID)
+	err := os.MkdirAll(filepath.Dir(curPath), 0777)
+	c.Assert(err, IsNil)
+	err = generateRandomDataFile(curPath, "1")
+	c.Assert(err, IsNil)
+	checksum, err := util.GetFileChecksum(curPath)
+	c.Assert(err, IsNil)
 
-		fInfo, err = cli.Get(curPath)
-		if err != nil || fInfo == nil {
-			logrus.Warnf("Failed to get file %v info during wait: %v", curPath, err)
-			continue
-		}
+	// The file without the config file should not be introduced.
+	noConfigPath := types.GetBackingImageFilePath(s.dir, biName+"-no-config", biUUID+"-no-config")
+	err = os.MkdirAll(filepath.Dir(noConfigPath), 0777)
+	c.Assert(err, IsNil)
+	err = generateRandomDataFile(noConfigPath, "1")
+	c.Assert(err, IsNil)
 
-		if fInfo.State != desireState {
-			logrus.Debugf("Waiting for file %v becoming state %v, current state %v, progress %v%% (%v Byte)",
-				curPath, desireState, fInfo.State, fInfo.Progress, fInfo.ProcessedSize)
-			continue
-		}
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
 
-		if fInfo.State == string(types.StateReady) {
-			config, err := util.ReadSyncingFileConfig(util.GetSyncingFileConfigFilePath(curPath))
-			if err != nil {
-				return nil, fmt.Errorf("failed to get the config file after waiting for the file becoming state %v: %v", types.StateReady, err)
-			}
-			fInfoConfig := util.SyncingFileConfig{
-				FilePath:         fInfo.FilePath,
-				UUID:             fInfo.UUID,
-				Size:             fInfo.Size,
-				VirtualSize:      fInfo.VirtualSize,
-				RealSize:         fInfo.RealSize,
-				ExpectedChecksum: fInfo.ExpectedChecksum,
-				CurrentChecksum:  fInfo.CurrentChecksum,
-				ModificationTime: fInfo.ModificationTime,
-			}
-			if !reflect.DeepEqual(*config, fInfoConfig) {
-				return nil, fmt.Errorf("the file config %+v does not match the file info %+v after waiting for the file becoming state %v: %v", *config, fInfoConfig, types.StateReady, err)
-			}
-		}
-		return fInfo, nil
+	cli := &client.SyncClient{
+		Remote: s.addr,
 	}
 
-	if fInfo != nil {
-		return nil, fmt.Errorf("failed to wait for file %v to become state %v within %v second, "+
-			"current state: %v, progress %v, current checksum %v, message: %v",
-			curPath, desireState, waitIntervalInSecond,
-			fInfo.State, fInfo.Progress, fInfo.CurrentChecksum, fInfo.Message)
-	}
-	return nil, fmt.Errorf("failed to wait for datasource file to become state %v within %v second, no file info",
-		desireState, waitIntervalInSecond)
-}
+	err = cli.Fetch(curPath, curPath, biUUID, TestDiskUUID, checksum, MB)
+	c.Assert(err, IsNil)
+	fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
 
-func prepareTestWorkDirectory() (string, error) {
-	currentUser, err := user.Current()
-	if err != nil {
-		return "", err
-	}
-	dir := filepath.Join(currentUser.HomeDir, "test-dir", "sync-tests")
-	if err = os.RemoveAll(dir); err != nil {
-		return "", err
-	}
-	if err = os.MkdirAll(dir, 0666); err != nil {
-		return "", err
-	}
+	// Restart the sync server with the disk path
+	s.cancel()
+	isStopped := util.DetectHTTPServerAvailability(s.httpAddr, 5, false)
+	c.Assert(isStopped, Equals, true)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go func() {
+		_ = NewServer(s.ctx, s.addr, s.dir, Options{}, &MockHandler{})
+	}()
+	isRunning = util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
 
-	return dir, nil
+	fInfoList, err := cli.List()
+	c.Assert(err, IsNil)
+	c.Assert(fInfoList, HasLen, 1)
+	c.Assert(fInfoList[curPath], NotNil)
+	c.Assert(fInfoList[curPath].State, Equals, string(types.StateReady))
+	c.Assert(fInfoList[curPath].UUID, Equals, biUUID)
+	c.Assert(fInfoList[curPath].CurrentChecksum, Equals, fInfo.CurrentChecksum)
+	c.Assert(fInfoList[curPath].ModificationTime, Equals, fInfo.ModificationTime)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
 }
 
-func generateRandomDataFile(filePath, sizeInMB string) error {
-	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-		return err
-	}
+func (s *SyncTestSuite) TestUploadCompressed(c *C) {
+	logrus.Debugf("Testing sync server: TestUploadCompressed")
 
-	f, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
+	originalFilePath := filepath.Join(s.dir, "sync-upload-compressed-original")
+	err := generateRandomDataFile(originalFilePath, "1")
+	c.Assert(err, IsNil)
+	expectedChecksum, err := util.GetFileChecksum(originalFilePath)
+	c.Assert(err, IsNil)
+
+	compressedFilePath := originalFilePath + ".gz"
+	original, err := os.ReadFile(originalFilePath)
+	c.Assert(err, IsNil)
+	compressedFile, err := os.Create(compressedFilePath)
+	c.Assert(err, IsNil)
+	gzipWriter := gzip.NewWriter(compressedFile)
+	_, err = gzipWriter.Write(original)
+	c.Assert(err, IsNil)
+	c.Assert(gzipWriter.Close(), IsNil)
+	c.Assert(compressedFile.Close(), IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
 	}
 
-	return exec.Command("dd", "if=/dev/urandom", "of="+filePath, "bs=1M", "count="+sizeInMB).Run()
+	curPath := filepath.Join(s.dir, "sync-upload-compressed")
+	err = cli.Upload(compressedFilePath, curPath, TestSyncingFileUUID, TestDiskUUID, expectedChecksum)
+	c.Assert(err, IsNil)
+
+	fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.Size, Equals, int64(len(original)))
+	c.Assert(fInfo.CurrentChecksum, Equals, expectedChecksum)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
 }
 
-func createQcow2File(filePath string, sizeInGB int64) error {
-	// A simple call to `qemu-img create -f qcow2 $filePath 20G` gives
-	// us a file that's only 196928 bytes on disk.  Unfortunately, this is
-	// *not* an even multiple of 512 bytes (196928 / 512 == 384.625), which
-	// means when we use it as sync file we hit an error: "the file size
-	// 196928 should be a multiple of 512 bytes since Longhorn uses directIO
-	// by default". The least worst workaround for this I could think of
-	// is using `dd` to stick an extra 512 byte block of zeros on the end
+func (s *SyncTestSuite) TestUploadChecksumAlgorithm(c *C) {
+	logrus.Debugf("Testing sync server: TestUploadChecksumAlgorithm")
+
+	originalFilePath := filepath.Join(s.dir, "sync-upload-checksum-original")
+	err := generateRandomDataFile(originalFilePath, "1")
+	c.Assert(err, IsNil)
+	original, err := os.ReadFile(originalFilePath)
+	c.Assert(err, IsNil)
+	sha256Sum := sha256.Sum256(original)
+	blake3Sum := blake3.Sum256(original)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	for i, testCase := range []struct {
+		expectedChecksum  string
+		checksumAlgorithm types.ChecksumAlgorithm
+		currentChecksum   string
+	}{
+		{"sha256:" + hex.EncodeToString(sha256Sum[:]), types.ChecksumAlgorithmSHA256, "sha256:" + hex.EncodeToString(sha256Sum[:])},
+		{"SHA256:" + strings.ToUpper(hex.EncodeToString(sha256Sum[:])), types.ChecksumAlgorithmSHA256, "sha256:" + hex.EncodeToString(sha256Sum[:])},
+		{"blake3:" + hex.EncodeToString(blake3Sum[:]), types.ChecksumAlgorithmBLAKE3, "blake3:" + hex.EncodeToString(blake3Sum[:])},
+		{"", types.ChecksumAlgorithmSHA512, ""},
+	} {
+		curPath := filepath.Join(s.dir, fmt.Sprintf("sync-upload-checksum-%d", i))
+		err = cli.Upload(originalFilePath, curPath, fmt.Sprintf("%v-%d", TestSyncingFileUUID, i), TestDiskUUID, testCase.expectedChecksum)
+		c.Assert(err, IsNil)
+
+		fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+		c.Assert(err, IsNil)
+		expectedCurrentChecksum := testCase.currentChecksum
+		if expectedCurrentChecksum == "" {
+			expectedCurrentChecksum, err = util.GetFileChecksum(originalFilePath)
+			c.Assert(err, IsNil)
+		}
+		c.Assert(fInfo.CurrentChecksum, Equals, expectedCurrentChecksum)
+
+		config, err := util.ReadSyncingFileConfig(util.GetSyncingFileConfigFilePath(curPath))
+		c.Assert(err, IsNil)
+		c.Assert(config.ChecksumAlgorithm, Equals, testCase.checksumAlgorithm)
+		c.Assert(config.CurrentChecksum, Equals, expectedCurrentChecksum)
+
+		err = cli.Delete(curPath)
+		c.Assert(err, IsNil)
+	}
+
+	// The file with a mismatching checksum fails.
+	curPath := filepath.Join(s.dir, "sync-upload-checksum-mismatch")
+	err = cli.Upload(originalFilePath, curPath, TestSyncingFileUUID+"-mismatch", TestDiskUUID, "sha256:"+strings.Repeat("0", 64))
+	// The checksum is calculated during the upload, so the mismatch is reported directly.
+	c.Assert(err, ErrorMatches, "(?s).*doesn't match the file actual checksum.*")
+	_, err = getAndWaitFileState(cli, curPath, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+
+	// The unsupported algorithm and the invalid checksum are rejected directly.
+	err = cli.Upload(originalFilePath, filepath.Join(s.dir, "sync-upload-checksum-invalid"), TestSyncingFileUUID+"-invalid", TestDiskUUID, "md5:"+strings.Repeat("0", 32))
+	c.Assert(err, ErrorMatches, "(?s).*unsupported checksum algorithm md5.*")
+	err = cli.Upload(originalFilePath, filepath.Join(s.dir, "sync-upload-checksum-invalid"), TestSyncingFileUUID+"-invalid", TestDiskUUID, "sha256:"+strings.Repeat("0", 32))
+	c.Assert(err, ErrorMatches, "(?s).*invalid sha256 checksum.*")
+}
+
+func (s *SyncTestSuite) TestUploadSession(c *C) {
+	logrus.Debugf("Testing sync server: TestUploadSession")
+
+	originalFilePath := filepath.Join(s.dir, "sync-upload-session-original")
+	err := generateRandomDataFile(originalFilePath, "3")
+	c.Assert(err, IsNil)
+	original, err := os.ReadFile(originalFilePath)
+	c.Assert(err, IsNil)
+	expectedChecksum, err := util.GetFileChecksum(originalFilePath)
+	c.Assert(err, IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	curPath := filepath.Join(s.dir, "sync-upload-session")
+	session, err := cli.CreateUploadSession(curPath, TestSyncingFileUUID, TestDiskUUID, expectedChecksum, "", "", "", "", int64(len(original)))
+	c.Assert(err, IsNil)
+	c.Assert(session.Size, Equals, int64(len(original)))
+	c.Assert(session.Offset, Equals, int64(0))
+	c.Assert(session.State, Equals, string(types.StateInProgress))
+
+	session, err = cli.UploadChunk(curPath, 0, original[:MB])
+	c.Assert(err, IsNil)
+	c.Assert(session.Offset, Equals, int64(MB))
+
+	// The chunk not starting at the received offset is rejected.
+	_, err = cli.UploadChunk(curPath, 0, original[:MB])
+	c.Assert(err, ErrorMatches, fmt.Sprintf("(?s).*%d.*the chunk offset doesn't match the received offset.*", http.StatusConflict))
+	_, err = cli.UploadChunk(curPath, 2*MB, original[2*MB:])
+	c.Assert(err, ErrorMatches, fmt.Sprintf("(?s).*%d.*the chunk offset doesn't match the received offset.*", http.StatusConflict))
+
+	// The chunk with a mismatching checksum is rejected, and the received offset won't move.
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/v1/files/%s/upload?offset=%d&checksum=%s", s.httpAddr, url.QueryEscape(curPath), MB, client.GetChunkChecksum(original[:MB])), bytes.NewReader(original[MB:2*MB]))
+	c.Assert(err, IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(resp.Body.Close(), IsNil)
+	session, err = cli.GetUploadSession(curPath)
+	c.Assert(err, IsNil)
+	c.Assert(session.Offset, Equals, int64(MB))
+
+	// The upload cannot be finalized before all chunks are received.
+	err = cli.FinalizeUploadSession(curPath)
+	c.Assert(err, ErrorMatches, "(?s).*only 1048576 of 3145728 bytes are received.*")
+
+	// Creating the session again resumes the upload from the received offset.
+	session, err = cli.CreateUploadSession(curPath, TestSyncingFileUUID, TestDiskUUID, expectedChecksum, "", "", "", "", int64(len(original)))
+	c.Assert(err, IsNil)
+	c.Assert(session.Offset, Equals, int64(MB))
+	_, err = cli.CreateUploadSession(curPath, TestSyncingFileUUID+"-other", TestDiskUUID, expectedChecksum, "", "", "", "", int64(len(original)))
+	c.Assert(err, ErrorMatches, "(?s).*already exists.*")
+
+	for session.Offset < int64(len(original)) {
+		session, err = cli.UploadChunk(curPath, session.Offset, original[session.Offset:session.Offset+MB])
+		c.Assert(err, IsNil)
+	}
+	err = cli.FinalizeUploadSession(curPath)
+	c.Assert(err, IsNil)
+
+	// The checksum is calculated during the upload, so the file is ready immediately.
+	fInfo, err := cli.Get(curPath)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.State, Equals, string(types.StateReady))
+	c.Assert(fInfo.Size, Equals, int64(len(original)))
+	c.Assert(fInfo.CurrentChecksum, Equals, expectedChecksum)
+	_, err = os.Stat(util.GetBlockChecksumsFilePath(curPath))
+	c.Assert(err, IsNil)
+
+	// Finalizing a ready file does nothing.
+	err = cli.FinalizeUploadSession(curPath)
+	c.Assert(err, IsNil)
+	session, err = cli.GetUploadSession(curPath)
+	c.Assert(err, IsNil)
+	c.Assert(session.Offset, Equals, int64(len(original)))
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestUploadSessionCompressed(c *C) {
+	logrus.Debugf("Testing sync server: TestUploadSessionCompressed")
+
+	originalFilePath := filepath.Join(s.dir, "sync-upload-session-compressed-original")
+	err := generateRandomDataFile(originalFilePath, "1")
+	c.Assert(err, IsNil)
+	original, err := os.ReadFile(originalFilePath)
+	c.Assert(err, IsNil)
+	expectedChecksum, err := util.GetFileChecksum(originalFilePath)
+	c.Assert(err, IsNil)
+
+	compressed := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(compressed)
+	_, err = gzipWriter.Write(original)
+	c.Assert(err, IsNil)
+	c.Assert(gzipWriter.Close(), IsNil)
+	data := compressed.Bytes()
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	// The compression is detected from the first chunk.
+	curPath := filepath.Join(s.dir, "sync-upload-session-compressed")
+	session, err := cli.CreateUploadSession(curPath, TestSyncingFileUUID, TestDiskUUID, expectedChecksum, "", "", "", "", int64(len(data)))
+	c.Assert(err, IsNil)
+	half := int64(len(data) / 2)
+	session, err = cli.UploadChunk(curPath, session.Offset, data[:half])
+	c.Assert(err, IsNil)
+	session, err = cli.UploadChunk(curPath, session.Offset, data[half:])
+	c.Assert(err, IsNil)
+	c.Assert(session.Offset, Equals, int64(len(data)))
+	err = cli.FinalizeUploadSession(curPath)
+	c.Assert(err, IsNil)
+
+	fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.Size, Equals, int64(len(original)))
+	c.Assert(fInfo.CurrentChecksum, Equals, expectedChecksum)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestEvents(c *C) {
+	logrus.Debugf("Testing sync server: TestEvents")
+
+	originalFilePath := filepath.Join(s.dir, "sync-events-original")
+	err := generateRandomDataFile(originalFilePath, "1")
+	c.Assert(err, IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	watch := func(ctx context.Context, epoch, revision int64) chan *api.FileEvent {
+		eventCh := make(chan *api.FileEvent, 100)
+		go func() {
+			_ = cli.WatchEvents(ctx, epoch, revision, func(event *api.FileEvent) error {
+				eventCh <- event
+				return nil
+			})
+		}()
+		return eventCh
+	}
+	waitForEvent := func(eventCh chan *api.FileEvent, eventType api.FileEventType, state string) *api.FileEvent {
+		timeout := time.After(30 * time.Second)
+		for {
+			select {
+			case event := <-eventCh:
+				if event.Type == eventType && (state == "" || event.FileInfo.State == state) {
+					return event
+				}
+			case <-timeout:
+				c.Fatalf("timeout waiting for event %v with state %v", eventType, state)
+			}
+		}
+	}
+
+	// A new subscriber without a revision starts with a reset event.
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	eventCh := watch(ctx, 0, 0)
+	resetEvent := waitForEvent(eventCh, api.FileEventTypeReset, "")
+	c.Assert(resetEvent.Revision, Equals, int64(0))
+	epoch := resetEvent.Epoch
+	c.Assert(epoch, Not(Equals), int64(0))
+
+	curPath := filepath.Join(s.dir, "sync-events")
+	err = cli.Upload(originalFilePath, curPath, TestSyncingFileUUID, TestDiskUUID, "")
+	c.Assert(err, IsNil)
+
+	createdEvent := waitForEvent(eventCh, api.FileEventTypeCreated, "")
+	c.Assert(createdEvent.FileInfo.FilePath, Equals, curPath)
+	readyEvent := waitForEvent(eventCh, api.FileEventTypeState, string(types.StateReady))
+	c.Assert(readyEvent.Revision > createdEvent.Revision, Equals, true)
+	c.Assert(readyEvent.FileInfo.Progress, Equals, 100)
+
+	// The ready file modified on the disk is re-validated even if no client lists or gets it.
+	time.Sleep(time.Second)
+	err = os.WriteFile(curPath, []byte("modified"), 0666)
+	c.Assert(err, IsNil)
+	failedEvent := waitForEvent(eventCh, api.FileEventTypeState, string(types.StateFailed))
+	c.Assert(failedEvent.FileInfo.Message, Matches, "ready file is modified at .* with a different checksum .*")
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+	deletedEvent := waitForEvent(eventCh, api.FileEventTypeDeleted, "")
+	c.Assert(deletedEvent.Revision > failedEvent.Revision, Equals, true)
+	c.Assert(deletedEvent.FileInfo.FilePath, Equals, curPath)
+	cancel()
+
+	// A subscriber resumes from its last revision.
+	ctx, cancel = context.WithCancel(s.ctx)
+	defer cancel()
+	eventCh = watch(ctx, epoch, createdEvent.Revision)
+	select {
+	case event := <-eventCh:
+		c.Assert(event.Revision, Equals, createdEvent.Revision+1)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for the replayed event")
+	}
+	replayedDeletedEvent := waitForEvent(eventCh, api.FileEventTypeDeleted, "")
+	c.Assert(replayedDeletedEvent.Revision, Equals, deletedEvent.Revision)
+	cancel()
+
+	// A subscriber with an unknown revision starts over.
+	ctx, cancel = context.WithCancel(s.ctx)
+	defer cancel()
+	eventCh = watch(ctx, epoch, deletedEvent.Revision+100)
+	resetEvent = waitForEvent(eventCh, api.FileEventTypeReset, "")
+	c.Assert(resetEvent.Revision, Equals, deletedEvent.Revision)
+	cancel()
+
+	// A subscriber with a revision of another epoch, e.g., from before the server restart, starts over
+	// even if the revision exists in the current epoch.
+	ctx, cancel = context.WithCancel(s.ctx)
+	defer cancel()
+	eventCh = watch(ctx, epoch-1, createdEvent.Revision)
+	select {
+	case event := <-eventCh:
+		c.Assert(event.Type, Equals, api.FileEventTypeReset)
+		c.Assert(event.Epoch, Equals, epoch)
+		c.Assert(event.Revision, Equals, deletedEvent.Revision)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for the reset event")
+	}
+	cancel()
+
+	// The last event ID carries the epoch as well.
+	request, err := http.NewRequestWithContext(s.ctx, http.MethodGet, s.httpAddr+"/v1/events", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set("Last-Event-ID", fmt.Sprintf("%d-%d", epoch, createdEvent.Revision))
+	resp, err := http.DefaultClient.Do(request)
+	c.Assert(err, IsNil)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, fmt.Sprintf("id: %d-%d\n", epoch, createdEvent.Revision+1))
+	c.Assert(resp.Body.Close(), IsNil)
+}
+
+func getAndWaitFileScrubResult(cli *client.SyncClient, curPath string, desireResult types.ScrubResult, waitIntervalInSecond int) (fInfo *api.FileInfo, err error) {
+	endTime := time.Now().Add(time.Duration(waitIntervalInSecond) * time.Second)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for time.Now().Before(endTime) {
+		<-ticker.C
+
+		fInfo, err = cli.Get(curPath)
+		if err != nil || fInfo == nil {
+			logrus.Warnf("Failed to get file %v info during wait: %v", curPath, err)
+			continue
+		}
+		if fInfo.LastScrubResult == string(desireResult) {
+			return fInfo, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to wait for file %v scrub result becoming %v within %v second", curPath, desireResult, waitIntervalInSecond)
+}
+
+func getAndWaitFileState(cli *client.SyncClient, curPath, desireState string, waitIntervalInSecond int) (fInfo *api.FileInfo, err error) {
+	endTime := time.Now().Add(time.Duration(waitIntervalInSecond) * time.Second)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for time.Now().Before(endTime) {
+		<-ticker.C
+
+		fInfo, err = cli.Get(curPath)
+		if err != nil || fInfo == nil {
+			logrus.Warnf("Failed to get file %v info during wait: %v", curPath, err)
+			continue
+		}
+
+		if fInfo.State != desireState {
+			logrus.Debugf("Waiting for file %v becoming state %v, current state %v, progress %v%% (%v Byte)",
+				curPath, desireState, fInfo.State, fInfo.Progress, fInfo.ProcessedSize)
+			continue
+		}
+
+		if fInfo.State == string(types.StateReady) {
+			config, err := util.ReadSyncingFileConfig(util.GetSyncingFileConfigFilePath(curPath))
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the config file after waiting for the file becoming state %v: %v", types.StateReady, err)
+			}
+			checksumAlgorithm, _, err := util.ParseChecksum(fInfo.CurrentChecksum)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the current checksum %v after waiting for the file becoming state %v: %v", fInfo.CurrentChecksum, types.StateReady, err)
+			}
+			fInfoConfig := util.SyncingFileConfig{
+				FilePath:         fInfo.FilePath,
+				UUID:             fInfo.UUID,
+				Size:             fInfo.Size,
+				VirtualSize:      fInfo.VirtualSize,
+				RealSize:         fInfo.RealSize,
+				ExpectedChecksum: fInfo.ExpectedChecksum,
+				CurrentChecksum:  fInfo.CurrentChecksum,
+				ModificationTime: fInfo.ModificationTime,
+
+				ChecksumAlgorithm: checksumAlgorithm,
+			}
+			if !reflect.DeepEqual(*config, fInfoConfig) {
+				return nil, fmt.Errorf("the file config %+v does not match the file info %+v after waiting for the file becoming state %v: %v", *config, fInfoConfig, types.StateReady, err)
+			}
+		}
+		return fInfo, nil
+	}
+
+	if fInfo != nil {
+		return nil, fmt.Errorf("failed to wait for file %v to become state %v within %v second, "+
+			"current state: %v, progress %v, current checksum %v, message: %v",
+			curPath, desireState, waitIntervalInSecond,
+			fInfo.State, fInfo.Progress, fInfo.CurrentChecksum, fInfo.Message)
+	}
+	return nil, fmt.Errorf("failed to wait for datasource file to become state %v within %v second, no file info",
+		desireState, waitIntervalInSecond)
+}
+
+func prepareTestWorkDirectory() (string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(currentUser.HomeDir, "test-dir", "sync-tests")
+	if err = os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(dir, 0666); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func generateRandomDataFile(filePath, sizeInMB string) error {
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return exec.Command("dd", "if=/dev/urandom", "of="+filePath, "bs=1M", "count="+sizeInMB).Run()
+}
+
+func createQcow2File(filePath string, sizeInGB int64) error {
+	// A simple call to `qemu-img create -f qcow2 $filePath 20G` gives
+	// us a file that's only 196928 bytes on disk.  Unfortunately, this is
+	// *not* an even multiple of 512 bytes (196928 / 512 == 384.625), which
+	// means when we use it as sync file we hit an error: "the file size
+	// 196928 should be a multiple of 512 bytes since Longhorn uses directIO
+	// by default". The least worst workaround for this I could think of
+	// is using `dd` to stick an extra 512 byte block of zeros on the end
 	// if the file size isn't evenly divisible by 512.
 	_, err := imageutil.NewQemuImgExecutor().Exec([]string{}, "create", "-f", "qcow2", filePath, strconv.FormatInt(sizeInGB, 10)+"G")
 	if err != nil {
@@ -857,3 +1584,1088 @@ func createQcow2File(filePath string, sizeInGB int64) error {
 	}
 	return exec.Command("dd", "if=/dev/zero", "of="+filePath, "bs=512", "count=1", "seek="+strconv.FormatInt(stat.Size()/512+1, 10)).Run()
 }
+
+func (s *SyncTestSuite) TestMetrics(c *C) {
+	logrus.Debugf("Testing sync server: TestMetrics")
+
+	originalFilePath := filepath.Join(s.dir, "sync-metrics-original")
+	err := generateRandomDataFile(originalFilePath, "1")
+	c.Assert(err, IsNil)
+	fetchSrcFilePath := filepath.Join(s.dir, "sync-metrics-fetch-src")
+	err = generateRandomDataFile(fetchSrcFilePath, "1")
+	c.Assert(err, IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	uploadPath := filepath.Join(s.dir, "sync-metrics-upload")
+	err = cli.Upload(originalFilePath, uploadPath, TestSyncingFileUUID, TestDiskUUID, "")
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, uploadPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	// The checksum of the fetched file is calculated after the processing.
+	fetchPath := filepath.Join(s.dir, "sync-metrics-fetch")
+	err = cli.Fetch(fetchSrcFilePath, fetchPath, TestSyncingFileUUID+"-fetch", TestDiskUUID, "", MB)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, fetchPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	resp, err := http.Get(s.httpAddr + "/v1/files/" + url.QueryEscape(uploadPath) + "/download")
+	c.Assert(err, IsNil)
+	_, err = io.Copy(io.Discard, resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Body.Close(), IsNil)
+
+	// Wait for the file counts refreshed
+	time.Sleep(2 * EventCheckInterval)
+
+	resp, err = http.Get(s.httpAddr + "/metrics")
+	c.Assert(err, IsNil)
+	body, err := io.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Body.Close(), IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	for _, metric := range []string{
+		`backing_image_manager_transferred_bytes_total{direction="received",source_type="upload"}`,
+		`backing_image_manager_transferred_bytes_total{direction="sent",source_type="export"}`,
+		`backing_image_manager_operation_duration_seconds_count{operation="upload",outcome="succeeded"}`,
+		`backing_image_manager_operation_duration_seconds_count{operation="fetch",outcome="succeeded"}`,
+		`backing_image_manager_checksum_duration_seconds_count{algorithm="sha512"}`,
+		`backing_image_manager_files{state="ready"} 2`,
+		`backing_image_manager_files{state="failed"} 0`,
+	} {
+		c.Assert(strings.Contains(string(body), metric), Equals, true, Commentf("missing metric %v", metric))
+	}
+
+	err = cli.Delete(uploadPath)
+	c.Assert(err, IsNil)
+	err = cli.Delete(fetchPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestBandwidthLimits(c *C) {
+	logrus.Debugf("Testing sync server: TestBandwidthLimits")
+
+	originalFilePath := filepath.Join(s.dir, "sync-bandwidth-limits-original")
+	err := generateRandomDataFile(originalFilePath, "2")
+	c.Assert(err, IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	limits, err := cli.GetBandwidthLimits()
+	c.Assert(err, IsNil)
+	c.Assert(*limits, Equals, api.BandwidthLimits{})
+
+	_, err = cli.UpdateBandwidthLimits(&api.BandwidthLimits{Upload: -1})
+	c.Assert(err, NotNil)
+
+	limits, err = cli.UpdateBandwidthLimits(&api.BandwidthLimits{Total: 100 * MB, Upload: MB})
+	c.Assert(err, IsNil)
+	c.Assert(*limits, Equals, api.BandwidthLimits{Total: 100 * MB, Upload: MB})
+
+	// Uploading 2MiB data takes about 2 seconds with the upload limit.
+	uploadPath := filepath.Join(s.dir, "sync-bandwidth-limits-upload")
+	startedAt := time.Now()
+	err = cli.Upload(originalFilePath, uploadPath, TestSyncingFileUUID, TestDiskUUID, "")
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, uploadPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(startedAt) > 1500*time.Millisecond, Equals, true)
+
+	err = cli.Delete(uploadPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestRateLimitedSendingCancellation(c *C) {
+	logrus.Debugf("Testing sync server: TestRateLimitedSendingCancellation")
+
+	filePath := filepath.Join(s.dir, "sync-rate-limited-sending-cancellation")
+	err := generateRandomDataFile(filePath, "1")
+	c.Assert(err, IsNil)
+	fileIo, err := sparse.NewBufferedFileIoProcessor(filePath, os.O_RDONLY, 0)
+	c.Assert(err, IsNil)
+	defer fileIo.Close()
+
+	// Reading 1MiB data takes about 1024 seconds with the limit, unless the sending is cancelled.
+	ctx, cancel := context.WithCancel(s.ctx)
+	limitedFileIo := &rateLimitedFileIo{FileIoProcessor: fileIo, ctx: ctx, limiter: util.NewRateLimiter(1024)}
+	go func() {
+		time.Sleep(time.Second)
+		cancel()
+	}()
+	startedAt := time.Now()
+	_, err = limitedFileIo.ReadAt(make([]byte, MB), 0)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(time.Since(startedAt) < 10*time.Second, Equals, true)
+}
+
+func (s *SyncTestSuite) TestOperationScheduling(c *C) {
+	logrus.Debugf("Testing sync server: TestOperationScheduling")
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{ConcurrencyLimits: map[string]int{OperationDownload: 1}}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+	highPriorityCli := &client.SyncClient{
+		Remote:   s.addr,
+		Priority: 10,
+	}
+
+	runningPath := filepath.Join(s.dir, "sync-scheduling-running")
+	err := cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", runningPath, TestSyncingFileUUID+"-running", TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, runningPath, string(types.StateInProgress), 30)
+	c.Assert(err, IsNil)
+
+	lowPriorityPath := filepath.Join(s.dir, "sync-scheduling-low-priority")
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", lowPriorityPath, TestSyncingFileUUID+"-low-priority", TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	highPriorityPath := filepath.Join(s.dir, "sync-scheduling-high-priority")
+	err = highPriorityCli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", highPriorityPath, TestSyncingFileUUID+"-high-priority", TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+
+	// The later operation with higher priority is ahead in the queue.
+	queued := false
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Second)
+		lowPriorityInfo, err := cli.Get(lowPriorityPath)
+		c.Assert(err, IsNil)
+		highPriorityInfo, err := cli.Get(highPriorityPath)
+		c.Assert(err, IsNil)
+		if lowPriorityInfo.Queued == 2 && highPriorityInfo.Queued == 1 {
+			c.Assert(lowPriorityInfo.State, Equals, string(types.StateStarting))
+			c.Assert(highPriorityInfo.State, Equals, string(types.StateStarting))
+			queued = true
+			break
+		}
+	}
+	c.Assert(queued, Equals, true)
+
+	_, err = getAndWaitFileState(cli, runningPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	highPriorityInfo, err := getAndWaitFileState(cli, highPriorityPath, string(types.StateInProgress), 30)
+	c.Assert(err, IsNil)
+	c.Assert(highPriorityInfo.Queued, Equals, 0)
+	lowPriorityInfo, err := cli.Get(lowPriorityPath)
+	c.Assert(err, IsNil)
+	c.Assert(lowPriorityInfo.Queued, Equals, 1)
+
+	for _, filePath := range []string{runningPath, lowPriorityPath, highPriorityPath} {
+		err = cli.Delete(filePath)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *SyncTestSuite) TestDiskSpaceAdmission(c *C) {
+	logrus.Debugf("Testing sync server: TestDiskSpaceAdmission")
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{DiskSpaceSafetyMargin: 1 << 60}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	// The download fails before writing any data since the safety margin cannot be satisfied.
+	curPath := filepath.Join(s.dir, "sync-disk-space-admission")
+	err := cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	fileInfo, err := getAndWaitFileState(cli, curPath, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fileInfo.FailureReason, Equals, string(types.FailureReasonInsufficientSpace))
+	c.Assert(fileInfo.ProcessedSize, Equals, int64(0))
+	_, err = os.Stat(curPath + TmpFileSuffix)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+
+	// The upload session fails before receiving any chunk.
+	sessionPath := filepath.Join(s.dir, "sync-disk-space-admission-session")
+	_, err = cli.CreateUploadSession(sessionPath, TestSyncingFileUUID+"-session", TestDiskUUID, "", "", "", "", "", MB)
+	c.Assert(err, NotNil)
+	fileInfo, err = getAndWaitFileState(cli, sessionPath, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fileInfo.FailureReason, Equals, string(types.FailureReasonInsufficientSpace))
+	err = cli.Delete(sessionPath)
+	c.Assert(err, IsNil)
+
+	// The reservations of the concurrent operations are counted in the admission.
+	available, err := util.GetDiskAvailableSpace(s.dir)
+	c.Assert(err, IsNil)
+	size := available / 5 * 3
+	reserver, err := NewSpaceReserver(0)
+	c.Assert(err, IsNil)
+	firstPath := filepath.Join(s.dir, "sync-disk-space-reservation-1")
+	secondPath := filepath.Join(s.dir, "sync-disk-space-reservation-2")
+	err = reserver.reserve(firstPath, size)
+	c.Assert(err, IsNil)
+	err = reserver.reserve(secondPath, size)
+	c.Assert(errors.Is(err, ErrInsufficientSpace), Equals, true)
+	reserver.release(firstPath)
+	err = reserver.reserve(secondPath, size)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestDecompressedSpaceReservation(c *C) {
+	logrus.Debugf("Testing sync server: TestDecompressedSpaceReservation")
+
+	originalFilePath := filepath.Join(s.dir, "sync-decompressed-space-original")
+	err := generateRandomDataFile(originalFilePath, "1")
+	c.Assert(err, IsNil)
+	original, err := os.ReadFile(originalFilePath)
+	c.Assert(err, IsNil)
+	expectedChecksum, err := util.GetFileChecksum(originalFilePath)
+	c.Assert(err, IsNil)
+
+	compressed := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(compressed)
+	_, err = gzipWriter.Write(original)
+	c.Assert(err, IsNil)
+	c.Assert(gzipWriter.Close(), IsNil)
+	data := compressed.Bytes()
+	compressedFilePath := originalFilePath + ".gz"
+	err = os.WriteFile(compressedFilePath, data, 0666)
+	c.Assert(err, IsNil)
+
+	// The disk can hold the compressed data, but not a reservation step of the decompressed data.
+	available, err := util.GetDiskAvailableSpace(s.dir)
+	c.Assert(err, IsNil)
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{DiskSpaceSafetyMargin: available - 32*MB}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	// The decompression during the upload reserves the space for the decompressed data rather than the compressed size.
+	curPath := filepath.Join(s.dir, "sync-decompressed-space")
+	err = cli.Upload(compressedFilePath, curPath, TestSyncingFileUUID, TestDiskUUID, expectedChecksum)
+	c.Assert(err, NotNil)
+	fileInfo, err := getAndWaitFileState(cli, curPath, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fileInfo.FailureReason, Equals, string(types.FailureReasonInsufficientSpace))
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+
+	// The decompressed copy written after the upload session is reserved as well.
+	sessionPath := filepath.Join(s.dir, "sync-decompressed-space-session")
+	session, err := cli.CreateUploadSession(sessionPath, TestSyncingFileUUID+"-session", TestDiskUUID, expectedChecksum, "", "", "", "", int64(len(data)))
+	c.Assert(err, IsNil)
+	_, err = cli.UploadChunk(sessionPath, session.Offset, data)
+	c.Assert(err, IsNil)
+	err = cli.FinalizeUploadSession(sessionPath)
+	c.Assert(err, NotNil)
+	fileInfo, err = getAndWaitFileState(cli, sessionPath, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fileInfo.FailureReason, Equals, string(types.FailureReasonInsufficientSpace))
+	err = cli.Delete(sessionPath)
+	c.Assert(err, IsNil)
+
+	// The reservation never exceeds the decompressed size limit.
+	limitedPath := filepath.Join(s.dir, "sync-decompressed-space-limited")
+	session, err = cli.CreateUploadSession(limitedPath, TestSyncingFileUUID+"-limited", TestDiskUUID, expectedChecksum, "", strconv.Itoa(2*MB), "", "", int64(len(data)))
+	c.Assert(err, IsNil)
+	_, err = cli.UploadChunk(limitedPath, session.Offset, data)
+	c.Assert(err, IsNil)
+	err = cli.FinalizeUploadSession(limitedPath)
+	c.Assert(err, IsNil)
+	fileInfo, err = getAndWaitFileState(cli, limitedPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fileInfo.CurrentChecksum, Equals, expectedChecksum)
+	err = cli.Delete(limitedPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestCollectLeftovers(c *C) {
+	logrus.Debugf("Testing sync server: TestCollectLeftovers")
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, s.dir, Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	curPath := types.GetBackingImageFilePath(s.dir, "leftover-test", TestSyncingFileUUID)
+	err := os.MkdirAll(filepath.Dir(curPath), 0755)
+	c.Assert(err, IsNil)
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	orphanedDir := types.GetBackingImageDirectory(s.dir, "orphaned", "orphaned-uuid")
+	err = os.MkdirAll(orphanedDir, 0755)
+	c.Assert(err, IsNil)
+	err = generateRandomDataFile(filepath.Join(orphanedDir, types.BackingImageFileName), "1")
+	c.Assert(err, IsNil)
+	conversionFilePath := curPath + util.Qcow2ConversionFileSuffix
+	err = os.WriteFile(conversionFilePath, []byte("leftover"), 0666)
+	c.Assert(err, IsNil)
+	staleDataSourceFilePath := types.GetDataSourceFilePath(s.dir, "stale", "stale-uuid") + TmpFileSuffix
+	activeDataSourceFilePath := types.GetDataSourceFilePath(s.dir, "active", "active-uuid") + TmpFileSuffix
+	err = os.MkdirAll(filepath.Dir(staleDataSourceFilePath), 0755)
+	c.Assert(err, IsNil)
+	for _, filePath := range []string{staleDataSourceFilePath, activeDataSourceFilePath} {
+		err = os.WriteFile(filePath, []byte("leftover"), 0666)
+		c.Assert(err, IsNil)
+	}
+	activeDataSources := []string{types.GetDataSourceFileName("active", "active-uuid")}
+	expectedLeftoverTypes := map[string]api.LeftoverType{
+		orphanedDir:             api.LeftoverTypeOrphanedDirectory,
+		conversionFilePath:      api.LeftoverTypeQcow2ConversionFile,
+		staleDataSourceFilePath: api.LeftoverTypeTmpFile,
+	}
+
+	// A dry run only reports the leftovers.
+	collection, err := cli.CollectLeftovers(true, 0, activeDataSources)
+	c.Assert(err, IsNil)
+	c.Assert(collection.DryRun, Equals, true)
+	c.Assert(collection.Leftovers, HasLen, len(expectedLeftoverTypes))
+	for _, leftover := range collection.Leftovers {
+		c.Assert(leftover.Type, Equals, expectedLeftoverTypes[leftover.Path])
+		c.Assert(leftover.Size > 0, Equals, true)
+		c.Assert(leftover.Expired, Equals, true)
+		c.Assert(leftover.Deleted, Equals, false)
+		_, err = os.Stat(leftover.Path)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(collection.ReclaimedSize, Equals, int64(0))
+
+	// The leftovers within the grace period are kept.
+	collection, err = cli.CollectLeftovers(false, time.Hour, activeDataSources)
+	c.Assert(err, IsNil)
+	c.Assert(collection.Leftovers, HasLen, len(expectedLeftoverTypes))
+	for _, leftover := range collection.Leftovers {
+		c.Assert(leftover.Expired, Equals, false)
+		c.Assert(leftover.Deleted, Equals, false)
+	}
+
+	collection, err = cli.CollectLeftovers(false, 0, activeDataSources)
+	c.Assert(err, IsNil)
+	c.Assert(collection.Leftovers, HasLen, len(expectedLeftoverTypes))
+	reclaimedSize := int64(0)
+	for _, leftover := range collection.Leftovers {
+		c.Assert(leftover.Deleted, Equals, true)
+		reclaimedSize += leftover.Size
+		_, err = os.Stat(leftover.Path)
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
+	c.Assert(collection.ReclaimedSize, Equals, reclaimedSize)
+
+	// The tracked file and the active data source file are untouched.
+	_, err = os.Stat(activeDataSourceFilePath)
+	c.Assert(err, IsNil)
+	fileInfo, err := cli.Get(curPath)
+	c.Assert(err, IsNil)
+	c.Assert(fileInfo.State, Equals, string(types.StateReady))
+
+	collection, err = cli.CollectLeftovers(true, 0, activeDataSources)
+	c.Assert(err, IsNil)
+	c.Assert(collection.Leftovers, HasLen, 0)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestCollectCloneSourceConversionFile(c *C) {
+	logrus.Debugf("Testing sync server: TestCollectCloneSourceConversionFile")
+
+	diskPath := c.MkDir()
+	service, err := InitService(s.ctx, s.addr, diskPath, Options{}, &MockHandler{})
+	c.Assert(err, IsNil)
+
+	sourcePath := types.GetBackingImageFilePath(diskPath, "clone-source", "clone-source-uuid")
+	targetPath := types.GetBackingImageFilePath(diskPath, "clone-target", "clone-target-uuid")
+	conversionFilePath := sourcePath + util.RawConversionFileSuffix
+	for _, filePath := range []string{sourcePath, targetPath} {
+		err = os.MkdirAll(filepath.Dir(filePath), 0755)
+		c.Assert(err, IsNil)
+	}
+	for _, filePath := range []string{sourcePath, conversionFilePath} {
+		err = os.WriteFile(filePath, []byte("clone"), 0666)
+		c.Assert(err, IsNil)
+	}
+
+	source := newSyncingFile(s.ctx, sourcePath, "clone-source-uuid", TestDiskUUID, "", types.ChecksumAlgorithmSHA512, 0, nil, nil, nil, nil)
+	source.state = types.StateReady
+	target := newSyncingFile(s.ctx, targetPath, "clone-target-uuid", TestDiskUUID, "", types.ChecksumAlgorithmSHA512, 0, nil, nil, nil, nil)
+	target.state = types.StateInProgress
+	target.cloneSourceConversionFilePath = conversionFilePath
+	service.lock.Lock()
+	service.filePathMap[sourcePath] = source
+	service.filePathMap[targetPath] = target
+	service.lock.Unlock()
+
+	// The conversion file of the source is in use while the clone is preparing the target.
+	collection := service.collectLeftovers(false, 0, nil)
+	c.Assert(collection.Leftovers, HasLen, 0)
+	_, err = os.Stat(conversionFilePath)
+	c.Assert(err, IsNil)
+
+	target.lock.Lock()
+	target.state = types.StateFailed
+	target.lock.Unlock()
+	collection = service.collectLeftovers(false, 0, nil)
+	c.Assert(collection.Leftovers, HasLen, 1)
+	c.Assert(collection.Leftovers[0].Path, Equals, conversionFilePath)
+	c.Assert(collection.Leftovers[0].Type, Equals, api.LeftoverTypeRawConversionFile)
+	c.Assert(collection.Leftovers[0].Deleted, Equals, true)
+}
+
+func (s *SyncTestSuite) TestRetentionPolicy(c *C) {
+	logrus.Debugf("Testing sync server: TestRetentionPolicy")
+
+	referencedPath := filepath.Join(s.dir, "sync-retention-referenced")
+	options := Options{
+		// The downloads fail immediately with insufficient space.
+		DiskSpaceSafetyMargin: 1 << 60,
+		RetentionPolicy: RetentionPolicy{
+			FailedFileTTL: 2 * time.Second,
+			IsFileReferenced: func(filePath string, state types.State) bool {
+				return filePath == referencedPath
+			},
+		},
+	}
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", options, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	curPath := filepath.Join(s.dir, "sync-retention")
+	err := cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", referencedPath, TestSyncingFileUUID+"-referenced", TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+
+	fileInfo, err := getAndWaitFileState(cli, curPath, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+	evictionTime, err := time.Parse(time.RFC3339, fileInfo.EvictionTime)
+	c.Assert(err, IsNil)
+	c.Assert(time.Until(evictionTime) <= 2*time.Second, Equals, true)
+	referencedFileInfo, err := getAndWaitFileState(cli, referencedPath, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+	c.Assert(referencedFileInfo.EvictionTime, Equals, "")
+
+	forgotten := false
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Second)
+		if _, err := cli.Get(curPath); err != nil {
+			c.Assert(util.IsHTTPClientErrorNotFound(err), Equals, true)
+			forgotten = true
+			break
+		}
+	}
+	c.Assert(forgotten, Equals, true)
+
+	referencedFileInfo, err = cli.Get(referencedPath)
+	c.Assert(err, IsNil)
+	c.Assert(referencedFileInfo.State, Equals, string(types.StateFailed))
+
+	err = cli.Delete(referencedPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestTLS(c *C) {
+	logrus.Debugf("Testing sync server: TestTLS")
+
+	caCert, caKey, err := generateTestCertificate(nil, nil, "test-ca")
+	c.Assert(err, IsNil)
+	caFile := filepath.Join(s.dir, "ca.crt")
+	err = writeTestCertificate(caFile, "", caCert, caKey)
+	c.Assert(err, IsNil)
+	serverCertFile, serverKeyFile := filepath.Join(s.dir, "server.crt"), filepath.Join(s.dir, "server.key")
+	serverCert, serverKey, err := generateTestCertificate(caCert, caKey, "localhost")
+	c.Assert(err, IsNil)
+	err = writeTestCertificate(serverCertFile, serverKeyFile, serverCert, serverKey)
+	c.Assert(err, IsNil)
+	clientCertFile, clientKeyFile := filepath.Join(s.dir, "client.crt"), filepath.Join(s.dir, "client.key")
+	clientCert, clientKey, err := generateTestCertificate(caCert, caKey, "client")
+	c.Assert(err, IsNil)
+	err = writeTestCertificate(clientCertFile, clientKeyFile, clientCert, clientKey)
+	c.Assert(err, IsNil)
+
+	options := Options{
+		TLS: &util.TLSOptions{
+			CertFile: serverCertFile,
+			KeyFile:  serverKeyFile,
+			CAFile:   caFile,
+		},
+	}
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", options, &MockHandler{})
+	}()
+	// The plain HTTP request gets a bad request response from the TLS server.
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	plainClient := &client.SyncClient{Remote: s.addr}
+	_, err = plainClient.List()
+	c.Assert(err, NotNil)
+
+	noCertClient := &client.SyncClient{Remote: s.addr, TLS: &util.TLSOptions{CAFile: caFile}}
+	_, err = noCertClient.List()
+	c.Assert(err, NotNil)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+		TLS: &util.TLSOptions{
+			CertFile: clientCertFile,
+			KeyFile:  clientKeyFile,
+			CAFile:   caFile,
+		},
+	}
+	_, err = cli.List()
+	c.Assert(err, IsNil)
+
+	curPath := filepath.Join(s.dir, "sync-tls")
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	curInfo, err := cli.Get(curPath)
+	c.Assert(err, IsNil)
+
+	// The files are sent between the peers over TLS.
+	receivePath := filepath.Join(s.dir, "sync-tls-receive")
+	err = cli.Receive(receivePath, TestSyncingFileUUID+"-receive", TestDiskUUID, curInfo.CurrentChecksum, types.SyncingFileTypeRaw, 30001, curInfo.Size, types.DataEnginev1, false)
+	c.Assert(err, IsNil)
+	err = cli.Send(curPath, "localhost:30001")
+	c.Assert(err, IsNil)
+	receiveInfo, err := getAndWaitFileState(cli, receivePath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(receiveInfo.CurrentChecksum, Equals, curInfo.CurrentChecksum)
+
+	// The sender not supporting TLS can still send the file to the receiver explicitly accepting it.
+	plainReceivePath := filepath.Join(s.dir, "sync-tls-plain-receive")
+	err = cli.Receive(plainReceivePath, TestSyncingFileUUID+"-plain-receive", TestDiskUUID, curInfo.CurrentChecksum, types.SyncingFileTypeRaw, 30002, curInfo.Size, types.DataEnginev1, true)
+	c.Assert(err, IsNil)
+	err = RequestBackingImageSending(s.ctx, curPath, "localhost:30002", nil)
+	c.Assert(err, IsNil)
+	plainReceiveInfo, err := getAndWaitFileState(cli, plainReceivePath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(plainReceiveInfo.CurrentChecksum, Equals, curInfo.CurrentChecksum)
+
+	// The rotated server certificate is used by the new connections.
+	c.Assert(getTestPeerCertificateSerialNumber(s.addr, cli.TLS), Equals, serverCert.SerialNumber.String())
+	rotatedServerCert, rotatedServerKey, err := generateTestCertificate(caCert, caKey, "localhost")
+	c.Assert(err, IsNil)
+	err = writeTestCertificate(serverCertFile, serverKeyFile, rotatedServerCert, rotatedServerKey)
+	c.Assert(err, IsNil)
+	modTime := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(serverCertFile, modTime, modTime), IsNil)
+	c.Assert(os.Chtimes(serverKeyFile, modTime, modTime), IsNil)
+	rotated := false
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Second)
+		if getTestPeerCertificateSerialNumber(s.addr, cli.TLS) == rotatedServerCert.SerialNumber.String() {
+			rotated = true
+			break
+		}
+	}
+	c.Assert(rotated, Equals, true)
+
+	// The rotated CA is used by the existing clients to verify the new connections.
+	clientTLS, err := util.NewClientTLS(cli.TLS)
+	c.Assert(err, IsNil)
+	rotatedCACert, rotatedCAKey, err := generateTestCertificate(nil, nil, "test-rotated-ca")
+	c.Assert(err, IsNil)
+	rotatedServerCert, rotatedServerKey, err = generateTestCertificate(rotatedCACert, rotatedCAKey, "localhost")
+	c.Assert(err, IsNil)
+	rotatedClientCert, rotatedClientKey, err := generateTestCertificate(rotatedCACert, rotatedCAKey, "client")
+	c.Assert(err, IsNil)
+	c.Assert(writeTestCertificate(caFile, "", rotatedCACert, rotatedCAKey), IsNil)
+	c.Assert(writeTestCertificate(serverCertFile, serverKeyFile, rotatedServerCert, rotatedServerKey), IsNil)
+	c.Assert(writeTestCertificate(clientCertFile, clientKeyFile, rotatedClientCert, rotatedClientKey), IsNil)
+	modTime = modTime.Add(time.Minute)
+	for _, file := range []string{caFile, serverCertFile, serverKeyFile, clientCertFile, clientKeyFile} {
+		c.Assert(os.Chtimes(file, modTime, modTime), IsNil)
+	}
+	rotated = false
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Second)
+		conn, err := clientTLS.DialContext(context.Background(), "tcp", s.addr)
+		if err != nil {
+			continue
+		}
+		serialNumber := conn.(*tls.Conn).ConnectionState().PeerCertificates[0].SerialNumber.String()
+		_ = conn.Close()
+		if serialNumber == rotatedServerCert.SerialNumber.String() {
+			rotated = true
+			break
+		}
+	}
+	c.Assert(rotated, Equals, true)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
+
+func generateTestCertificate(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, commonName string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{commonName},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func writeTestCertificate(certFile, keyFile string, cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		return err
+	}
+	if keyFile == "" {
+		return nil
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func getTestPeerCertificateSerialNumber(address string, options *util.TLSOptions) string {
+	clientTLS, err := util.NewClientTLS(options)
+	if err != nil {
+		return ""
+	}
+	conn, err := clientTLS.DialContext(context.Background(), "tcp", address)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.(*tls.Conn).ConnectionState().PeerCertificates[0].SerialNumber.String()
+}
+
+func (s *SyncTestSuite) TestAuthentication(c *C) {
+	logrus.Debugf("Testing sync server: TestAuthentication")
+
+	auth, err := util.NewAuthenticator("test-secret")
+	c.Assert(err, IsNil)
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{Auth: auth}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	_, err = (&client.SyncClient{Remote: s.addr}).List()
+	c.Assert(isHTTPClientError(err, http.StatusUnauthorized), Equals, true)
+	_, err = (&client.SyncClient{Remote: s.addr, Token: "invalid-secret"}).List()
+	c.Assert(isHTTPClientError(err, http.StatusUnauthorized), Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+		Token:  auth.GetSecretToken(),
+	}
+	curPath := filepath.Join(s.dir, "sync-auth")
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	readToken, _, err := auth.IssueToken([]util.TokenScope{util.TokenScopeRead}, "", time.Minute)
+	c.Assert(err, IsNil)
+	readClient := &client.SyncClient{Remote: s.addr, Token: readToken}
+	_, err = readClient.List()
+	c.Assert(err, IsNil)
+	err = readClient.Delete(curPath)
+	c.Assert(isHTTPClientError(err, http.StatusForbidden), Equals, true)
+	c.Assert(getTestDebugStatusCode(s.httpAddr, readToken), Equals, http.StatusForbidden)
+	debugToken, _, err := auth.IssueToken([]util.TokenScope{util.TokenScopeDebug}, "", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(getTestDebugStatusCode(s.httpAddr, debugToken), Equals, http.StatusOK)
+
+	expiredToken, _, err := auth.IssueToken([]util.TokenScope{util.TokenScopeRead}, "", -time.Second)
+	c.Assert(err, IsNil)
+	_, err = (&client.SyncClient{Remote: s.addr, Token: expiredToken}).List()
+	c.Assert(isHTTPClientError(err, http.StatusUnauthorized), Equals, true)
+
+	// The download token can only read the file it's issued for.
+	downloadToken, _, err := auth.IssueToken([]util.TokenScope{util.TokenScopeDownload}, curPath, time.Minute)
+	c.Assert(err, IsNil)
+	downloadClient := &client.SyncClient{Remote: s.addr, Token: downloadToken}
+	fileInfo, err := downloadClient.Get(curPath)
+	c.Assert(err, IsNil)
+	c.Assert(fileInfo.State, Equals, string(types.StateReady))
+	_, err = downloadClient.Get(curPath + "-other")
+	c.Assert(isHTTPClientError(err, http.StatusForbidden), Equals, true)
+	_, err = downloadClient.List()
+	c.Assert(isHTTPClientError(err, http.StatusForbidden), Equals, true)
+	err = downloadClient.Delete(curPath)
+	c.Assert(isHTTPClientError(err, http.StatusForbidden), Equals, true)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
+
+func isHTTPClientError(err error, statusCode int) bool {
+	return err != nil && strings.Contains(err.Error(), util.GetHTTPClientErrorPrefix(statusCode))
+}
+
+func getTestDebugStatusCode(httpAddr, token string) int {
+	req, err := http.NewRequest(http.MethodGet, httpAddr+"/debug/pprof/cmdline", nil)
+	if err != nil {
+		return 0
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (s *SyncTestSuite) TestPathConfinement(c *C) {
+	logrus.Debugf("Testing sync server: TestPathConfinement")
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, s.dir, Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	outsideDir := filepath.Join(s.dir, "outside")
+	err := os.MkdirAll(outsideDir, 0755)
+	c.Assert(err, IsNil)
+	outsidePath := filepath.Join(outsideDir, "file")
+	err = generateRandomDataFile(outsidePath, "1")
+	c.Assert(err, IsNil)
+	workDir := filepath.Join(s.dir, types.BackingImageManagerDirectoryName)
+	err = os.MkdirAll(workDir, 0755)
+	c.Assert(err, IsNil)
+	err = os.Symlink(outsideDir, filepath.Join(workDir, "symlink"))
+	c.Assert(err, IsNil)
+
+	for _, filePath := range []string{
+		outsidePath,
+		workDir,
+		filepath.Join(workDir, "..", "outside", "file"),
+		filepath.Join(workDir, "symlink", types.BackingImageFileName),
+		"relative/" + types.BackingImageFileName,
+	} {
+		err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", filePath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+		c.Assert(isHTTPClientError(err, http.StatusForbidden), Equals, true, Commentf("file path %v", filePath))
+	}
+
+	curPath := types.GetBackingImageFilePath(s.dir, "confinement-test", TestSyncingFileUUID)
+	err = cli.Fetch(outsidePath, curPath, TestSyncingFileUUID, TestDiskUUID, "", MockFileSize)
+	c.Assert(isHTTPClientError(err, http.StatusForbidden), Equals, true)
+	_, err = os.Stat(outsidePath)
+	c.Assert(err, IsNil)
+
+	fileInfoList, err := cli.List()
+	c.Assert(err, IsNil)
+	c.Assert(fileInfoList, HasLen, 0)
+
+	err = os.MkdirAll(filepath.Dir(curPath), 0755)
+	c.Assert(err, IsNil)
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestFileURLConfinement(c *C) {
+	logrus.Debugf("Testing sync server: TestFileURLConfinement")
+
+	imageDir := filepath.Join(s.dir, "images")
+	err := os.MkdirAll(imageDir, 0755)
+	c.Assert(err, IsNil)
+	imagePath := filepath.Join(imageDir, "image.raw")
+	err = generateRandomDataFile(imagePath, "1")
+	c.Assert(err, IsNil)
+	outsidePath := filepath.Join(s.dir, "outside.raw")
+	err = generateRandomDataFile(outsidePath, "1")
+	c.Assert(err, IsNil)
+	err = os.Symlink(outsidePath, filepath.Join(imageDir, "symlink.raw"))
+	c.Assert(err, IsNil)
+
+	handler, err := NewHandlerRegistry([]string{imageDir})
+	c.Assert(err, IsNil)
+	go func() {
+		_ = NewServer(s.ctx, s.addr, s.dir, Options{}, handler)
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	curPath := types.GetBackingImageFilePath(s.dir, "file-url-test", TestSyncingFileUUID)
+	err = os.MkdirAll(filepath.Dir(curPath), 0755)
+	c.Assert(err, IsNil)
+	for _, url := range []string{
+		"file://" + outsidePath,
+		"file://" + filepath.Join(imageDir, "symlink.raw"),
+		"file://" + imageDir + "/../outside.raw",
+	} {
+		err = cli.DownloadFromURL(url, "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+		c.Assert(isHTTPClientError(err, http.StatusForbidden), Equals, true, Commentf("URL %v", url))
+	}
+	fileInfoList, err := cli.List()
+	c.Assert(err, IsNil)
+	c.Assert(fileInfoList, HasLen, 0)
+
+	err = cli.DownloadFromURL("file://"+imagePath, "", "", "", "", curPath, TestSyncingFileUUID, TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
+
+func (s *SyncTestSuite) TestDrain(c *C) {
+	logrus.Debugf("Testing sync server: TestDrain")
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	// The src file was moved to the tmp file by the fetch interrupted before the restart.
+	srcPath := filepath.Join(s.dir, "drain-fetch-src")
+	fetchPath := filepath.Join(s.dir, "drain-fetch-dst")
+	tmpPath := fetchPath + TmpFileSuffix
+	err := generateRandomDataFile(tmpPath, "1")
+	c.Assert(err, IsNil)
+	checksum, err := util.GetFileChecksum(tmpPath)
+	c.Assert(err, IsNil)
+	err = util.WriteDownloadCheckpoint(util.GetDownloadCheckpointFilePath(tmpPath), &util.DownloadCheckpoint{
+		Operation: OperationFetch,
+		URL:       srcPath,
+		Size:      MB,
+	})
+	c.Assert(err, IsNil)
+	err = cli.Fetch(srcPath, fetchPath, TestSyncingFileUUID+"-fetch", TestDiskUUID, checksum, MB)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, fetchPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(util.IsDownloadCheckpointExisting(tmpPath), Equals, false)
+
+	// The partial data of a fetch failed without the interruption is not kept.
+	failedSrcPath := filepath.Join(s.dir, "drain-fetch-failed-src")
+	failedFetchPath := filepath.Join(s.dir, "drain-fetch-failed-dst")
+	err = generateRandomDataFile(failedSrcPath, "1")
+	c.Assert(err, IsNil)
+	err = cli.Fetch(failedSrcPath, failedFetchPath, TestSyncingFileUUID+"-fetch-failed", TestDiskUUID, "invalid-checksum", MB)
+	c.Assert(err, IsNil)
+	failedFetchInfo, err := getAndWaitFileState(cli, failedFetchPath, string(types.StateFailed), 30)
+	c.Assert(err, IsNil)
+	c.Assert(failedFetchInfo.FailureReason, Equals, "")
+	_, err = os.Stat(failedFetchPath + TmpFileSuffix)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(util.IsDownloadCheckpointExisting(failedFetchPath+TmpFileSuffix), Equals, false)
+
+	downloadPath := filepath.Join(s.dir, "drain-download")
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", downloadPath, TestSyncingFileUUID+"-download", TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(err, IsNil)
+	_, err = getAndWaitFileState(cli, downloadPath, string(types.StateInProgress), 30)
+	c.Assert(err, IsNil)
+
+	report, err := cli.Drain(time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(report.Interrupted, HasLen, 1)
+	c.Assert(report.Interrupted[0].FilePath, Equals, downloadPath)
+	c.Assert(report.Interrupted[0].Operation, Equals, OperationDownload)
+	c.Assert(report.Interrupted[0].Resumable, Equals, false)
+
+	downloadInfo, err := cli.Get(downloadPath)
+	c.Assert(err, IsNil)
+	c.Assert(downloadInfo.State, Equals, string(types.StateFailed))
+	c.Assert(downloadInfo.FailureReason, Equals, string(types.FailureReasonInterrupted))
+	fetchInfo, err := cli.Get(fetchPath)
+	c.Assert(err, IsNil)
+	c.Assert(fetchInfo.State, Equals, string(types.StateReady))
+
+	err = cli.DownloadFromURL("http://test-download-from-url.io", "", "", "", "", filepath.Join(s.dir, "drain-refused"), TestSyncingFileUUID+"-refused", TestDiskUUID, "", types.DataEnginev1)
+	c.Assert(isHTTPClientError(err, http.StatusServiceUnavailable), Equals, true)
+}
+
+func (s *SyncTestSuite) TestHealth(c *C) {
+	logrus.Debugf("Testing sync server: TestHealth")
+
+	encodedDiskCfg, err := json.Marshal(&util.DiskConfig{DiskUUID: "replaced-disk-uuid"})
+	c.Assert(err, IsNil)
+	err = os.WriteFile(filepath.Join(s.dir, util.DiskConfigFile), encodedDiskCfg, 0666)
+	c.Assert(err, IsNil)
+
+	auth, err := util.NewAuthenticator("test-secret")
+	c.Assert(err, IsNil)
+	go func() {
+		_ = NewServer(s.ctx, s.addr, s.dir, Options{Auth: auth, DiskUUID: TestDiskUUID}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	// The probes don't need a token.
+	resp, err := http.Get(s.httpAddr + types.HealthzPath)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Body.Close(), IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	resp, err = http.Get(s.httpAddr + types.ReadyzPath)
+	c.Assert(err, IsNil)
+	report := &api.HealthReport{}
+	err = json.NewDecoder(resp.Body).Decode(report)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Body.Close(), IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(report.Ready, Equals, false)
+
+	checks := map[string]api.HealthCheck{}
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+	}
+	c.Assert(checks, HasLen, 4)
+	c.Assert(checks["disk"].Healthy, Equals, true)
+	c.Assert(checks["disk-uuid"].Healthy, Equals, false)
+	c.Assert(strings.Contains(checks["disk-uuid"].Error, "replaced-disk-uuid"), Equals, true)
+	_, exists := checks["qemu-img"]
+	c.Assert(exists, Equals, true)
+	_, exists = checks["cryptsetup"]
+	c.Assert(exists, Equals, true)
+
+	// The other requests are still authenticated.
+	_, err = (&client.SyncClient{Remote: s.addr}).List()
+	c.Assert(isHTTPClientError(err, http.StatusUnauthorized), Equals, true)
+}
+
+func (s *SyncTestSuite) TestImageConversion(c *C) {
+	logrus.Debugf("Testing sync server: TestImageConversion")
+
+	rawFilePath := filepath.Join(s.dir, "sync-image-conversion-raw")
+	err := generateRandomDataFile(rawFilePath, "1")
+	c.Assert(err, IsNil)
+	rawChecksum, err := util.GetFileChecksum(rawFilePath)
+	c.Assert(err, IsNil)
+
+	vmdkFilePath := filepath.Join(s.dir, "sync-image-conversion-vmdk")
+	_, err = imageutil.NewQemuImgExecutor().Exec([]string{}, "convert", "-f", "raw", "-O", "vmdk", rawFilePath, vmdkFilePath)
+	c.Assert(err, IsNil)
+	vmdk, err := os.ReadFile(vmdkFilePath)
+	c.Assert(err, IsNil)
+	vmdkChecksum, err := util.GetFileChecksum(vmdkFilePath)
+	c.Assert(err, IsNil)
+
+	go func() {
+		_ = NewServer(s.ctx, s.addr, "", Options{}, &MockHandler{})
+	}()
+	isRunning := util.DetectHTTPServerAvailability(s.httpAddr, 5, true)
+	c.Assert(isRunning, Equals, true)
+
+	cli := &client.SyncClient{
+		Remote: s.addr,
+	}
+
+	curPath := filepath.Join(s.dir, "sync-image-conversion")
+	_, err = cli.CreateUploadSession(curPath, TestSyncingFileUUID, TestDiskUUID, vmdkChecksum, "", "", types.ImageFormatVDI, "", int64(len(vmdk)))
+	c.Assert(err, ErrorMatches, "(?s).*unsupported target format.*")
+	_, err = cli.CreateUploadSession(curPath, TestSyncingFileUUID, TestDiskUUID, vmdkChecksum, "", "", types.SyncingFileTypeQcow2, types.DataEnginev2, int64(len(vmdk)))
+	c.Assert(err, ErrorMatches, "(?s).*not supported by data engine v2.*")
+
+	// The expected checksum is the one of the source image.
+	session, err := cli.CreateUploadSession(curPath, TestSyncingFileUUID, TestDiskUUID, vmdkChecksum, "", "", types.SyncingFileTypeRaw, "", int64(len(vmdk)))
+	c.Assert(err, IsNil)
+	for session.Offset < int64(len(vmdk)) {
+		end := session.Offset + MB
+		if end > int64(len(vmdk)) {
+			end = int64(len(vmdk))
+		}
+		session, err = cli.UploadChunk(curPath, session.Offset, vmdk[session.Offset:end])
+		c.Assert(err, IsNil)
+	}
+	err = cli.FinalizeUploadSession(curPath)
+	c.Assert(err, IsNil)
+
+	fInfo, err := getAndWaitFileState(cli, curPath, string(types.StateReady), 30)
+	c.Assert(err, IsNil)
+	c.Assert(fInfo.SourceFormat, Equals, types.ImageFormatVMDK)
+	c.Assert(fInfo.SourceChecksum, Equals, vmdkChecksum)
+	c.Assert(fInfo.CurrentChecksum, Equals, rawChecksum)
+	c.Assert(fInfo.Size, Equals, int64(MB))
+
+	config, err := util.ReadSyncingFileConfig(util.GetSyncingFileConfigFilePath(curPath))
+	c.Assert(err, IsNil)
+	c.Assert(config.SourceFormat, Equals, types.ImageFormatVMDK)
+	c.Assert(config.SourceChecksum, Equals, vmdkChecksum)
+
+	err = cli.Delete(curPath)
+	c.Assert(err, IsNil)
+}
@@ -1,8 +1,10 @@
 package sync
 
 import (
+	"bufio"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,12 +25,18 @@ import (
 	"github.com/longhorn/sparse-tools/sparse"
 
 	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/client"
+	"github.com/longhorn/backing-image-manager/pkg/health"
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
 	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
 )
 
 const (
-	AutoForgetCheckInterval = time.Hour
-	AutoForgetWaitInterval  = 24 * time.Hour
+	// AutoForgetCheckInterval is the max interval of checking the files to be forgotten by the retention policy.
+	AutoForgetCheckInterval = time.Minute
+	// AutoForgetWaitInterval is the default TTL of the ready and the failed files in the retention policy.
+	AutoForgetWaitInterval = 24 * time.Hour
 )
 
 type Service struct {
@@ -39,14 +48,33 @@ type Service struct {
 	filePathMap map[string]*SyncingFile
 	fileUUIDMap map[string]*SyncingFile
 
+	// diskPath is empty if the service doesn't manage the backing images in a disk, e.g. in a data source.
+	diskPath string
+
+	options          Options
+	bandwidthLimiter *BandwidthLimiter
+	scheduler        *OperationScheduler
+	spaceReserver    *SpaceReserver
+	retentionPolicy  *RetentionPolicy
+	pathConfinement  *PathConfinement
+	healthChecker    *health.Checker
+
+	events       *eventHub
+	eventTrigger chan struct{}
+
+	// draining refuses the new operations once the drain starts.
+	draining bool
+
 	// for unit test
 	handler Handler
 	sender  Sender
 }
 
-type Sender func(string, string) error
+// Sender sends the file to the receiver address. The read of the file is limited by the limiter,
+// and the wait for the limiter is cancelled along with the context.
+type Sender func(ctx context.Context, filePath, receiverAddress string, limiter *util.RateLimiter) error
 
-func InitService(ctx context.Context, listenAddr string, handler Handler) (*Service, error) {
+func InitService(ctx context.Context, listenAddr, diskPath string, options Options, handler Handler) (*Service, error) {
 	s := &Service{
 		ctx: ctx,
 		log: logrus.StandardLogger().WithFields(
@@ -59,58 +87,167 @@ func InitService(ctx context.Context, listenAddr string, handler Handler) (*Serv
 		filePathMap: map[string]*SyncingFile{},
 		fileUUIDMap: map[string]*SyncingFile{},
 
+		diskPath: diskPath,
+
+		options:          options,
+		bandwidthLimiter: options.BandwidthLimiter,
+		retentionPolicy:  &options.RetentionPolicy,
+
+		events:       newEventHub(),
+		eventTrigger: make(chan struct{}, 1),
+
 		handler: handler,
 		sender:  RequestBackingImageSending,
 	}
 
-	// go s.autoForget()
+	if s.bandwidthLimiter == nil {
+		bandwidthLimiter, err := NewBandwidthLimiter(api.BandwidthLimits{})
+		if err != nil {
+			return nil, err
+		}
+		s.bandwidthLimiter = bandwidthLimiter
+	}
 
-	s.log.Debugf("Sync Service: initialized")
+	scheduler, err := NewOperationScheduler(ctx, options.ConcurrencyLimits)
+	if err != nil {
+		return nil, err
+	}
+	s.scheduler = scheduler
 
-	// TODO: Add websocket to notify the syncing file update
+	spaceReserver, err := NewSpaceReserver(options.DiskSpaceSafetyMargin)
+	if err != nil {
+		return nil, err
+	}
+	s.spaceReserver = spaceReserver
+
+	allowedRoots := options.AllowedRoots
+	if len(allowedRoots) == 0 && diskPath != "" {
+		allowedRoots = GetDiskAllowedRoots(diskPath)
+	}
+	pathConfinement, err := NewPathConfinement(allowedRoots)
+	if err != nil {
+		return nil, err
+	}
+	s.pathConfinement = pathConfinement
+	if options.TLS.Enabled() {
+		clientTLS, err := util.NewClientTLS(options.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.sender = newTLSSender(clientTLS, s.sender)
+	}
+
+	var healthChecks []health.Check
+	if diskPath != "" {
+		healthChecks = append(healthChecks, health.DiskCheck(diskPath))
+		if options.DiskUUID != "" {
+			healthChecks = append(healthChecks, health.DiskUUIDCheck(diskPath, options.DiskUUID))
+		}
+	}
+	healthChecks = append(healthChecks, health.QemuImgCheck(), health.CryptsetupCheck())
+	s.healthChecker = health.NewChecker(healthChecks...)
+
+	if options.RetentionPolicy.FailedFileTTL > 0 || options.RetentionPolicy.ReadyFileTTL > 0 {
+		go s.autoForget()
+	}
+
+	if diskPath != "" {
+		s.introduceExistingFiles(diskPath)
+	}
+
+	if options.ScrubInterval > 0 {
+		go s.scrub()
+	}
+
+	go s.watchFileChanges()
+	go s.validateReadyFiles()
+
+	s.log.Debugf("Sync Service: initialized")
 
 	return s, nil
 }
 
-func RequestBackingImageSending(filePath, receiverAddress string) error {
-	return sparse.SyncFile(filePath, receiverAddress, types.FileSyncHTTPClientTimeout, false, false)
-}
-
-// func (s *Service) autoForget() {
-// 	autoForgetWaitList := map[string]time.Time{}
-// 	ticker := time.NewTicker(AutoForgetCheckInterval)
-// 	defer ticker.Stop()
-// 	for {
-// 		now := time.Now()
-// 		select {
-// 		case <-s.ctx.Done():
-// 			return
-// 		case <-ticker.C:
-// 			s.lock.Lock()
-// 			for filePath, sf := range s.filePathMap {
-// 				sfInfo := sf.Get()
-// 				if sfInfo.State != string(types.StateReady) && sfInfo.State != string(types.StateFailed) {
-// 					delete(autoForgetWaitList, filePath)
-// 					continue
-// 				}
-// 				if _, exists := autoForgetWaitList[filePath]; !exists {
-// 					autoForgetWaitList[filePath] = now
-// 				}
-// 				if now.After(autoForgetWaitList[filePath].Add(AutoForgetWaitInterval)) {
-// 					s.log.Debugf("Sync Service: automatically forgot sync file %v, state %v", filePath, sfInfo.State)
-// 					delete(s.filePathMap, filePath)
-// 					delete(s.fileUUIDMap, sf.uuid)
-// 				}
-// 			}
-// 			for filePath := range autoForgetWaitList {
-// 				if _, exists := s.filePathMap[filePath]; !exists {
-// 					delete(autoForgetWaitList, filePath)
-// 				}
-// 			}
-// 			s.lock.Unlock()
-// 		}
-// 	}
-// }
+// introduceExistingFiles re-registers the ready backing image files left in the disk by the previous run,
+// so that the callers can get the correct file list right after a restart.
+func (s *Service) introduceExistingFiles(diskPath string) {
+	diskUUID, err := util.GetDiskConfig(diskPath)
+	if err != nil {
+		s.log.WithError(err).Warnf("Sync Service: failed to get the disk uuid before introducing the existing files in disk %v", diskPath)
+	}
+
+	workDir := filepath.Join(diskPath, types.BackingImageManagerDirectoryName)
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log.WithError(err).Warnf("Sync Service: failed to read the work directory %v before introducing the existing files", workDir)
+		}
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		filePath := filepath.Join(workDir, entry.Name(), types.BackingImageFileName)
+		sf, err := IntroduceSyncingFile(s.ctx, filePath, diskUUID, s.handler, s.bandwidthLimiter, s.spaceReserver, s.retentionPolicy)
+		if err != nil {
+			s.log.WithError(err).Warnf("Sync Service: skipped introducing the existing file %v", filePath)
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), "-"+sf.uuid) {
+			s.log.Warnf("Sync Service: skipped introducing the existing file %v since the directory name doesn't match uuid %v", filePath, sf.uuid)
+			continue
+		}
+		if _, exists := s.fileUUIDMap[sf.uuid]; exists {
+			s.log.Warnf("Sync Service: skipped introducing the existing file %v since uuid %v is already used by another file", filePath, sf.uuid)
+			continue
+		}
+		s.filePathMap[filePath] = sf
+		s.fileUUIDMap[sf.uuid] = sf
+	}
+
+	s.log.Infof("Sync Service: introduced %v existing file(s) in the work directory %v", len(s.filePathMap), workDir)
+}
+
+func RequestBackingImageSending(ctx context.Context, filePath, receiverAddress string, limiter *util.RateLimiter) error {
+	if limiter == nil {
+		return sparse.SyncFile(filePath, receiverAddress, types.FileSyncHTTPClientTimeout, false, false)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	fileIo, err := sparse.NewBufferedFileIoProcessor(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := fileIo.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close file %v after sending", filePath)
+		}
+	}()
+
+	return sparse.SyncContent(fileIo.Name(), &rateLimitedFileIo{FileIoProcessor: fileIo, ctx: ctx, limiter: limiter}, info.Size(), receiverAddress, types.FileSyncHTTPClientTimeout, false, false)
+}
+
+// rateLimitedFileIo limits the data read by the sparse sync client.
+type rateLimitedFileIo struct {
+	sparse.FileIoProcessor
+	ctx     context.Context
+	limiter *util.RateLimiter
+}
+
+func (f *rateLimitedFileIo) ReadAt(data []byte, offset int64) (int, error) {
+	n, err := f.FileIoProcessor.ReadAt(data, offset)
+	if waitErr := f.limiter.WaitN(f.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
 
 func (s *Service) List(writer http.ResponseWriter, request *http.Request) {
 	// Deep copy
@@ -204,12 +341,84 @@ func (s *Service) cleanup(filePath string, deleteFile bool) {
 		delete(s.fileUUIDMap, sf.uuid)
 	}
 	s.lock.Unlock()
+	s.triggerFileChangeCheck()
 
 	if sf != nil && deleteFile {
 		sf.Delete()
 	}
 }
 
+// GetBlockChecksums returns the block checksums of a ready file, which can be compared with
+// the ones of another copy to find out exactly which blocks differ.
+func (s *Service) GetBlockChecksums(writer http.ResponseWriter, request *http.Request) {
+	encodedID := mux.Vars(request)["id"]
+	filePath, err := url.QueryUnescape(encodedID)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid id %v for decoding: %v", encodedID, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.RLock()
+	sf := s.filePathMap[filePath]
+	s.lock.RUnlock()
+
+	if sf == nil {
+		http.Error(writer, fmt.Sprintf("can not find sync file %v", filePath), http.StatusNotFound)
+		return
+	}
+
+	blockChecksums, err := sf.GetBlockChecksums()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	outgoingJSON, err := json.Marshal(blockChecksums)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err := writer.Write(outgoingJSON); err != nil {
+		logrus.WithError(err).Warn("Failed to write response")
+	}
+}
+
+// DownloadBlock returns the data of a block of a ready file after verifying it with the block checksum.
+func (s *Service) DownloadBlock(writer http.ResponseWriter, request *http.Request) {
+	encodedID := mux.Vars(request)["id"]
+	filePath, err := url.QueryUnescape(encodedID)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid id %v for decoding: %v", encodedID, err.Error()), http.StatusBadRequest)
+		return
+	}
+	index, err := strconv.Atoi(mux.Vars(request)["index"])
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid block index %v: %v", mux.Vars(request)["index"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.RLock()
+	sf := s.filePathMap[filePath]
+	s.lock.RUnlock()
+
+	if sf == nil {
+		http.Error(writer, fmt.Sprintf("can not find sync file %v", filePath), http.StatusNotFound)
+		return
+	}
+
+	data, err := sf.ReadBlock(index)
+	if err != nil {
+		s.log.Errorf("Sync Service: failed to read block %v of file %v, err: %v", index, filePath, err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := writer.Write(data); err != nil {
+		logrus.WithError(err).Warn("Failed to write response")
+	}
+}
+
 func (s *Service) DownloadToDst(writer http.ResponseWriter, request *http.Request) {
 	var err error
 	defer func() {
@@ -270,7 +479,9 @@ func (s *Service) DownloadToDst(writer http.ResponseWriter, request *http.Reques
 			return
 		}
 
-		if _, ioErr := io.Copy(writer, src); ioErr != nil {
+		written, ioErr := io.Copy(writer, src)
+		metrics.AddTransferredBytes(metrics.DirectionSent, OperationExport, written)
+		if ioErr != nil {
 			err = ioErr
 			return
 		}
@@ -301,15 +512,58 @@ func (s *Service) DownloadToDst(writer http.ResponseWriter, request *http.Reques
 
 	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.gz", strings.Split(backingImageNameUUID, "-")[0]))
 	writer.Header().Set("Content-Type", "application/octet-stream")
-	if _, ioErr := io.Copy(gzipWriter, src); ioErr != nil {
+	written, ioErr := io.Copy(gzipWriter, src)
+	metrics.AddTransferredBytes(metrics.DirectionSent, OperationExport, written)
+	if ioErr != nil {
 		err = ioErr
 	}
 }
 
+// getDecompressionParameters parses the optional compression type and the decompressed size limit.
+// The compression will be detected automatically by default.
+func getDecompressionParameters(queryParams url.Values) (types.CompressionType, int64, error) {
+	compression, err := util.ParseCompressionType(queryParams.Get(types.DataSourceTypeParameterCompression))
+	if err != nil {
+		return "", 0, err
+	}
+
+	decompressedSizeLimit := int64(types.DefaultDecompressedSizeLimit)
+	if decompressedSizeLimitStr := queryParams.Get(types.DataSourceTypeParameterDecompressedSizeLimit); decompressedSizeLimitStr != "" {
+		decompressedSizeLimit, err = strconv.ParseInt(decompressedSizeLimitStr, 10, 64)
+		if err != nil || decompressedSizeLimit <= 0 {
+			return "", 0, fmt.Errorf("invalid decompressed size limit %v", decompressedSizeLimitStr)
+		}
+	}
+
+	return compression, decompressedSizeLimit, nil
+}
+
+// getPriority parses the optional priority of the operation. The operation with higher priority starts first
+// when there are queued operations. The priority is 0 by default.
+func getPriority(queryParams url.Values) (int, error) {
+	priorityStr := queryParams.Get("priority")
+	if priorityStr == "" {
+		return 0, nil
+	}
+	priority, err := strconv.Atoi(priorityStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid priority %v", priorityStr)
+	}
+	return priority, nil
+}
+
 func (s *Service) checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksum string, size int64) (*SyncingFile, error) {
+	checksumAlgorithm, expectedChecksum, err := util.ParseChecksum(expectedChecksum)
+	if err != nil {
+		return nil, err
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	if err := s.checkNotDrainingNoLock(); err != nil {
+		return nil, err
+	}
 	if _, exists := s.filePathMap[filePath]; exists {
 		return nil, fmt.Errorf("file %v already exists", filePath)
 	}
@@ -317,10 +571,11 @@ func (s *Service) checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksu
 		return nil, fmt.Errorf("file %v with uuid %v already exists", filePath, uuid)
 	}
 
-	sf := NewSyncingFile(s.ctx, filePath, uuid, diskUUID, expectedChecksum, size, s.handler)
+	sf := NewSyncingFile(s.ctx, filePath, uuid, diskUUID, expectedChecksum, checksumAlgorithm, size, s.handler, s.bandwidthLimiter, s.spaceReserver, s.retentionPolicy)
 	s.filePathMap[filePath] = sf
 	s.fileUUIDMap[uuid] = sf
 	s.log.Debugf("Sync Service: initializing sync file %v", filePath)
+	s.triggerFileChangeCheck()
 
 	return sf, nil
 }
@@ -328,7 +583,7 @@ func (s *Service) checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksu
 func (s *Service) Fetch(writer http.ResponseWriter, request *http.Request) {
 	err := s.doFetch(request)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
 		return
 	}
 }
@@ -343,10 +598,16 @@ func (s *Service) doFetch(request *http.Request) (err error) {
 	if srcFilePath == "" {
 		return fmt.Errorf("no srcFilePath for existing file fetch")
 	}
+	if srcFilePath, err = s.confinePath(request, srcFilePath); err != nil {
+		return err
+	}
 	dstFilePath := queryParams.Get("dst-file-path")
 	if dstFilePath == "" {
 		return fmt.Errorf("no dstFilePath for existing file fetch")
 	}
+	if dstFilePath, err = s.confinePath(request, dstFilePath); err != nil {
+		return err
+	}
 	uuid := queryParams.Get("uuid")
 	if uuid == "" {
 		return fmt.Errorf("no uuid for existing file fetch")
@@ -363,6 +624,10 @@ func (s *Service) doFetch(request *http.Request) (err error) {
 	if size%types.DefaultSectorSize != 0 {
 		return fmt.Errorf("the file size %d should be a multiple of %d bytes since Longhorn uses directIO by default", size, types.DefaultSectorSize)
 	}
+	priority, err := getPriority(queryParams)
+	if err != nil {
+		return err
+	}
 
 	sf, err := s.checkAndInitSyncFile(dstFilePath, uuid, diskUUID, expectedChecksum, size)
 	if err != nil {
@@ -377,6 +642,13 @@ func (s *Service) doFetch(request *http.Request) (err error) {
 			return
 		}
 
+		done, err := sf.WaitForScheduling(s.scheduler, OperationFetch, priority)
+		if err != nil {
+			s.log.Errorf("Sync Service: failed to wait for scheduling the fetch of sync file %v: %v", dstFilePath, err)
+			return
+		}
+		defer done()
+
 		if err := sf.Fetch(srcFilePath); err != nil {
 			s.log.Errorf("Sync Service: failed to fetch sync file from %v to %v: %v", srcFilePath, dstFilePath, err)
 			// SyncFile will mark itself as Failed if the processing is not started on time. There is no need to handle it here.
@@ -390,7 +662,7 @@ func (s *Service) doFetch(request *http.Request) (err error) {
 func (s *Service) DownloadFromURL(writer http.ResponseWriter, request *http.Request) {
 	err := s.doDownloadFromURL(request)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
 		return
 	}
 }
@@ -407,6 +679,9 @@ func (s *Service) doDownloadFromURL(request *http.Request) (err error) {
 	if filePath == "" {
 		return fmt.Errorf("no filePath for file downloading")
 	}
+	if filePath, err = s.confinePath(request, filePath); err != nil {
+		return err
+	}
 	uuid := queryParams.Get("uuid")
 	if uuid == "" {
 		return fmt.Errorf("no uuid for downloading file")
@@ -415,9 +690,32 @@ func (s *Service) doDownloadFromURL(request *http.Request) (err error) {
 	if url == "" {
 		return fmt.Errorf("no URL for file downloading")
 	}
+	if err = s.confineURL(request, url); err != nil {
+		return err
+	}
 	diskUUID := queryParams.Get("disk-uuid")
 	expectedChecksum := queryParams.Get("expected-checksum")
 	dataEngine := queryParams.Get("data-engine")
+	// The file will be downloaded via a single connection by default.
+	concurrentLimit := 1
+	if concurrentLimitStr := queryParams.Get("concurrent-limit"); concurrentLimitStr != "" {
+		concurrentLimit, err = strconv.Atoi(concurrentLimitStr)
+		if err != nil || concurrentLimit < 1 {
+			return fmt.Errorf("invalid concurrentLimit %v for downloading file", concurrentLimitStr)
+		}
+	}
+	compression, decompressedSizeLimit, err := getDecompressionParameters(queryParams)
+	if err != nil {
+		return err
+	}
+	targetFormat, err := util.ParseImageTargetFormat(queryParams.Get(types.DataSourceTypeParameterTargetFormat), dataEngine)
+	if err != nil {
+		return err
+	}
+	priority, err := getPriority(queryParams)
+	if err != nil {
+		return err
+	}
 
 	sf, err := s.checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksum, 0)
 	if err != nil {
@@ -432,7 +730,14 @@ func (s *Service) doDownloadFromURL(request *http.Request) (err error) {
 			return
 		}
 
-		if _, err := sf.DownloadFromURL(url, dataEngine); err != nil {
+		done, err := sf.WaitForScheduling(s.scheduler, OperationDownload, priority)
+		if err != nil {
+			s.log.Errorf("Sync Service: failed to wait for scheduling the download of sync file %v: %v", filePath, err)
+			return
+		}
+		defer done()
+
+		if _, err := sf.DownloadFromURL(url, concurrentLimit, compression, decompressedSizeLimit, targetFormat, dataEngine); err != nil {
 			s.log.Errorf("Sync Service: failed to download sync file %v: %v", filePath, err)
 			return
 		}
@@ -444,7 +749,7 @@ func (s *Service) doDownloadFromURL(request *http.Request) (err error) {
 func (s *Service) CloneFromBackingImage(writer http.ResponseWriter, request *http.Request) {
 	err := s.doCloneFromBackingImage(request)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
 		return
 	}
 }
@@ -467,6 +772,11 @@ func (s *Service) doCloneFromBackingImage(request *http.Request) (err error) {
 		return fmt.Errorf("%v is not specified", types.DataSourceTypeCloneParameterBackingImageUUID)
 	}
 
+	sourceFilePath := types.GetBackingImageFilePath(types.DiskPathInContainer, sourceBackingImage, sourceBackingImageUUID)
+	if _, err = s.confinePath(request, sourceFilePath); err != nil {
+		return err
+	}
+
 	encryption := types.EncryptionType(queryParams.Get(types.DataSourceTypeCloneParameterEncryption))
 	if encryption != types.EncryptionTypeEncrypt && encryption != types.EncryptionTypeDecrypt && encryption != types.EncryptionTypeIgnore {
 		return fmt.Errorf("%v operation %v is not specified", types.DataSourceTypeCloneParameterEncryption, encryption)
@@ -475,6 +785,9 @@ func (s *Service) doCloneFromBackingImage(request *http.Request) (err error) {
 	if filePath == "" {
 		return fmt.Errorf("no filePath restoring file")
 	}
+	if filePath, err = s.confinePath(request, filePath); err != nil {
+		return err
+	}
 	uuid := queryParams.Get("uuid")
 	if uuid == "" {
 		return fmt.Errorf("no uuid for restoring file")
@@ -489,6 +802,10 @@ func (s *Service) doCloneFromBackingImage(request *http.Request) (err error) {
 			return errors.Wrap(err, "failed to get credential failed from request")
 		}
 	}
+	priority, err := getPriority(queryParams)
+	if err != nil {
+		return err
+	}
 
 	sf, err := s.checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksum, 0)
 	if err != nil {
@@ -500,6 +817,13 @@ func (s *Service) doCloneFromBackingImage(request *http.Request) (err error) {
 			return
 		}
 
+		done, err := sf.WaitForScheduling(s.scheduler, OperationClone, priority)
+		if err != nil {
+			s.log.Errorf("Sync Service: failed to wait for scheduling the cloning of sync file %v: %v", filePath, err)
+			return
+		}
+		defer done()
+
 		if _, err := sf.CloneToFileWithEncryption(sourceBackingImage, sourceBackingImageUUID, encryption, credential, dataEngine); err != nil {
 			s.log.Errorf("Sync Service: failed to clone sync file %v: %v", filePath, err)
 			return
@@ -512,7 +836,7 @@ func (s *Service) doCloneFromBackingImage(request *http.Request) (err error) {
 func (s *Service) RestoreFromBackupURL(writer http.ResponseWriter, request *http.Request) {
 	err := s.doRestoreFromBackupURL(request)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
 		return
 	}
 }
@@ -529,6 +853,9 @@ func (s *Service) doRestoreFromBackupURL(request *http.Request) (err error) {
 	if filePath == "" {
 		return fmt.Errorf("no filePath restoring file")
 	}
+	if filePath, err = s.confinePath(request, filePath); err != nil {
+		return err
+	}
 	uuid := queryParams.Get("uuid")
 	if uuid == "" {
 		return fmt.Errorf("no uuid for restoring file")
@@ -555,6 +882,19 @@ func (s *Service) doRestoreFromBackupURL(request *http.Request) (err error) {
 
 	dataEngine := queryParams.Get("data-engine")
 
+	compression, decompressedSizeLimit, err := getDecompressionParameters(queryParams)
+	if err != nil {
+		return err
+	}
+	targetFormat, err := util.ParseImageTargetFormat(queryParams.Get(types.DataSourceTypeParameterTargetFormat), dataEngine)
+	if err != nil {
+		return err
+	}
+	priority, err := getPriority(queryParams)
+	if err != nil {
+		return err
+	}
+
 	sf, err := s.checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksum, 0)
 	if err != nil {
 		return err
@@ -566,7 +906,14 @@ func (s *Service) doRestoreFromBackupURL(request *http.Request) (err error) {
 			return
 		}
 
-		if err := sf.RestoreFromBackupURL(backupURL, credential, concurrentLimit, dataEngine); err != nil {
+		done, err := sf.WaitForScheduling(s.scheduler, OperationRestore, priority)
+		if err != nil {
+			s.log.Errorf("Sync Service: failed to wait for scheduling the restoration of sync file %v: %v", filePath, err)
+			return
+		}
+		defer done()
+
+		if err := sf.RestoreFromBackupURL(backupURL, credential, concurrentLimit, compression, decompressedSizeLimit, targetFormat, dataEngine); err != nil {
 			s.log.Errorf("Sync Service: failed to download sync file %v: %v", filePath, err)
 			return
 		}
@@ -579,7 +926,7 @@ func (s *Service) doRestoreFromBackupURL(request *http.Request) (err error) {
 func (s *Service) UploadFromRequest(writer http.ResponseWriter, request *http.Request) {
 	err := s.doUploadFromRequest(request)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
 		return
 	}
 }
@@ -597,6 +944,9 @@ func (s *Service) doUploadFromRequest(request *http.Request) (err error) {
 	if filePath == "" {
 		return fmt.Errorf("no file-path for uploading file")
 	}
+	if filePath, err = s.confinePath(request, filePath); err != nil {
+		return err
+	}
 	uuid := queryParams.Get("uuid")
 	if uuid == "" {
 		return fmt.Errorf("no uuid for uploading file")
@@ -607,19 +957,17 @@ func (s *Service) doUploadFromRequest(request *http.Request) (err error) {
 	if err != nil {
 		return err
 	}
-	if size%types.DefaultSectorSize != 0 {
-		return fmt.Errorf("the uploaded file size %d should be a multiple of %d bytes since Longhorn uses directIO by default", size, types.DefaultSectorSize)
+	compression, decompressedSizeLimit, err := getDecompressionParameters(queryParams)
+	if err != nil {
+		return err
 	}
 
 	dataEngine := queryParams.Get(types.DataSourceTypeParameterDataEngine)
-
-	sf, err := s.checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksum, size)
+	targetFormat, err := util.ParseImageTargetFormat(queryParams.Get(types.DataSourceTypeParameterTargetFormat), dataEngine)
 	if err != nil {
 		return err
 	}
 
-	s.log.Info("Sync Service: start uploading file")
-
 	// Prepare the src/reader
 	reader, err := request.MultipartReader()
 	if err != nil {
@@ -645,23 +993,243 @@ func (s *Service) doUploadFromRequest(request *http.Request) (err error) {
 		}
 	}()
 
+	src := bufio.NewReader(p)
+	if compression == types.CompressionTypeAuto {
+		if compression, err = util.DetectCompression(src); err != nil {
+			return err
+		}
+	}
+	// The decompressed size will be checked after the upload.
+	if compression == types.CompressionTypeNone && size%types.DefaultSectorSize != 0 {
+		return fmt.Errorf("the uploaded file size %d should be a multiple of %d bytes since Longhorn uses directIO by default", size, types.DefaultSectorSize)
+	}
+
+	sf, err := s.checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksum, size)
+	if err != nil {
+		return err
+	}
+
+	s.log.Infof("Sync Service: start uploading file, compression %v", compression)
+
 	if err := sf.WaitForStateNonPending(); err != nil {
 		s.log.Errorf("Sync Service: failed to wait for sync file %v becoming non-pending state before starting the actual upload: %v", filePath, err)
 		// SyncFile will mark itself as Failed if the processing is not started on time. There is no need to handle it here.
 		return err
 	}
 
-	if _, err := sf.IdleTimeoutCopyToFile(p, dataEngine); err != nil {
+	if _, err := sf.IdleTimeoutCopyToFile(&readCloser{Reader: src, Closer: p}, compression, decompressedSizeLimit, targetFormat, dataEngine); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// CreateUploadSession starts a resumable chunked upload. Creating the session again for the same file
+// returns the existing session, so that an interrupted upload can resume from the received offset.
+func (s *Service) CreateUploadSession(writer http.ResponseWriter, request *http.Request) {
+	session, err := s.doCreateUploadSession(request)
+	if err != nil {
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
+		return
+	}
+	writeUploadSession(writer, session)
+}
+
+func (s *Service) doCreateUploadSession(request *http.Request) (session *api.UploadSession, err error) {
+	defer func() {
+		if err != nil {
+			s.log.Errorf("Sync Service: failed to create upload session, err: %v", err)
+		}
+	}()
+
+	queryParams := request.URL.Query()
+	filePath := queryParams.Get("file-path")
+	if filePath == "" {
+		return nil, fmt.Errorf("no file-path for upload session")
+	}
+	if filePath, err = s.confinePath(request, filePath); err != nil {
+		return nil, err
+	}
+	uuid := queryParams.Get("uuid")
+	if uuid == "" {
+		return nil, fmt.Errorf("no uuid for upload session")
+	}
+	diskUUID := queryParams.Get("disk-uuid")
+	expectedChecksum := queryParams.Get("expected-checksum")
+	size, err := strconv.ParseInt(queryParams.Get("size"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid size %v for upload session", size)
+	}
+	compression, decompressedSizeLimit, err := getDecompressionParameters(queryParams)
+	if err != nil {
+		return nil, err
+	}
+	// The decompressed size will be checked after the upload.
+	if compression == types.CompressionTypeNone && size%types.DefaultSectorSize != 0 {
+		return nil, fmt.Errorf("the uploaded file size %d should be a multiple of %d bytes since Longhorn uses directIO by default", size, types.DefaultSectorSize)
+	}
+	dataEngine := queryParams.Get(types.DataSourceTypeParameterDataEngine)
+	targetFormat, err := util.ParseImageTargetFormat(queryParams.Get(types.DataSourceTypeParameterTargetFormat), dataEngine)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	sf := s.filePathMap[filePath]
+	s.lock.RUnlock()
+	if sf != nil {
+		if sf.uuid != uuid {
+			return nil, fmt.Errorf("file %v with a different uuid %v already exists", filePath, sf.uuid)
+		}
+		s.log.Infof("Sync Service: upload session of file %v already exists, will resume it", filePath)
+		return sf.GetUploadSession()
+	}
+
+	sf, err = s.checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksum, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sf.WaitForStateNonPending(); err != nil {
+		s.log.Errorf("Sync Service: failed to wait for sync file %v becoming non-pending state before starting the upload session: %v", filePath, err)
+		// SyncFile will mark itself as Failed if the processing is not started on time. There is no need to handle it here.
+		return nil, err
+	}
+	if err := sf.StartUploadSession(compression, decompressedSizeLimit, targetFormat, dataEngine); err != nil {
+		return nil, err
+	}
+
+	return sf.GetUploadSession()
+}
+
+// GetUploadSession returns the received offset of an upload session, from which the next chunk should start.
+func (s *Service) GetUploadSession(writer http.ResponseWriter, request *http.Request) {
+	encodedID := mux.Vars(request)["id"]
+	filePath, err := url.QueryUnescape(encodedID)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid id %v for decoding: %v", encodedID, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.RLock()
+	sf := s.filePathMap[filePath]
+	s.lock.RUnlock()
+
+	if sf == nil {
+		http.Error(writer, fmt.Sprintf("can not find sync file %v", filePath), http.StatusNotFound)
+		return
+	}
+
+	session, err := sf.GetUploadSession()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeUploadSession(writer, session)
+}
+
+// UploadChunk writes the request body to the file at the offset. The chunk is rejected with
+// http.StatusConflict if the offset is not the received offset, or with http.StatusBadRequest
+// if the checksum doesn't match the received data.
+func (s *Service) UploadChunk(writer http.ResponseWriter, request *http.Request) {
+	encodedID := mux.Vars(request)["id"]
+	filePath, err := url.QueryUnescape(encodedID)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid id %v for decoding: %v", encodedID, err.Error()), http.StatusBadRequest)
+		return
+	}
+	queryParams := request.URL.Query()
+	offset, err := strconv.ParseInt(queryParams.Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid chunk offset %v: %v", queryParams.Get("offset"), err.Error()), http.StatusBadRequest)
+		return
+	}
+	checksum := queryParams.Get("checksum")
+	if checksum == "" {
+		http.Error(writer, "no checksum for the chunk", http.StatusBadRequest)
+		return
+	}
+
+	s.lock.RLock()
+	sf := s.filePathMap[filePath]
+	s.lock.RUnlock()
+
+	if sf == nil {
+		http.Error(writer, fmt.Sprintf("can not find sync file %v", filePath), http.StatusNotFound)
+		return
+	}
+
+	if _, err := sf.WriteUploadChunk(offset, checksum, request.Body); err != nil {
+		s.log.Errorf("Sync Service: failed to upload chunk at offset %v of file %v, err: %v", offset, filePath, err)
+		switch {
+		case errors.Is(err, ErrUploadChunkOffsetMismatch):
+			http.Error(writer, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrUploadChunkChecksumMismatch):
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	session, err := sf.GetUploadSession()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeUploadSession(writer, session)
+}
+
+// FinalizeUploadSession should be invoked after all chunks are received. Then the file will be processed
+// like the other sources, e.g., decompressed and verified with the expected checksum.
+func (s *Service) FinalizeUploadSession(writer http.ResponseWriter, request *http.Request) {
+	err := s.doFinalizeUploadSession(request)
+	if err != nil {
+		s.log.Errorf("Sync Service: failed to finalize upload session, err: %v", err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Service) doFinalizeUploadSession(request *http.Request) error {
+	filePath, err := url.QueryUnescape(mux.Vars(request)["id"])
+	if err != nil {
+		return err
+	}
+	if filePath == "" {
+		return fmt.Errorf("no filePath for upload session finalization")
+	}
+
+	s.lock.RLock()
+	sf := s.filePathMap[filePath]
+	s.lock.RUnlock()
+
+	if sf == nil {
+		return fmt.Errorf("can not find sync file %v for upload session finalization", filePath)
+	}
+
+	return sf.FinalizeUploadSession()
+}
+
+func writeUploadSession(writer http.ResponseWriter, session *api.UploadSession) {
+	outgoingJSON, err := json.Marshal(session)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err := writer.Write(outgoingJSON); err != nil {
+		logrus.WithError(err).Warn("Failed to write response")
+	}
+}
+
 func (s *Service) ReceiveFromPeer(writer http.ResponseWriter, request *http.Request) {
 	err := s.doReceiveFromPeer(request)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
 		return
 	}
 }
@@ -676,6 +1244,9 @@ func (s *Service) doReceiveFromPeer(request *http.Request) (err error) {
 	if filePath == "" {
 		return fmt.Errorf("no filePath for file requesting")
 	}
+	if filePath, err = s.confinePath(request, filePath); err != nil {
+		return err
+	}
 	uuid := queryParams.Get("uuid")
 	if uuid == "" {
 		return fmt.Errorf("no uuid for file requesting")
@@ -701,6 +1272,15 @@ func (s *Service) doReceiveFromPeer(request *http.Request) (err error) {
 		return err
 	}
 	dataEngine := queryParams.Get(types.DataSourceTypeParameterDataEngine)
+	// The receiver serves TLS as the sync server does, unless the sender doesn't support TLS.
+	var tlsConfig *tls.Config
+	if s.options.TLS.Enabled() {
+		if plainHTTPSender, _ := strconv.ParseBool(queryParams.Get("plain-http-sender")); plainHTTPSender {
+			s.log.Warnf("Sync Service: receiving file %v in plain HTTP since the sender doesn't support TLS", filePath)
+		} else if tlsConfig, err = util.NewServerTLSConfig(s.options.TLS); err != nil {
+			return err
+		}
+	}
 
 	sf, err := s.checkAndInitSyncFile(filePath, uuid, diskUUID, expectedChecksum, size)
 	if err != nil {
@@ -715,7 +1295,7 @@ func (s *Service) doReceiveFromPeer(request *http.Request) (err error) {
 			return
 		}
 
-		if err := sf.Receive(int(port), fileType, dataEngine); err != nil {
+		if err := sf.Receive(int(port), fileType, dataEngine, tlsConfig); err != nil {
 			s.log.Errorf("Sync Service: failed to receive sync file %v: %v", filePath, err)
 			return
 		}
@@ -727,7 +1307,7 @@ func (s *Service) doReceiveFromPeer(request *http.Request) (err error) {
 func (s *Service) SendToPeer(writer http.ResponseWriter, request *http.Request) {
 	err := s.doSendToPeer(request)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
 		return
 	}
 }
@@ -748,14 +1328,145 @@ func (s *Service) doSendToPeer(request *http.Request) (err error) {
 	if toAddress == "" {
 		return fmt.Errorf("no toAddress for file sending")
 	}
+	priority, err := getPriority(request.URL.Query())
+	if err != nil {
+		return err
+	}
 
 	s.lock.RLock()
 	sf := s.filePathMap[filePath]
+	drainingErr := s.checkNotDrainingNoLock()
 	s.lock.RUnlock()
 
+	if drainingErr != nil {
+		return drainingErr
+	}
 	if sf == nil {
 		return fmt.Errorf("can not find sync file %v for sending", filePath)
 	}
 
-	return sf.Send(toAddress, s.sender)
+	return sf.Send(toAddress, s.sender, s.scheduler, priority)
+}
+
+func (s *Service) RepairFromPeer(writer http.ResponseWriter, request *http.Request) {
+	err := s.doRepairFromPeer(request)
+	if err != nil {
+		s.log.Errorf("Sync Service: failed to do repair from peer, err: %v", err)
+		http.Error(writer, err.Error(), getErrorStatusCode(err, http.StatusInternalServerError))
+		return
+	}
+}
+
+func (s *Service) doRepairFromPeer(request *http.Request) error {
+	filePath, err := url.QueryUnescape(mux.Vars(request)["id"])
+	if err != nil {
+		return err
+	}
+	if filePath == "" {
+		return fmt.Errorf("no filePath for file repairing")
+	}
+	queryParams := request.URL.Query()
+	peerAddress := queryParams.Get("peer-address")
+	if peerAddress == "" {
+		return fmt.Errorf("no peer address for file repairing")
+	}
+	peerFilePath := queryParams.Get("peer-file-path")
+	if peerFilePath == "" {
+		peerFilePath = filePath
+	}
+
+	s.lock.RLock()
+	sf := s.filePathMap[filePath]
+	drainingErr := s.checkNotDrainingNoLock()
+	s.lock.RUnlock()
+
+	if drainingErr != nil {
+		return drainingErr
+	}
+	if sf == nil {
+		return fmt.Errorf("can not find sync file %v for repairing", filePath)
+	}
+
+	priority, err := getPriority(queryParams)
+	if err != nil {
+		return err
+	}
+
+	peerClient := &client.SyncClient{
+		Remote: peerAddress,
+		TLS:    s.options.TLS,
+		Token:  request.Header.Get(types.PeerTokenHeader),
+	}
+	return sf.RepairFromPeer(peerClient, peerFilePath, s.scheduler, priority)
+}
+
+func (s *Service) GetBandwidthLimits(writer http.ResponseWriter, request *http.Request) {
+	writeBandwidthLimits(writer, s.bandwidthLimiter.Get())
+}
+
+// UpdateBandwidthLimits overwrites all the bandwidth limits with the request body. The new limits apply to
+// the in-flight transfers as well.
+func (s *Service) UpdateBandwidthLimits(writer http.ResponseWriter, request *http.Request) {
+	limits := api.BandwidthLimits{}
+	if err := json.NewDecoder(request.Body).Decode(&limits); err != nil {
+		http.Error(writer, fmt.Sprintf("failed to decode the bandwidth limits: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.bandwidthLimiter.Update(limits); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.log.Infof("Sync Service: updated the bandwidth limits to %+v", limits)
+
+	writeBandwidthLimits(writer, s.bandwidthLimiter.Get())
+}
+
+func (s *Service) ListLeftovers(writer http.ResponseWriter, request *http.Request) {
+	s.doCollectLeftovers(writer, request, true)
+}
+
+func (s *Service) CollectLeftovers(writer http.ResponseWriter, request *http.Request) {
+	queryParams := request.URL.Query()
+	s.doCollectLeftovers(writer, request, queryParams.Get("dryRun") == "true")
+}
+
+func (s *Service) doCollectLeftovers(writer http.ResponseWriter, request *http.Request, dryRun bool) {
+	if s.diskPath == "" {
+		http.Error(writer, "cannot collect the leftovers since the sync service doesn't manage a disk", http.StatusBadRequest)
+		return
+	}
+
+	queryParams := request.URL.Query()
+	gracePeriod := DefaultLeftoverGracePeriod
+	if gracePeriodStr := queryParams.Get("gracePeriod"); gracePeriodStr != "" {
+		var err error
+		if gracePeriod, err = time.ParseDuration(gracePeriodStr); err != nil || gracePeriod < 0 {
+			http.Error(writer, fmt.Sprintf("invalid grace period %v", gracePeriodStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res := s.collectLeftovers(dryRun, gracePeriod, queryParams["activeDataSource"])
+
+	outgoingJSON, err := json.Marshal(res)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err := writer.Write(outgoingJSON); err != nil {
+		logrus.WithError(err).Warn("Failed to write response")
+	}
+}
+
+func writeBandwidthLimits(writer http.ResponseWriter, limits api.BandwidthLimits) {
+	outgoingJSON, err := json.Marshal(limits)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err := writer.Write(outgoingJSON); err != nil {
+		logrus.WithError(err).Warn("Failed to write response")
+	}
 }
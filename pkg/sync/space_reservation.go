@@ -0,0 +1,87 @@
+package sync
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+// ErrInsufficientSpace means the disk doesn't have enough free space for the file being prepared.
+var ErrInsufficientSpace = fmt.Errorf("%v", types.FailureReasonInsufficientSpace)
+
+// SpaceReserver keeps the ledger of the disk space reserved by the files being prepared, so that the
+// concurrent operations don't over-commit the disk. A file is admitted only if the free space can hold
+// the size of the file besides the safety margin and the unwritten part of the other reservations.
+// A nil SpaceReserver admits everything.
+type SpaceReserver struct {
+	lock         sync.Mutex
+	safetyMargin int64
+	// reservations are the expected sizes of the files, keyed by the paths the data is written to.
+	reservations map[string]int64
+}
+
+func NewSpaceReserver(safetyMargin int64) (*SpaceReserver, error) {
+	if safetyMargin < 0 {
+		return nil, fmt.Errorf("invalid disk space safety margin %v, which should not be negative", safetyMargin)
+	}
+	return &SpaceReserver{
+		safetyMargin: safetyMargin,
+		reservations: map[string]int64{},
+	}, nil
+}
+
+// reserve admits the file of the size if the disk containing it has enough free space.
+// The space allocated by a partially written file, e.g. a resumed download, is deducted from the size.
+// The reservation is kept until it's released.
+func (r *SpaceReserver) reserve(filePath string, size int64) error {
+	if r == nil || size <= 0 {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	available, err := util.GetDiskAvailableSpace(filepath.Dir(filePath))
+	if err != nil {
+		return fmt.Errorf("failed to get the available space of the disk for file %v: %v", filePath, err)
+	}
+
+	reserved := int64(0)
+	for reservedFilePath, reservedSize := range r.reservations {
+		if reservedFilePath == filePath {
+			continue
+		}
+		reserved += getUnallocatedSize(reservedFilePath, reservedSize)
+	}
+
+	required := getUnallocatedSize(filePath, size)
+	if required+reserved+r.safetyMargin > available {
+		return fmt.Errorf("%w: file %v requires %v bytes, but the disk has %v bytes available with %v bytes reserved by other files and a safety margin of %v bytes",
+			ErrInsufficientSpace, filePath, required, available, reserved, r.safetyMargin)
+	}
+
+	r.reservations[filePath] = size
+	return nil
+}
+
+func (r *SpaceReserver) release(filePath string) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.reservations, filePath)
+}
+
+// getUnallocatedSize returns the part of the size not allocated by the file on the disk yet.
+func getUnallocatedSize(filePath string, size int64) int64 {
+	allocated, err := util.GetFileRealSize(filePath)
+	if err != nil {
+		return size
+	}
+	return max(size-allocated, 0)
+}
@@ -0,0 +1,377 @@
+package sync
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/sparse-tools/sparse"
+	sparserest "github.com/longhorn/sparse-tools/sparse/rest"
+
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+const (
+	// SparseReceiverIdleTimeout shuts down the receiver if the sender doesn't connect for a while,
+	// which is the same as the plain HTTP receiver of the sparse tools.
+	SparseReceiverIdleTimeout = 90 * time.Second
+)
+
+// newTLSSender wraps the sender, so that the file is sent over TLS. The sparse sync client only speaks
+// plain HTTP, hence it sends the file to a tunnel on the loopback address, which forwards each connection
+// to the receiver over TLS.
+func newTLSSender(clientTLS *util.ClientTLS, sender Sender) Sender {
+	return func(ctx context.Context, filePath, receiverAddress string, limiter *util.RateLimiter) error {
+		tunnel, err := newTLSTunnel(ctx, clientTLS, receiverAddress)
+		if err != nil {
+			return err
+		}
+		defer tunnel.close()
+
+		return sender(ctx, filePath, tunnel.address(), limiter)
+	}
+}
+
+// tlsTunnel accepts the plain connections on the loopback address, and forwards them to the remote address over TLS.
+type tlsTunnel struct {
+	ctx           context.Context
+	clientTLS     *util.ClientTLS
+	remoteAddress string
+	listener      net.Listener
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTLSTunnel(ctx context.Context, clientTLS *util.ClientTLS, remoteAddress string) (*tlsTunnel, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen for the TLS tunnel to %v", remoteAddress)
+	}
+	t := &tlsTunnel{
+		ctx:           ctx,
+		clientTLS:     clientTLS,
+		remoteAddress: remoteAddress,
+		listener:      listener,
+		conns:         map[net.Conn]struct{}{},
+	}
+	go t.serve()
+	return t, nil
+}
+
+func (t *tlsTunnel) address() string {
+	return t.listener.Addr().String()
+}
+
+func (t *tlsTunnel) serve() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.forward(conn)
+	}
+}
+
+func (t *tlsTunnel) forward(conn net.Conn) {
+	remoteConn, err := t.clientTLS.DialContext(t.ctx, "tcp", t.remoteAddress)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to connect to the TLS tunnel remote %v", t.remoteAddress)
+		_ = conn.Close()
+		return
+	}
+	if !t.track(conn, remoteConn) {
+		_ = conn.Close()
+		_ = remoteConn.Close()
+		return
+	}
+	defer t.untrack(conn, remoteConn)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(remoteConn, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, remoteConn)
+		done <- struct{}{}
+	}()
+	// Either side closing the connection ends the forwarding of both directions.
+	<-done
+}
+
+// track returns false if the tunnel is already closed.
+func (t *tlsTunnel) track(conns ...net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conns == nil {
+		return false
+	}
+	for _, conn := range conns {
+		t.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (t *tlsTunnel) untrack(conns ...net.Conn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+		delete(t.conns, conn)
+	}
+}
+
+// close stops accepting the connections and closes the forwarded ones, including the idle connections
+// kept by the sparse sync client.
+func (t *tlsTunnel) close() {
+	_ = t.listener.Close()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.conns = nil
+}
+
+// sparseReceiver serves the same API as the sparse tools receiver, so that the sparse sync client can send
+// the file over TLS. The sparse tools receiver always serves plain HTTP.
+// The fast sync of the snapshot disk files is not supported, since only the sync servers send files over TLS.
+type sparseReceiver struct {
+	filePath          string
+	fileAlreadyExists bool
+	syncFileOps       sparserest.SyncFileOperations
+	cancel            context.CancelFunc
+
+	lock   sync.RWMutex
+	fileIo sparse.FileIoProcessor
+}
+
+// serveSparseReceiverTLS receives the file at the port over TLS. It returns http.ErrServerClosed once
+// the sender closes the transfer, the context is done, or no sender connects for a while.
+func serveSparseReceiverTLS(ctx context.Context, port int, filePath string, syncFileOps sparserest.SyncFileOperations, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	_, err := os.Stat(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	receiver := &sparseReceiver{
+		filePath:          filePath,
+		fileAlreadyExists: err == nil,
+		syncFileOps:       syncFileOps,
+		cancel:            cancel,
+	}
+	defer receiver.closeFile()
+
+	router := mux.NewRouter().StrictSlash(true)
+	router.HandleFunc("/v1-ssync/open", receiver.open).Methods("GET")
+	router.HandleFunc("/v1-ssync/close", receiver.close).Methods("POST")
+	router.HandleFunc("/v1-ssync/sendHole", receiver.sendHole).Methods("POST")
+	router.HandleFunc("/v1-ssync/writeData", receiver.writeData).Methods("POST")
+	router.HandleFunc("/v1-ssync/getChecksum", receiver.getChecksum).Methods("GET")
+
+	idleTimer := sparserest.NewIdleTimer(SparseReceiverIdleTimeout)
+	srv := &http.Server{
+		Addr:      ":" + strconv.Itoa(port),
+		Handler:   router,
+		TLSConfig: tlsConfig,
+		ConnState: idleTimer.ConnState,
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-idleTimer.Done():
+			logrus.Errorf("Shutting down the TLS receiver of file %v since it is idle for %v", filePath, SparseReceiverIdleTimeout)
+		}
+		_ = srv.Close()
+	}()
+
+	return srv.ListenAndServeTLS("", "")
+}
+
+func (r *sparseReceiver) getFileIo() (sparse.FileIoProcessor, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.fileIo == nil {
+		return nil, fmt.Errorf("the receiver of file %v is not opened", r.filePath)
+	}
+	return r.fileIo, nil
+}
+
+func (r *sparseReceiver) closeFile() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.fileIo != nil {
+		_ = r.fileIo.Close()
+		r.fileIo = nil
+	}
+}
+
+func (r *sparseReceiver) open(writer http.ResponseWriter, request *http.Request) {
+	if err := r.doOpen(writer, request); err != nil {
+		logrus.WithError(err).Errorf("Failed to open the TLS receiver of file %v", r.filePath)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (r *sparseReceiver) doOpen(writer http.ResponseWriter, request *http.Request) error {
+	directIO, err := strconv.ParseBool(request.URL.Query().Get("directIO"))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse directIO")
+	}
+	interval, err := getSparseQueryInterval(request)
+	if err != nil {
+		return err
+	}
+	if directIO && interval.End%sparse.Blocks != 0 {
+		return fmt.Errorf("invalid file size %v for directIO", interval.End)
+	}
+
+	var fileIo sparse.FileIoProcessor
+	if directIO {
+		fileIo, err = sparse.NewDirectFileIoProcessor(r.filePath, os.O_RDWR, 0666, true)
+	} else {
+		fileIo, err = sparse.NewBufferedFileIoProcessor(r.filePath, os.O_RDWR, 0666, true)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to open file %v", r.filePath)
+	}
+	if err := fileIo.Truncate(interval.End); err != nil {
+		_ = fileIo.Close()
+		return errors.Wrapf(err, "failed to truncate file %v", r.filePath)
+	}
+
+	r.closeFile()
+	r.lock.Lock()
+	r.fileIo = fileIo
+	r.lock.Unlock()
+
+	writer.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(writer).Encode(r.fileAlreadyExists)
+}
+
+func (r *sparseReceiver) close(writer http.ResponseWriter, request *http.Request) {
+	r.closeFile()
+	r.cancel()
+}
+
+func (r *sparseReceiver) sendHole(writer http.ResponseWriter, request *http.Request) {
+	if err := r.doSendHole(request); err != nil {
+		logrus.WithError(err).Errorf("Failed to punch hole for the TLS receiver of file %v", r.filePath)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (r *sparseReceiver) doSendHole(request *http.Request) error {
+	interval, err := getSparseQueryInterval(request)
+	if err != nil {
+		return err
+	}
+	fileIo, err := r.getFileIo()
+	if err != nil {
+		return err
+	}
+	if err := sparse.NewFiemapFile(fileIo.GetFile()).PunchHole(interval.Begin, interval.Len()); err != nil {
+		return errors.Wrapf(err, "failed to punch hole interval %+v", interval)
+	}
+	return nil
+}
+
+func (r *sparseReceiver) writeData(writer http.ResponseWriter, request *http.Request) {
+	if err := r.doWriteData(request); err != nil {
+		logrus.WithError(err).Errorf("Failed to write data for the TLS receiver of file %v", r.filePath)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (r *sparseReceiver) doWriteData(request *http.Request) error {
+	interval, err := getSparseQueryInterval(request)
+	if err != nil {
+		return err
+	}
+	fileIo, err := r.getFileIo()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(request.Body, interval.Len()))
+	if err != nil {
+		return errors.Wrap(err, "failed to read the data")
+	}
+	if err := sparse.WriteDataInterval(fileIo, interval, data); err != nil {
+		return errors.Wrapf(err, "failed to write data interval %+v", interval)
+	}
+	if !r.fileAlreadyExists {
+		r.syncFileOps.UpdateSyncFileProgress(interval.Len())
+	}
+	return nil
+}
+
+func (r *sparseReceiver) getChecksum(writer http.ResponseWriter, request *http.Request) {
+	if err := r.doGetChecksum(writer, request); err != nil {
+		logrus.WithError(err).Errorf("Failed to get checksum for the TLS receiver of file %v", r.filePath)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (r *sparseReceiver) doGetChecksum(writer http.ResponseWriter, request *http.Request) error {
+	interval, err := getSparseQueryInterval(request)
+	if err != nil {
+		return err
+	}
+	fileIo, err := r.getFileIo()
+	if err != nil {
+		return err
+	}
+
+	// The interval has the valid data only if a single extent covers the whole interval.
+	var checksum []byte
+	exts, err := sparse.GetFiemapRegionExts(fileIo, interval, 2)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get fiemap region exts %+v", interval)
+	}
+	if len(exts) == 1 && int64(exts[0].Logical) <= interval.Begin && int64(exts[0].Logical+exts[0].Length) >= interval.End {
+		if checksum, err = sparse.HashFileInterval(fileIo, interval); err != nil {
+			return errors.Wrapf(err, "failed to hash interval %+v", interval)
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(checksum); err != nil {
+		return err
+	}
+	if r.fileAlreadyExists {
+		r.syncFileOps.UpdateSyncFileProgress(interval.Len())
+	}
+	return nil
+}
+
+func getSparseQueryInterval(request *http.Request) (sparse.Interval, error) {
+	queryParams := request.URL.Query()
+	begin, err := strconv.ParseInt(queryParams.Get("begin"), 10, 64)
+	if err != nil {
+		return sparse.Interval{}, errors.Wrap(err, "failed to parse the interval begin")
+	}
+	end, err := strconv.ParseInt(queryParams.Get("end"), 10, 64)
+	if err != nil {
+		return sparse.Interval{}, errors.Wrap(err, "failed to parse the interval end")
+	}
+	if begin < 0 || end < begin {
+		return sparse.Interval{}, fmt.Errorf("invalid interval [%v, %v)", begin, end)
+	}
+	return sparse.Interval{Begin: begin, End: end}, nil
+}
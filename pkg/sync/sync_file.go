@@ -2,6 +2,7 @@ package sync
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
@@ -23,7 +24,9 @@ import (
 
 	"github.com/longhorn/backing-image-manager/api"
 	"github.com/longhorn/backing-image-manager/pkg/backup"
+	"github.com/longhorn/backing-image-manager/pkg/client"
 	"github.com/longhorn/backing-image-manager/pkg/crypto"
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
 	"github.com/longhorn/backing-image-manager/pkg/types"
 	"github.com/longhorn/backing-image-manager/pkg/util"
 )
@@ -72,6 +75,19 @@ const (
 	TmpFileSuffix = ".tmp"
 )
 
+// The operations of the sync files, which are used as the metric labels.
+const (
+	OperationFetch    = "fetch"
+	OperationDownload = string(types.DataSourceTypeDownload)
+	OperationRestore  = string(types.DataSourceTypeRestore)
+	OperationClone    = string(types.DataSourceTypeClone)
+	OperationUpload   = string(types.DataSourceTypeUpload)
+	OperationReceive  = "receive"
+	OperationSend     = "send"
+	OperationExport   = "export"
+	OperationRepair   = "repair"
+)
+
 type SyncingFile struct {
 	lock *sync.RWMutex
 
@@ -79,6 +95,12 @@ type SyncingFile struct {
 
 	ctx    context.Context
 	cancel context.CancelFunc
+	// sendingCtx outlives ctx, which is done once the file is ready. It's cancelled when the file is
+	// deleted or the sending is interrupted by the drain.
+	sendingCtx    context.Context
+	sendingCancel context.CancelFunc
+	// parentCtx is used to renew ctx when the ready or failed file is processed again, e.g. by the repair.
+	parentCtx context.Context
 
 	filePath         string
 	tmpFilePath      string
@@ -95,13 +117,59 @@ type SyncingFile struct {
 	modificationTime string
 	message          string
 
+	// checksumAlgorithm is decided by the expected checksum, and is used to calculate the current checksum.
+	checksumAlgorithm types.ChecksumAlgorithm
+	// inlineChecksum is calculated during the processing for the sources writing the data in order.
+	inlineChecksum *inlineChecksum
+	// uploadSession is set only during a resumable chunked upload.
+	uploadSession *uploadSession
+
+	// sourceFormat and sourceChecksum are the provenance of the file converted from another image format
+	// once ingested. They are empty if the file is not converted.
+	sourceFormat   string
+	sourceChecksum string
+
+	// cloneSourceConversionFilePath is the raw image converted from the qcow2 clone source. It's in the
+	// directory of the source file rather than this file, and is in use as long as this file is being prepared.
+	cloneSourceConversionFilePath string
+
+	lastScrubbedAt  string
+	lastScrubResult types.ScrubResult
+
 	sendingReference int
 
+	// operation is the one preparing the file, and is reset once the file becomes ready or failed.
+	operation          string
+	operationStartedAt time.Time
+
+	bandwidthLimiter *BandwidthLimiter
+	// spaceReserver admits the file being prepared only if the disk has enough free space for it.
+	spaceReserver *SpaceReserver
+	failureReason types.FailureReason
+	// finishedAt is the time the file became ready or failed, which starts the retention period of the file.
+	finishedAt      time.Time
+	retentionPolicy *RetentionPolicy
+
+	// schedulingTicket is set only when the operation preparing the file is waiting in the queue of the scheduler.
+	scheduler        *OperationScheduler
+	schedulingTicket *operationTicket
+
+	// interrupted is set by the drain of the sync service. The file fails with reason interrupted.
+	interrupted bool
+
 	// for unit test
 	handler Handler
 }
 
 func (sf *SyncingFile) UpdateRestoreProgress(processedSize int, err error) {
+	restored, limiter := sf.updateRestoreProgress(processedSize, err)
+	// The restore workers are blocked by the progress update, hence waiting here limits the restore.
+	if waitErr := limiter.WaitN(sf.ctx, int(restored)); waitErr != nil {
+		sf.log.WithError(waitErr).Debug("SyncingFile: stopped waiting for the restore bandwidth limit")
+	}
+}
+
+func (sf *SyncingFile) updateRestoreProgress(processedSize int, err error) (int64, *util.RateLimiter) {
 	sf.lock.Lock()
 	defer sf.lock.Unlock()
 
@@ -109,8 +177,10 @@ func (sf *SyncingFile) UpdateRestoreProgress(processedSize int, err error) {
 		sf.state = types.StateInProgress
 	}
 	if sf.state == types.StateReady {
-		return
+		return 0, nil
 	}
+	restored := int64(processedSize) - sf.processedSize
+	sf.addTransferredBytesNoLock(restored)
 	sf.processedSize = int64(processedSize)
 	if sf.size > 0 {
 		sf.progress = int((float32(sf.processedSize) / float32(sf.size)) * 100)
@@ -119,14 +189,59 @@ func (sf *SyncingFile) UpdateRestoreProgress(processedSize int, err error) {
 	if err != nil {
 		sf.message = errors.Wrapf(err, "failed to restore backing image").Error()
 	}
+	return restored, sf.getRateLimiterNoLock()
 }
 
 func (sf *SyncingFile) UpdateProgress(processedSize int64) {
 	sf.updateProgress(processedSize)
 }
 
+// RollbackProgress takes back the progress of an abandoned segmented download. The transferred bytes
+// in the metrics are kept since the data was actually transferred.
+func (sf *SyncingFile) RollbackProgress(size int64) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+
+	sf.processedSize = sf.processedSize - size
+	if sf.size > 0 {
+		sf.progress = int((float32(sf.processedSize) / float32(sf.size)) * 100)
+	}
+}
+
+// UpdateSyncFileProgress is called by the receiver after writing each data interval. Waiting here
+// delays the response to the sender, hence it limits the receive.
 func (sf *SyncingFile) UpdateSyncFileProgress(size int64) {
 	sf.updateProgress(size)
+	if err := sf.GetRateLimiter().WaitN(sf.ctx, int(size)); err != nil {
+		sf.log.WithError(err).Debug("SyncingFile: stopped waiting for the receive bandwidth limit")
+	}
+}
+
+// ReserveSpace replaces the disk space reservation of the tmp file with the size, which is the decompressed size
+// reached so far when the data is decompressed during the copy.
+func (sf *SyncingFile) ReserveSpace(size int64) error {
+	return sf.spaceReserver.reserve(sf.tmpFilePath, size)
+}
+
+// GetRateLimiter returns the rate limiter of the operation preparing the file. It's nil if there is no such limit.
+func (sf *SyncingFile) GetRateLimiter() *util.RateLimiter {
+	sf.lock.RLock()
+	defer sf.lock.RUnlock()
+	return sf.getRateLimiterNoLock()
+}
+
+func (sf *SyncingFile) getRateLimiterNoLock() *util.RateLimiter {
+	switch sf.operation {
+	case OperationDownload:
+		return sf.bandwidthLimiter.Download()
+	case OperationUpload:
+		return sf.bandwidthLimiter.Upload()
+	case OperationReceive:
+		return sf.bandwidthLimiter.Receive()
+	case OperationRestore:
+		return sf.bandwidthLimiter.Restore()
+	}
+	return nil
 }
 
 func (sf *SyncingFile) updateProgress(processedSize int64) {
@@ -140,40 +255,15 @@ func (sf *SyncingFile) updateProgress(processedSize int64) {
 		return
 	}
 
+	sf.addTransferredBytesNoLock(processedSize)
 	sf.processedSize = sf.processedSize + processedSize
 	if sf.size > 0 {
 		sf.progress = int((float32(sf.processedSize) / float32(sf.size)) * 100)
 	}
 }
 
-func NewSyncingFile(parentCtx context.Context, filePath, uuid, diskUUID, expectedChecksum string, size int64, handler Handler) *SyncingFile {
-	ctx, cancel := context.WithCancel(parentCtx)
-	sf := &SyncingFile{
-		lock: &sync.RWMutex{},
-		log: logrus.StandardLogger().WithFields(
-			logrus.Fields{
-				"component": "sync-file",
-				"filePath":  filePath,
-				"uuid":      uuid,
-			},
-		),
-		ctx:    ctx,
-		cancel: cancel,
-
-		filePath:         filePath,
-		tmpFilePath:      fmt.Sprintf("%s%s", filePath, TmpFileSuffix),
-		uuid:             uuid,
-		diskUUID:         diskUUID,
-		size:             size,
-		expectedChecksum: expectedChecksum,
-
-		state: types.StatePending,
-
-		handler: handler,
-	}
-	if size > 0 {
-		sf.log.WithField("size", size)
-	}
+func NewSyncingFile(parentCtx context.Context, filePath, uuid, diskUUID, expectedChecksum string, checksumAlgorithm types.ChecksumAlgorithm, size int64, handler Handler, bandwidthLimiter *BandwidthLimiter, spaceReserver *SpaceReserver, retentionPolicy *RetentionPolicy) *SyncingFile {
+	sf := newSyncingFile(parentCtx, filePath, uuid, diskUUID, expectedChecksum, checksumAlgorithm, size, handler, bandwidthLimiter, spaceReserver, retentionPolicy)
 
 	go func() {
 		// This may be time-consuming.
@@ -188,7 +278,7 @@ func NewSyncingFile(parentCtx context.Context, filePath, uuid, diskUUID, expecte
 			sf.lock.Lock()
 			defer sf.lock.Unlock()
 			if err != nil {
-				sf.state = types.StateFailed
+				sf.finishNoLock(types.StateFailed)
 				sf.log.Infof("SyncingFile: failed to init file syncing: %v", err)
 			} else {
 				sf.state = types.StateStarting
@@ -201,8 +291,11 @@ func NewSyncingFile(parentCtx context.Context, filePath, uuid, diskUUID, expecte
 			err = mkErr
 			return
 		}
-		if err = os.RemoveAll(sf.tmpFilePath); err != nil {
-			return
+		// The partial data of an interrupted download is kept so that the download can be resumed.
+		if !util.IsDownloadCheckpointExisting(sf.tmpFilePath) {
+			if err = os.RemoveAll(sf.tmpFilePath); err != nil {
+				return
+			}
 		}
 		if err = os.RemoveAll(sf.filePath); err != nil {
 			return
@@ -212,9 +305,110 @@ func NewSyncingFile(parentCtx context.Context, filePath, uuid, diskUUID, expecte
 	return sf
 }
 
+// IntroduceSyncingFile registers a ready file left on the disk by the previous run, e.g. before a restart.
+// The file is introduced only when its config file is valid. If the file is modified after the config
+// being written, the file will be state unknown until the checksum re-calculation is done.
+func IntroduceSyncingFile(parentCtx context.Context, filePath, diskUUID string, handler Handler, bandwidthLimiter *BandwidthLimiter, spaceReserver *SpaceReserver, retentionPolicy *RetentionPolicy) (*SyncingFile, error) {
+	config, err := util.ReadSyncingFileConfig(util.GetSyncingFileConfigFilePath(filePath))
+	if err != nil {
+		return nil, err
+	}
+	if config.FilePath != filePath {
+		return nil, fmt.Errorf("the file path %v in the config file doesn't match the actual file path %v", config.FilePath, filePath)
+	}
+	if config.UUID == "" {
+		return nil, fmt.Errorf("the uuid in the config file is empty")
+	}
+	if config.CurrentChecksum == "" {
+		return nil, fmt.Errorf("the current checksum in the config file is empty")
+	}
+	if !isExpectedChecksum(config.ExpectedChecksum, config.CurrentChecksum, config.SourceChecksum) {
+		return nil, fmt.Errorf("file expected checksum %v doesn't match the existing file checksum %v in the config file", config.ExpectedChecksum, config.CurrentChecksum)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("the file %v should not be dir", filePath)
+	}
+	if config.Size != info.Size() {
+		return nil, fmt.Errorf("the file size %v in the config file doesn't match the existing file size %v", config.Size, info.Size())
+	}
+
+	checksumAlgorithm := config.ChecksumAlgorithm
+	if checksumAlgorithm == "" {
+		checksumAlgorithm = types.DefaultChecksumAlgorithm
+	}
+
+	sf := newSyncingFile(parentCtx, filePath, config.UUID, diskUUID, config.ExpectedChecksum, checksumAlgorithm, config.Size, handler, bandwidthLimiter, spaceReserver, retentionPolicy)
+
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.cancel()
+	sf.currentChecksum = config.CurrentChecksum
+	sf.sourceFormat = config.SourceFormat
+	sf.sourceChecksum = config.SourceChecksum
+	sf.processedSize = info.Size()
+	sf.virtualSize = config.VirtualSize
+	sf.realSize = config.RealSize
+	sf.modificationTime = config.ModificationTime
+	sf.updateSyncReadyNoLock()
+	// The checksum in the config file can be directly used only if the file is not modified.
+	sf.validateReadyFileNoLock()
+
+	sf.log.Infof("SyncingFile: introduced the existing file in path %v", filePath)
+
+	return sf, nil
+}
+
+func newSyncingFile(parentCtx context.Context, filePath, uuid, diskUUID, expectedChecksum string, checksumAlgorithm types.ChecksumAlgorithm, size int64, handler Handler, bandwidthLimiter *BandwidthLimiter, spaceReserver *SpaceReserver, retentionPolicy *RetentionPolicy) *SyncingFile {
+	ctx, cancel := context.WithCancel(parentCtx)
+	sendingCtx, sendingCancel := context.WithCancel(parentCtx)
+	sf := &SyncingFile{
+		lock: &sync.RWMutex{},
+		log: logrus.StandardLogger().WithFields(
+			logrus.Fields{
+				"component": "sync-file",
+				"filePath":  filePath,
+				"uuid":      uuid,
+			},
+		),
+		ctx:           ctx,
+		cancel:        cancel,
+		sendingCtx:    sendingCtx,
+		sendingCancel: sendingCancel,
+		parentCtx:     parentCtx,
+
+		filePath:         filePath,
+		tmpFilePath:      fmt.Sprintf("%s%s", filePath, TmpFileSuffix),
+		uuid:             uuid,
+		diskUUID:         diskUUID,
+		size:             size,
+		expectedChecksum: expectedChecksum,
+
+		checksumAlgorithm: checksumAlgorithm,
+
+		state: types.StatePending,
+
+		bandwidthLimiter: bandwidthLimiter,
+		spaceReserver:    spaceReserver,
+		retentionPolicy:  retentionPolicy,
+
+		handler: handler,
+	}
+	if size > 0 {
+		sf.log.WithField("size", size)
+	}
+
+	return sf
+}
+
 func (sf *SyncingFile) checkAndReuseFile() (err error) {
 	sf.lock.RLock()
 	expectedChecksum := sf.expectedChecksum
+	checksumAlgorithm := sf.checksumAlgorithm
 	filePath := sf.filePath
 	size := sf.size
 	sf.lock.RUnlock()
@@ -237,31 +431,38 @@ func (sf *SyncingFile) checkAndReuseFile() (err error) {
 		return fmt.Errorf("sync file expected size %v doesn't match the existing file size %v", size, info.Size())
 	}
 
-	var currentChecksum string
+	var currentChecksum, sourceFormat, sourceChecksum string
+	var blockChecksums *util.BlockChecksums
 	config, err := util.ReadSyncingFileConfig(configFilePath)
-	if config != nil && config.ModificationTime == info.ModTime().UTC().String() {
+	if config != nil && config.ModificationTime == info.ModTime().UTC().String() && isConfigChecksumAlgorithm(config, checksumAlgorithm) {
 		logrus.Debugf("SyncingFile: directly get the checksum from a valid config during file reusage: %v", config.CurrentChecksum)
 		currentChecksum = config.CurrentChecksum
+		sourceFormat, sourceChecksum = config.SourceFormat, config.SourceChecksum
 	} else {
-		logrus.Debugf("SyncingFile: failed to get the checksum from a valid config during file reusage, will directly calculated it then")
-		currentChecksum, err = util.GetFileChecksum(filePath)
+		logrus.Debugf("SyncingFile: failed to get the %v checksum from a valid config during file reusage, will directly calculated it then", checksumAlgorithm)
+		currentChecksum, blockChecksums, err = util.GetFileBlockChecksums(filePath, checksumAlgorithm, util.DefaultChecksumBlockSize)
 		if err != nil {
 			return errors.Wrapf(err, "failed to calculate checksum for the existing file during init")
 		}
 	}
-	if expectedChecksum != "" && expectedChecksum != currentChecksum {
+	if !isExpectedChecksum(expectedChecksum, currentChecksum, sourceChecksum) {
 		return fmt.Errorf("file expected checksum %v doesn't match the existing file checksum %v", expectedChecksum, currentChecksum)
 	}
 
 	sf.lock.Lock()
 	sf.cancel()
 	sf.currentChecksum = currentChecksum
+	sf.sourceFormat = sourceFormat
+	sf.sourceChecksum = sourceChecksum
 	sf.processedSize = info.Size()
 	sf.modificationTime = info.ModTime().UTC().String()
 	sf.updateSyncReadyNoLock()
 	sf.updateVirtualSizeNoLock(sf.filePath)
 	sf.updateRealSizeNoLock(sf.filePath)
 	sf.writeConfigNoLock()
+	if blockChecksums != nil {
+		sf.writeBlockChecksumsNoLock(blockChecksums)
+	}
 	sf.lock.Unlock()
 
 	sf.log.Infof("SyncingFile: directly reuse/introduce the existing file in path %v", filePath)
@@ -282,6 +483,12 @@ func (sf *SyncingFile) waitForProcessingBeginWithTimeout() {
 			sf.lock.Unlock()
 			return
 		}
+		// The timeout starts over after the operation leaves the queue.
+		if sf.schedulingTicket != nil {
+			count = 0
+			sf.lock.Unlock()
+			continue
+		}
 		if count >= RetryCount {
 			sf.handleFailureNoLock(fmt.Errorf("failed to wait for processing begin in %v seconds, current state %v", RetryCount, sf.state))
 			sf.lock.Unlock()
@@ -310,6 +517,28 @@ func (sf *SyncingFile) WaitForStateNonPending() error {
 	}
 }
 
+// WaitForScheduling queues the operation preparing the file until the scheduler allows it to run.
+// The caller should call the returned function once the operation is done.
+func (sf *SyncingFile) WaitForScheduling(scheduler *OperationScheduler, operation string, priority int) (func(), error) {
+	ticket := scheduler.schedule(operation, priority)
+
+	sf.lock.Lock()
+	sf.scheduler = scheduler
+	sf.schedulingTicket = ticket
+	sf.lock.Unlock()
+
+	err := scheduler.wait(sf.ctx, ticket)
+
+	sf.lock.Lock()
+	sf.schedulingTicket = nil
+	sf.lock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return func() { scheduler.done(ticket) }, nil
+}
+
 func (sf *SyncingFile) Get() api.FileInfo {
 	sf.lock.Lock()
 	defer sf.lock.Unlock()
@@ -322,6 +551,24 @@ func (sf *SyncingFile) Get() api.FileInfo {
 	return sf.getNoLock()
 }
 
+// peek returns the file info without validating the ready file, hence it has no side effect.
+func (sf *SyncingFile) peek() api.FileInfo {
+	sf.lock.RLock()
+	defer sf.lock.RUnlock()
+	return sf.getNoLock()
+}
+
+// validateReadyFile returns true if the ready file is found modified and starts being re-checked.
+func (sf *SyncingFile) validateReadyFile() bool {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if sf.state != types.StateReady {
+		return false
+	}
+	sf.validateReadyFileNoLock()
+	return sf.state != types.StateReady
+}
+
 func (sf *SyncingFile) validateReadyFileNoLock() {
 	if sf.state != types.StateReady {
 		return
@@ -333,28 +580,30 @@ func (sf *SyncingFile) validateReadyFileNoLock() {
 
 		go func() {
 			var err error
-			if checksum, cksumErr := util.GetFileChecksum(sf.filePath); cksumErr != nil {
+			checksum, blockChecksums, cksumErr := util.GetFileBlockChecksums(sf.filePath, sf.checksumAlgorithm, util.DefaultChecksumBlockSize)
+			if cksumErr != nil {
 				err = errors.Wrapf(cksumErr, "failed to re-calculate checksum after ready file being modified, will mark the file as failed")
 			} else if checksum != sf.currentChecksum {
-				err = fmt.Errorf("ready file is modified at %v with a different checksum %v, previous checksum %v", modificationTime, checksum, sf.currentChecksum)
+				err = fmt.Errorf("ready file is modified at %v with a different checksum %v, previous checksum %v%v", modificationTime, checksum, sf.currentChecksum, sf.getCorruptedBlocksMessage(blockChecksums))
 			}
 
 			sf.lock.Lock()
 			defer sf.lock.Unlock()
 			if err != nil {
-				sf.state = types.StateFailed
+				sf.finishNoLock(types.StateFailed)
 				sf.message = err.Error()
 			} else {
-				sf.state = types.StateReady
+				sf.finishNoLock(types.StateReady)
 				sf.message = ""
 				sf.writeConfigNoLock()
+				sf.writeBlockChecksumsNoLock(blockChecksums)
 			}
 		}()
 	}
 }
 
 func (sf *SyncingFile) getNoLock() api.FileInfo {
-	return api.FileInfo{
+	info := api.FileInfo{
 		DiskUUID:         sf.diskUUID,
 		ExpectedChecksum: sf.expectedChecksum,
 
@@ -370,8 +619,22 @@ func (sf *SyncingFile) getNoLock() api.FileInfo {
 		ModificationTime: sf.modificationTime,
 		Message:          sf.message,
 
+		SourceFormat:   sf.sourceFormat,
+		SourceChecksum: sf.sourceChecksum,
+
 		SendingReference: sf.sendingReference,
+
+		LastScrubbedAt:  sf.lastScrubbedAt,
+		LastScrubResult: string(sf.lastScrubResult),
+
+		Queued: sf.scheduler.position(sf.schedulingTicket),
+
+		FailureReason: string(sf.failureReason),
 	}
+	if evictionTime := sf.getEvictionTimeNoLock(); !evictionTime.IsZero() {
+		info.EvictionTime = evictionTime.UTC().Format(time.RFC3339)
+	}
+	return info
 }
 
 func (sf *SyncingFile) Delete() {
@@ -381,9 +644,15 @@ func (sf *SyncingFile) Delete() {
 	defer sf.lock.RUnlock()
 
 	sf.cancel()
+	sf.sendingCancel()
+	sf.spaceReserver.release(sf.tmpFilePath)
 	if err := os.RemoveAll(sf.tmpFilePath); err != nil {
 		sf.log.Warnf("SyncingFile: failed to delete tmp sync file %v: %v", sf.tmpFilePath, err)
 	}
+	checkpointFilePath := util.GetDownloadCheckpointFilePath(sf.tmpFilePath)
+	if err := os.RemoveAll(checkpointFilePath); err != nil {
+		sf.log.Warnf("SyncingFile: failed to delete download checkpoint file %v: %v", checkpointFilePath, err)
+	}
 	if err := os.RemoveAll(sf.filePath); err != nil {
 		sf.log.Warnf("SyncingFile: failed to delete sync file %v: %v", sf.filePath, err)
 	}
@@ -391,6 +660,10 @@ func (sf *SyncingFile) Delete() {
 	if err := os.RemoveAll(configFilePath); err != nil {
 		sf.log.Warnf("SyncingFile: failed to delete sync file config file %v: %v", configFilePath, err)
 	}
+	blockChecksumsFilePath := util.GetBlockChecksumsFilePath(sf.filePath)
+	if err := os.RemoveAll(blockChecksumsFilePath); err != nil {
+		sf.log.Warnf("SyncingFile: failed to delete sync file block checksums file %v: %v", blockChecksumsFilePath, err)
+	}
 }
 
 func (sf *SyncingFile) GetFileReader() (io.ReadCloser, error) {
@@ -406,30 +679,142 @@ func (sf *SyncingFile) GetFileReader() (io.ReadCloser, error) {
 	return os.Open(sf.filePath)
 }
 
-func (sf *SyncingFile) isProcessingRequired() (bool, error) {
-	sf.lock.RLock()
-	defer sf.lock.RUnlock()
+// GetBlockChecksums returns the block checksums of the ready file. The block checksums will be
+// re-calculated if the stored ones are missing or outdated, e.g. for the files prepared by the old versions.
+func (sf *SyncingFile) GetBlockChecksums() (*util.BlockChecksums, error) {
+	sf.lock.Lock()
+	sf.validateReadyFileNoLock()
+	if sf.state != types.StateReady {
+		sf.lock.Unlock()
+		return nil, fmt.Errorf("cannot get the block checksums for a non-ready file, current state %v", sf.state)
+	}
+	filePath := sf.filePath
+	size := sf.size
+	modificationTime := sf.modificationTime
+	currentChecksum := sf.currentChecksum
+	checksumAlgorithm := sf.checksumAlgorithm
+	sf.lock.Unlock()
+
+	blockChecksums, err := util.ReadBlockChecksums(util.GetBlockChecksumsFilePath(filePath))
+	if err == nil && blockChecksums.ModificationTime == modificationTime && blockChecksums.Algorithm == checksumAlgorithm && blockChecksums.Size == size {
+		return blockChecksums, nil
+	}
+
+	sf.log.Infof("SyncingFile: the stored block checksums are missing or outdated, will re-calculate them")
+	checksum, blockChecksums, err := util.GetFileBlockChecksums(filePath, checksumAlgorithm, util.DefaultChecksumBlockSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to calculate the block checksums for file %v", filePath)
+	}
+	if checksum != currentChecksum {
+		return nil, fmt.Errorf("the re-calculated checksum %v doesn't match the file current checksum %v", checksum, currentChecksum)
+	}
+
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if util.FileModificationTime(filePath) != modificationTime || sf.modificationTime != modificationTime {
+		return nil, fmt.Errorf("file %v has been modified while calculating the block checksums", filePath)
+	}
+	sf.writeBlockChecksumsNoLock(blockChecksums)
+
+	return blockChecksums, nil
+}
+
+// ReadBlock returns the data of a block of the ready file. The data is verified by the block checksum
+// before being returned, so that a corrupted block won't be spread to the peers.
+func (sf *SyncingFile) ReadBlock(index int) ([]byte, error) {
+	blockChecksums, err := sf.GetBlockChecksums()
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(blockChecksums.Blocks) {
+		return nil, fmt.Errorf("invalid block index %v, the file has %v blocks", index, len(blockChecksums.Blocks))
+	}
+
+	f, err := os.Open(sf.filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errClose := f.Close(); errClose != nil {
+			sf.log.WithError(errClose).Errorf("Failed to close file %v", sf.filePath)
+		}
+	}()
+
+	offset, length := blockChecksums.GetBlockRange(index)
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, errors.Wrapf(err, "failed to read block %v of file %v", index, sf.filePath)
+	}
+	if err := blockChecksums.VerifyBlock(index, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (sf *SyncingFile) isProcessingRequired(operation string) (bool, error) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
 
 	if sf.state == types.StateReady {
 		sf.log.Infof("SyncingFile: file is already state %v, no need to process it", types.StateReady)
 		return false, nil
 	}
+	if sf.interrupted {
+		return false, ErrInterrupted
+	}
 	if sf.state != types.StateStarting {
 		return false, fmt.Errorf("invalid state %v for actual processing", sf.state)
 	}
 
+	// The partial data kept for resuming an operation cannot be reused by the others.
+	if !sf.isPartialDataReusableNoLock(operation) {
+		if err := sf.discardPartialDataNoLock(); err != nil {
+			return false, errors.Wrapf(err, "failed to clean up the partial data in tmp file %v", sf.tmpFilePath)
+		}
+	}
+
+	sf.operation = operation
+	sf.operationStartedAt = time.Now()
 	return true, nil
 }
 
+// observeOperationNoLock records the duration and the outcome of the operation once the file becomes ready or failed.
+func (sf *SyncingFile) observeOperationNoLock(err error) {
+	if sf.operation == "" {
+		return
+	}
+	metrics.ObserveOperation(sf.operation, sf.operationStartedAt, err)
+	sf.operation = ""
+}
+
+func (sf *SyncingFile) addTransferredBytesNoLock(bytes int64) {
+	if sf.operation == "" {
+		return
+	}
+	metrics.AddTransferredBytes(getTransferDirection(sf.operation), sf.operation, bytes)
+}
+
+func getTransferDirection(operation string) string {
+	switch operation {
+	case OperationDownload, OperationRestore:
+		return metrics.DirectionDownloaded
+	case OperationSend, OperationExport:
+		return metrics.DirectionSent
+	}
+	return metrics.DirectionReceived
+}
+
 func (sf *SyncingFile) Fetch(srcFilePath string) (err error) {
 	sf.log.Infof("SyncingFile: start to fetch sync file from %v", srcFilePath)
 
 	shouldReuseFile := srcFilePath == sf.filePath
 
 	srcConfigFilePath := util.GetSyncingFileConfigFilePath(srcFilePath)
+	srcBlockChecksumsFilePath := util.GetBlockChecksumsFilePath(srcFilePath)
 	defer func() {
-		// cleanup the src file
-		if !shouldReuseFile {
+		// cleanup the src file. The src file is kept for the same fetch after a restart if it's not moved yet.
+		if !shouldReuseFile && !errors.Is(err, ErrInterrupted) {
 			sf.log.Infof("SyncingFile: try to clean up src file %v and its config file %v after fetch", srcFilePath, srcConfigFilePath)
 			if err := os.RemoveAll(srcFilePath); err != nil {
 				sf.log.Errorf("SyncingFile: failed to clean up src file %v after fetch: %v", srcFilePath, err)
@@ -437,10 +822,13 @@ func (sf *SyncingFile) Fetch(srcFilePath string) (err error) {
 			if err := os.RemoveAll(srcConfigFilePath); err != nil {
 				sf.log.Errorf("SyncingFile: failed to clean up src config file %v after fetch: %v", srcConfigFilePath, err)
 			}
+			if err := os.RemoveAll(srcBlockChecksumsFilePath); err != nil {
+				sf.log.Errorf("SyncingFile: failed to clean up src block checksums file %v after fetch: %v", srcBlockChecksumsFilePath, err)
+			}
 		}
 	}()
 
-	needProcessing, err := sf.isProcessingRequired()
+	needProcessing, err := sf.isProcessingRequired(OperationFetch)
 	if err != nil {
 		return err
 	}
@@ -449,7 +837,7 @@ func (sf *SyncingFile) Fetch(srcFilePath string) (err error) {
 	}
 
 	defer func() {
-		if finalErr := sf.finishProcessing(err, types.DataEnginev1); finalErr != nil {
+		if finalErr := sf.finishProcessing(err, types.DataEnginev1, ""); finalErr != nil {
 			err = finalErr
 		}
 	}()
@@ -461,11 +849,33 @@ func (sf *SyncingFile) Fetch(srcFilePath string) (err error) {
 
 	srcFileStat, err := os.Stat(srcFilePath)
 	if err != nil {
-		return err
+		// The src file has been moved to the tmp file by the same fetch before a restart.
+		if !os.IsNotExist(err) {
+			return err
+		}
+		sf.lock.Lock()
+		checkpoint := sf.loadResumeCheckpointNoLock(OperationFetch, srcFilePath)
+		sf.lock.Unlock()
+		if checkpoint == nil {
+			return err
+		}
+		sf.log.Infof("SyncingFile: resuming the fetch from %v with the tmp file %v moved before", srcFilePath, sf.tmpFilePath)
+		sf.lock.Lock()
+		sf.state = types.StateInProgress
+		sf.processedSize = checkpoint.Size
+		sf.lock.Unlock()
+		return nil
 	}
 	if srcFileStat.IsDir() {
 		return fmt.Errorf("the src file %v of the fetch call should not be dir", srcFilePath)
 	}
+	// The checkpoint lets the same fetch find the data in the tmp file if the processing is interrupted after the move.
+	sf.lock.Lock()
+	err = sf.saveResumeCheckpointNoLock(OperationFetch, srcFilePath, srcFileStat.Size())
+	sf.lock.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "failed to save the fetch checkpoint for tmp file %v", sf.tmpFilePath)
+	}
 	if err = os.Rename(srcFilePath, sf.tmpFilePath); err != nil {
 		return err
 	}
@@ -476,6 +886,13 @@ func (sf *SyncingFile) Fetch(srcFilePath string) (err error) {
 			return err
 		}
 	}
+	// The block checksums file is still valid only if the file is not modified, which is checked when using it.
+	if srcBlockChecksumsFileStat, err := os.Stat(srcBlockChecksumsFilePath); err == nil && !srcBlockChecksumsFileStat.IsDir() {
+		sf.log.Debugf("SyncingFile: found the corresponding src block checksums file %v", srcBlockChecksumsFilePath)
+		if err = os.Rename(srcBlockChecksumsFilePath, util.GetBlockChecksumsFilePath(sf.filePath)); err != nil {
+			return err
+		}
+	}
 
 	sf.lock.Lock()
 	sf.state = types.StateInProgress
@@ -485,10 +902,10 @@ func (sf *SyncingFile) Fetch(srcFilePath string) (err error) {
 	return nil
 }
 
-func (sf *SyncingFile) DownloadFromURL(url, dataEngine string) (written int64, err error) {
+func (sf *SyncingFile) DownloadFromURL(url string, concurrentLimit int, compression types.CompressionType, decompressedSizeLimit int64, targetFormat, dataEngine string) (written int64, err error) {
 	sf.log.Infof("SyncingFile: start to download sync file from URL %v", url)
 
-	needProcessing, err := sf.isProcessingRequired()
+	needProcessing, err := sf.isProcessingRequired(OperationDownload)
 	if err != nil {
 		return 0, err
 	}
@@ -497,11 +914,17 @@ func (sf *SyncingFile) DownloadFromURL(url, dataEngine string) (written int64, e
 	}
 
 	defer func() {
-		if finalErr := sf.finishProcessing(err, dataEngine); finalErr != nil {
+		if finalErr := sf.finishProcessing(err, dataEngine, targetFormat); finalErr != nil {
 			err = finalErr
 		}
 	}()
 
+	// The handler may write the data out of order, e.g. a segmented download,
+	// then the inline checksum won't cover the whole file and will be ignored.
+	if err := sf.startInlineChecksum(); err != nil {
+		return 0, err
+	}
+
 	size, err := sf.handler.GetSizeFromURL(url)
 	if err != nil {
 		return 0, err
@@ -511,13 +934,17 @@ func (sf *SyncingFile) DownloadFromURL(url, dataEngine string) (written int64, e
 	sf.log.WithField("size", size)
 	sf.lock.Unlock()
 
-	return sf.handler.DownloadFromURL(sf.ctx, url, sf.tmpFilePath, sf)
+	if err := sf.spaceReserver.reserve(sf.tmpFilePath, size); err != nil {
+		return 0, err
+	}
+
+	return sf.handler.DownloadFromURL(sf.ctx, url, sf.tmpFilePath, concurrentLimit, compression, decompressedSizeLimit, sf)
 }
 
-func (sf *SyncingFile) RestoreFromBackupURL(backupURL string, credential map[string]string, concurrentLimit int, dataEngine string) (err error) {
+func (sf *SyncingFile) RestoreFromBackupURL(backupURL string, credential map[string]string, concurrentLimit int, compression types.CompressionType, decompressedSizeLimit int64, targetFormat, dataEngine string) (err error) {
 	sf.log.Infof("SyncingFile: start to restore sync file from backup URL %v", backupURL)
 
-	needProcessing, err := sf.isProcessingRequired()
+	needProcessing, err := sf.isProcessingRequired(OperationRestore)
 	if err != nil {
 		return err
 	}
@@ -526,7 +953,7 @@ func (sf *SyncingFile) RestoreFromBackupURL(backupURL string, credential map[str
 	}
 
 	defer func() {
-		if finalErr := sf.finishProcessing(err, dataEngine); finalErr != nil {
+		if finalErr := sf.finishProcessing(err, dataEngine, targetFormat); finalErr != nil {
 			err = finalErr
 		}
 	}()
@@ -551,14 +978,51 @@ func (sf *SyncingFile) RestoreFromBackupURL(backupURL string, credential map[str
 	sf.size = info.Size
 	sf.lock.Unlock()
 
+	if err := sf.spaceReserver.reserve(sf.tmpFilePath, info.Size); err != nil {
+		return err
+	}
+
 	// async call to start restoration
 	if err := backup.DoBackupRestore(backupURL, sf.tmpFilePath, concurrentLimit, sf); err != nil {
 		return err
 	}
 
 	// wait until restoration is complete or failed
-	err = sf.waitForRestoreComplete()
-	return err
+	if err = sf.waitForRestoreComplete(); err != nil {
+		return err
+	}
+
+	// The restoration writes the blocks to the file directly, hence the decompression can only be done afterward.
+	return sf.decompressTmpFile(compression, decompressedSizeLimit)
+}
+
+func (sf *SyncingFile) decompressTmpFile(compression types.CompressionType, decompressedSizeLimit int64) error {
+	if compression == types.CompressionTypeNone {
+		return nil
+	}
+
+	decompressedFilePath := fmt.Sprintf("%v-decompressed.tmp", sf.tmpFilePath)
+	defer func() {
+		sf.spaceReserver.release(decompressedFilePath)
+		if err := os.RemoveAll(decompressedFilePath); err != nil {
+			sf.log.Warnf("SyncingFile: failed to clean up the decompressed file %v: %v", decompressedFilePath, err)
+		}
+	}()
+
+	// The decompressed file is a second copy besides the tmp file, hence it needs its own reservation.
+	reserve := func(size int64) error {
+		return sf.spaceReserver.reserve(decompressedFilePath, size)
+	}
+	compression, err := util.DecompressFile(sf.tmpFilePath, decompressedFilePath, compression, decompressedSizeLimit, reserve)
+	if err != nil {
+		return err
+	}
+	if compression == types.CompressionTypeNone {
+		return nil
+	}
+	sf.log.Infof("SyncingFile: decompressed the %v tmp file", compression)
+
+	return os.Rename(decompressedFilePath, sf.tmpFilePath)
 }
 
 func (sf *SyncingFile) waitForRestoreComplete() (err error) {
@@ -598,7 +1062,7 @@ func (sf *SyncingFile) CloneToFileWithEncryption(sourceBackingImage, sourceBacki
 		}
 	}()
 
-	needProcessing, err := sf.isProcessingRequired()
+	needProcessing, err := sf.isProcessingRequired(OperationClone)
 	if err != nil {
 		return 0, err
 	}
@@ -606,7 +1070,7 @@ func (sf *SyncingFile) CloneToFileWithEncryption(sourceBackingImage, sourceBacki
 		return 0, nil
 	}
 	defer func() {
-		if finalErr := sf.finishProcessing(err, dataEngine); finalErr != nil {
+		if finalErr := sf.finishProcessing(err, dataEngine, ""); finalErr != nil {
 			err = finalErr
 		}
 	}()
@@ -628,6 +1092,13 @@ func (sf *SyncingFile) CloneToFileWithEncryption(sourceBackingImage, sourceBacki
 		return 0, errors.Wrapf(err, "failed to prepare target file")
 	}
 
+	// The data is encrypted after being copied to the target device.
+	if encryption != types.EncryptionTypeEncrypt {
+		if err := sf.startInlineChecksum(); err != nil {
+			return 0, err
+		}
+	}
+
 	sourceFileReader, sourceLoopDevicePath, err := sf.openCloneSourceFile(sourceFile, encryption, credential)
 	defer func() {
 		if sourceFileReader != nil {
@@ -729,7 +1200,10 @@ func (sf *SyncingFile) prepareCloneSourceFile(sourceBackingImage, sourceBackingI
 			return "", tmpRawFile, writeZero, errors.Wrapf(err, "failed to get source backing file %v qemu info", sourceFile)
 		}
 		if imgInfo.Format == "qcow2" {
-			tmpRawFile := fmt.Sprintf("%v-raw.tmp", sourceFile)
+			tmpRawFile := sourceFile + util.RawConversionFileSuffix
+			sf.lock.Lock()
+			sf.cloneSourceConversionFilePath = tmpRawFile
+			sf.lock.Unlock()
 
 			if err := util.ConvertFromQcow2ToRaw(sourceFile, tmpRawFile); err != nil {
 				return "", tmpRawFile, writeZero, errors.Wrapf(err, "failed to create raw image from qcow2 image %v", sourceFile)
@@ -751,6 +1225,9 @@ func (sf *SyncingFile) prepareCloneTargetFile(sourceFile string, encryption type
 	if err := sf.setFileSizeForEncryption(sourceFileSize, encryption); err != nil {
 		return errors.Wrap(err, "failed to set size for the target file")
 	}
+	if err := sf.spaceReserver.reserve(sf.tmpFilePath, sf.size); err != nil {
+		return err
+	}
 	f, err := os.OpenFile(sf.tmpFilePath, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return err
@@ -764,7 +1241,9 @@ func (sf *SyncingFile) prepareCloneTargetFile(sourceFile string, encryption type
 	return nil
 }
 
-func (sf *SyncingFile) IdleTimeoutCopyToFile(src io.ReadCloser, dataEngine string) (copied int64, err error) {
+// IdleTimeoutCopyToFile copies the data from src to the file. If the data is compressed, it will be decompressed
+// during the copy, and the returned size is the decompressed size. The compression type cannot be auto here.
+func (sf *SyncingFile) IdleTimeoutCopyToFile(src io.ReadCloser, compression types.CompressionType, decompressedSizeLimit int64, targetFormat, dataEngine string) (copied int64, err error) {
 	sf.log.Infof("SyncingFile: start to copy data to sync file")
 
 	defer func() {
@@ -773,7 +1252,7 @@ func (sf *SyncingFile) IdleTimeoutCopyToFile(src io.ReadCloser, dataEngine strin
 		}
 	}()
 
-	needProcessing, err := sf.isProcessingRequired()
+	needProcessing, err := sf.isProcessingRequired(OperationUpload)
 	if err != nil {
 		return 0, err
 	}
@@ -790,27 +1269,54 @@ func (sf *SyncingFile) IdleTimeoutCopyToFile(src io.ReadCloser, dataEngine strin
 			logrus.WithError(errClose).Error("Failed to close the file")
 		}
 	}()
-	if err = f.Truncate(sf.size); err != nil {
-		return 0, err
-	}
 
 	defer func() {
-		if finalErr := sf.finishProcessing(err, dataEngine); finalErr != nil {
+		if finalErr := sf.finishProcessing(err, dataEngine, targetFormat); finalErr != nil {
 			err = finalErr
 		}
 	}()
 
-	nw, err := IdleTimeoutCopy(sf.ctx, sf.cancel, src, f, sf, false)
+	if err = sf.startInlineChecksum(); err != nil {
+		return 0, err
+	}
+
+	if err = sf.spaceReserver.reserve(sf.tmpFilePath, sf.size); err != nil {
+		return 0, err
+	}
+
+	if compression == types.CompressionTypeNone {
+		if err = f.Truncate(sf.size); err != nil {
+			return 0, err
+		}
+		nw, err := IdleTimeoutCopy(sf.ctx, sf.cancel, src, f, sf, false)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to copy the data with timeout")
+		}
+		return nw, nil
+	}
+
+	// The size of the file is the compressed size, which is used for the progress only.
+	if err = f.Truncate(0); err != nil {
+		return 0, err
+	}
+	nw, err := DecompressionCopy(sf.ctx, sf.cancel, src, f, compression, decompressedSizeLimit, sf)
 	if err != nil {
-		err = errors.Wrapf(err, "failed to copy the data with timeout")
+		return 0, errors.Wrapf(err, "failed to decompress the %v data with timeout", compression)
 	}
-	return nw, err
+	if err = f.Truncate(nw); err != nil {
+		return 0, err
+	}
+	if nw%types.DefaultSectorSize != 0 {
+		return 0, fmt.Errorf("the decompressed file size %d should be a multiple of %d bytes since Longhorn uses directIO by default", nw, types.DefaultSectorSize)
+	}
+	return nw, nil
 }
 
-func (sf *SyncingFile) Receive(port int, fileType, dataEngine string) (err error) {
+// Receive launches a receiver at the port, and waits for the sender. The receiver serves TLS if the config is set.
+func (sf *SyncingFile) Receive(port int, fileType, dataEngine string, tlsConfig *tls.Config) (err error) {
 	sf.log.Infof("SyncingFile: start to launch a receiver at port %v", port)
 
-	needProcessing, err := sf.isProcessingRequired()
+	needProcessing, err := sf.isProcessingRequired(OperationReceive)
 	if err != nil {
 		return err
 	}
@@ -819,17 +1325,44 @@ func (sf *SyncingFile) Receive(port int, fileType, dataEngine string) (err error
 	}
 
 	defer func() {
-		if finalErr := sf.finishProcessing(err, dataEngine); finalErr != nil {
+		if finalErr := sf.finishProcessing(err, dataEngine, ""); finalErr != nil {
 			err = finalErr
 		}
 	}()
 
+	if err = sf.spaceReserver.reserve(sf.tmpFilePath, sf.size); err != nil {
+		return err
+	}
+
+	// The data received before an interruption is kept in the tmp file. The sender compares the checksum
+	// of each interval with the existing file, then sends only the intervals not received yet.
+	sf.lock.Lock()
+	if checkpoint := sf.loadResumeCheckpointNoLock(OperationReceive, ""); checkpoint != nil && checkpoint.Size == sf.size {
+		sf.log.Infof("SyncingFile: resuming the receive with the data in tmp file %v", sf.tmpFilePath)
+	} else if err = sf.discardPartialDataNoLock(); err == nil {
+		err = sf.saveResumeCheckpointNoLock(OperationReceive, "", sf.size)
+	}
+	sf.lock.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "failed to prepare the receive checkpoint for tmp file %v", sf.tmpFilePath)
+	}
+
 	// TODO: After merging the sparse tool repo into this sync service, we don't need to launch a separate server here.
 	//  Instead, this SyncingFile is responsible for punching hole, reading/writing data, and computing checksum.
-	if serverErr := sparserest.Server(sf.ctx, strconv.Itoa(port), sf.tmpFilePath, sf); serverErr != nil && serverErr != http.ErrServerClosed {
+	var serverErr error
+	if tlsConfig != nil {
+		serverErr = serveSparseReceiverTLS(sf.ctx, port, sf.tmpFilePath, sf, tlsConfig)
+	} else {
+		serverErr = sparserest.Server(sf.ctx, strconv.Itoa(port), sf.tmpFilePath, sf)
+	}
+	if serverErr != nil && serverErr != http.ErrServerClosed {
 		err = serverErr
 		return err
 	}
+	// The receiver server is closed rather than finished by the sender.
+	if sf.isInterrupted() {
+		return ErrInterrupted
+	}
 
 	// For sparse files, holes may not be calculated into s.processedSize.
 	// And if the whole file is empty, the state would be starting rather than in-progress.
@@ -856,7 +1389,8 @@ func (sf *SyncingFile) Receive(port int, fileType, dataEngine string) (err error
 	return nil
 }
 
-func (sf *SyncingFile) Send(toAddress string, sender Sender) (err error) {
+// Send launches the sending in the background. The sending may be queued by the scheduler.
+func (sf *SyncingFile) Send(toAddress string, sender Sender, scheduler *OperationScheduler, priority int) (err error) {
 	sf.lock.Lock()
 	defer sf.lock.Unlock()
 
@@ -870,30 +1404,188 @@ func (sf *SyncingFile) Send(toAddress string, sender Sender) (err error) {
 	}
 
 	sf.sendingReference++
+	size := sf.size
+	limiter := sf.bandwidthLimiter.Send()
 	go func() {
 		defer func() {
 			sf.lock.Lock()
 			sf.sendingReference--
 			sf.lock.Unlock()
 		}()
-		if err := sender(sf.filePath, toAddress); err != nil {
+		// The context of a ready file is already cancelled, hence the sending uses its own context.
+		ticket := scheduler.schedule(OperationSend, priority)
+		if err := scheduler.wait(sf.sendingCtx, ticket); err != nil {
+			sf.log.Errorf("SyncingFile: failed to wait for sending file: %v", err)
+			return
+		}
+		defer scheduler.done(ticket)
+
+		startedAt := time.Now()
+		err := sender(sf.sendingCtx, sf.filePath, toAddress, limiter)
+		metrics.ObserveOperation(OperationSend, startedAt, err)
+		if err != nil {
 			sf.log.Errorf("SyncingFile: failed to send file: %v", err)
+			return
 		}
+		metrics.AddTransferredBytes(metrics.DirectionSent, OperationSend, size)
 	}()
 
 	return nil
 }
 
-func (sf *SyncingFile) finishProcessing(err error, dataEngine string) (finalErr error) {
+// RepairFromPeer compares the block checksums of the file with the healthy copy of the peer sync server,
+// then pulls only the mismatching blocks into the file. The file will be back to state ready
+// once the whole file checksum is verified. The repair may be queued by the scheduler.
+func (sf *SyncingFile) RepairFromPeer(peerClient *client.SyncClient, peerFilePath string, scheduler *OperationScheduler, priority int) error {
 	sf.lock.Lock()
 	defer sf.lock.Unlock()
 
-	sf.cancel()
+	if sf.state != types.StateReady && sf.state != types.StateFailed && sf.state != types.StateCorrupted {
+		return fmt.Errorf("invalid state %v for file repairing", sf.state)
+	}
+	if sf.sendingReference > 0 {
+		return fmt.Errorf("cannot repair file %v during sending", sf.filePath)
+	}
+	if sf.currentChecksum == "" {
+		return fmt.Errorf("cannot repair file %v without the checksum", sf.filePath)
+	}
+	if _, err := os.Stat(sf.filePath); err != nil {
+		return errors.Wrapf(err, "cannot repair file %v", sf.filePath)
+	}
+
+	if sf.interrupted {
+		return ErrInterrupted
+	}
+
+	// The context of the ready or failed file is already cancelled. The new one is cancelled by the deletion
+	// or the drain, as well as once the repair is done.
+	sf.ctx, sf.cancel = context.WithCancel(sf.parentCtx)
+	ctx := sf.ctx
+	sf.state = types.StateInProgress
+	sf.progress = 0
+	sf.failureReason = ""
+	sf.message = fmt.Sprintf("repairing the file from peer %v", peerClient.Remote)
+	sf.operation = OperationRepair
+	sf.operationStartedAt = time.Now()
+	sf.log.Infof("SyncingFile: start to repair the file from peer %v file %v", peerClient.Remote, peerFilePath)
+
+	go func() {
+		done, err := sf.WaitForScheduling(scheduler, OperationRepair, priority)
+		if err == nil {
+			err = sf.repairFromPeer(ctx, peerClient, peerFilePath)
+			done()
+		}
+
+		sf.lock.Lock()
+		defer sf.lock.Unlock()
+		sf.cancel()
+		if err != nil {
+			sf.finishNoLock(types.StateFailed)
+			if sf.interrupted {
+				sf.failureReason = types.FailureReasonInterrupted
+			}
+			sf.observeOperationNoLock(err)
+			// The file is kept for the next repair.
+			sf.message = fmt.Sprintf("failed to repair the file from peer %v: %v", peerClient.Remote, err)
+			sf.log.Errorf("SyncingFile: %s", sf.message)
+		}
+	}()
+
+	return nil
+}
+
+func (sf *SyncingFile) repairFromPeer(ctx context.Context, peerClient *client.SyncClient, peerFilePath string) error {
+	sf.lock.RLock()
+	size := sf.size
+	currentChecksum := sf.currentChecksum
+	checksumAlgorithm := sf.checksumAlgorithm
+	sf.lock.RUnlock()
+
+	peerBlockChecksums, err := peerClient.GetBlockChecksums(ctx, peerFilePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the block checksums of the peer file")
+	}
+	if peerBlockChecksums.Algorithm != checksumAlgorithm || peerBlockChecksums.Size != size {
+		return fmt.Errorf("the peer file with %v block checksums and size %v doesn't match the file with checksum algorithm %v and size %v",
+			peerBlockChecksums.Algorithm, peerBlockChecksums.Size, checksumAlgorithm, size)
+	}
+
+	f, err := os.OpenFile(sf.filePath, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := f.Close(); errClose != nil {
+			sf.log.WithError(errClose).Errorf("Failed to close file %v", sf.filePath)
+		}
+	}()
+	// The size of the corrupted file may be changed.
+	if err := f.Truncate(size); err != nil {
+		return errors.Wrapf(err, "failed to truncate the file to size %v before repairing", size)
+	}
+
+	_, blockChecksums, err := util.GetFileBlockChecksumsWithRateLimit(ctx, sf.filePath, checksumAlgorithm, peerBlockChecksums.BlockSize, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to calculate the block checksums before repairing")
+	}
+	corruptedBlocks, err := blockChecksums.Diff(peerBlockChecksums)
+	if err != nil {
+		return err
+	}
+	sf.log.Infof("SyncingFile: found %v corrupted block(s) %v with block size %v", len(corruptedBlocks), corruptedBlocks, peerBlockChecksums.BlockSize)
+
+	for i, index := range corruptedBlocks {
+		data, err := peerClient.DownloadBlock(ctx, peerFilePath, index, peerBlockChecksums)
+		if err != nil {
+			return errors.Wrapf(err, "failed to download block %v from the peer", index)
+		}
+		offset, _ := peerBlockChecksums.GetBlockRange(index)
+		if _, err := f.WriteAt(data, offset); err != nil {
+			return errors.Wrapf(err, "failed to write block %v", index)
+		}
+
+		sf.lock.Lock()
+		sf.progress = (i + 1) * 100 / len(corruptedBlocks)
+		sf.addTransferredBytesNoLock(int64(len(data)))
+		sf.lock.Unlock()
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync the file after repairing")
+	}
 
+	checksum, blockChecksums, err := util.GetFileBlockChecksumsWithRateLimit(ctx, sf.filePath, checksumAlgorithm, util.DefaultChecksumBlockSize, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to re-calculate the checksum after repairing")
+	}
+	if checksum != currentChecksum {
+		return fmt.Errorf("the repaired file checksum %v doesn't match the file checksum %v", checksum, currentChecksum)
+	}
+
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.modificationTime = util.FileModificationTime(sf.filePath)
+	sf.processedSize = size
+	sf.updateSyncReadyNoLock()
+	sf.updateRealSizeNoLock(sf.filePath)
+	sf.message = ""
+	sf.writeConfigNoLock()
+	sf.writeBlockChecksumsNoLock(blockChecksums)
+	sf.log.Infof("SyncingFile: repaired %v block(s) from peer %v", len(corruptedBlocks), peerClient.Remote)
+
+	return nil
+}
+
+func (sf *SyncingFile) finishProcessing(err error, dataEngine, targetFormat string) (finalErr error) {
+	sf.lock.Lock()
 	defer func() {
 		sf.handleFailureNoLock(finalErr)
+		sf.lock.Unlock()
 	}()
 
+	sf.cancel()
+	// The data is already written to the disk, hence the reservation is no longer needed.
+	sf.spaceReserver.release(sf.tmpFilePath)
+
 	if err != nil {
 		finalErr = err
 		return
@@ -919,37 +1611,39 @@ func (sf *SyncingFile) finishProcessing(err error, dataEngine string) (finalErr
 	}
 	sf.modificationTime = stat.ModTime().UTC().String()
 
-	// If the file is qcow2, we need to convert it to raw for dumping the data to the spdk lvol
-	// This will only happen when preparing the first backing image in data source.
-	if dataEngine == types.DataEnginev2 {
-		imgInfo, qemuErr := imageutil.NewQemuImgExecutor().GetImageInfo(sf.tmpFilePath)
-		if qemuErr != nil {
-			finalErr = errors.Wrapf(qemuErr, "failed to detect if file %v is qcow2", sf.tmpFilePath)
-			return
-		}
-		tmpRawFile := fmt.Sprintf("%v-raw.tmp", sf.tmpFilePath)
-		if imgInfo.Format == "qcow2" {
-			if convertErr := util.ConvertFromQcow2ToRaw(sf.tmpFilePath, tmpRawFile); convertErr != nil {
-				finalErr = errors.Wrapf(convertErr, "failed to create raw image from qcow2 image %v", sf.tmpFilePath)
-				return
-			}
-			if removeErr := os.RemoveAll(sf.tmpFilePath); removeErr != nil {
-				sf.log.Warnf("SyncingFile: failed to remove the qcow2 file %v after converting to raw file", sf.tmpFilePath)
-			}
-			if renameErr := os.Rename(tmpRawFile, sf.tmpFilePath); renameErr != nil {
-				finalErr = errors.Wrapf(renameErr, "failed to rename tmp raw file %v to file %v", tmpRawFile, sf.tmpFilePath)
-				return
-			}
-		}
-
-		stat, statErr := os.Stat(sf.tmpFilePath)
-		if statErr != nil {
-			finalErr = errors.Wrapf(statErr, "failed to stat tmp file %v after converting from qcow2 to raw file", sf.tmpFilePath)
-			return
-		}
-		sf.size = stat.Size()
-		sf.processedSize = stat.Size()
-		sf.modificationTime = stat.ModTime().UTC().String()
+	// The image formats other than raw and qcow2, e.g. VMDK, are converted once ingested, and the v2 data engine
+	// requires raw for dumping the data to the spdk lvol. This will only happen when preparing the first backing
+	// image in data source. The detection, the source checksum and the conversion may take a while, hence the lock
+	// is released meanwhile. Nothing else writes the tmp file once the processing is done.
+	inlineChecksum, processedSize := sf.inlineChecksum, sf.processedSize
+	sf.lock.Unlock()
+	conversion, convertErr := sf.convertImage(targetFormat, dataEngine, inlineChecksum, processedSize)
+	sf.lock.Lock()
+	if convertErr != nil {
+		finalErr = convertErr
+		return
+	}
+	if sf.state != types.StateInProgress {
+		sf.log.Warnf("SyncingFile: invalid state %v after the image format detection", sf.state)
+		return
+	}
+	if conversion != nil {
+		// The checksum calculated during the processing belongs to the file before the conversion.
+		sf.inlineChecksum = nil
+		sf.size = conversion.size
+		sf.processedSize = conversion.size
+		sf.modificationTime = conversion.modificationTime
+		sf.sourceFormat = conversion.sourceFormat
+		sf.sourceChecksum = conversion.sourceChecksum
+	}
+
+	// The file can be ready immediately if the checksum has been calculated during the processing.
+	inlineChecksum = sf.inlineChecksum
+	sf.inlineChecksum = nil
+	if currentChecksum, blockChecksums, ok := inlineChecksum.get(sf.processedSize); ok {
+		sf.log.Debugf("SyncingFile: directly use the %v checksum calculated during the processing: %v", sf.checksumAlgorithm, currentChecksum)
+		finalErr = sf.completeProcessingNoLock(currentChecksum, blockChecksums)
+		return
 	}
 
 	// Check if there is an existing config file then try to load the checksum
@@ -961,9 +1655,11 @@ func (sf *SyncingFile) finishProcessing(err error, dataEngine string) (finalErr
 			return
 		}
 	}
-	if config != nil && config.ModificationTime == sf.modificationTime {
+	if config != nil && config.ModificationTime == sf.modificationTime && isConfigChecksumAlgorithm(config, sf.checksumAlgorithm) {
 		logrus.Debugf("SyncingFile: directly get the checksum from the valid config during processing wrap-up: %v", config.CurrentChecksum)
 		sf.currentChecksum = config.CurrentChecksum
+		// The provenance is kept when the converted file is fetched by the manager.
+		sf.sourceFormat, sf.sourceChecksum = config.SourceFormat, config.SourceChecksum
 		sf.updateSyncReadyNoLock()
 		sf.updateVirtualSizeNoLock(sf.tmpFilePath)
 		sf.updateRealSizeNoLock(sf.tmpFilePath)
@@ -974,6 +1670,7 @@ func (sf *SyncingFile) finishProcessing(err error, dataEngine string) (finalErr
 			finalErr = errors.Wrapf(err, "failed to rename tmp file %v to file %v", sf.tmpFilePath, sf.filePath)
 			return
 		}
+		sf.removeResumeCheckpointNoLock()
 		sf.log.Info("SyncingFile: succeeded processing file")
 		return
 	}
@@ -984,6 +1681,85 @@ func (sf *SyncingFile) finishProcessing(err error, dataEngine string) (finalErr
 	return
 }
 
+// imageConversion is the tmp file converted from the source image format.
+type imageConversion struct {
+	sourceFormat     string
+	sourceChecksum   string
+	size             int64
+	modificationTime string
+}
+
+// convertImage detects the format of the tmp file via qemu-img, then converts the file to the target format.
+// If the target format is empty, only the file in a convertible format is converted, to raw for the v2 data engine
+// and qcow2 for v1, and a qcow2 file is converted to raw for v2. The checksum of the file before the conversion is
+// kept as the source checksum, and the checksum of the converted file will be calculated as the current checksum.
+// It returns nil if the file is not converted. The caller should not hold the lock.
+func (sf *SyncingFile) convertImage(targetFormat, dataEngine string, inlineChecksum *inlineChecksum, processedSize int64) (*imageConversion, error) {
+	imgInfo, err := imageutil.NewQemuImgExecutor().GetImageInfo(sf.tmpFilePath)
+	if err != nil {
+		if targetFormat == "" && dataEngine != types.DataEnginev2 {
+			sf.log.WithError(err).Warnf("SyncingFile: failed to detect the image format of tmp file %v, will keep the file as is", sf.tmpFilePath)
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to detect the image format of file %v", sf.tmpFilePath)
+	}
+	sourceFormat := imgInfo.Format
+	if targetFormat == "" {
+		switch {
+		case util.IsConvertibleImageFormat(sourceFormat) && dataEngine == types.DataEnginev2:
+			targetFormat = types.SyncingFileTypeRaw
+		case util.IsConvertibleImageFormat(sourceFormat):
+			targetFormat = types.SyncingFileTypeQcow2
+		case sourceFormat == types.SyncingFileTypeQcow2 && dataEngine == types.DataEnginev2:
+			targetFormat = types.SyncingFileTypeRaw
+		default:
+			return nil, nil
+		}
+	}
+	if sourceFormat == targetFormat {
+		return nil, nil
+	}
+	if sourceFormat != types.SyncingFileTypeRaw && sourceFormat != types.SyncingFileTypeQcow2 && !util.IsConvertibleImageFormat(sourceFormat) {
+		return nil, fmt.Errorf("cannot convert file %v in unsupported image format %v to %v", sf.tmpFilePath, sourceFormat, targetFormat)
+	}
+	if err := util.CheckImageSelfContained(sf.tmpFilePath, sourceFormat); err != nil {
+		return nil, errors.Wrapf(err, "cannot convert file %v", sf.tmpFilePath)
+	}
+
+	sourceChecksum, _, ok := inlineChecksum.get(processedSize)
+	if !ok {
+		if sourceChecksum, err = util.GetFileChecksumWithAlgorithm(sf.tmpFilePath, sf.checksumAlgorithm); err != nil {
+			return nil, errors.Wrapf(err, "failed to calculate the source checksum of file %v before the conversion", sf.tmpFilePath)
+		}
+	}
+
+	sf.log.Infof("SyncingFile: converting file from image format %v to %v", sourceFormat, targetFormat)
+	convertedFilePath := sf.tmpFilePath + util.Qcow2ConversionFileSuffix
+	if targetFormat == types.SyncingFileTypeRaw {
+		convertedFilePath = sf.tmpFilePath + util.RawConversionFileSuffix
+	}
+	if err := util.ConvertImage(sf.tmpFilePath, sourceFormat, convertedFilePath, targetFormat); err != nil {
+		if errRemove := os.RemoveAll(convertedFilePath); errRemove != nil {
+			sf.log.WithError(errRemove).Warnf("SyncingFile: failed to clean up the converted file %v", convertedFilePath)
+		}
+		return nil, err
+	}
+	if err := os.Rename(convertedFilePath, sf.tmpFilePath); err != nil {
+		return nil, errors.Wrapf(err, "failed to rename the converted file %v to tmp file %v", convertedFilePath, sf.tmpFilePath)
+	}
+
+	stat, err := os.Stat(sf.tmpFilePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat tmp file %v after the conversion", sf.tmpFilePath)
+	}
+	return &imageConversion{
+		sourceFormat:     sourceFormat,
+		sourceChecksum:   sourceChecksum,
+		size:             stat.Size(),
+		modificationTime: stat.ModTime().UTC().String(),
+	}, nil
+}
+
 func (sf *SyncingFile) postProcessSyncFile() {
 	var finalErr error
 	defer func() {
@@ -992,7 +1768,7 @@ func (sf *SyncingFile) postProcessSyncFile() {
 		sf.lock.Unlock()
 	}()
 
-	currentChecksum, err := util.GetFileChecksum(sf.tmpFilePath)
+	currentChecksum, blockChecksums, err := util.GetFileBlockChecksums(sf.tmpFilePath, sf.checksumAlgorithm, util.DefaultChecksumBlockSize)
 	if err != nil {
 		finalErr = errors.Wrapf(err, "failed to calculate checksum for tmp file %v", sf.tmpFilePath)
 		return
@@ -1004,34 +1780,100 @@ func (sf *SyncingFile) postProcessSyncFile() {
 		finalErr = fmt.Errorf("tmp file %v has been modified while calculaing checksum", sf.tmpFilePath)
 		return
 	}
+	finalErr = sf.completeProcessingNoLock(currentChecksum, blockChecksums)
+}
+
+// completeProcessingNoLock verifies the checksum of the tmp file then makes the file ready.
+func (sf *SyncingFile) completeProcessingNoLock(currentChecksum string, blockChecksums *util.BlockChecksums) error {
 	sf.currentChecksum = currentChecksum
-	if sf.expectedChecksum != "" && sf.expectedChecksum != sf.currentChecksum {
-		finalErr = fmt.Errorf("the expected checksum %v doesn't match the file actual checksum %v", sf.expectedChecksum, sf.currentChecksum)
-		return
+	if !isExpectedChecksum(sf.expectedChecksum, sf.currentChecksum, sf.sourceChecksum) {
+		return fmt.Errorf("the expected checksum %v doesn't match the file actual checksum %v", sf.expectedChecksum, sf.currentChecksum)
 	}
 
 	// If the state is already failed, there is no need to update the state
 	if sf.state == types.StateFailed {
-		return
+		return nil
 	}
 	sf.updateSyncReadyNoLock()
 	sf.updateVirtualSizeNoLock(sf.tmpFilePath)
 	sf.updateRealSizeNoLock(sf.tmpFilePath)
 	sf.writeConfigNoLock()
+	sf.writeBlockChecksumsNoLock(blockChecksums)
 
 	// Renaming won't change the file modification time.
 	if err := os.Rename(sf.tmpFilePath, sf.filePath); err != nil {
-		finalErr = errors.Wrapf(err, "failed to rename tmp file %v to file %v", sf.tmpFilePath, sf.filePath)
-		return
+		return errors.Wrapf(err, "failed to rename tmp file %v to file %v", sf.tmpFilePath, sf.filePath)
 	}
+	sf.removeResumeCheckpointNoLock()
 
 	sf.log.Info("SyncingFile: succeeded processing file")
+	return nil
+}
+
+func (sf *SyncingFile) startInlineChecksum() error {
+	calculator, err := util.NewBlockChecksumsCalculator(sf.checksumAlgorithm, util.DefaultChecksumBlockSize)
+	if err != nil {
+		return err
+	}
+
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.inlineChecksum = &inlineChecksum{
+		calculator: calculator,
+	}
+	return nil
+}
+
+// UpdateChecksum is called by IdleTimeoutCopy with the data written to the tmp file in order.
+func (sf *SyncingFile) UpdateChecksum(data []byte) {
+	sf.lock.RLock()
+	ic := sf.inlineChecksum
+	sf.lock.RUnlock()
+
+	if ic != nil {
+		ic.update(data)
+	}
+}
+
+type inlineChecksum struct {
+	lock       sync.Mutex
+	calculator *util.BlockChecksumsCalculator
+}
+
+func (ic *inlineChecksum) update(data []byte) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	// Writing to the calculator never returns an error.
+	_, _ = ic.calculator.Write(data)
+}
+
+func (ic *inlineChecksum) Write(p []byte) (int, error) {
+	ic.update(p)
+	return len(p), nil
+}
+
+// get returns the checksum and the block checksums only if the calculated data covers the whole file.
+func (ic *inlineChecksum) get(fileSize int64) (string, *util.BlockChecksums, bool) {
+	if ic == nil {
+		return "", nil, false
+	}
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	if ic.calculator.Size() != fileSize {
+		return "", nil, false
+	}
+	blockChecksums, err := ic.calculator.BlockChecksums()
+	if err != nil {
+		return "", nil, false
+	}
+	return ic.calculator.Checksum(), blockChecksums, true
 }
 
 func (sf *SyncingFile) updateSyncReadyNoLock() {
 	sf.progress = 100
 	sf.size = sf.processedSize
-	sf.state = types.StateReady
+	sf.finishNoLock(types.StateReady)
+	sf.observeOperationNoLock(nil)
 	sf.log = sf.log.WithFields(logrus.Fields{
 		"size":            sf.size,
 		"currentChecksum": sf.currentChecksum,
@@ -1063,6 +1905,17 @@ func (sf *SyncingFile) updateRealSizeNoLock(filePath string) {
 	sf.realSize = realSize
 }
 
+// finishNoLock moves the file to a terminal state, which starts the retention period of the file.
+func (sf *SyncingFile) finishNoLock(state types.State) {
+	sf.state = state
+	sf.finishedAt = time.Now()
+}
+
+// getEvictionTimeNoLock returns the time when the file will be forgotten automatically, or the zero time if it won't be.
+func (sf *SyncingFile) getEvictionTimeNoLock() time.Time {
+	return sf.retentionPolicy.getEvictionTime(sf.filePath, sf.state, sf.finishedAt)
+}
+
 func (sf *SyncingFile) handleFailureNoLock(err error) {
 	if err == nil {
 		return
@@ -1074,9 +1927,20 @@ func (sf *SyncingFile) handleFailureNoLock(err error) {
 		sf.log.Warnf("SyncingFile: file is already state %v, cannot mark it as %v", types.StateReady, types.StateFailed)
 		return
 	}
-	sf.state = types.StateFailed
-	if err := os.RemoveAll(sf.tmpFilePath); err != nil {
-		sf.log.Warnf("SyncingFile: failed to clean up tmp sync file %v after processing failure, will continue the failure handling: %v", sf.tmpFilePath, err)
+	sf.finishNoLock(types.StateFailed)
+	if errors.Is(err, ErrInsufficientSpace) {
+		sf.failureReason = types.FailureReasonInsufficientSpace
+	}
+	if sf.interrupted {
+		sf.failureReason = types.FailureReasonInterrupted
+	}
+	sf.observeOperationNoLock(err)
+	// A failed download can be resumed by the retry. But the partial data of a fetch or a receive, which
+	// is as large as the file, is worth keeping only if the operation is interrupted by the drain.
+	if sf.interrupted || sf.isPartialDataReusableNoLock(OperationDownload) {
+		sf.log.Infof("SyncingFile: keep tmp sync file %v after processing failure since the operation can be resumed later", sf.tmpFilePath)
+	} else if err := sf.discardPartialDataNoLock(); err != nil {
+		sf.log.Warnf("SyncingFile: failed to clean up tmp sync file %v and its checkpoint after processing failure, will continue the failure handling: %v", sf.tmpFilePath, err)
 	}
 	if err := os.RemoveAll(sf.filePath); err != nil {
 		sf.log.Warnf("SyncingFile: failed to clean up sync file %v after processing failure, will continue the failure handling: %v", sf.filePath, err)
@@ -1096,11 +1960,55 @@ func (sf *SyncingFile) writeConfigNoLock() {
 		ExpectedChecksum: sf.expectedChecksum,
 		CurrentChecksum:  sf.currentChecksum,
 		ModificationTime: sf.modificationTime,
+
+		ChecksumAlgorithm: sf.checksumAlgorithm,
+		SourceFormat:      sf.sourceFormat,
+		SourceChecksum:    sf.sourceChecksum,
 	}); err != nil {
 		sf.log.Warnf("SyncingFile: failed to write config file when the file becomes ready: %v", err)
 	}
 }
 
+// writeBlockChecksumsNoLock stores the block checksums next to the config file.
+// The modification time is recorded to find out if the block checksums are outdated.
+func (sf *SyncingFile) writeBlockChecksumsNoLock(blockChecksums *util.BlockChecksums) {
+	blockChecksums.ModificationTime = sf.modificationTime
+	if err := util.WriteBlockChecksums(util.GetBlockChecksumsFilePath(sf.filePath), blockChecksums); err != nil {
+		sf.log.Warnf("SyncingFile: failed to write block checksums file when the file becomes ready: %v", err)
+	}
+}
+
+// getCorruptedBlocksMessage compares the re-calculated block checksums with the stored ones,
+// so that the message tells where the damage is.
+func (sf *SyncingFile) getCorruptedBlocksMessage(blockChecksums *util.BlockChecksums) string {
+	storedBlockChecksums, err := util.ReadBlockChecksums(util.GetBlockChecksumsFilePath(sf.filePath))
+	if err != nil {
+		return ""
+	}
+	corruptedBlocks, err := storedBlockChecksums.Diff(blockChecksums)
+	if err != nil {
+		return fmt.Sprintf(", cannot find out the corrupted blocks: %v", err)
+	}
+	return fmt.Sprintf(", corrupted blocks %v with block size %v", corruptedBlocks, storedBlockChecksums.BlockSize)
+}
+
+// isConfigChecksumAlgorithm checks if the checksum in the config is calculated by the algorithm.
+func isConfigChecksumAlgorithm(config *util.SyncingFileConfig, checksumAlgorithm types.ChecksumAlgorithm) bool {
+	if config.ChecksumAlgorithm == "" {
+		return checksumAlgorithm == types.DefaultChecksumAlgorithm
+	}
+	return config.ChecksumAlgorithm == checksumAlgorithm
+}
+
+// isExpectedChecksum checks the expected checksum against the file. The expected checksum of a converted file
+// can be the one of either the source or the converted file.
+func isExpectedChecksum(expectedChecksum, currentChecksum, sourceChecksum string) bool {
+	if expectedChecksum == "" || expectedChecksum == currentChecksum {
+		return true
+	}
+	return sourceChecksum != "" && expectedChecksum == sourceChecksum
+}
+
 func (sf *SyncingFile) setFileSizeForEncryption(sourceSize int64, encryption types.EncryptionType) error {
 	sf.lock.Lock()
 	if encryption == types.EncryptionTypeIgnore { // nolint: staticcheck
@@ -0,0 +1,305 @@
+package sync
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backing-image-manager/api"
+	"github.com/longhorn/backing-image-manager/pkg/types"
+	"github.com/longhorn/backing-image-manager/pkg/util"
+)
+
+var (
+	ErrUploadChunkOffsetMismatch   = errors.New("the chunk offset doesn't match the received offset")
+	ErrUploadChunkChecksumMismatch = errors.New("the chunk checksum doesn't match the received data")
+)
+
+// uploadSession tracks a resumable chunked upload. The chunks should be uploaded in order,
+// and a chunk is accepted only when its checksum matches, so the received offset always
+// points to the end of the verified data and an interrupted upload can resume from it.
+type uploadSession struct {
+	// writeLock serializes the chunk writes.
+	writeLock sync.Mutex
+
+	compression           types.CompressionType
+	decompressedSizeLimit int64
+	targetFormat          string
+	dataEngine            string
+
+	// offset and lastActiveAt are protected by the lock of the SyncingFile.
+	offset       int64
+	lastActiveAt time.Time
+}
+
+// StartUploadSession prepares the tmp file for a resumable chunked upload. If the compression is auto,
+// it will be detected from the first chunk.
+func (sf *SyncingFile) StartUploadSession(compression types.CompressionType, decompressedSizeLimit int64, targetFormat, dataEngine string) (err error) {
+	sf.log.Infof("SyncingFile: start an upload session, compression %v", compression)
+
+	needProcessing, err := sf.isProcessingRequired(OperationUpload)
+	if err != nil {
+		return err
+	}
+	if !needProcessing {
+		return nil
+	}
+
+	defer func() {
+		if err != nil {
+			if finalErr := sf.finishProcessing(err, dataEngine, targetFormat); finalErr != nil {
+				err = finalErr
+			}
+		}
+	}()
+
+	f, err := os.OpenFile(sf.tmpFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = sf.spaceReserver.reserve(sf.tmpFilePath, sf.size); err != nil {
+		return err
+	}
+	if compression == types.CompressionTypeNone {
+		if err = sf.startInlineChecksum(); err != nil {
+			return err
+		}
+	}
+
+	session := &uploadSession{
+		compression:           compression,
+		decompressedSizeLimit: decompressedSizeLimit,
+		targetFormat:          targetFormat,
+		dataEngine:            dataEngine,
+		lastActiveAt:          time.Now(),
+	}
+
+	sf.lock.Lock()
+	if sf.state != types.StateStarting {
+		sf.lock.Unlock()
+		return fmt.Errorf("invalid state %v for starting the upload session", sf.state)
+	}
+	sf.state = types.StateInProgress
+	sf.uploadSession = session
+	sf.lock.Unlock()
+
+	go sf.expireIdleUploadSession(session)
+
+	return nil
+}
+
+// expireIdleUploadSession fails the file if no chunk is received within the idle timeout.
+func (sf *SyncingFile) expireIdleUploadSession(session *uploadSession) {
+	timer := time.NewTimer(types.UploadSessionIdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-sf.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		sf.lock.Lock()
+		if sf.uploadSession != session {
+			sf.lock.Unlock()
+			return
+		}
+		idle := time.Since(session.lastActiveAt)
+		if idle < types.UploadSessionIdleTimeout {
+			sf.lock.Unlock()
+			timer.Reset(types.UploadSessionIdleTimeout - idle)
+			continue
+		}
+		sf.uploadSession = nil
+		sf.inlineChecksum = nil
+		sf.cancel()
+		sf.spaceReserver.release(sf.tmpFilePath)
+		sf.handleFailureNoLock(fmt.Errorf("no chunk is received in the upload session for %v", types.UploadSessionIdleTimeout))
+		sf.lock.Unlock()
+		return
+	}
+}
+
+// GetUploadSession returns the received offset of the upload. A ready file is considered fully received.
+func (sf *SyncingFile) GetUploadSession() (*api.UploadSession, error) {
+	sf.lock.RLock()
+	defer sf.lock.RUnlock()
+
+	res := &api.UploadSession{
+		FilePath: sf.filePath,
+		UUID:     sf.uuid,
+		Size:     sf.size,
+		State:    string(sf.state),
+	}
+	switch {
+	case sf.uploadSession != nil:
+		res.Offset = sf.uploadSession.offset
+	case sf.state == types.StateReady:
+		res.Offset = sf.size
+	case sf.state != types.StatePending && sf.state != types.StateStarting:
+		return nil, fmt.Errorf("there is no upload session for file %v in state %v", sf.filePath, sf.state)
+	}
+	return res, nil
+}
+
+func (sf *SyncingFile) getUploadSession() (*uploadSession, error) {
+	sf.lock.RLock()
+	defer sf.lock.RUnlock()
+	if sf.uploadSession == nil {
+		return nil, fmt.Errorf("there is no upload session for file %v in state %v", sf.filePath, sf.state)
+	}
+	return sf.uploadSession, nil
+}
+
+// WriteUploadChunk writes a chunk to the received offset. The chunk is accepted only when its checksum
+// matches, otherwise the received offset won't move and the chunk should be uploaded again.
+// It returns the received offset after the write.
+func (sf *SyncingFile) WriteUploadChunk(offset int64, checksum string, src io.Reader) (int64, error) {
+	checksumAlgorithm, checksum, err := util.ParseChecksum(checksum)
+	if err != nil {
+		return 0, err
+	}
+	h, err := util.NewChecksumHash(checksumAlgorithm)
+	if err != nil {
+		return 0, err
+	}
+
+	session, err := sf.getUploadSession()
+	if err != nil {
+		return 0, err
+	}
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+
+	sf.lock.Lock()
+	if sf.uploadSession != session {
+		sf.lock.Unlock()
+		return 0, fmt.Errorf("the upload session for file %v is already closed", sf.filePath)
+	}
+	receivedOffset := session.offset
+	size := sf.size
+	session.lastActiveAt = time.Now()
+	sf.lock.Unlock()
+
+	if offset != receivedOffset {
+		return receivedOffset, errors.Wrapf(ErrUploadChunkOffsetMismatch, "chunk offset %v, received offset %v", offset, receivedOffset)
+	}
+
+	reader := bufio.NewReader(src)
+	if offset == 0 && session.compression == types.CompressionTypeAuto {
+		compression, err := util.DetectCompression(reader)
+		if err != nil {
+			return receivedOffset, err
+		}
+		sf.log.Infof("SyncingFile: detected the compression %v from the first chunk", compression)
+		session.compression = compression
+		if compression == types.CompressionTypeNone {
+			if err := sf.startInlineChecksum(); err != nil {
+				return receivedOffset, err
+			}
+		}
+	}
+
+	f, err := os.OpenFile(sf.tmpFilePath, os.O_RDWR, 0666)
+	if err != nil {
+		return receivedOffset, err
+	}
+	defer func() {
+		if errClose := f.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close the file")
+		}
+	}()
+
+	// Read one more byte than the remaining size to detect the oversized chunk.
+	limitedReader := util.NewRateLimitedReader(sf.ctx, reader, sf.GetRateLimiter())
+	written, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(f, offset), h), io.LimitReader(limitedReader, size-offset+1))
+	if err != nil {
+		return receivedOffset, errors.Wrapf(err, "failed to write the chunk at offset %v", offset)
+	}
+	if offset+written > size {
+		return receivedOffset, fmt.Errorf("the chunk at offset %v exceeds the file size %v", offset, size)
+	}
+	if chunkChecksum := hex.EncodeToString(h.Sum(nil)); util.FormatChecksum(checksumAlgorithm, chunkChecksum) != checksum {
+		return receivedOffset, errors.Wrapf(ErrUploadChunkChecksumMismatch, "chunk offset %v, expected checksum %v, actual checksum %v", offset, checksum, chunkChecksum)
+	}
+
+	// The inline checksum can only include the verified data, hence it is calculated after the verification.
+	sf.lock.RLock()
+	ic := sf.inlineChecksum
+	sf.lock.RUnlock()
+	if ic != nil {
+		if _, err := io.Copy(ic, io.NewSectionReader(f, offset, written)); err != nil {
+			return receivedOffset, errors.Wrapf(err, "failed to calculate the checksum for the chunk at offset %v", offset)
+		}
+	}
+
+	sf.lock.Lock()
+	session.offset += written
+	session.lastActiveAt = time.Now()
+	receivedOffset = session.offset
+	sf.lock.Unlock()
+	sf.updateProgress(written)
+
+	return receivedOffset, nil
+}
+
+// FinalizeUploadSession closes the upload session after all chunks are received, then processes the
+// file like the other sources. Finalizing a ready file does nothing.
+func (sf *SyncingFile) FinalizeUploadSession() (err error) {
+	sf.lock.RLock()
+	state := sf.state
+	sf.lock.RUnlock()
+	if state == types.StateReady {
+		return nil
+	}
+
+	session, err := sf.getUploadSession()
+	if err != nil {
+		return err
+	}
+	// Wait for the in-flight chunk
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+
+	sf.lock.Lock()
+	if sf.uploadSession != session {
+		sf.lock.Unlock()
+		return fmt.Errorf("the upload session for file %v is already closed", sf.filePath)
+	}
+	if session.offset != sf.size {
+		sf.lock.Unlock()
+		return fmt.Errorf("cannot finalize the upload session since only %v of %v bytes are received", session.offset, sf.size)
+	}
+	sf.uploadSession = nil
+	sf.lock.Unlock()
+
+	sf.log.Infof("SyncingFile: finalizing the upload session, compression %v", session.compression)
+
+	defer func() {
+		if finalErr := sf.finishProcessing(err, session.dataEngine, session.targetFormat); finalErr != nil {
+			err = finalErr
+		}
+	}()
+
+	if err := sf.decompressTmpFile(session.compression, session.decompressedSizeLimit); err != nil {
+		return err
+	}
+	stat, err := os.Stat(sf.tmpFilePath)
+	if err != nil {
+		return err
+	}
+	if stat.Size()%types.DefaultSectorSize != 0 {
+		return fmt.Errorf("the uploaded file size %d should be a multiple of %d bytes since Longhorn uses directIO by default", stat.Size(), types.DefaultSectorSize)
+	}
+	return nil
+}
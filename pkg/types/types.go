@@ -26,8 +26,23 @@ const (
 	MonitorInterval         = 3 * time.Second
 	CommandExecutionTimeout = 10 * time.Second
 
+	// UploadSessionIdleTimeout is how long a resumable upload session waits for the next chunk before failing.
+	UploadSessionIdleTimeout = 1 * time.Hour
+	DefaultUploadChunkSize   = 16 * 1024 * 1024 // 16MB
+
+	// EventKeepAliveInterval is the interval of the keep-alive comments in the event stream without any change.
+	EventKeepAliveInterval = 15 * time.Second
+
+	// PeerTokenHeader carries the token presented to the peer sync server, e.g. the download token of the peer file.
+	PeerTokenHeader = "X-Peer-Token"
+
 	FileSyncHTTPClientTimeout = 5 // TODO: use 5 seconds as default, need to refactor it
 
+	// HealthzPath is the liveness probe of the sync server and the data source server.
+	HealthzPath = "/healthz"
+	// ReadyzPath is the readiness probe of the sync server and the data source server, which runs the dependency checks.
+	ReadyzPath = "/readyz"
+
 	SendingLimit = 3
 
 	BackingImageFileName    = "backing"
@@ -49,6 +64,27 @@ const (
 	StateUnknown          = State("unknown")
 	StateReady            = State("ready")
 	StateReadyForTransfer = State("ready-for-transfer")
+	// StateCorrupted means the data of a ready file doesn't match its checksum while the file is not modified.
+	StateCorrupted = State("corrupted")
+)
+
+type ScrubResult string
+
+const (
+	ScrubResultPassed    = ScrubResult("passed")
+	ScrubResultCorrupted = ScrubResult("corrupted")
+	ScrubResultError     = ScrubResult("error")
+)
+
+// FailureReason tells why a sync file failed when the failure needs to be handled differently by the caller.
+type FailureReason string
+
+const (
+	// FailureReasonInsufficientSpace means the disk doesn't have enough free space for the file.
+	FailureReasonInsufficientSpace = FailureReason("insufficient-space")
+	// FailureReasonInterrupted means the operation preparing the file was interrupted by the drain on shutdown.
+	// The same request can resume the operation after a restart if the partial data is kept.
+	FailureReasonInterrupted = FailureReason("interrupted")
 )
 
 type DataSourceType string
@@ -66,13 +102,17 @@ const (
 	DataSourceTypeCloneParameterBackingImageUUID = "backing-image-uuid"
 	DataSourceTypeCloneParameterEncryption       = "encryption"
 
-	DataSourceTypeDownloadParameterURL            = "url"
-	DataSourceTypeRestoreParameterBackupURL       = "backup-url"
-	DataSourceTypeRestoreParameterConcurrentLimit = "concurrent-limit"
-	DataSourceTypeFileType                        = "file-type"
-	DataSourceTypeParameterDataEngine             = "data-engine"
-	DataEnginev1                                  = "v1"
-	DataEnginev2                                  = "v2"
+	DataSourceTypeDownloadParameterURL             = "url"
+	DataSourceTypeDownloadParameterConcurrentLimit = "concurrent-limit"
+	DataSourceTypeRestoreParameterBackupURL        = "backup-url"
+	DataSourceTypeRestoreParameterConcurrentLimit  = "concurrent-limit"
+	DataSourceTypeFileType                         = "file-type"
+	DataSourceTypeParameterDataEngine              = "data-engine"
+	DataSourceTypeParameterCompression             = "compression"
+	DataSourceTypeParameterDecompressedSizeLimit   = "decompressed-size-limit"
+	DataSourceTypeParameterTargetFormat            = "target-format"
+	DataEnginev1                                   = "v1"
+	DataEnginev2                                   = "v2"
 
 	DataSourceTypeExportFromVolumeParameterVolumeSize                = "volume-size"
 	DataSourceTypeExportFromVolumeParameterSnapshotName              = "snapshot-name"
@@ -85,6 +125,37 @@ const (
 	SyncingFileTypeEmpty = ""
 	SyncingFileTypeRaw   = "raw"
 	SyncingFileTypeQcow2 = "qcow2"
+
+	// The image formats converted to the target format once ingested. qemu-img reports VHD as vpc.
+	ImageFormatVMDK = "vmdk"
+	ImageFormatVHD  = "vpc"
+	ImageFormatVHDX = "vhdx"
+	ImageFormatVDI  = "vdi"
+)
+
+type CompressionType string
+
+const (
+	CompressionTypeAuto  = CompressionType("auto")
+	CompressionTypeNone  = CompressionType("none")
+	CompressionTypeGzip  = CompressionType("gzip")
+	CompressionTypeXz    = CompressionType("xz")
+	CompressionTypeZstd  = CompressionType("zstd")
+	CompressionTypeBzip2 = CompressionType("bzip2")
+
+	// DefaultDecompressedSizeLimit prevents a small malicious compressed file from filling up the disk.
+	DefaultDecompressedSizeLimit = 1 << 40 // 1TiB
+)
+
+type ChecksumAlgorithm string
+
+const (
+	ChecksumAlgorithmSHA256 = ChecksumAlgorithm("sha256")
+	ChecksumAlgorithmSHA512 = ChecksumAlgorithm("sha512")
+	ChecksumAlgorithmBLAKE3 = ChecksumAlgorithm("blake3")
+
+	// DefaultChecksumAlgorithm is used for the checksum strings without the algorithm prefix.
+	DefaultChecksumAlgorithm = ChecksumAlgorithmSHA512
 )
 
 type EncryptionType string
@@ -0,0 +1,208 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+)
+
+type TokenScope string
+
+const (
+	// TokenScopeRead allows the requests reading the files and the states, including the metrics.
+	TokenScopeRead = TokenScope("read")
+	// TokenScopeWrite allows the requests launching, modifying or deleting the files.
+	TokenScopeWrite = TokenScope("write")
+	// TokenScopeDebug allows the pprof endpoints.
+	TokenScopeDebug = TokenScope("debug")
+	// TokenScopeDownload allows reading the single file in the token claims only.
+	TokenScopeDownload = TokenScope("download")
+
+	// DefaultDownloadTokenTTL is the lifetime of the download tokens. The token is checked when a request starts,
+	// hence a download lasting longer than the TTL is not interrupted.
+	DefaultDownloadTokenTTL = time.Hour
+
+	tokenVersionPrefix = "v1."
+)
+
+// TokenClaims are signed in a short-lived token.
+type TokenClaims struct {
+	Scopes []TokenScope `json:"scopes"`
+	// FilePath restricts the token to the file. Empty means all files.
+	FilePath string `json:"filePath,omitempty"`
+	// ExpiresAt is in Unix seconds.
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+func (c *TokenClaims) allows(requiredScope TokenScope, filePath string) bool {
+	if c.FilePath != "" && c.FilePath != filePath {
+		return false
+	}
+	for _, scope := range c.Scopes {
+		if scope == requiredScope {
+			return true
+		}
+		// The download token can only read the file it's issued for.
+		if scope == TokenScopeDownload && requiredScope == TokenScopeRead && filePath != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator verifies the bearer tokens of the HTTP requests. A token is either the shared secret,
+// which has all the scopes, or a short-lived token signed by the shared secret with the limited scopes.
+type Authenticator struct {
+	secret []byte
+}
+
+func NewAuthenticator(secret string) (*Authenticator, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("the authentication secret cannot be empty")
+	}
+	return &Authenticator{secret: []byte(secret)}, nil
+}
+
+// Enabled is false for a nil authenticator, which means the requests are not authenticated.
+func (a *Authenticator) Enabled() bool {
+	return a != nil
+}
+
+// GetSecretToken returns the shared secret for the clients in the same process. It's empty if not enabled.
+func (a *Authenticator) GetSecretToken() string {
+	if a == nil {
+		return ""
+	}
+	return string(a.secret)
+}
+
+// IssueToken signs the claims. The token expires after ttl.
+func (a *Authenticator) IssueToken(scopes []TokenScope, filePath string, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	payload, err := json.Marshal(&TokenClaims{
+		Scopes:    scopes,
+		FilePath:  filePath,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	encodedPayload := tokenVersionPrefix + base64.RawURLEncoding.EncodeToString(payload)
+	return encodedPayload + "." + base64.RawURLEncoding.EncodeToString(a.sign(encodedPayload)), expiresAt, nil
+}
+
+func (a *Authenticator) sign(encodedPayload string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(encodedPayload))
+	return mac.Sum(nil)
+}
+
+func (a *Authenticator) verify(token string) (*TokenClaims, error) {
+	if subtle.ConstantTimeCompare([]byte(token), a.secret) == 1 {
+		return &TokenClaims{Scopes: []TokenScope{TokenScopeRead, TokenScopeWrite, TokenScopeDebug}}, nil
+	}
+
+	if !strings.HasPrefix(token, tokenVersionPrefix) {
+		return nil, fmt.Errorf("invalid token")
+	}
+	separator := strings.LastIndex(token, ".")
+	encodedPayload, encodedSignature := token[:separator], token[separator+1:]
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, a.sign(encodedPayload)) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encodedPayload, tokenVersionPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token payload: %v", err)
+	}
+	claims := &TokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("invalid token payload: %v", err)
+	}
+	if !time.Now().Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, fmt.Errorf("token expired at %v", time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	return claims, nil
+}
+
+// getRequiredTokenScope returns debug for the pprof endpoints, read for GET and HEAD, and write for the others.
+func getRequiredTokenScope(request *http.Request) TokenScope {
+	switch {
+	case strings.HasPrefix(request.URL.Path, "/debug/"):
+		return TokenScopeDebug
+	case request.Method == http.MethodGet || request.Method == http.MethodHead:
+		return TokenScopeRead
+	default:
+		return TokenScopeWrite
+	}
+}
+
+// Middleware rejects the requests without a valid bearer token with 401, and the ones whose token doesn't have
+// the required scope with 403. The health probes are not authenticated. getDownloadFilePath returns the file read by
+// the request if the request can be allowed by a download token, otherwise empty. It can be nil if the router
+// doesn't serve any download.
+func (a *Authenticator) Middleware(getDownloadFilePath func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			// The probes of the kubelet cannot present a token.
+			if request.URL.Path == types.HealthzPath || request.URL.Path == types.ReadyzPath {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+			if !found || token == "" {
+				logrus.Warnf("Rejected unauthenticated request %v %v from %v", request.Method, request.URL.Path, request.RemoteAddr)
+				http.Error(writer, "missing the bearer token", http.StatusUnauthorized)
+				return
+			}
+			claims, err := a.verify(token)
+			if err != nil {
+				logrus.WithError(err).Warnf("Rejected request %v %v from %v with an invalid token", request.Method, request.URL.Path, request.RemoteAddr)
+				http.Error(writer, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			requiredScope := getRequiredTokenScope(request)
+			filePath := ""
+			if getDownloadFilePath != nil {
+				filePath = getDownloadFilePath(request)
+			}
+			if !claims.allows(requiredScope, filePath) {
+				logrus.Warnf("Rejected request %v %v from %v without the %v scope", request.Method, request.URL.Path, request.RemoteAddr, requiredScope)
+				http.Error(writer, fmt.Sprintf("the token doesn't have the %v scope for the request", requiredScope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// NewHTTPClientWithToken creates the client by NewHTTPClient, and presents the bearer token in each request if it's set.
+func NewHTTPClientWithToken(timeout time.Duration, options *TLSOptions, token string) *http.Client {
+	httpClient := NewHTTPClient(timeout, options)
+	if token != "" {
+		httpClient.Transport = tokenTransport{base: httpClient.Transport, token: token}
+	}
+	return httpClient
+}
+
+type tokenTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t tokenTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(request)
+}
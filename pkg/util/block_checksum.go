@@ -0,0 +1,258 @@
+package util
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backing-image-manager/pkg/metrics"
+	"github.com/longhorn/backing-image-manager/pkg/types"
+)
+
+const (
+	BlockChecksumsFileSuffix = ".blocks"
+
+	DefaultChecksumBlockSize = 2 << 20
+)
+
+// BlockChecksums is a hash tree of a file. The leaves are the checksums of the fixed size blocks,
+// and each parent node is the checksum of the concatenation of its children.
+// Comparing the block checksums of two copies finds out exactly which blocks differ.
+type BlockChecksums struct {
+	Algorithm        types.ChecksumAlgorithm `json:"algorithm"`
+	BlockSize        int64                   `json:"blockSize"`
+	Size             int64                   `json:"size"`
+	ModificationTime string                  `json:"modificationTime"`
+	Root             string                  `json:"root"`
+	Blocks           []string                `json:"blocks"`
+}
+
+func GetBlockChecksumsFilePath(syncingFilePath string) string {
+	return fmt.Sprintf("%s%s", syncingFilePath, BlockChecksumsFileSuffix)
+}
+
+func WriteBlockChecksums(blockChecksumsFilePath string, blockChecksums *BlockChecksums) error {
+	encoded, err := json.Marshal(blockChecksums)
+	if err != nil {
+		return errors.Wrapf(err, "BUG: Cannot marshal %+v", blockChecksums)
+	}
+
+	tmpFilePath := blockChecksumsFilePath + ".tmp"
+	if err := os.WriteFile(tmpFilePath, encoded, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilePath, blockChecksumsFilePath)
+}
+
+func ReadBlockChecksums(blockChecksumsFilePath string) (*BlockChecksums, error) {
+	output, err := os.ReadFile(blockChecksumsFilePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot find the block checksums file %v", blockChecksumsFilePath)
+	}
+
+	blockChecksums := &BlockChecksums{}
+	if err := json.Unmarshal(output, blockChecksums); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal %v content", blockChecksumsFilePath)
+	}
+	return blockChecksums, nil
+}
+
+// GetBlockRange returns the offset and the length of the block.
+func (bc *BlockChecksums) GetBlockRange(index int) (int64, int64) {
+	offset := int64(index) * bc.BlockSize
+	return offset, min(bc.BlockSize, bc.Size-offset)
+}
+
+// VerifyBlock checks if the data matches the checksum of the block.
+func (bc *BlockChecksums) VerifyBlock(index int, data []byte) error {
+	if index < 0 || index >= len(bc.Blocks) {
+		return fmt.Errorf("invalid block index %v, there are %v blocks", index, len(bc.Blocks))
+	}
+	if _, length := bc.GetBlockRange(index); int64(len(data)) != length {
+		return fmt.Errorf("the data size %v of block %v doesn't match the block size %v", len(data), index, length)
+	}
+
+	h, err := NewChecksumHash(bc.Algorithm)
+	if err != nil {
+		return err
+	}
+	// Writing to a hash never returns an error.
+	_, _ = h.Write(data)
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != bc.Blocks[index] {
+		return fmt.Errorf("block %v is corrupted, the checksum %v doesn't match the expected checksum %v", index, checksum, bc.Blocks[index])
+	}
+	return nil
+}
+
+// Diff returns the indexes of the blocks that differ from the other copy.
+func (bc *BlockChecksums) Diff(other *BlockChecksums) ([]int, error) {
+	if bc.Algorithm != other.Algorithm || bc.BlockSize != other.BlockSize || bc.Size != other.Size {
+		return nil, fmt.Errorf("cannot compare the %v block checksums with block size %v and file size %v to the %v block checksums with block size %v and file size %v",
+			bc.Algorithm, bc.BlockSize, bc.Size, other.Algorithm, other.BlockSize, other.Size)
+	}
+	if len(bc.Blocks) != len(other.Blocks) {
+		return nil, fmt.Errorf("the block count %v doesn't match the other block count %v", len(bc.Blocks), len(other.Blocks))
+	}
+
+	diff := []int{}
+	if bc.Root == other.Root {
+		return diff, nil
+	}
+	for i := range bc.Blocks {
+		if bc.Blocks[i] != other.Blocks[i] {
+			diff = append(diff, i)
+		}
+	}
+	return diff, nil
+}
+
+// BlockChecksumsCalculator calculates the whole file checksum and the block checksums
+// of the data written to it in order.
+type BlockChecksumsCalculator struct {
+	algorithm types.ChecksumAlgorithm
+	blockSize int64
+
+	fileHash  hash.Hash
+	blockHash hash.Hash
+	blockLeft int64
+	size      int64
+	blocks    [][]byte
+}
+
+func NewBlockChecksumsCalculator(algorithm types.ChecksumAlgorithm, blockSize int64) (*BlockChecksumsCalculator, error) {
+	fileHash, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	blockHash, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockChecksumsCalculator{
+		algorithm: algorithm,
+		blockSize: blockSize,
+		fileHash:  fileHash,
+		blockHash: blockHash,
+		blockLeft: blockSize,
+	}, nil
+}
+
+func (c *BlockChecksumsCalculator) Write(p []byte) (int, error) {
+	// Writing to a hash never returns an error.
+	_, _ = c.fileHash.Write(p)
+	written := len(p)
+	for len(p) > 0 {
+		n := int(min(int64(len(p)), c.blockLeft))
+		_, _ = c.blockHash.Write(p[:n])
+		p = p[n:]
+		c.blockLeft -= int64(n)
+		if c.blockLeft == 0 {
+			c.blocks = append(c.blocks, c.blockHash.Sum(nil))
+			c.blockHash.Reset()
+			c.blockLeft = c.blockSize
+		}
+	}
+	c.size += int64(written)
+	return written, nil
+}
+
+func (c *BlockChecksumsCalculator) Size() int64 {
+	return c.size
+}
+
+// Checksum returns the self-describing checksum string of the whole data.
+func (c *BlockChecksumsCalculator) Checksum() string {
+	return FormatChecksum(c.algorithm, hex.EncodeToString(c.fileHash.Sum(nil)))
+}
+
+func (c *BlockChecksumsCalculator) BlockChecksums() (*BlockChecksums, error) {
+	blocks := c.blocks
+	if c.blockLeft != c.blockSize {
+		blocks = append(blocks[:len(blocks):len(blocks)], c.blockHash.Sum(nil))
+	}
+
+	root, err := getMerkleRoot(c.algorithm, blocks)
+	if err != nil {
+		return nil, err
+	}
+	bc := &BlockChecksums{
+		Algorithm: c.algorithm,
+		BlockSize: c.blockSize,
+		Size:      c.size,
+		Root:      hex.EncodeToString(root),
+		Blocks:    make([]string, len(blocks)),
+	}
+	for i, block := range blocks {
+		bc.Blocks[i] = hex.EncodeToString(block)
+	}
+	return bc, nil
+}
+
+func getMerkleRoot(algorithm types.ChecksumAlgorithm, nodes [][]byte) ([]byte, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return h.Sum(nil), nil
+	}
+	for len(nodes) > 1 {
+		parents := make([][]byte, 0, (len(nodes)+1)/2)
+		for i := 0; i < len(nodes); i += 2 {
+			// The last node without a sibling is promoted directly.
+			if i+1 == len(nodes) {
+				parents = append(parents, nodes[i])
+				break
+			}
+			h.Reset()
+			_, _ = h.Write(nodes[i])
+			_, _ = h.Write(nodes[i+1])
+			parents = append(parents, h.Sum(nil))
+		}
+		nodes = parents
+	}
+	return nodes[0], nil
+}
+
+// GetFileBlockChecksums reads the file once to calculate both the whole file checksum and the block checksums.
+func GetFileBlockChecksums(filePath string, algorithm types.ChecksumAlgorithm, blockSize int64) (string, *BlockChecksums, error) {
+	return GetFileBlockChecksumsWithRateLimit(context.Background(), filePath, algorithm, blockSize, nil)
+}
+
+// GetFileBlockChecksumsWithRateLimit is the same as GetFileBlockChecksums except that the read is limited by the limiter.
+func GetFileBlockChecksumsWithRateLimit(ctx context.Context, filePath string, algorithm types.ChecksumAlgorithm, blockSize int64, limiter *RateLimiter) (string, *BlockChecksums, error) {
+	startedAt := time.Now()
+	calculator, err := NewBlockChecksumsCalculator(algorithm, blockSize)
+	if err != nil {
+		return "", nil, err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if errClose := f.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close file")
+		}
+	}()
+
+	if _, err := io.Copy(calculator, NewRateLimitedReader(ctx, f, limiter)); err != nil {
+		return "", nil, err
+	}
+
+	blockChecksums, err := calculator.BlockChecksums()
+	if err != nil {
+		return "", nil, err
+	}
+	metrics.ObserveChecksum(string(algorithm), startedAt)
+	return calculator.Checksum(), blockChecksums, nil
+}
@@ -0,0 +1,66 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"lukechampine.com/blake3"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+)
+
+const (
+	blake3ChecksumSize = 32
+)
+
+// ParseChecksum returns the algorithm and the normalized form of a checksum string.
+// The algorithm can be specified via a prefix, e.g. "sha256:<hex>". A checksum without
+// the prefix is a SHA-512 checksum for compatibility, and a SHA-512 checksum is always
+// normalized to the bare hex string.
+func ParseChecksum(checksum string) (types.ChecksumAlgorithm, string, error) {
+	prefix, sum, found := strings.Cut(checksum, ":")
+	if !found {
+		return types.DefaultChecksumAlgorithm, checksum, nil
+	}
+
+	algorithm := types.ChecksumAlgorithm(strings.ToLower(prefix))
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return "", "", err
+	}
+	sum = strings.ToLower(sum)
+	decoded, err := hex.DecodeString(sum)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid %v checksum %v: %v", algorithm, checksum, err)
+	}
+	if len(decoded) != h.Size() {
+		return "", "", fmt.Errorf("invalid %v checksum %v: the length should be %v bytes", algorithm, checksum, h.Size())
+	}
+
+	return algorithm, FormatChecksum(algorithm, sum), nil
+}
+
+// FormatChecksum returns the self-describing checksum string of the hex sum.
+func FormatChecksum(algorithm types.ChecksumAlgorithm, sum string) string {
+	if algorithm == types.DefaultChecksumAlgorithm {
+		return sum
+	}
+	return fmt.Sprintf("%s:%s", algorithm, sum)
+}
+
+func NewChecksumHash(algorithm types.ChecksumAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case types.ChecksumAlgorithmSHA256:
+		return sha256.New(), nil
+	case types.ChecksumAlgorithmSHA512:
+		return sha512.New(), nil
+	case types.ChecksumAlgorithmBLAKE3:
+		return blake3.New(blake3ChecksumSize, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %v", algorithm)
+	}
+}
@@ -0,0 +1,226 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+
+	"github.com/longhorn/backing-image-manager/pkg/types"
+)
+
+const (
+	compressionMagicMaxLength = 6
+
+	// DecompressedSpaceReservationStep is how much the disk space reservation grows each time
+	// during the decompression, since the decompressed size is unknown beforehand.
+	DecompressedSpaceReservationStep = 64 << 20
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte{'B', 'Z', 'h'}
+)
+
+// ParseCompressionType validates the compression type in a request. Empty means auto detection.
+func ParseCompressionType(compression string) (types.CompressionType, error) {
+	switch compressionType := types.CompressionType(compression); compressionType {
+	case "":
+		return types.CompressionTypeAuto, nil
+	case types.CompressionTypeAuto, types.CompressionTypeNone, types.CompressionTypeGzip,
+		types.CompressionTypeXz, types.CompressionTypeZstd, types.CompressionTypeBzip2:
+		return compressionType, nil
+	default:
+		return "", fmt.Errorf("unsupported compression type %v", compression)
+	}
+}
+
+// DetectCompression peeks the magic bytes at the beginning of the data to determine the compression type.
+// It won't consume any data from the reader.
+func DetectCompression(r *bufio.Reader) (types.CompressionType, error) {
+	header, err := r.Peek(compressionMagicMaxLength)
+	if err != nil && err != io.EOF {
+		return "", errors.Wrapf(err, "failed to read the header for compression detection")
+	}
+	return DetectCompressionFromHeader(header), nil
+}
+
+func DetectCompressionFromHeader(header []byte) types.CompressionType {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return types.CompressionTypeGzip
+	case bytes.HasPrefix(header, xzMagic):
+		return types.CompressionTypeXz
+	case bytes.HasPrefix(header, zstdMagic):
+		return types.CompressionTypeZstd
+	case bytes.HasPrefix(header, bzip2Magic) && len(header) > len(bzip2Magic) &&
+		header[len(bzip2Magic)] >= '1' && header[len(bzip2Magic)] <= '9':
+		return types.CompressionTypeBzip2
+	}
+	return types.CompressionTypeNone
+}
+
+type decompressionReader struct {
+	reader       io.Reader
+	closer       func() error
+	compression  types.CompressionType
+	sizeLimit    int64
+	decompressed int64
+}
+
+func (d *decompressionReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	d.decompressed += int64(n)
+	if d.sizeLimit > 0 && d.decompressed > d.sizeLimit {
+		return n, fmt.Errorf("the %v decompressed data exceeds the size limit %v", d.compression, d.sizeLimit)
+	}
+	return n, err
+}
+
+func (d *decompressionReader) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer()
+}
+
+// NewDecompressionReader returns a reader producing the decompressed data of r. The reader fails
+// once the decompressed data exceeds sizeLimit. A non-positive sizeLimit means no limit.
+func NewDecompressionReader(r io.Reader, compression types.CompressionType, sizeLimit int64) (io.ReadCloser, error) {
+	d := &decompressionReader{
+		compression: compression,
+		sizeLimit:   sizeLimit,
+	}
+
+	switch compression {
+	case types.CompressionTypeGzip:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create gzip reader")
+		}
+		d.reader = gzipReader
+		d.closer = gzipReader.Close
+	case types.CompressionTypeXz:
+		xzReader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create xz reader")
+		}
+		d.reader = xzReader
+	case types.CompressionTypeZstd:
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create zstd reader")
+		}
+		d.reader = zstdReader
+		d.closer = func() error {
+			zstdReader.Close()
+			return nil
+		}
+	case types.CompressionTypeBzip2:
+		d.reader = bzip2.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported compression type %v for decompression", compression)
+	}
+
+	return d, nil
+}
+
+type spaceReservingWriteSeeker struct {
+	io.WriteSeeker
+	reserve   func(size int64) error
+	sizeLimit int64
+	written   int64
+	reserved  int64
+}
+
+func (w *spaceReservingWriteSeeker) Write(p []byte) (int, error) {
+	if required := w.written + int64(len(p)); required > w.reserved {
+		reserved := required + DecompressedSpaceReservationStep
+		if w.sizeLimit > 0 {
+			reserved = max(min(reserved, w.sizeLimit), required)
+		}
+		if err := w.reserve(reserved); err != nil {
+			return 0, err
+		}
+		w.reserved = reserved
+	}
+	n, err := w.WriteSeeker.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// NewSpaceReservingWriteSeeker returns a WriteSeeker that grows the disk space reservation via reserve in steps
+// before writing the data of an unknown size, e.g. the decompressed data. The reservation covers only the written
+// data since the skipped ranges are not allocated, and it won't exceed sizeLimit unless the written data does.
+// A non-positive sizeLimit means no limit.
+func NewSpaceReservingWriteSeeker(dst io.WriteSeeker, reserve func(size int64) error, sizeLimit int64) io.WriteSeeker {
+	return &spaceReservingWriteSeeker{
+		WriteSeeker: dst,
+		reserve:     reserve,
+		sizeLimit:   sizeLimit,
+	}
+}
+
+// DecompressFile decompresses the file to dstFilePath. If compression is auto, the compression type is detected
+// by the magic bytes. It returns the actual compression type, and nothing will be written if the file is not compressed.
+// The disk space for the decompressed data is reserved via reserve during the decompression if it's set.
+func DecompressFile(filePath, dstFilePath string, compression types.CompressionType, sizeLimit int64, reserve func(size int64) error) (types.CompressionType, error) {
+	srcFile, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if errClose := srcFile.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close compressed file")
+		}
+	}()
+
+	src := bufio.NewReader(srcFile)
+	if compression == types.CompressionTypeAuto {
+		if compression, err = DetectCompression(src); err != nil {
+			return "", err
+		}
+	}
+	if compression == types.CompressionTypeNone {
+		return compression, nil
+	}
+
+	reader, err := NewDecompressionReader(src, compression, sizeLimit)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if errClose := reader.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close %v reader", compression)
+		}
+	}()
+
+	writer, err := os.Create(dstFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if errClose := writer.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close destination file")
+		}
+	}()
+
+	var dst io.Writer = writer
+	if reserve != nil {
+		dst = NewSpaceReservingWriteSeeker(writer, reserve, sizeLimit)
+	}
+	if _, err = io.Copy(dst, reader); err != nil {
+		return "", errors.Wrapf(err, "failed to decompress %v file %v", compression, filePath)
+	}
+	return compression, nil
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the bytes per second of the I/O sharing it. A nil RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	lock sync.Mutex
+	// bytesPerSecond can be updated at runtime. 0 means no limit.
+	bytesPerSecond int64
+	// next is the time when all the bytes reserved so far are allowed.
+	next time.Time
+
+	// parent limits the I/O of this limiter as well, so that it can be shared by multiple limiters.
+	parent *RateLimiter
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+// NewAdjustableRateLimiter returns a limiter even if there is no limit for now, so that the limit can be set later.
+// The I/O is limited by the parent as well if the parent is not nil.
+func NewAdjustableRateLimiter(bytesPerSecond int64, parent *RateLimiter) *RateLimiter {
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	return &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		parent:         parent,
+	}
+}
+
+// SetLimit updates the bytes per second of the limiter. 0 means no limit.
+// The bytes reserved before the update won't be delayed by the new limit.
+func (l *RateLimiter) SetLimit(bytesPerSecond int64) {
+	if l == nil {
+		return
+	}
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.bytesPerSecond = bytesPerSecond
+	l.next = time.Now()
+}
+
+// Limit returns the bytes per second of the limiter. 0 means no limit.
+func (l *RateLimiter) Limit() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.bytesPerSecond
+}
+
+// reserve reserves n bytes in the limiter and all its ancestors, then returns how long the caller should wait.
+func (l *RateLimiter) reserve(now time.Time, n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	var wait time.Duration
+	l.lock.Lock()
+	if l.bytesPerSecond > 0 {
+		if l.next.Before(now) {
+			l.next = now
+		}
+		l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+		wait = l.next.Sub(now)
+	}
+	l.lock.Unlock()
+
+	if parentWait := l.parent.reserve(now, n); parentWait > wait {
+		wait = parentWait
+	}
+	return wait
+}
+
+// WaitN blocks until n bytes are allowed to be transferred, or the context is done.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	wait := l.reserve(time.Now(), n)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+// NewRateLimitedReader returns a reader whose throughput is limited by the limiter.
+func NewRateLimitedReader(ctx context.Context, reader io.Reader, limiter *RateLimiter) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+	return &rateLimitedReader{
+		ctx:     ctx,
+		reader:  reader,
+		limiter: limiter,
+	}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
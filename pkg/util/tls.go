@@ -0,0 +1,280 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSOptions are the certificate files used by both the servers and the clients of a process.
+// A server presents the certificate, and requires the client certificates signed by the CA if CAFile is set,
+// i.e. mutual TLS. A client verifies the server certificate with the CA, and presents the certificate if set.
+// The files are reloaded once they are modified, so that the certificates can be rotated without restarts.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// ServerName overrides the name used by a client to verify the server certificate.
+	ServerName string
+}
+
+// Enabled is false for nil options, which means plain connections.
+func (o *TLSOptions) Enabled() bool {
+	return o != nil && (o.CertFile != "" || o.KeyFile != "" || o.CAFile != "")
+}
+
+func (o *TLSOptions) validate(isServer bool) error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("the TLS certificate file and key file should be specified together")
+	}
+	if isServer && o.CertFile == "" {
+		return fmt.Errorf("the TLS certificate file and key file are required by the server")
+	}
+	return nil
+}
+
+// tlsFiles loads the certificate and the CA files, and reloads them once the files are modified.
+type tlsFiles struct {
+	options TLSOptions
+
+	lock        sync.Mutex
+	lastChecked time.Time
+	modTimes    map[string]time.Time
+	certificate *tls.Certificate
+	caPool      *x509.CertPool
+}
+
+// tlsFilesCheckInterval avoids checking the files for each handshake.
+const tlsFilesCheckInterval = time.Second
+
+func newTLSFiles(options TLSOptions) (*tlsFiles, error) {
+	f := &tlsFiles{
+		options:  options,
+		modTimes: map[string]time.Time{},
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *tlsFiles) load() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range []string{f.options.CertFile, f.options.KeyFile, f.options.CAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	var certificate *tls.Certificate
+	if f.options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.options.CertFile, f.options.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load the TLS certificate %v and key %v: %v", f.options.CertFile, f.options.KeyFile, err)
+		}
+		certificate = &cert
+	}
+	var caPool *x509.CertPool
+	if f.options.CAFile != "" {
+		caPEM, err := os.ReadFile(f.options.CAFile)
+		if err != nil {
+			return err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("failed to parse the TLS CA file %v", f.options.CAFile)
+		}
+	}
+
+	f.modTimes = modTimes
+	f.certificate = certificate
+	f.caPool = caPool
+	return nil
+}
+
+// get returns the current certificate and CA pool. The files are reloaded if any of them is modified.
+// The previous ones are kept if the reload fails, e.g. the files are being rotated.
+func (f *tlsFiles) get() (*tls.Certificate, *x509.CertPool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if time.Since(f.lastChecked) < tlsFilesCheckInterval {
+		return f.certificate, f.caPool
+	}
+	f.lastChecked = time.Now()
+
+	for file, modTime := range f.modTimes {
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		if err := f.load(); err != nil {
+			logrus.WithError(err).Warnf("Failed to reload the TLS files after %v is modified, will keep using the previous ones", file)
+		} else {
+			logrus.Infof("Reloaded the TLS files after %v is modified", file)
+		}
+		break
+	}
+	return f.certificate, f.caPool
+}
+
+// NewServerTLSConfig creates the TLS config of a server, which picks up the modified files for the new connections.
+func NewServerTLSConfig(options *TLSOptions) (*tls.Config, error) {
+	if err := options.validate(true); err != nil {
+		return nil, err
+	}
+	files, err := newTLSFiles(*options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certificate, caPool := files.get()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*certificate},
+				// Keep the protocols negotiated by the HTTP and gRPC servers.
+				NextProtos: []string{"h2", "http/1.1"},
+			}
+			if caPool != nil {
+				config.ClientCAs = caPool
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}, nil
+}
+
+// ClientTLS creates the TLS configs of the client connections. Each connection verifies the server certificate
+// with the CA pool and presents the client certificate that are current at the handshake, so that the files can
+// be rotated without restarts. The system CA pool is used if CAFile is not set.
+type ClientTLS struct {
+	files      *tlsFiles
+	serverName string
+}
+
+func NewClientTLS(options *TLSOptions) (*ClientTLS, error) {
+	if err := options.validate(false); err != nil {
+		return nil, err
+	}
+	files, err := newTLSFiles(*options)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientTLS{files: files, serverName: options.ServerName}, nil
+}
+
+// Config returns the TLS config of a new connection to the server. The ServerName of the options overrides serverName.
+func (c *ClientTLS) Config(serverName string) *tls.Config {
+	if c.serverName != "" {
+		serverName = c.serverName
+	}
+	certificate, caPool := c.files.get()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    caPool,
+		ServerName: serverName,
+	}
+	if certificate != nil {
+		config.Certificates = []tls.Certificate{*certificate}
+	}
+	return config
+}
+
+// DialContext establishes a TLS connection to the address with a new config.
+func (c *ClientTLS) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		Config:    c.Config(host),
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// Credentials returns the gRPC transport credentials doing each handshake with a new config.
+func (c *ClientTLS) Credentials() credentials.TransportCredentials {
+	return &clientTLSCredentials{
+		TransportCredentials: credentials.NewTLS(c.Config(c.serverName)),
+		clientTLS:            c,
+	}
+}
+
+type clientTLSCredentials struct {
+	credentials.TransportCredentials
+	clientTLS *ClientTLS
+}
+
+func (c *clientTLSCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if c.clientTLS.serverName != "" {
+		authority = c.clientTLS.serverName
+	}
+	return credentials.NewTLS(c.clientTLS.Config("")).ClientHandshake(ctx, authority, rawConn)
+}
+
+func (c *clientTLSCredentials) Clone() credentials.TransportCredentials {
+	return c.clientTLS.Credentials()
+}
+
+var (
+	httpTransportsLock sync.Mutex
+	httpTransports     = map[TLSOptions]http.RoundTripper{}
+)
+
+// NewHTTPClient creates an HTTP client without proxy. The connections are over TLS if the options are enabled.
+// The transport is shared by the clients with the same options, and a transport failing all requests
+// is used if the TLS files cannot be loaded, so that the error is returned by the requests.
+func NewHTTPClient(timeout time.Duration, options *TLSOptions) *http.Client {
+	if !options.Enabled() {
+		return &http.Client{Timeout: timeout, Transport: NoProxyTransport}
+	}
+
+	httpTransportsLock.Lock()
+	defer httpTransportsLock.Unlock()
+	transport, exists := httpTransports[*options]
+	if !exists {
+		clientTLS, err := NewClientTLS(options)
+		if err != nil {
+			return &http.Client{Timeout: timeout, Transport: failingTransport{err: err}}
+		}
+		t := NoProxyTransport.Clone()
+		t.DialTLSContext = clientTLS.DialContext
+		transport = t
+		httpTransports[*options] = transport
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("failed to prepare the TLS config: %v", t.err)
+}
+
+// GetHTTPURL returns the base URL of the HTTP server at the address.
+func GetHTTPURL(address string, options *TLSOptions) string {
+	if options.Enabled() {
+		return "https://" + address
+	}
+	return "http://" + address
+}
@@ -3,7 +3,6 @@ package util
 import (
 	"compress/gzip"
 	"context"
-	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -24,6 +23,8 @@ import (
 	"google.golang.org/grpc/status"
 
 	"github.com/longhorn/go-common-libs/backingimage"
+	lhexec "github.com/longhorn/go-common-libs/exec"
+	lhtypes "github.com/longhorn/go-common-libs/types"
 
 	"github.com/longhorn/backing-image-manager/pkg/types"
 )
@@ -39,6 +40,16 @@ func PrintJSON(obj interface{}) error {
 }
 
 func GetFileChecksum(filePath string) (string, error) {
+	return GetFileChecksumWithAlgorithm(filePath, types.DefaultChecksumAlgorithm)
+}
+
+// GetFileChecksumWithAlgorithm returns the self-describing checksum string of the file.
+func GetFileChecksumWithAlgorithm(filePath string, algorithm types.ChecksumAlgorithm) (string, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
 	f, err := os.Open(filePath)
 	if err != nil {
 		return "", err
@@ -49,12 +60,11 @@ func GetFileChecksum(filePath string) (string, error) {
 		}
 	}()
 
-	h := sha512.New()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
 
-	return hex.EncodeToString(h.Sum(nil)), nil
+	return FormatChecksum(algorithm, hex.EncodeToString(h.Sum(nil))), nil
 }
 
 func CopyFile(srcPath, dstPath string) (int64, error) {
@@ -168,6 +178,13 @@ type SyncingFileConfig struct {
 	ExpectedChecksum string `json:"expectedChecksum"`
 	CurrentChecksum  string `json:"currentChecksum"`
 	ModificationTime string `json:"modificationTime"`
+
+	// ChecksumAlgorithm is empty in the config files written by the old versions, which means SHA-512.
+	ChecksumAlgorithm types.ChecksumAlgorithm `json:"checksumAlgorithm,omitempty"`
+
+	// SourceFormat and SourceChecksum are set only if the file is converted from another image format.
+	SourceFormat   string `json:"sourceFormat,omitempty"`
+	SourceChecksum string `json:"sourceChecksum,omitempty"`
 }
 
 func GetSyncingFileConfigFilePath(syncingFilePath string) string {
@@ -204,6 +221,76 @@ func ReadSyncingFileConfig(configFilePath string) (*SyncingFileConfig, error) {
 	return config, nil
 }
 
+const (
+	DownloadCheckpointFileSuffix = ".checkpoint"
+	// RawConversionFileSuffix is appended to the file converted from qcow2 or decrypted for cloning.
+	RawConversionFileSuffix = "-raw.tmp"
+	// Qcow2ConversionFileSuffix is appended to the file converted from raw to qcow2.
+	Qcow2ConversionFileSuffix = ".qcow2tmp"
+)
+
+// DownloadCheckpoint records how much data of a download has been durably written to the
+// destination file, as well as the validator of the remote content, so that a retry can
+// continue from the offset rather than starting over.
+// A single stream download uses Offset only, while a segmented download tracks each segment.
+// The fetch and the receive leave a checkpoint with Operation set, so that the data can be
+// reused by the same operation after an interruption.
+type DownloadCheckpoint struct {
+	// Operation is the sync file operation writing the data. It's empty for a download.
+	Operation    string            `json:"operation,omitempty"`
+	URL          string            `json:"url"`
+	ETag         string            `json:"etag"`
+	LastModified string            `json:"lastModified"`
+	Size         int64             `json:"size"`
+	Offset       int64             `json:"offset"`
+	Segments     []DownloadSegment `json:"segments,omitempty"`
+}
+
+// DownloadSegment is the byte range [Start, End) of a segmented download.
+// The data in [Start, Offset) has been written to the destination file.
+type DownloadSegment struct {
+	Start  int64 `json:"start"`
+	End    int64 `json:"end"`
+	Offset int64 `json:"offset"`
+}
+
+func GetDownloadCheckpointFilePath(filePath string) string {
+	return fmt.Sprintf("%s%s", filePath, DownloadCheckpointFileSuffix)
+}
+
+func WriteDownloadCheckpoint(checkpointFilePath string, checkpoint *DownloadCheckpoint) error {
+	encoded, err := json.Marshal(checkpoint)
+	if err != nil {
+		return errors.Wrapf(err, "BUG: Cannot marshal %+v", checkpoint)
+	}
+
+	// Write to a separate file then rename it so that a crash won't leave a half-written checkpoint.
+	tmpCheckpointFilePath := checkpointFilePath + ".tmp"
+	if err := os.WriteFile(tmpCheckpointFilePath, encoded, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpCheckpointFilePath, checkpointFilePath)
+}
+
+func ReadDownloadCheckpoint(checkpointFilePath string) (*DownloadCheckpoint, error) {
+	output, err := os.ReadFile(checkpointFilePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot find the download checkpoint file %v", checkpointFilePath)
+	}
+
+	checkpoint := &DownloadCheckpoint{}
+	if err := json.Unmarshal(output, checkpoint); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal %v content %v", checkpointFilePath, output)
+	}
+	return checkpoint, nil
+}
+
+// IsDownloadCheckpointExisting checks if there is partial data of a download that can be resumed later.
+func IsDownloadCheckpointExisting(filePath string) bool {
+	_, err := os.Stat(GetDownloadCheckpointFilePath(filePath))
+	return err == nil
+}
+
 func ConvertFromRawToQcow2(filePath string) error {
 	imageToolExecutor := backingimage.NewQemuImgExecutor()
 	if imgInfo, err := imageToolExecutor.GetImageInfo(filePath); err != nil {
@@ -212,7 +299,7 @@ func ConvertFromRawToQcow2(filePath string) error {
 		return nil
 	}
 
-	tmpFilePath := filePath + ".qcow2tmp"
+	tmpFilePath := filePath + Qcow2ConversionFileSuffix
 	defer func() {
 		if errRemove := os.RemoveAll(tmpFilePath); errRemove != nil {
 			logrus.WithError(errRemove).Error("Failed to remove temporary file")
@@ -242,18 +329,96 @@ func ConvertFromQcow2ToRaw(sourcePath, targetPath string) error {
 	return nil
 }
 
+// IsConvertibleImageFormat checks if the image format can be converted to raw or qcow2 once ingested.
+func IsConvertibleImageFormat(format string) bool {
+	switch format {
+	case types.ImageFormatVMDK, types.ImageFormatVHD, types.ImageFormatVHDX, types.ImageFormatVDI:
+		return true
+	}
+	return false
+}
+
+// ParseImageTargetFormat validates the format an ingested image should be converted to. Empty means the raw and
+// qcow2 images are kept as is, and the images in the convertible formats are converted to qcow2. The v2 data
+// engine always requires raw.
+func ParseImageTargetFormat(targetFormat, dataEngine string) (string, error) {
+	switch targetFormat {
+	case "", types.SyncingFileTypeRaw:
+		return targetFormat, nil
+	case types.SyncingFileTypeQcow2:
+		if dataEngine == types.DataEnginev2 {
+			return "", fmt.Errorf("target format %v is not supported by data engine %v", targetFormat, dataEngine)
+		}
+		return targetFormat, nil
+	default:
+		return "", fmt.Errorf("unsupported target format %v", targetFormat)
+	}
+}
+
+type imageDetail struct {
+	Filename        string `json:"filename"`
+	BackingFilename string `json:"backing-filename"`
+	FormatSpecific  struct {
+		Data struct {
+			Extents []struct {
+				Filename string `json:"filename"`
+			} `json:"extents"`
+		} `json:"data"`
+	} `json:"format-specific"`
+}
+
+// CheckImageSelfContained makes sure the image doesn't reference any other file, e.g. a backing file or a VMDK
+// extent file, since qemu-img would read the referenced files on the host during the conversion.
+func CheckImageSelfContained(filePath, format string) error {
+	output, err := backingimage.NewQemuImgExecutor().Exec([]string{}, "info", "--output=json", "-f", format, filePath)
+	if err != nil {
+		return err
+	}
+	detail := &imageDetail{}
+	if err := json.Unmarshal([]byte(output), detail); err != nil {
+		return errors.Wrapf(err, "failed to parse the image info of %v", filePath)
+	}
+	if detail.BackingFilename != "" {
+		return fmt.Errorf("%v image %v references backing file %v", format, filePath, detail.BackingFilename)
+	}
+	for _, extent := range detail.FormatSpecific.Data.Extents {
+		if extent.Filename != detail.Filename {
+			return fmt.Errorf("%v image %v references extent file %v", format, filePath, extent.Filename)
+		}
+	}
+	return nil
+}
+
+// ConvertImage converts the source image to the target path in the target format. The conversion may take long
+// for a large image, hence it's not limited by a timeout.
+func ConvertImage(sourcePath, sourceFormat, targetPath, targetFormat string) error {
+	args := []string{"convert", "-f", sourceFormat, "-O", targetFormat, sourcePath, targetPath}
+	if _, err := lhexec.NewExecutor().Execute([]string{}, backingimage.QemuImgBinary, args, lhtypes.ExecuteNoTimeout); err != nil {
+		return errors.Wrapf(err, "failed to convert %v image %v to %v", sourceFormat, sourcePath, targetFormat)
+	}
+	return nil
+}
+
 func GetFileRealSize(filePath string) (int64, error) {
 	var stat syscall.Stat_t
 	err := syscall.Stat(filePath, &stat)
 	if err != nil {
 		return 0, err
 	}
-	fmt.Printf("stat.Blksize: %v\n", stat.Blksize)
 
 	// 512 is defined in the Linux kernel and remains consistent across all distributions.
 	return stat.Blocks * types.DefaultLinuxBlcokSize, nil
 }
 
+// GetDiskAvailableSpace returns the free bytes available to unprivileged users in the filesystem containing the path.
+func GetDiskAvailableSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
 func FileModificationTime(filePath string) string {
 	fi, err := os.Stat(filePath)
 	if err != nil {